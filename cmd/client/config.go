@@ -10,9 +10,12 @@ import (
 )
 
 type Config struct {
-	configPath    string
-	ServerAddress string
-	ServerPort    string
+	configPath     string
+	ServerAddress  string
+	ServerPort     string
+	HashKnownHosts bool
+	// "qpass", "tls" or "noise", empty means qpass
+	Transport string
 }
 
 func ConfigInit() (*Config, error) {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	qcrypto "github.com/Queueue0/qpass/internal/crypto"
+)
+
+// Every install has its own device key, which it proves it holds whenever it
+// connects to the sync server. The server uses it to tell devices apart, so a
+// lost device can be revoked on its own.
+const deviceKeyFile = "device.key"
+
+var ErrInvalidDeviceKey = errors.New("Invalid device key file")
+
+// Reads the device key, generating one if there isn't one yet
+func loadDeviceKey(qpassHome string) (*qcrypto.PrivateKey, error) {
+	path := fmt.Sprintf("%s/%s", qpassHome, deviceKeyFile)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return genDeviceKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, ErrInvalidDeviceKey
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidDeviceKey
+	}
+
+	return qcrypto.NewPrivateKey(signer)
+}
+
+func genDeviceKey(path string) (*qcrypto.PrivateKey, error) {
+	key, err := qcrypto.GenerateKey(qcrypto.KeyEd25519)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := x509.MarshalPKCS8PrivateKey(key.Signer())
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
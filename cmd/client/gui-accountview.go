@@ -0,0 +1,147 @@
+package main
+
+import (
+	"image/color"
+
+	"gioui.org/app"
+	"gioui.org/io/system"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/models"
+	"github.com/Queueue0/qpass/internal/validator"
+)
+
+// Lets u, a copy of the active user, change their username and master
+// password. The main window uses the active user, so u is handed back for it
+// to swap in after each attempt, which may have changed u even if it failed.
+func (a *Application) AccountView(w *app.Window, u models.User, handBack func(models.User)) error {
+	defer u.Destroy()
+
+	var (
+		ops             op.Ops
+		currentPassword widget.Editor
+		userName        widget.Editor
+		password        widget.Editor
+		confirmPassword widget.Editor
+		saveBtn         widget.Clickable
+		v               validator.Validator
+		errorTxt        string
+	)
+
+	th := material.NewTheme()
+	userName.SetText(u.Username)
+
+	var fieldError = func(key string) layout.FlexChild {
+		return layout.Rigid(
+			func(gtx layout.Context) layout.Dimensions {
+				if v.Valid() {
+					return layout.Dimensions{}
+				}
+				errTxt, in := v.FieldErrors[key]
+				if !in {
+					return layout.Dimensions{}
+				}
+
+				txt := material.Body1(th, errTxt)
+				txt.Color = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+
+				margins := layout.UniformInset(unit.Dp(10))
+				margins.Bottom = 0
+				return margins.Layout(gtx, txt.Layout)
+			},
+		)
+	}
+
+	var field = func(ed *widget.Editor, hint string, mask bool) layout.FlexChild {
+		return layout.Rigid(
+			func(gtx layout.Context) layout.Dimensions {
+				txt := material.Editor(th, ed, hint)
+				ed.SingleLine = true
+				if mask {
+					ed.Mask = '*'
+				}
+
+				margins := layout.UniformInset(unit.Dp(10))
+				padding := layout.UniformInset(inputPadding)
+
+				border := widget.Border{
+					Color:        borderColor,
+					CornerRadius: unit.Dp(1),
+					Width:        unit.Dp(2),
+				}
+
+				return margins.Layout(gtx,
+					func(gtx layout.Context) layout.Dimensions {
+						return border.Layout(gtx,
+							func(gtx layout.Context) layout.Dimensions {
+								return padding.Layout(gtx, txt.Layout)
+							},
+						)
+					},
+				)
+			},
+		)
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if saveBtn.Clicked(gtx) {
+				cur, un, pw, cpw := currentPassword.Text(), userName.Text(), password.Text(), confirmPassword.Text()
+
+				v = validator.Validator{}
+				v.CheckField(validator.NotBlank(cur), "current", "This field cannot be blank")
+				v.CheckField(validator.NotBlank(un), "username", "This field cannot be blank")
+				v.CheckField(validator.NotBlank(pw), "password", "This field cannot be blank")
+				v.CheckField(validator.Matches(cpw, pw), "password", "Passwords don't match")
+
+				if v.Valid() {
+					err := a.changeCredentials(&u, cur, un, pw)
+					handBack(u.Clone())
+					if err != nil {
+						errorTxt = err.Error()
+					} else {
+						w.Perform(system.ActionClose)
+					}
+				}
+			}
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx,
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						lbl := material.Label(th, unit.Sp(16), errorTxt)
+						return lbl.Layout(gtx)
+					},
+				),
+				fieldError("current"),
+				field(&currentPassword, "Current Password", true),
+				fieldError("username"),
+				field(&userName, "Username", false),
+				fieldError("password"),
+				field(&password, "New Password", true),
+				field(&confirmPassword, "Confirm New Password", true),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						btn := material.Button(th, &saveBtn, "Save")
+						return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+							return btn.Layout(gtx)
+						})
+					},
+				),
+			)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return e.Err
+		}
+	}
+}
@@ -42,12 +42,12 @@ func (a *Application) AddView(w *app.Window) (models.Password, error) {
 					if err != nil {
 						return models.Password{}, err
 					}
-					np = models.Password{
-						ID:          id,
-						UserID:      a.ActiveUser.ID,
-						ServiceName: sn,
-						Username:    un,
-						Password:    pw,
+
+					// Read back rather than built from the editors, so
+					// the password is kept in a secret like the others
+					np, err = a.PasswordModel.Get(id, *a.ActiveUser)
+					if err != nil {
+						return models.Password{}, err
 					}
 
 					return np, nil
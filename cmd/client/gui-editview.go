@@ -9,6 +9,7 @@ import (
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/models"
 	"github.com/Queueue0/qpass/internal/validator"
 )
@@ -25,7 +26,6 @@ func (a *Application) EditView(w *app.Window, p *models.Password) error {
 
 	serviceName.SetText(p.ServiceName)
 	userName.SetText(p.Username)
-	password.SetText(p.Password)
 
 	th := material.NewTheme()
 
@@ -35,14 +35,22 @@ func (a *Application) EditView(w *app.Window, p *models.Password) error {
 			gtx := app.NewContext(&ops, e)
 
 			if editBtn.Clicked(gtx) {
-				sn, un, pw := serviceName.Text(), userName.Text(), password.Text()
+				sn, un := serviceName.Text(), userName.Text()
 
 				// Validate data
 				v = validator.Validator{}
 				v.CheckField(validator.NotBlank(sn), "service", "Service Name cannot be blank")
 
 				if v.Valid() {
+					// The current password is never put in the editor, so
+					// leaving it blank keeps it
+					pw := crypto.SecretFromString(password.Text())
+					if pw.Len() == 0 {
+						pw = p.Plaintext().Clone()
+					}
+
 					err := a.PasswordModel.Update(*a.ActiveUser, p.UUID.String(), sn, un, pw)
+					pw.Destroy()
 					if err != nil {
 						return err
 					}
@@ -52,9 +60,8 @@ func (a *Application) EditView(w *app.Window, p *models.Password) error {
 						return err
 					}
 
-					p.ServiceName = npw.ServiceName
-					p.Username = npw.Username
-					p.Password = npw.Password
+					p.Destroy()
+					*p = npw
 					return nil
 				}
 			}
@@ -140,7 +147,7 @@ func (a *Application) EditView(w *app.Window, p *models.Password) error {
 				),
 				layout.Rigid(
 					func(gtx layout.Context) layout.Dimensions {
-						txt := material.Editor(th, &password, "Password")
+						txt := material.Editor(th, &password, "Password (leave blank to keep)")
 						password.SingleLine = true
 						password.Submit = true
 
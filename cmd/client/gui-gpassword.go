@@ -6,24 +6,35 @@ import (
 
 	"gioui.org/unit"
 	"gioui.org/widget"
+	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/models"
 )
 
 var borderColor = color.NRGBA{R: 100, G: 100, B: 100, A: 200}
 var inputPadding = unit.Dp(10)
 
+// Password is shared with the models.Password a gPassword is made from,
+// rather than another copy of it. It's only revealed while the user has it
+// shown, instead of on every frame.
 type gPassword struct {
+	ID          int
 	ServiceName string
 	Username    string
-	Password    string
+	Password    *crypto.Secret
 	Shown       bool
 	ShowBtn     *widget.Clickable
 	CopyBtn     *widget.Clickable
 	EditBtn     *widget.Clickable
+
+	revealed string
 }
 
 func (p *gPassword) toggleShow() {
 	p.Shown = !p.Shown
+	p.revealed = ""
+	if p.Shown {
+		p.revealed = p.Password.Reveal()
+	}
 }
 
 type gpwList []*gPassword
@@ -36,9 +47,10 @@ func (gl gpwList) sort() {
 
 func newGPassword(p models.Password) *gPassword {
 	return &gPassword{
+		ID:          p.ID,
 		ServiceName: p.ServiceName,
 		Username:    p.Username,
-		Password:    p.Password,
+		Password:    p.Plaintext(),
 		Shown:       false,
 		ShowBtn:     &widget.Clickable{},
 		CopyBtn:     &widget.Clickable{},
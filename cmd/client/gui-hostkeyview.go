@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log"
+
+	"gioui.org/app"
+	"gioui.org/io/system"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// Used as the crypto.HostKeyPrompt when connecting to the sync server.
+// Blocks until the user has made a decision.
+func (a *Application) confirmHostKey(hostname, fingerprint string) bool {
+	w := new(app.Window)
+	w.Option(app.Title("Unknown Server"))
+	w.Option(app.Size(unit.Dp(700), unit.Dp(250)))
+	trusted, err := a.HostKeyView(w, hostname, fingerprint)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	return trusted
+}
+
+func (a *Application) hostKeyChanged(e *crypto.HostKeyChangedError) {
+	w := new(app.Window)
+	w.Option(app.Title("Server Key Changed"))
+	w.Option(app.Size(unit.Dp(700), unit.Dp(350)))
+	err := a.HostKeyChangedView(w, e)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (a *Application) HostKeyView(w *app.Window, hostname, fingerprint string) (bool, error) {
+	var (
+		ops       op.Ops
+		trustBtn  widget.Clickable
+		cancelBtn widget.Clickable
+		trusted   bool
+	)
+
+	th := material.NewTheme()
+
+	lines := []string{
+		fmt.Sprintf("The authenticity of server '%s' can't be established.", hostname),
+		"Key fingerprint:",
+		fingerprint,
+		"Only trust this server if the fingerprint matches the one shown by the server.",
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if trustBtn.Clicked(gtx) {
+				trusted = true
+				w.Perform(system.ActionClose)
+			}
+
+			if cancelBtn.Clicked(gtx) {
+				w.Perform(system.ActionClose)
+			}
+
+			children := []layout.FlexChild{}
+			for _, line := range lines {
+				children = append(children, layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						margins.Bottom = 0
+						return margins.Layout(gtx, material.Body1(th, line).Layout)
+					},
+				))
+			}
+
+			children = append(children, layout.Rigid(
+				func(gtx layout.Context) layout.Dimensions {
+					return layout.Flex{
+						Axis:    layout.Horizontal,
+						Spacing: layout.SpaceSides,
+					}.Layout(gtx,
+						layout.Rigid(
+							func(gtx layout.Context) layout.Dimensions {
+								margins := layout.UniformInset(unit.Dp(10))
+								btn := material.Button(th, &trustBtn, "Trust")
+								return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+									return btn.Layout(gtx)
+								})
+							},
+						),
+						layout.Rigid(
+							func(gtx layout.Context) layout.Dimensions {
+								margins := layout.UniformInset(unit.Dp(10))
+								btn := material.Button(th, &cancelBtn, "Cancel")
+								return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+									return btn.Layout(gtx)
+								})
+							},
+						),
+					)
+				},
+			))
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx, children...)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return trusted, e.Err
+		}
+	}
+}
+
+func (a *Application) HostKeyChangedView(w *app.Window, changed *crypto.HostKeyChangedError) error {
+	var (
+		ops      op.Ops
+		closeBtn widget.Clickable
+	)
+
+	th := material.NewTheme()
+
+	lines := []string{
+		fmt.Sprintf("The key for server '%s' has changed.", changed.Hostname),
+		"Someone could be impersonating the server. The connection has been refused.",
+		"If you expected the key to change, remove the old key in Settings and connect again.",
+		"Known key fingerprint:",
+		changed.Old,
+		"Received key fingerprint:",
+		changed.New,
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if closeBtn.Clicked(gtx) {
+				w.Perform(system.ActionClose)
+			}
+
+			children := []layout.FlexChild{}
+			for i, line := range lines {
+				children = append(children, layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						txt := material.Body1(th, line)
+						if i < 2 {
+							txt.Color = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+						}
+
+						margins := layout.UniformInset(unit.Dp(10))
+						margins.Bottom = 0
+						return margins.Layout(gtx, txt.Layout)
+					},
+				))
+			}
+
+			children = append(children, layout.Rigid(
+				func(gtx layout.Context) layout.Dimensions {
+					margins := layout.UniformInset(unit.Dp(10))
+					btn := material.Button(th, &closeBtn, "Close")
+					return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+						return btn.Layout(gtx)
+					})
+				},
+			))
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx, children...)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return e.Err
+		}
+	}
+}
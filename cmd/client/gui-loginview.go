@@ -20,6 +20,7 @@ func (a *Application) LoginView(w *app.Window) error {
 		loginBtn   widget.Clickable
 		syncBtn    widget.Clickable
 		newUserBtn widget.Clickable
+		recoverBtn widget.Clickable
 		optionsBtn widget.Clickable
 		errorTxt   string
 	)
@@ -32,6 +33,7 @@ func (a *Application) LoginView(w *app.Window) error {
 			errorTxt = err.Error()
 		} else {
 			a.ActiveUser = &u
+			a.refreshKDF(password.Text())
 			w.Perform(system.ActionClose)
 		}
 	}
@@ -62,6 +64,23 @@ func (a *Application) LoginView(w *app.Window) error {
 		}()
 	}
 
+	var recoverAccount = func() {
+		go func() {
+			rw := new(app.Window)
+			rw.Option(app.Title("Recover Account"))
+			rw.Option(app.Size(unit.Dp(1280), unit.Dp(720)))
+			recovered, err := a.RecoveryView(rw)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+
+			if recovered {
+				errorTxt = "Account recovered! Please log in with your new password."
+				w.Invalidate()
+			}
+		}()
+	}
+
 	var options = func() {
 		go func() {
 			ow := new(app.Window)
@@ -91,6 +110,10 @@ func (a *Application) LoginView(w *app.Window) error {
 				addUser()
 			}
 
+			if recoverBtn.Clicked(gtx) {
+				recoverAccount()
+			}
+
 			if optionsBtn.Clicked(gtx) {
 				options()
 			}
@@ -183,6 +206,7 @@ func (a *Application) LoginView(w *app.Window) error {
 						lbtn := material.Button(th, &loginBtn, "Log In")
 						sbtn := material.Button(th, &syncBtn, "Sync")
 						nubtn := material.Button(th, &newUserBtn, "New User")
+						rbtn := material.Button(th, &recoverBtn, "Recover")
 						obtn := material.Button(th, &optionsBtn, "⚙️")
 
 						margins := layout.UniformInset(unit.Dp(5))
@@ -218,6 +242,15 @@ func (a *Application) LoginView(w *app.Window) error {
 									)
 								},
 							),
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									return margins.Layout(gtx,
+										func(gtx layout.Context) layout.Dimensions {
+											return rbtn.Layout(gtx)
+										},
+									)
+								},
+							),
 							layout.Rigid(
 								func (gtx layout.Context) layout.Dimensions {
 									return margins.Layout(gtx,
@@ -3,20 +3,25 @@ package main
 import (
 	"fmt"
 	"io"
+	"slices"
 	"strings"
+	"sync"
 
 	"gio.tools/icons"
 	"gioui.org/app"
 	"gioui.org/font"
 	"gioui.org/io/clipboard"
+	"gioui.org/io/system"
 	"gioui.org/layout"
 	"gioui.org/op"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/models"
 )
 
-func (a *Application) MainView(w *app.Window) error {
+// Reports whether the user locked the vault, rather than closing the window
+func (a *Application) MainView(w *app.Window) (bool, error) {
 	pws := gpwList{}
 	for _, p := range a.Passwords {
 		gp := newGPassword(p)
@@ -24,20 +29,71 @@ func (a *Application) MainView(w *app.Window) error {
 	}
 
 	var (
-		ops       op.Ops
-		searchBox widget.Editor
-		searchBtn widget.Clickable
-		addBtn    widget.Clickable
-		pwlist    widget.List
-		th        = material.NewTheme()
+		ops        op.Ops
+		searchBox  widget.Editor
+		searchBtn  widget.Clickable
+		addBtn     widget.Clickable
+		accountBtn widget.Clickable
+		totpBtn    widget.Clickable
+		lockBtn    widget.Clickable
+		locked     bool
+		pwlist     widget.List
+		th         = material.NewTheme()
+
+		// Windows opened alongside this one, which use the active user's
+		// secrets, so they're closed and waited for before it's logged out
+		views       sync.WaitGroup
+		viewWindows []*app.Window
+
+		// Copies of the active user changed by those windows, swapped in
+		// here so it's only ever changed while this window isn't using it
+		changedUsers = make(chan models.User, 1)
 	)
 
+	var handBack = func(u models.User) {
+		changedUsers <- u
+		w.Invalidate()
+	}
+
+	var swapUser = func(u models.User) {
+		a.ActiveUser.Destroy()
+		a.ActiveUser = &u
+	}
+
+	var swapChangedUsers = func() {
+		for {
+			select {
+			case u := <-changedUsers:
+				swapUser(u)
+			default:
+				return
+			}
+		}
+	}
+
+	var openView = func(title string, view func(*app.Window) error) {
+		vw := new(app.Window)
+		vw.Option(app.Title(title))
+		vw.Option(app.Size(unit.Dp(1280), unit.Dp(720)))
+		viewWindows = append(viewWindows, vw)
+
+		views.Add(1)
+		go func() {
+			defer views.Done()
+			err := view(vw)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+		}()
+	}
+
 	pwlist.List.Axis = layout.Vertical
 
 	for {
 		switch e := w.Event().(type) {
 		case app.FrameEvent:
 			gtx := app.NewContext(&ops, e)
+			swapChangedUsers()
 
 			if searchBtn.Clicked(gtx) {
 				sl := a.Passwords.Search(searchBox.Text())
@@ -65,10 +121,28 @@ func (a *Application) MainView(w *app.Window) error {
 				}
 			}
 
+			if accountBtn.Clicked(gtx) {
+				u := a.ActiveUser.Clone()
+				openView("Account", func(vw *app.Window) error {
+					return a.AccountView(vw, u, handBack)
+				})
+			}
+
+			if totpBtn.Clicked(gtx) {
+				openView("Two-Factor Authentication", a.TwoFactorView)
+			}
+
+			if lockBtn.Clicked(gtx) {
+				locked = true
+				w.Perform(system.ActionClose)
+			}
+
 			for i := range pws {
 				p := pws[i]
 				if p.CopyBtn.Clicked(gtx) {
-					gtx.Execute(clipboard.WriteCmd{Type: "application/text", Data: io.NopCloser(strings.NewReader(p.Password))})
+					// The clipboard is written after this frame, by which time
+					// the secret may have been destroyed by locking or editing
+					gtx.Execute(clipboard.WriteCmd{Type: "application/text", Data: io.NopCloser(strings.NewReader(p.Password.Reveal()))})
 				}
 
 				if p.ShowBtn.Clicked(gtx) {
@@ -76,11 +150,20 @@ func (a *Application) MainView(w *app.Window) error {
 				}
 
 				if p.EditBtn.Clicked(gtx) {
-					err := a.EditView(w, &a.Passwords[i])
+					// pws may be a search result, so it's found by ID rather
+					// than by where it is in the list
+					j := slices.IndexFunc(a.Passwords, func(ap models.Password) bool {
+						return ap.ID == p.ID
+					})
+					if j < 0 {
+						continue
+					}
+
+					err := a.EditView(w, &a.Passwords[j])
 					if err != nil {
 						fmt.Println(err.Error())
 					} else {
-						pws[i] = newGPassword(a.Passwords[i])
+						pws[i] = newGPassword(a.Passwords[j])
 						w.Invalidate()
 					}
 				}
@@ -133,14 +216,46 @@ func (a *Application) MainView(w *app.Window) error {
 						)
 					},
 				),
-				// Button
+				// Buttons
 				layout.Rigid(
 					func(gtx layout.Context) layout.Dimensions {
 						inset := layout.UniformInset(unit.Dp(10))
 						btn := material.Button(th, &addBtn, "+ Add New")
-						return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-							return btn.Layout(gtx)
-						})
+						abtn := material.Button(th, &accountBtn, "Account")
+						tbtn := material.Button(th, &totpBtn, "Two-Factor")
+						lbtn := material.Button(th, &lockBtn, "Lock")
+						return layout.Flex{
+							Axis: layout.Horizontal,
+						}.Layout(gtx,
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+										return btn.Layout(gtx)
+									})
+								},
+							),
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+										return abtn.Layout(gtx)
+									})
+								},
+							),
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+										return tbtn.Layout(gtx)
+									})
+								},
+							),
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+										return lbtn.Layout(gtx)
+									})
+								},
+							),
+						)
 					},
 				),
 				// Header
@@ -231,9 +346,9 @@ func (a *Application) MainView(w *app.Window) error {
 															text.Text = ""
 															text.Font.Weight = font.Normal
 															if p.Shown {
-																text.Text = p.Password
+																text.Text = p.revealed
 															} else {
-																text.Text = strings.Repeat("*", len(p.Password))
+																text.Text = strings.Repeat("*", p.Password.Len())
 															}
 															return text.Layout(gtx)
 														},
@@ -275,9 +390,28 @@ func (a *Application) MainView(w *app.Window) error {
 			e.Frame(gtx.Ops)
 
 		case app.DestroyEvent:
+			for _, vw := range viewWindows {
+				vw.Perform(system.ActionClose)
+			}
+			// Views may be waiting to hand back a user while they close
+			closed := make(chan struct{})
+			go func() {
+				views.Wait()
+				close(closed)
+			}()
+			for waiting := true; waiting; {
+				select {
+				case u := <-changedUsers:
+					swapUser(u)
+				case <-closed:
+					waiting = false
+				}
+			}
+			swapChangedUsers()
+
 			fmt.Println("Syncing...")
 			a.sync()
-			return e.Err
+			return locked, e.Err
 		}
 	}
 }
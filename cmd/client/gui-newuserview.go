@@ -21,9 +21,11 @@ func (a *Application) NewUserView(w *app.Window) (bool, error) {
 	var password widget.Editor
 	var confirmPassword widget.Editor
 	var addBtn widget.Clickable
+	var recovery widget.Bool
 	var v validator.Validator
 
 	created := false
+	recovery.Value = true
 
 	th := material.NewTheme()
 
@@ -43,8 +45,14 @@ func (a *Application) NewUserView(w *app.Window) (bool, error) {
 				v.CheckField(validator.Matches(cpw, pw), "password", "Passwords don't match")
 
 				if v.Valid() {
+					token, err := crypto.ClientAuthToken(un, pw, crypto.DefaultKDFParams)
+					if err != nil {
+						return false, err
+					}
+
 					// TODO: Handle the case where this fails better
-					UUID, err := a.newUserSync("", crypto.ClientAuthToken(un, pw))
+					UUID, err := a.newUserSync("", token.Bytes(), crypto.UserLookupID(un), crypto.DefaultKDFParams)
+					token.Destroy()
 					if err != nil {
 						rawUUID, err := uuid.NewRandom()
 						if err != nil {
@@ -53,11 +61,15 @@ func (a *Application) NewUserView(w *app.Window) (bool, error) {
 						UUID = rawUUID.String()
 					}
 
-					_, err = a.UserModel.Insert(un, pw, UUID)
+					_, err = a.UserModel.Insert(un, pw, UUID, crypto.DefaultKDFParams)
 					if err != nil {
 						return false, err
 					}
 
+					if recovery.Value {
+						a.newRecoveryKey(un, pw)
+					}
+
 					created = true
 					w.Perform(system.ActionClose)
 				}
@@ -216,6 +228,13 @@ func (a *Application) NewUserView(w *app.Window) (bool, error) {
 						)
 					},
 				),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						cb := material.CheckBox(th, &recovery, "Create a recovery key, in case I forget my password")
+						return margins.Layout(gtx, cb.Layout)
+					},
+				),
 				layout.Rigid(
 					func(gtx layout.Context) layout.Dimensions {
 						margins := layout.UniformInset(unit.Dp(10))
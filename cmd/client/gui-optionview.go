@@ -5,29 +5,52 @@ import (
 	"image/color"
 
 	"gioui.org/app"
+	"gioui.org/font"
 	"gioui.org/io/system"
 	"gioui.org/layout"
 	"gioui.org/op"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/validator"
 )
 
 func (a *Application) OptionView(w *app.Window) error {
 	var (
-		ops       op.Ops
-		v         validator.Validator
-		addressEd widget.Editor
-		portEd    widget.Editor
-		saveBtn   widget.Clickable
-		cancelBtn widget.Clickable
+		ops        op.Ops
+		v          validator.Validator
+		addressEd  widget.Editor
+		portEd     widget.Editor
+		saveBtn    widget.Clickable
+		cancelBtn  widget.Clickable
+		hashHosts  widget.Bool
+		transport  widget.Enum
+		hostList   widget.List
+		hosts      []crypto.KnownHost
+		removeBtns []widget.Clickable
 
 		th *material.Theme = material.NewTheme()
 	)
 
 	addressEd.SetText(a.Config.ServerAddress)
 	portEd.SetText(a.Config.ServerPort)
+	hashHosts.Value = a.Config.HashKnownHosts
+	transport.Value = a.Config.Transport
+	if transport.Value == "" {
+		transport.Value = crypto.TransportQpass
+	}
+	hostList.List.Axis = layout.Vertical
+
+	var loadHosts = func() {
+		var err error
+		hosts, err = crypto.ListKnownHosts()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		removeBtns = make([]widget.Clickable, len(hosts))
+	}
+	loadHosts()
 
 	for {
 		switch e := w.Event().(type) {
@@ -38,6 +61,8 @@ func (a *Application) OptionView(w *app.Window) error {
 				// TODO: Validate input, better error handling
 				a.Config.ServerAddress = addressEd.Text()
 				a.Config.ServerPort = portEd.Text()
+				a.Config.HashKnownHosts = hashHosts.Value
+				a.Config.Transport = transport.Value
 				err := a.Config.Save()
 				if err != nil {
 					fmt.Println(err.Error())
@@ -49,6 +74,18 @@ func (a *Application) OptionView(w *app.Window) error {
 				w.Perform(system.ActionClose)
 			}
 
+			for i := range removeBtns {
+				if removeBtns[i].Clicked(gtx) {
+					err := crypto.RemoveKnownHost(hosts[i].Host)
+					if err != nil {
+						fmt.Println(err.Error())
+					}
+					loadHosts()
+					w.Invalidate()
+					break
+				}
+			}
+
 			layout.Flex{
 				Axis:    layout.Vertical,
 				Spacing: layout.SpaceEnd,
@@ -162,6 +199,87 @@ func (a *Application) OptionView(w *app.Window) error {
 						)
 					},
 				),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						cb := material.CheckBox(th, &hashHosts, "Hash hostnames in known_hosts")
+						return margins.Layout(gtx, cb.Layout)
+					},
+				),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+							return layout.Flex{
+								Axis:      layout.Horizontal,
+								Alignment: layout.Middle,
+							}.Layout(gtx,
+								layout.Rigid(material.Body1(th, "Connect over").Layout),
+								layout.Rigid(material.RadioButton(th, &transport, crypto.TransportQpass, "qpass").Layout),
+								layout.Rigid(material.RadioButton(th, &transport, crypto.TransportTLS, "TLS").Layout),
+								layout.Rigid(material.RadioButton(th, &transport, crypto.TransportNoise, "Noise").Layout),
+							)
+						})
+					},
+				),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						lbl := material.Body1(th, "This device: "+crypto.Fingerprint(a.DeviceKey.Public()))
+						return margins.Layout(gtx, lbl.Layout)
+					},
+				),
+				// Known hosts
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						lbl := material.Body1(th, "Known Servers")
+						lbl.Font.Weight = font.Bold
+						return margins.Layout(gtx, lbl.Layout)
+					},
+				),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						gtx.Constraints.Max.Y = gtx.Dp(unit.Dp(200))
+						inset := layout.UniformInset(unit.Dp(2))
+						inset.Left = unit.Dp(10)
+
+						list := material.List(th, &hostList)
+						return list.Layout(gtx, len(hosts),
+							func(gtx layout.Context, i int) layout.Dimensions {
+								host := hosts[i]
+								name := host.Host
+								if host.Hashed {
+									name = "(hashed hostname)"
+								}
+
+								return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+									return layout.Flex{
+										Axis:      layout.Horizontal,
+										Spacing:   layout.SpaceEnd,
+										Alignment: layout.Middle,
+									}.Layout(gtx,
+										layout.Flexed(1,
+											func(gtx layout.Context) layout.Dimensions {
+												return material.Body1(th, name).Layout(gtx)
+											},
+										),
+										layout.Flexed(2,
+											func(gtx layout.Context) layout.Dimensions {
+												return material.Body1(th, crypto.Fingerprint(host.Key)).Layout(gtx)
+											},
+										),
+										layout.Rigid(
+											func(gtx layout.Context) layout.Dimensions {
+												btn := material.Button(th, &removeBtns[i], "Remove")
+												return btn.Layout(gtx)
+											},
+										),
+									)
+								})
+							})
+					},
+				),
 				layout.Rigid(
 					func(gtx layout.Context) layout.Dimensions {
 						return layout.Flex{
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+
+	"gioui.org/app"
+	"gioui.org/io/system"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/validator"
+)
+
+// Gives a newly created user a recovery key, and shows it to them along with
+// where their emergency kit was written. The user isn't logged in yet, so
+// this has to log them in to get at their data key.
+func (a *Application) newRecoveryKey(username, password string) {
+	u, err := a.UserModel.Authenticate(username, password)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	recoveryKey, err := a.UserModel.SetRecoveryKey(&u)
+	u.Destroy()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	id := u.ID.String()
+	path, kitErr := a.writeEmergencyKit(id, recoveryKey)
+
+	go func() {
+		kw := new(app.Window)
+		kw.Option(app.Title("Emergency Kit"))
+		kw.Option(app.Size(unit.Dp(1280), unit.Dp(720)))
+		err := a.EmergencyKitView(kw, id, recoveryKey, path, kitErr)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}()
+}
+
+// Shows a recovery key, which is only ever shown once, and zeroes it when
+// closed
+func (a *Application) EmergencyKitView(w *app.Window, id string, recoveryKey *crypto.Secret, path string, kitErr error) error {
+	defer recoveryKey.Destroy()
+
+	var (
+		ops     op.Ops
+		doneBtn widget.Clickable
+	)
+
+	th := material.NewTheme()
+
+	kitTxt := "Your emergency kit was saved to " + path + ". Print it or copy it somewhere safe, then delete it from this computer."
+	if kitErr != nil {
+		kitTxt = "Your emergency kit couldn't be saved (" + kitErr.Error() + "). Write down the account ID and recovery key below."
+	}
+
+	var line = func(txt string, size unit.Sp) layout.FlexChild {
+		return layout.Rigid(
+			func(gtx layout.Context) layout.Dimensions {
+				lbl := material.Label(th, size, txt)
+				margins := layout.UniformInset(unit.Dp(10))
+				return margins.Layout(gtx, lbl.Layout)
+			},
+		)
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if doneBtn.Clicked(gtx) {
+				w.Perform(system.ActionClose)
+			}
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx,
+				line("If you forget your master password, this recovery key is the only way back into your account. It won't be shown again.", unit.Sp(16)),
+				line(kitTxt, unit.Sp(16)),
+				line("Account ID: "+id, unit.Sp(20)),
+				line("Recovery key: "+recoveryKey.Reveal(), unit.Sp(20)),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						btn := material.Button(th, &doneBtn, "Done")
+						return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+							return btn.Layout(gtx)
+						})
+					},
+				),
+			)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return e.Err
+		}
+	}
+}
+
+// Lets a user who's forgotten their master password set a new one with their
+// recovery key
+func (a *Application) RecoveryView(w *app.Window) (bool, error) {
+	var (
+		ops             op.Ops
+		accountID       widget.Editor
+		recoveryKey     widget.Editor
+		userName        widget.Editor
+		password        widget.Editor
+		confirmPassword widget.Editor
+		recoverBtn      widget.Clickable
+		v               validator.Validator
+		errorTxt        string
+	)
+
+	recovered := false
+	th := material.NewTheme()
+
+	var fieldError = func(key string) layout.FlexChild {
+		return layout.Rigid(
+			func(gtx layout.Context) layout.Dimensions {
+				if v.Valid() {
+					return layout.Dimensions{}
+				}
+				errTxt, in := v.FieldErrors[key]
+				if !in {
+					return layout.Dimensions{}
+				}
+
+				txt := material.Body1(th, errTxt)
+				txt.Color = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+
+				margins := layout.UniformInset(unit.Dp(10))
+				margins.Bottom = 0
+				return margins.Layout(gtx, txt.Layout)
+			},
+		)
+	}
+
+	var field = func(ed *widget.Editor, hint string, mask bool) layout.FlexChild {
+		return layout.Rigid(
+			func(gtx layout.Context) layout.Dimensions {
+				txt := material.Editor(th, ed, hint)
+				ed.SingleLine = true
+				if mask {
+					ed.Mask = '*'
+				}
+
+				margins := layout.UniformInset(unit.Dp(10))
+				padding := layout.UniformInset(inputPadding)
+
+				border := widget.Border{
+					Color:        borderColor,
+					CornerRadius: unit.Dp(1),
+					Width:        unit.Dp(2),
+				}
+
+				return margins.Layout(gtx,
+					func(gtx layout.Context) layout.Dimensions {
+						return border.Layout(gtx,
+							func(gtx layout.Context) layout.Dimensions {
+								return padding.Layout(gtx, txt.Layout)
+							},
+						)
+					},
+				)
+			},
+		)
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if recoverBtn.Clicked(gtx) {
+				id, rk, un, pw, cpw := accountID.Text(), recoveryKey.Text(), userName.Text(), password.Text(), confirmPassword.Text()
+
+				v = validator.Validator{}
+				v.CheckField(validator.NotBlank(id), "id", "This field cannot be blank")
+				v.CheckField(validator.NotBlank(rk), "recovery", "This field cannot be blank")
+				v.CheckField(validator.NotBlank(un), "username", "This field cannot be blank")
+				v.CheckField(validator.NotBlank(pw), "password", "This field cannot be blank")
+				v.CheckField(validator.Matches(cpw, pw), "password", "Passwords don't match")
+
+				if v.Valid() {
+					err := a.recoverAccount(id, rk, un, pw)
+					if err != nil {
+						errorTxt = err.Error()
+					} else {
+						recovered = true
+						w.Perform(system.ActionClose)
+					}
+				}
+			}
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx,
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						lbl := material.Label(th, unit.Sp(16), errorTxt)
+						return lbl.Layout(gtx)
+					},
+				),
+				fieldError("id"),
+				field(&accountID, "Account ID", false),
+				fieldError("recovery"),
+				field(&recoveryKey, "Recovery Key", true),
+				fieldError("username"),
+				field(&userName, "Username", false),
+				fieldError("password"),
+				field(&password, "New Password", true),
+				field(&confirmPassword, "Confirm New Password", true),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						btn := material.Button(th, &recoverBtn, "Recover")
+						return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+							return btn.Layout(gtx)
+						})
+					},
+				),
+			)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return recovered, e.Err
+		}
+	}
+}
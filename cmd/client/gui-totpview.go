@@ -0,0 +1,263 @@
+package main
+
+import (
+	"image/color"
+	"log"
+
+	"gioui.org/app"
+	"gioui.org/io/system"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// Asks the user for a code from their authenticator app, or a recovery code,
+// when the sync server wants one. Blocks until they've entered one or given
+// up.
+func (a *Application) promptTOTPCode(incorrect bool) (string, bool) {
+	w := new(app.Window)
+	w.Option(app.Title("Two-Factor Authentication"))
+	w.Option(app.Size(unit.Dp(500), unit.Dp(250)))
+	code, ok, err := a.TOTPCodeView(w, incorrect)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	return code, ok
+}
+
+func (a *Application) TOTPCodeView(w *app.Window, incorrect bool) (string, bool, error) {
+	var (
+		ops       op.Ops
+		code      widget.Editor
+		okBtn     widget.Clickable
+		cancelBtn widget.Clickable
+		entered   bool
+	)
+
+	th := material.NewTheme()
+
+	lines := []string{"Enter the code from your authenticator app, or one of your recovery codes."}
+	if incorrect {
+		lines = append([]string{"That code was incorrect."}, lines...)
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if okBtn.Clicked(gtx) && code.Text() != "" {
+				entered = true
+				w.Perform(system.ActionClose)
+			}
+
+			if cancelBtn.Clicked(gtx) {
+				w.Perform(system.ActionClose)
+			}
+
+			children := []layout.FlexChild{}
+			for i, line := range lines {
+				children = append(children, layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						txt := material.Body1(th, line)
+						if incorrect && i == 0 {
+							txt.Color = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+						}
+
+						margins := layout.UniformInset(unit.Dp(10))
+						margins.Bottom = 0
+						return margins.Layout(gtx, txt.Layout)
+					},
+				))
+			}
+
+			children = append(children,
+				totpCodeField(th, &code),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						return layout.Flex{
+							Axis:    layout.Horizontal,
+							Spacing: layout.SpaceSides,
+						}.Layout(gtx,
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									margins := layout.UniformInset(unit.Dp(10))
+									btn := material.Button(th, &okBtn, "OK")
+									return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+										return btn.Layout(gtx)
+									})
+								},
+							),
+							layout.Rigid(
+								func(gtx layout.Context) layout.Dimensions {
+									margins := layout.UniformInset(unit.Dp(10))
+									btn := material.Button(th, &cancelBtn, "Cancel")
+									return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+										return btn.Layout(gtx)
+									})
+								},
+							),
+						)
+					},
+				),
+			)
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx, children...)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return code.Text(), entered, e.Err
+		}
+	}
+}
+
+// Lets the active user turn two-factor authentication on or off
+func (a *Application) TwoFactorView(w *app.Window) error {
+	var (
+		ops           op.Ops
+		code          widget.Editor
+		setUpBtn      widget.Clickable
+		confirmBtn    widget.Clickable
+		turnOffBtn    widget.Clickable
+		doneBtn       widget.Clickable
+		secret        []byte
+		recoveryCodes []string
+		statusTxt     string
+	)
+
+	th := material.NewTheme()
+
+	var button = func(btn *widget.Clickable, txt string) layout.FlexChild {
+		return layout.Rigid(
+			func(gtx layout.Context) layout.Dimensions {
+				margins := layout.UniformInset(unit.Dp(10))
+				b := material.Button(th, btn, txt)
+				return margins.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+					return b.Layout(gtx)
+				})
+			},
+		)
+	}
+
+	for {
+		switch e := w.Event().(type) {
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			if setUpBtn.Clicked(gtx) {
+				s, err := a.beginTOTP()
+				if err != nil {
+					statusTxt = err.Error()
+				} else {
+					secret, statusTxt = s, ""
+					code.SetText("")
+				}
+			}
+
+			if confirmBtn.Clicked(gtx) {
+				codes, err := a.enableTOTP(code.Text())
+				if err != nil {
+					statusTxt = err.Error()
+				} else {
+					recoveryCodes, statusTxt = codes, ""
+				}
+			}
+
+			if turnOffBtn.Clicked(gtx) {
+				err := a.disableTOTP(code.Text())
+				if err != nil {
+					statusTxt = err.Error()
+				} else {
+					statusTxt = "Two-factor authentication is off."
+					code.SetText("")
+				}
+			}
+
+			if doneBtn.Clicked(gtx) {
+				w.Perform(system.ActionClose)
+			}
+
+			var lines []string
+			var children []layout.FlexChild
+			switch {
+			case recoveryCodes != nil:
+				lines = append([]string{
+					"Two-factor authentication is on. If you lose your authenticator, you can use one of these recovery codes instead. Each works once, and they won't be shown again.",
+				}, recoveryCodes...)
+				children = []layout.FlexChild{button(&doneBtn, "Done")}
+			case secret != nil:
+				lines = []string{
+					"Add this key to your authenticator app, then enter the code it shows to finish.",
+					"Key: " + crypto.EncodeTOTPSecret(secret),
+					crypto.TOTPURI(secret, "QPass", a.ActiveUser.Username),
+				}
+				children = []layout.FlexChild{totpCodeField(th, &code), button(&confirmBtn, "Confirm")}
+			default:
+				lines = []string{
+					"Two-factor authentication asks for a code from an authenticator app when you log in on a new device.",
+					"To turn it off, enter a code from your authenticator app or a recovery code.",
+				}
+				children = []layout.FlexChild{button(&setUpBtn, "Set Up"), totpCodeField(th, &code), button(&turnOffBtn, "Turn Off")}
+			}
+
+			if statusTxt != "" {
+				lines = append([]string{statusTxt}, lines...)
+			}
+
+			labels := []layout.FlexChild{}
+			for _, line := range lines {
+				labels = append(labels, layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						margins := layout.UniformInset(unit.Dp(10))
+						margins.Bottom = 0
+						return margins.Layout(gtx, material.Body1(th, line).Layout)
+					},
+				))
+			}
+
+			layout.Flex{
+				Axis:    layout.Vertical,
+				Spacing: layout.SpaceEnd,
+			}.Layout(gtx, append(labels, children...)...)
+			e.Frame(gtx.Ops)
+
+		case app.DestroyEvent:
+			return e.Err
+		}
+	}
+}
+
+func totpCodeField(th *material.Theme, ed *widget.Editor) layout.FlexChild {
+	return layout.Rigid(
+		func(gtx layout.Context) layout.Dimensions {
+			txt := material.Editor(th, ed, "Code")
+			ed.SingleLine = true
+
+			margins := layout.UniformInset(unit.Dp(10))
+			padding := layout.UniformInset(inputPadding)
+
+			border := widget.Border{
+				Color:        borderColor,
+				CornerRadius: unit.Dp(1),
+				Width:        unit.Dp(2),
+			}
+
+			return margins.Layout(gtx,
+				func(gtx layout.Context) layout.Dimensions {
+					return border.Layout(gtx,
+						func(gtx layout.Context) layout.Dimensions {
+							return padding.Layout(gtx, txt.Layout)
+						},
+					)
+				},
+			)
+		},
+	)
+}
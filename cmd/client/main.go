@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -10,7 +11,6 @@ import (
 	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/dbman"
 	"github.com/Queueue0/qpass/internal/models"
-	"github.com/Queueue0/qpass/internal/protocol"
 )
 
 type Application struct {
@@ -19,6 +19,8 @@ type Application struct {
 	PasswordModel *models.PasswordModel
 	Passwords     models.PasswordList
 	Config        *Config
+	Sessions      *crypto.SessionCache
+	DeviceKey     *crypto.PrivateKey
 }
 
 func main() {
@@ -53,43 +55,26 @@ func main() {
 		log.Fatal(err)
 	}
 
+	deviceKey, err := loadDeviceKey(qpassHome)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	a := Application{
 		UserModel:     &um,
 		PasswordModel: &pm,
 		ActiveUser:    &models.User{},
 		Config:        c,
-	}
-
-	// Connect to and ping server
-	sc, err := crypto.Dial(a.ServerAddress())
-	if err != nil {
-		log.Println("Failed to connect to server", err.Error())
-	}
-
-	if sc != nil {
-		// Closing sc closes c
-		defer sc.Close()
-		ping := protocol.NewPing()
-		_, err = ping.WriteTo(sc)
-		if err != nil {
-			log.Println("Write error", err.Error())
-		}
-		var response protocol.Payload
-		_, err = response.ReadFrom(sc)
-		if err != nil {
-			log.Println("Read error", err.Error())
-		}
-
-		if response.Type() == protocol.PONG {
-			log.Println("PONG")
-		} else {
-			log.Println("Ping failed")
-		}
-		succ := protocol.NewSucc()
-		succ.WriteTo(sc)
+		Sessions:      crypto.NewSessionCache(),
+		DeviceKey:     deviceKey,
 	}
 
 	go func() {
+		// Connect to and ping server
+		// Done in here rather than before app.Main, as the user might need to
+		// confirm the server's key in a new window
+		a.ping()
+
 		//		if a.UserModel.Count() <= 0 {
 		//			created := false
 		//			aw := new(app.Window)
@@ -105,35 +90,62 @@ func main() {
 		//			}
 		//		}
 
-		lw := new(app.Window)
-		lw.Option(app.Title("Login"))
-		lw.Option(app.Size(unit.Dp(500), unit.Dp(200)))
-		if err := a.LoginView(lw); err != nil {
-			log.Fatal(err)
-		}
-
-		if len(a.ActiveUser.Key) <= 0 {
-			log.Println("No active user")
-			os.Exit(0)
-		}
-
-		err = a.sync()
-		if err != nil {
-			log.Println(err.Error())
-		}
-		a.Passwords, err = a.PasswordModel.GetAllForUser(*a.ActiveUser, false)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		w := new(app.Window)
-		w.Option(app.Title("QPass"))
-		w.Option(app.Size(unit.Dp(1280), unit.Dp(720)))
-		if err := a.MainView(w); err != nil {
-			log.Fatal(err)
+		for {
+			for {
+				lw := new(app.Window)
+				lw.Option(app.Title("Login"))
+				lw.Option(app.Size(unit.Dp(500), unit.Dp(200)))
+				if err := a.LoginView(lw); err != nil {
+					log.Fatal(err)
+				}
+
+				if a.ActiveUser.Key.Len() <= 0 {
+					log.Println("No active user")
+					os.Exit(0)
+				}
+
+				err = a.sync()
+				if errors.Is(err, models.ErrStaleCredentials) {
+					// Changed on another device, so log in again with the new
+					// credentials
+					log.Println(err.Error())
+					a.logout()
+					continue
+				}
+				if err != nil {
+					log.Println(err.Error())
+				}
+				break
+			}
+			a.Passwords, err = a.PasswordModel.GetAllForUser(*a.ActiveUser, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := new(app.Window)
+			w.Option(app.Title("QPass"))
+			w.Option(app.Size(unit.Dp(1280), unit.Dp(720)))
+			locked, err := a.MainView(w)
+			a.logout()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// Locking goes back to the login window, anything else quits
+			if !locked {
+				break
+			}
 		}
 		os.Exit(0)
 	}()
 
 	app.Main()
 }
+
+// Zeroes the active user's keys and decrypted passwords
+func (a *Application) logout() {
+	a.Passwords.Destroy()
+	a.Passwords = nil
+	a.ActiveUser.Destroy()
+	a.ActiveUser = &models.User{}
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"net"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/models"
 	"github.com/Queueue0/qpass/internal/protocol"
 	"github.com/google/uuid"
 )
@@ -15,6 +21,58 @@ var (
 	ErrCommFail     = errors.New("Communication with server failed unexpectedly")
 )
 
+// Returned by a sync that took everything from the server except entries
+// that couldn't be decrypted, which are asked for again on the next one. It
+// doesn't stop the rest of the sync.
+var ErrUnreadableEntries = errors.New("Some synced entries couldn't be decrypted")
+
+// Returned by a sync that sent everything except entries too large to fit in
+// a SYNC payload, which stay unsynced. It doesn't stop the rest of the sync.
+var ErrOversizedEntries = errors.New("Some entries are too large to sync")
+
+// Separates ErrUnreadableEntries and ErrOversizedEntries, which a sync carries
+// on after, from errors that end it
+func splitUnreadable(err error) (unreadable, fatal error) {
+	if errors.Is(err, ErrUnreadableEntries) || errors.Is(err, ErrOversizedEntries) {
+		return err, nil
+	}
+
+	return nil, err
+}
+
+// How long to wait on the sync server before giving up
+const serverTimeout = 30 * time.Second
+
+// Opens a secure connection to the sync server, asking the user before
+// trusting a server we haven't seen before. Requests can be made on it
+// concurrently.
+func (app *Application) dial() (*protocol.Conn, error) {
+	conf := crypto.ClientConfig{
+		HostKeyCallback: crypto.TrustOnFirstUse(app.confirmHostKey, app.Config.HashKnownHosts),
+		SessionCache:    app.Sessions,
+		IdleTimeout:     serverTimeout,
+		DeviceKey:       app.DeviceKey,
+		Capabilities:    crypto.CapDeltaSync,
+	}
+
+	c, err := crypto.DialTransport(app.Config.Transport, app.ServerAddress(), &conf)
+	if err != nil {
+		var changed *crypto.HostKeyChangedError
+		if errors.As(err, &changed) {
+			app.hostKeyChanged(changed)
+		}
+		return nil, err
+	}
+
+	return protocol.NewClientConn(c), nil
+}
+
+// Tells the server we're done with c, and closes it
+func hangUp(c *protocol.Conn) {
+	c.Send(protocol.NewSucc())
+	c.Close()
+}
+
 func (app *Application) send(p *protocol.Payload) error {
 	c, err := net.Dial("tcp", app.ServerAddress())
 	if err != nil {
@@ -32,112 +90,284 @@ func (app *Application) sync() error {
 		return ErrNoActiveUser
 	}
 
-	activeUUID := app.ActiveUser.ID.String()
+	ad := protocol.AuthData{
+		Token:  app.ActiveUser.AuthToken.Bytes(),
+		Lookup: app.ActiveUser.Lookup,
+		KDF:    app.ActiveUser.KDF,
+	}
 
-	ad := protocol.AuthData{Token: app.ActiveUser.AuthToken}
-	authBytes, err := ad.Encode()
+	c, err := app.dial()
 	if err != nil {
 		return err
 	}
+	defer hangUp(c)
 
-	apl, err := protocol.NewPayload(protocol.AUTH, authBytes)
+	_, err = app.authenticateUser(c, ad)
+	if errors.Is(err, protocol.ErrCredentialsChanged) {
+		err = app.UserModel.MarkStale(app.ActiveUser.ID.String())
+		if err != nil {
+			return err
+		}
+
+		return models.ErrStaleCredentials
+	}
+
+	if errors.Is(err, protocol.ErrAuthFailed) {
+		// The server doesn't know this user yet, so add them, then retry
+		// auth
+		_, err = newUser(c, app.ActiveUser.ID.String(), app.ActiveUser.AuthToken.Bytes(), app.ActiveUser.Lookup, app.ActiveUser.KDF)
+		if err != nil {
+			return err
+		}
+
+		_, err = authenticate(c, ad)
+	}
 	if err != nil {
 		return err
 	}
 
-	c, err := crypto.Dial(app.ServerAddress())
+	unreadable, err := splitUnreadable(app.syncDataKey(c, app.ActiveUser))
 	if err != nil {
 		return err
 	}
-	defer func() {
-		protocol.NewSucc().WriteTo(c)
-		c.Close()
-	}()
 
-	_, err = apl.WriteTo(c)
+	// Only the device the recovery key was made on has it to send, and
+	// sends it every time in case the server missed it. It doesn't depend
+	// on the passwords, so it goes alongside them.
+	recoveryErr := make(chan error, 1)
+	if app.ActiveUser.RecoveryKey != "" {
+		u := *app.ActiveUser
+		go func() {
+			recoveryErr <- sendRecoveryKey(c, u)
+		}()
+	} else {
+		recoveryErr <- nil
+	}
+
+	skipped, err := splitUnreadable(app.syncPasswords(c, *app.ActiveUser))
 	if err != nil {
 		return err
 	}
+	unreadable = errors.Join(unreadable, skipped)
 
-	authResp := protocol.Payload{}
-	_, err = authResp.ReadFrom(c)
+	err = <-recoveryErr
 	if err != nil {
 		return err
 	}
 
-	if authResp.Type() == protocol.FAIL {
-		// Try to add new user, then retry auth
-		_, err := app.newUserSync(app.ActiveUser.ID.String(), app.ActiveUser.AuthToken)
+	if !app.ActiveUser.BoundEntries {
+		// Passwords from before fields were bound to where they're stored
+		// are re-encrypted once everything is merged, then sent back
+		err = app.UserModel.BindEntries(app.ActiveUser)
 		if err != nil {
 			return err
 		}
 
-		_, err = apl.WriteTo(c)
+		return errors.Join(unreadable, app.syncPasswords(c, *app.ActiveUser))
+	}
+
+	return unreadable
+}
+
+// Sends u's passwords changed since they were last synced to the server, and
+// takes the server's changes since then. Everything is sent the first time,
+// when the server doesn't know where the last sync left off, or when it
+// doesn't sync only changes.
+func (app *Application) syncPasswords(c *protocol.Conn, u models.User) error {
+	var since uint64
+	var err error
+	if c.Capabilities().Has(crypto.CapDeltaSync) {
+		since, err = app.PasswordModel.SyncRevision(u)
 		if err != nil {
 			return err
 		}
+	}
+
+	err = app.syncPasswordsSince(c, u, since)
+	if errors.Is(err, protocol.ErrUnknownRevision) && since != 0 {
+		err = app.syncPasswordsSince(c, u, 0)
+	}
+
+	return err
+}
+
+func (app *Application) syncPasswordsSince(c *protocol.Conn, u models.User, since uint64) error {
+	var pws models.PasswordList
+	var err error
+	if since == 0 {
+		pws, err = app.PasswordModel.GetAllEncryptedForUser(u)
+	} else {
+		pws, err = app.PasswordModel.GetUnsyncedForUser(u)
+	}
+	if err != nil {
+		return err
+	}
+
+	payloads, oversized, err := protocol.SyncPayloads(protocol.SyncData{UUID: u.ID.String(), Entries: protocol.NewEntries(pws), Since: since})
+	if err != nil {
+		return err
+	}
 
-		authResp = protocol.Payload{}
-		_, err = authResp.ReadFrom(c)
+	// Left as they are, so they're still unsynced for the next sync to
+	// report again
+	var oversizedErr error
+	if len(oversized) > 0 {
+		ids := make([]string, len(oversized))
+		for i, entry := range oversized {
+			ids[i] = entry.UUID.String()
+		}
+		oversizedErr = fmt.Errorf("%w: %s", ErrOversizedEntries, strings.Join(ids, ", "))
+
+		pws = slices.DeleteFunc(pws, func(p models.Password) bool {
+			return slices.ContainsFunc(oversized, func(entry protocol.Entry) bool {
+				return entry.UUID == p.UUID
+			})
+		})
+	}
+
+	req := c.Open()
+	defer req.Close()
+
+	for _, pl := range payloads {
+		err = req.Send(pl)
+		if err != nil {
+			return err
+		}
+	}
+
+	var entries []protocol.Entry
+	var revision uint64
+	for {
+		r, err := req.Receive()
+		if err != nil {
+			return err
+		}
+		if r.Type() == protocol.FAIL {
+			return r.Err()
+		}
+		if r.Type() != protocol.SYNC {
+			return ErrCommFail
+		}
+
+		rd := protocol.SyncData{}
+		err = rd.Decode(r.Bytes())
 		if err != nil {
 			return err
 		}
 
-		if authResp.Type() == protocol.FAIL {
-			return errors.New("Remote error: " + authResp.String())
+		entries = append(entries, rd.Entries...)
+		revision = rd.Revision
+		if !rd.More {
+			break
 		}
 	}
 
-	if authResp.Type() != protocol.SUCC {
-		return errors.New("Unexpected response type from server")
+	skipped, err := app.PasswordModel.ApplySync(u, pws, protocol.Passwords(entries), revision)
+	if err != nil || len(skipped) == 0 {
+		return errors.Join(err, oversizedErr)
 	}
 
-	pws, err := app.PasswordModel.GetAllEncryptedForUser(*app.ActiveUser)
-	if err != nil {
-		return err
+	ids := make([]string, len(skipped))
+	for i, p := range skipped {
+		ids[i] = p.UUID.String()
 	}
 
-	sd := protocol.SyncData{UUID: activeUUID, Passwords: pws}
-	bytes, err := sd.Encode()
+	return errors.Join(fmt.Errorf("%w: %s", ErrUnreadableEntries, strings.Join(ids, ", ")), oversizedErr)
+}
+
+// Makes sure u's passwords are encrypted with the same data key as the server
+// has for them. Users from before data keys get one here, but it's only
+// decided once the server has it, as another device might have offered one
+// first.
+func (app *Application) syncDataKey(c *protocol.Conn, u *models.User) error {
+	offer := u.WrappedKey
+	if offer == "" {
+		var err error
+		offer, err = u.NewDataKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	wrappedKey, err := offerDataKey(c, offer)
 	if err != nil {
 		return err
 	}
 
-	pl, err := protocol.NewPayload(protocol.SYNC, bytes)
+	switch wrappedKey {
+	case u.WrappedKey:
+		return nil
+	case offer:
+		// Ours is the first, so bring the server's copies up to date while
+		// they're still encrypted with the old key, then mark ours as
+		// changed so they replace them
+		unreadable, err := splitUnreadable(app.syncPasswords(c, *u))
+		if err != nil {
+			return err
+		}
+
+		return errors.Join(unreadable, app.UserModel.SetDataKey(u, wrappedKey, true))
+	}
+
+	// The server's copies are already encrypted with its key
+	return app.UserModel.SetDataKey(u, wrappedKey, false)
+}
+
+// Offers the server a wrapped data key for the authenticated user, or asks
+// for theirs if offer is empty, and returns the one they have
+func offerDataKey(c *protocol.Conn, offer string) (string, error) {
+	dkd := protocol.DataKeyData{WrappedKey: offer}
+	b, err := dkd.Encode()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	_, err = pl.WriteTo(c)
+	p, err := protocol.NewPayload(protocol.VKEY, b)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	r := protocol.Payload{}
-	_, err = r.ReadFrom(c)
+	r, err := c.Do(p)
 	if err != nil {
-		return err
+		return "", err
 	}
+
 	if r.Type() == protocol.FAIL {
-		return errors.New("Remote error: " + r.String())
+		return "", r.Err()
+	}
+
+	if r.Type() != protocol.VKEY {
+		return "", ErrCommFail
 	}
 
-	rd := protocol.SyncData{}
+	rd := protocol.DataKeyData{}
 	err = rd.Decode(r.Bytes())
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = app.PasswordModel.ReplaceAllForUser(app.ActiveUser.ID.String(), rd.Passwords)
+	return rd.WrappedKey, nil
+}
+
+func (app *Application) newUserSync(id string, authToken, lookup []byte, params crypto.KDFParams) (string, error) {
+	c, err := app.dial()
 	if err != nil {
-		return err
+		return "", ErrPingFail
 	}
+	defer hangUp(c)
 
-	return nil
+	r, err := c.Do(protocol.NewPing())
+	if err != nil || r.Type() != protocol.PONG {
+		return "", ErrPingFail
+	}
+
+	return newUser(c, id, authToken, lookup, params)
 }
 
-func (app *Application) newUserSync(id string, authToken []byte) (string, error) {
-	nud := protocol.NewUserData{Token: authToken}
+// Asks the server to create a user with the given token, and the given ID if
+// there is one, and returns their ID
+func newUser(c *protocol.Conn, id string, authToken, lookup []byte, params crypto.KDFParams) (string, error) {
+	nud := protocol.NewUserData{Token: authToken, Lookup: lookup, KDF: params}
 	if id != "" {
 		nud.UUID = id
 	}
@@ -147,30 +377,16 @@ func (app *Application) newUserSync(id string, authToken []byte) (string, error)
 		return "", err
 	}
 
-	c, err := crypto.Dial(app.ServerAddress())
-	if err != nil {
-		return "", ErrPingFail
-	}
-	defer c.Close()
-
-	protocol.NewPing().WriteTo(c)
-	r := protocol.Payload{}
-	r.ReadFrom(c)
-
-	if r.Type() != protocol.PONG {
-		return "", ErrPingFail
-	}
-
 	// Will never error here, only possible error is if max payload size is
 	// exceeded which won't happen with just an auth token
 	p, _ := protocol.NewPayload(protocol.NUSR, b)
-	p.WriteTo(c)
-
-	r = protocol.Payload{}
-	r.ReadFrom(c)
+	r, err := c.Do(p)
+	if err != nil {
+		return "", err
+	}
 
 	if r.Type() == protocol.FAIL {
-		return "", errors.New(string(r.Bytes()))
+		return "", r.Err()
 	}
 
 	if r.Type() != protocol.SUCC {
@@ -180,7 +396,6 @@ func (app *Application) newUserSync(id string, authToken []byte) (string, error)
 	newid := string(r.Bytes())
 	_, err = uuid.Parse(newid)
 
-	protocol.NewSucc().WriteTo(c)
 	return newid, err
 }
 
@@ -190,65 +405,608 @@ func (app *Application) loginSync(username, password string) error {
 	if err == nil {
 		// Should maybe make a call to sync in this block
 		app.ActiveUser = &u
+		app.refreshKDF(password)
 		return nil
 	}
 
-	ad := protocol.AuthData{Token: crypto.ClientAuthToken(username, password)}
-	authBytes, err := ad.Encode()
+	c, err := app.dial()
 	if err != nil {
 		return err
 	}
+	defer hangUp(c)
 
-	apl, err := protocol.NewPayload(protocol.AUTH, authBytes)
+	// The auth token depends on the parameters the user's keys are derived
+	// with, which the server has to tell us. Users it doesn't know the
+	// parameters of yet are still on the legacy ones.
+	params, err := kdfParams(c, crypto.UserLookupID(username))
 	if err != nil {
 		return err
 	}
 
-	c, err := crypto.Dial(app.ServerAddress())
+	if !slices.Contains(params, crypto.LegacyKDFParams) {
+		params = append(params, crypto.LegacyKDFParams)
+	}
+
+	var idStr string
+	var kdf crypto.KDFParams
+	authErr := ErrCommFail
+	for _, p := range params {
+		token, err := crypto.ClientAuthToken(username, password, p)
+		if err != nil {
+			return err
+		}
+
+		id, err := app.authenticateUser(c, protocol.AuthData{Token: token.Bytes()})
+		token.Destroy()
+		if err == nil {
+			idStr, kdf = id, p
+			break
+		}
+
+		if !rejected(err) {
+			return err
+		}
+		authErr = err
+	}
+
+	if idStr == "" {
+		return authErr
+	}
+
+	exists, err := app.UserModel.Exists(idStr)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		protocol.NewSucc().WriteTo(c)
-		c.Close()
-	}()
 
-	_, err = apl.WriteTo(c)
+	if exists {
+		// The credentials were changed on another device, which wrapped the
+		// data key with the new ones
+		wrappedKey, err := offerDataKey(c, "")
+		if err != nil {
+			return err
+		}
+
+		err = app.UserModel.Relogin(idStr, username, password, kdf, wrappedKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = app.UserModel.Insert(username, password, idStr, kdf)
+		if err != nil {
+			return err
+		}
+	}
+
+	u, err = app.UserModel.Authenticate(username, password)
 	if err != nil {
 		return err
 	}
+	app.ActiveUser = &u
+	app.refreshKDF(password)
 
-	authResp := protocol.Payload{}
-	_, err = authResp.ReadFrom(c)
+	err = app.sync()
+	if err != nil {
+		return errors.New("sync: " + err.Error())
+	}
+
+	return nil
+}
+
+// Changes u's username and password, and the token the server knows them by.
+// Their other devices have to log in again with the new ones. u may have a new
+// data key even if this fails, as that's settled first.
+func (app *Application) changeCredentials(u *models.User, password, newUsername, newPassword string) error {
+	check, err := app.UserModel.Authenticate(u.Username, password)
+	check.Destroy()
+	if err != nil || check.ID != u.ID {
+		return models.ErrIncorrectCreds
+	}
+
+	c, err := app.dial()
 	if err != nil {
 		return err
 	}
+	defer hangUp(c)
 
-	if authResp.Type() == protocol.FAIL {
-		protocol.NewSucc().WriteTo(c)
-		return errors.New("Remote error: " + authResp.String())
+	_, err = app.authenticateUser(c, protocol.AuthData{Token: u.AuthToken.Bytes(), Lookup: u.Lookup, KDF: u.KDF})
+	if errors.Is(err, protocol.ErrCredentialsChanged) {
+		err = app.UserModel.MarkStale(u.ID.String())
+		if err != nil {
+			return err
+		}
+
+		return models.ErrStaleCredentials
 	}
 
-	if authResp.Type() != protocol.SUCC {
-		return errors.New("Unexpected response type from server")
+	if err != nil && !errors.Is(err, protocol.ErrAuthFailed) {
+		return err
 	}
 
-	idStr := string(authResp.Bytes())
-	_, err = app.UserModel.Insert(username, password, idStr)
+	// The data key has to be settled first, as it's what gets wrapped with
+	// the new credentials. If the server doesn't know this user, the next
+	// sync creates them with the new ones.
+	known := err == nil
+	if known {
+		err = app.syncDataKey(c, u)
+	} else if u.WrappedKey == "" {
+		var wrappedKey string
+		wrappedKey, err = u.NewDataKey()
+		if err == nil {
+			err = app.UserModel.SetDataKey(u, wrappedKey, true)
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	u, err = app.UserModel.Authenticate(username, password)
+	creds, err := u.NewCredentials(newUsername, newPassword, crypto.DefaultKDFParams)
 	if err != nil {
 		return err
 	}
-	app.ActiveUser = &u
 
-	err = app.sync()
+	if known {
+		err = sendCredentials(c, protocol.CRED, creds)
+		if err != nil {
+			creds.Destroy()
+			return err
+		}
+	}
+
+	// If this fails after the server has the new credentials, the next sync
+	// finds the old token retired and asks to log in with the new ones
+	err = app.UserModel.SetCredentials(u, creds)
 	if err != nil {
-		return errors.New("sync: " + err.Error())
+		creds.Destroy()
+	}
+
+	return err
+}
+
+// Gives the server new credentials for the authenticated user, with CRED for a
+// new username or password or KDFU for new key derivation parameters
+func sendCredentials(c *protocol.Conn, payloadType byte, creds *models.Credentials) error {
+	ad := protocol.AuthData{Token: creds.AuthToken.Bytes(), Lookup: creds.Lookup, KDF: creds.KDF, WrappedKey: creds.WrappedKey}
+	b, err := ad.Encode()
+	if err != nil {
+		return err
+	}
+
+	p, err := protocol.NewPayload(payloadType, b)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.Do(p)
+	if err != nil {
+		return err
+	}
+
+	if r.Type() == protocol.FAIL {
+		return r.Err()
+	}
+
+	if r.Type() != protocol.SUCC {
+		return ErrCommFail
 	}
 
 	return nil
 }
+
+// Gives the server the authenticated user's data key wrapped with their
+// recovery key
+func sendRecoveryKey(c *protocol.Conn, u models.User) error {
+	rd := protocol.RecoveryData{Verifier: u.RecoveryVerifier, WrappedKey: u.RecoveryKey}
+	b, err := rd.Encode()
+	if err != nil {
+		return err
+	}
+
+	p, err := protocol.NewPayload(protocol.RKEY, b)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.Do(p)
+	if err != nil {
+		return err
+	}
+
+	if r.Type() == protocol.FAIL {
+		return r.Err()
+	}
+
+	if r.Type() != protocol.SUCC {
+		return ErrCommFail
+	}
+
+	return nil
+}
+
+// Sets a new username and master password for the account with the given
+// ID, for a user who's forgotten their password but has their recovery key.
+// Their other devices have to log in again, as after any credential change.
+// Afterwards they log in with the new credentials as usual.
+func (app *Application) recoverAccount(id, recoveryKey, username, password string) error {
+	_, err := uuid.Parse(id)
+	if err != nil {
+		return errors.New("Invalid account ID")
+	}
+
+	kek, token, err := crypto.RecoveryKeys(recoveryKey)
+	if err != nil {
+		return err
+	}
+	defer kek.Destroy()
+	defer token.Destroy()
+
+	c, err := app.dial()
+	if err != nil {
+		return err
+	}
+	defer hangUp(c)
+
+	wrappedKey, err := app.recoverDataKey(c, protocol.RecoveryData{UUID: id, Token: token.Bytes()})
+	if err != nil {
+		return err
+	}
+
+	creds, err := models.RecoverCredentials(wrappedKey, kek, username, password, crypto.DefaultKDFParams)
+	if err != nil {
+		return err
+	}
+	defer creds.Destroy()
+
+	err = sendCredentials(c, protocol.CRED, creds)
+	if err != nil {
+		return err
+	}
+
+	// On a device that already has the account, take it over with the new
+	// credentials. Anywhere else, logging in with Sync fetches it.
+	exists, err := app.UserModel.Exists(id)
+	if err != nil || !exists {
+		return err
+	}
+
+	return app.UserModel.Relogin(id, username, password, creds.KDF, creds.WrappedKey)
+}
+
+// Sends an RCVR payload over c and returns the data key wrapped with the
+// recovery key, asking the user for a two-factor code if the server wants
+// one, until they get it right or give up
+func (app *Application) recoverDataKey(c *protocol.Conn, rd protocol.RecoveryData) (string, error) {
+	for {
+		b, err := rd.Encode()
+		if err != nil {
+			return "", err
+		}
+
+		p, err := protocol.NewPayload(protocol.RCVR, b)
+		if err != nil {
+			return "", err
+		}
+
+		r, err := c.Do(p)
+		if err != nil {
+			return "", err
+		}
+
+		if r.Type() == protocol.RCVR {
+			var reply protocol.RecoveryData
+			err = reply.Decode(r.Bytes())
+			return reply.WrappedKey, err
+		}
+
+		if r.Type() != protocol.FAIL {
+			return "", ErrCommFail
+		}
+
+		err = r.Err()
+		if !errors.Is(err, protocol.ErrTOTPRequired) && !errors.Is(err, protocol.ErrTOTPIncorrect) {
+			return "", err
+		}
+
+		code, ok := app.promptTOTPCode(rd.Code != "")
+		if !ok {
+			return "", ErrTOTPCancelled
+		}
+		rd.Code = code
+	}
+}
+
+// Sends an AUTH payload over c and returns the authenticated user's ID
+func authenticate(c *protocol.Conn, ad protocol.AuthData) (string, error) {
+	authBytes, err := ad.Encode()
+	if err != nil {
+		return "", err
+	}
+
+	apl, err := protocol.NewPayload(protocol.AUTH, authBytes)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := c.Do(apl)
+	if err != nil {
+		return "", err
+	}
+
+	if r.Type() == protocol.FAIL {
+		return "", r.Err()
+	}
+
+	if r.Type() != protocol.SUCC {
+		return "", ErrCommFail
+	}
+
+	return string(r.Bytes()), nil
+}
+
+// Reports whether err means the server doesn't know the credentials sent
+// with AUTH, rather than that something went wrong
+func rejected(err error) bool {
+	return errors.Is(err, protocol.ErrAuthFailed) || errors.Is(err, protocol.ErrCredentialsChanged)
+}
+
+var ErrTOTPCancelled = errors.New("Two-factor authentication code is required")
+
+// Authenticates like authenticate, asking the user for a two-factor code if
+// the server wants one, until they get it right or give up
+func (app *Application) authenticateUser(c *protocol.Conn, ad protocol.AuthData) (string, error) {
+	for {
+		id, err := authenticate(c, ad)
+		if !errors.Is(err, protocol.ErrTOTPRequired) && !errors.Is(err, protocol.ErrTOTPIncorrect) {
+			return id, err
+		}
+
+		code, ok := app.promptTOTPCode(ad.Code != "")
+		if !ok {
+			return "", ErrTOTPCancelled
+		}
+		ad.Code = code
+	}
+}
+
+// Sends a TOTP payload for the active user and returns the server's reply
+func (app *Application) sendTOTP(td protocol.TOTPData) (protocol.TOTPData, error) {
+	u := app.ActiveUser
+	c, err := app.dial()
+	if err != nil {
+		return protocol.TOTPData{}, err
+	}
+	defer hangUp(c)
+
+	_, err = app.authenticateUser(c, protocol.AuthData{Token: u.AuthToken.Bytes(), Lookup: u.Lookup, KDF: u.KDF})
+	if err != nil {
+		return protocol.TOTPData{}, err
+	}
+
+	b, err := td.Encode()
+	if err != nil {
+		return protocol.TOTPData{}, err
+	}
+
+	p, err := protocol.NewPayload(protocol.TOTP, b)
+	if err != nil {
+		return protocol.TOTPData{}, err
+	}
+
+	r, err := c.Do(p)
+	if err != nil {
+		return protocol.TOTPData{}, err
+	}
+
+	if r.Type() == protocol.FAIL {
+		return protocol.TOTPData{}, r.Err()
+	}
+
+	rd := protocol.TOTPData{}
+	switch r.Type() {
+	case protocol.TOTP:
+		err = rd.Decode(r.Bytes())
+	case protocol.SUCC:
+	default:
+		err = ErrCommFail
+	}
+
+	return rd, err
+}
+
+// Starts turning on two-factor authentication for the active user, and
+// returns the secret to add to their authenticator app
+func (app *Application) beginTOTP() ([]byte, error) {
+	rd, err := app.sendTOTP(protocol.TOTPData{})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rd.Secret) == 0 {
+		return nil, ErrCommFail
+	}
+
+	return rd.Secret, nil
+}
+
+// Turns on two-factor authentication once the user has a code from their
+// authenticator app, and returns their recovery codes
+func (app *Application) enableTOTP(code string) ([]string, error) {
+	rd, err := app.sendTOTP(protocol.TOTPData{Code: code})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rd.RecoveryCodes) == 0 {
+		return nil, ErrCommFail
+	}
+
+	return rd.RecoveryCodes, nil
+}
+
+// Turns off two-factor authentication with a current code or recovery code
+func (app *Application) disableTOTP(code string) error {
+	_, err := app.sendTOTP(protocol.TOTPData{Code: code, Disable: true})
+	return err
+}
+
+// Most sets of key derivation parameters tried when logging in
+const maxKDFParams = 4
+
+// Asks the server which parameters the keys of users with the given lookup ID
+// are derived with
+func kdfParams(c *protocol.Conn, lookup []byte) ([]crypto.KDFParams, error) {
+	kd := protocol.KDFData{Lookup: lookup}
+	b, err := kd.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := protocol.NewPayload(protocol.KDFP, b)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.Do(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Type() == protocol.FAIL {
+		return nil, r.Err()
+	}
+
+	if r.Type() != protocol.KDFP {
+		return nil, ErrCommFail
+	}
+
+	rd := protocol.KDFData{}
+	err = rd.Decode(r.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't let the server pick parameters we wouldn't, or ones weak enough
+	// that the token we'd send would give the password away. Each set costs
+	// a key derivation here and a token hash on the server, so only the most
+	// used ones, which the server lists first, are tried.
+	params := []crypto.KDFParams{}
+	for _, p := range rd.Params {
+		if len(params) == maxKDFParams {
+			break
+		}
+
+		if p.ValidateRemote() == nil && !slices.Contains(params, p) {
+			params = append(params, p)
+		}
+	}
+
+	return params, nil
+}
+
+// Brings the parameters the active user's keys are derived with in line with
+// the sync server, in case another device has changed them, and upgrades them
+// if they're weaker than the defaults. The user is logged in either way, so
+// failures are only logged.
+func (app *Application) refreshKDF(password string) {
+	err := app.updateKDF(password)
+	if err != nil {
+		log.Println("Updating key derivation parameters failed:", err.Error())
+	}
+}
+
+func (app *Application) updateKDF(password string) error {
+	u := app.ActiveUser
+	c, err := app.dial()
+	if err != nil {
+		return err
+	}
+	defer hangUp(c)
+
+	params, err := kdfParams(c, u.Lookup)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(params, u.KDF) {
+		// Another device may have changed them, and the server's copies of
+		// our passwords are already encrypted with the resulting key
+		for _, p := range params {
+			token, err := crypto.ClientAuthToken(u.Username, password, p)
+			if err != nil {
+				return err
+			}
+
+			_, err = app.authenticateUser(c, protocol.AuthData{Token: token.Bytes()})
+			token.Destroy()
+			if err == nil {
+				return app.UserModel.Rekey(u, password, p, false)
+			}
+
+			if !rejected(err) {
+				return err
+			}
+		}
+	}
+
+	if !u.KDF.NeedsUpgrade() {
+		return nil
+	}
+
+	_, err = app.authenticateUser(c, protocol.AuthData{Token: u.AuthToken.Bytes(), Lookup: u.Lookup, KDF: u.KDF})
+	if err != nil && !errors.Is(err, protocol.ErrAuthFailed) {
+		return err
+	}
+
+	// The server's data key has to be wrapped with the new key too
+	known := err == nil
+	if known {
+		err = app.syncDataKey(c, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	creds, err := u.NewCredentials(u.Username, password, crypto.DefaultKDFParams)
+	if err != nil {
+		return err
+	}
+
+	// The server has to take the new token before we switch to it, or a
+	// refusal would leave us with one it doesn't know. If the server doesn't
+	// know this user, the next sync creates them with the upgraded token.
+	if known {
+		err = sendCredentials(c, protocol.KDFU, creds)
+		if err != nil {
+			creds.Destroy()
+			return err
+		}
+	}
+
+	// If this fails after the server has the new token, the old one is
+	// refused from then on and the next login adopts the new parameters
+	err = app.UserModel.SetCredentials(u, creds)
+	if err != nil {
+		creds.Destroy()
+	}
+
+	return err
+}
+
+func (app *Application) ping() {
+	sc, err := app.dial()
+	if err != nil {
+		log.Println("Failed to connect to server", err.Error())
+		return
+	}
+
+	defer hangUp(sc)
+	response, err := sc.Do(protocol.NewPing())
+	if err != nil {
+		log.Println("Ping error", err.Error())
+	}
+
+	if response.Type() == protocol.PONG {
+		log.Println("PONG")
+	} else {
+		log.Println("Ping failed")
+	}
+}
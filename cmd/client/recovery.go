@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+const emergencyKitTemplate = `QPass Emergency Kit
+
+Keep this somewhere safe, such as printed out and locked away. Anyone with
+it can take over your account.
+
+Sync server:   %s
+Account ID:    %s
+Recovery key:  %s
+
+If you forget your master password, choose Recover on the login screen and
+enter the account ID and recovery key above. You'll be asked for a new
+username and master password, and your other devices will need to log in
+again with them.
+`
+
+// Writes an emergency kit with the recovery key for the account with the
+// given ID to the user's home directory, readable only by them, and returns
+// where it was written
+func (a *Application) writeEmergencyKit(id string, recoveryKey *crypto.Secret) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(home, "qpass-emergency-kit-"+id[:8]+"-*.txt")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = fmt.Fprintf(f, emergencyKitTemplate, a.ServerAddress(), id, recoveryKey.Reveal())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), f.Close()
+}
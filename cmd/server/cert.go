@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// The TLS transport uses a certificate self-signed by the first host key,
+// kept next to the keys. It's replaced whenever it no longer matches that key
+// or the endorsements being presented, so it follows key rotations.
+const certFile = "cert.pem"
+
+func loadCertificate(dir string, hostKeys []*crypto.PrivateKey, endorsements []*crypto.Endorsement) ([]byte, error) {
+	if len(hostKeys) == 0 {
+		return nil, crypto.ErrNoCertificate
+	}
+	key := hostKeys[0]
+
+	path := dir + "/" + certFile
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block != nil && block.Type == "CERTIFICATE" && crypto.CertificateCurrent(block.Bytes, key.Public(), endorsements) {
+		return block.Bytes, nil
+	}
+
+	log.Println("Generating TLS certificate for", crypto.Fingerprint(key.Public()))
+	cert, err := crypto.NewCertificate(key, endorsements)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
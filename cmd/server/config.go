@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+type Config struct {
+	configPath    string
+	ListenAddress string
+	// Host key algorithms to present, by name. Keys that don't exist yet
+	// are generated on startup. If empty, whatever keys already exist are
+	// used, or a new ed25519 key if there are none.
+	//
+	// To move an RSA server to ed25519, add "ed25519" before "rsa". Clients
+	// that pinned the RSA key keep asking for it, new clients get ed25519.
+	HostKeyTypes []string
+	// How long clients can resume sessions with a ticket, e.g. "12h". Set
+	// to "-1s" to stop issuing tickets.
+	TicketLifetime time.Duration
+	// How long clients have to complete the handshake, and how long they
+	// can stay connected without sending anything, e.g. "30s" and "5m"
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+	// Only accept devices that have logged in before. Turn this on once
+	// all your devices are set up.
+	RejectUnknownDevices bool
+	// How long a device that's passed a user's two-factor authentication
+	// can log in as them without a code, e.g. "720h". Set to "-1s" to ask
+	// every time.
+	TOTPRememberDevice time.Duration
+	// Transports to accept connections over, any of "qpass", "tls" and
+	// "noise". All of them can share ListenAddress. Over TLS, only the first
+	// host key is presented.
+	Transports []string
+	// How many bytes and records each side sends under one traffic key
+	// before replacing it. Set to -1 to only replace keys on demand. TLS
+	// connections manage their own keys.
+	KeyUpdateBytes   int64
+	KeyUpdateRecords int64
+}
+
+const (
+	defaultListenAddress = "127.0.0.1:10448"
+	defaultIdleTimeout   = 5 * time.Minute
+
+	defaultTOTPRememberDevice = 30 * 24 * time.Hour
+)
+
+func ConfigInit(qpassHome string) (*Config, error) {
+	conf := &Config{}
+	conf.configPath = fmt.Sprintf("%s/%s", qpassHome, "config.toml")
+	if _, err := os.Stat(conf.configPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			_, err = os.Create(conf.configPath)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	_, err := toml.DecodeFile(conf.configPath, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ListenAddress == "" {
+		conf.ListenAddress = defaultListenAddress
+	}
+
+	if conf.TicketLifetime == 0 {
+		conf.TicketLifetime = crypto.DefaultTicketLifetime
+	}
+
+	if conf.HandshakeTimeout == 0 {
+		conf.HandshakeTimeout = crypto.DefaultHandshakeTimeout
+	}
+
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = defaultIdleTimeout
+	}
+
+	if conf.TOTPRememberDevice == 0 {
+		conf.TOTPRememberDevice = defaultTOTPRememberDevice
+	}
+
+	if conf.KeyUpdateBytes == 0 {
+		conf.KeyUpdateBytes = crypto.DefaultKeyUpdateBytes
+	}
+
+	if conf.KeyUpdateRecords == 0 {
+		conf.KeyUpdateRecords = crypto.DefaultKeyUpdateRecords
+	}
+
+	if len(conf.Transports) == 0 {
+		conf.Transports = []string{crypto.TransportQpass}
+	}
+
+	for _, t := range conf.Transports {
+		if t != crypto.TransportQpass && t != crypto.TransportTLS && t != crypto.TransportNoise {
+			return nil, fmt.Errorf("unknown transport %q", t)
+		}
+	}
+
+	return conf, nil
+}
+
+func (c *Config) Save() error {
+	file, err := os.Create(c.configPath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	encoder := toml.NewEncoder(file)
+	return encoder.Encode(c)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/models"
+	"github.com/google/uuid"
+)
+
+// Clients prove which device they are during the handshake. Devices are
+// recorded when a user logs in or registers from them, and can be revoked
+// from the command line:
+//
+//	qpass-server devices [list]
+//	qpass-server devices revoke <id>
+//
+// Revoked devices are refused during the handshake from then on, including by
+// a running server. With RejectUnknownDevices set, devices that haven't been
+// recorded yet are refused too, so no new devices can be added.
+
+// Used as the crypto.DeviceCallback for incoming connections
+func (app *Application) verifyDevice(key crypto.PublicKey) error {
+	d, err := app.devices.Get(key)
+	if errors.Is(err, models.ErrNoDevice) {
+		if app.rejectUnknownDevices {
+			return crypto.ErrUnknownDevice
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.Revoked {
+		return crypto.ErrDeviceRevoked
+	}
+
+	return nil
+}
+
+// Records a successful login or registration from a device
+func (app *Application) registerDevice(key crypto.PublicKey, id string) {
+	if key.IsZero() {
+		return
+	}
+
+	userID, err := uuid.Parse(id)
+	if err == nil {
+		err = app.devices.Register(key, userID)
+	}
+
+	if err != nil {
+		log.Println("Unable to register device", crypto.Fingerprint(key), err.Error())
+	}
+}
+
+func devicesCommand(dm *models.DeviceModel, args []string) error {
+	if len(args) == 0 || args[0] == "list" {
+		return listDevices(dm)
+	}
+
+	if args[0] == "revoke" {
+		if len(args) != 2 {
+			return errors.New("usage: devices revoke <id>")
+		}
+
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+
+		err = dm.Revoke(id)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Revoked device", id)
+		return nil
+	}
+
+	return fmt.Errorf("unknown devices command %q", args[0])
+}
+
+func listDevices(dm *models.DeviceModel) error {
+	devices, err := dm.GetAll()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKEY\tUSER\tLAST SEEN\tSTATUS")
+	for _, d := range devices {
+		status := "active"
+		if d.Revoked {
+			status = "revoked"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", d.ID, d.Fingerprint(), d.UserID, d.LastSeen.Local().Format(time.DateTime), status)
+	}
+
+	return w.Flush()
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"errors"
 	"log"
-	"net"
+	"slices"
 
 	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/models"
@@ -12,136 +13,512 @@ import (
 	"github.com/google/uuid"
 )
 
-func (app *Application) sync(p protocol.Payload, c net.Conn) {
-	var sd protocol.SyncData
-	err := sd.Decode(p.Bytes())
+var ErrSyncInterrupted = &protocol.Error{Code: protocol.CodeMalformed, Message: "Sync interrupted by another request"}
+
+var ErrNotOwner = &protocol.Error{Code: protocol.CodeInvalid, Message: "Entries belong to another user"}
+
+// Merges the entries a client sends, in as many SYNC payloads as it needs,
+// then sends back the user's entries that other syncs changed since the
+// client last synced the same way, or all of them unless delta syncs were
+// agreed on, along with the server's copies of any entries it sent that were
+// kept over its own
+func (app *Application) sync(p protocol.Payload, req *protocol.Request, userID string, delta bool) error {
+	id, err := uuid.Parse(userID)
 	if err != nil {
-		log.Println(err.Error())
-		protocol.NewFail(err.Error()).WriteTo(c)
-		return
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	// Checked before anything is merged, which moves the revision on
+	current, err := app.passwords.ServerRevision(id)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
 	}
 
-	for _, p := range sd.Passwords {
-		exists, err := app.passwords.Exists(p.UUID.String())
+	var sd protocol.SyncData
+	var since uint64
+	var merged []uint64
+	kept := models.PasswordList{}
+	for first := true; ; first = false {
+		err = sd.Decode(p.Bytes())
 		if err != nil {
-			protocol.NewFail(err.Error()).WriteTo(c)
-			return
+			req.Send(protocol.NewFail(err))
+			return err
 		}
 
-		if !exists {
-			err = app.passwords.DumbInsert(p)
-			if err != nil {
-				protocol.NewFail(err.Error()).WriteTo(c)
-				return
-			}
-			continue
+		if first && delta {
+			since = sd.Since
 		}
 
-		if p.Deleted {
-			err = app.passwords.Delete(p.UUID.String())
+		// The rest of the sync still has to be read when the revision is
+		// unknown, but isn't merged, as the client sends everything again
+		if since <= current {
+			revision, k, err := app.passwords.ServerMerge(id, protocol.Passwords(sd.Entries))
+			if errors.Is(err, models.ErrNotOwner) {
+				err = ErrNotOwner
+			}
 			if err != nil {
-				protocol.NewFail(err.Error()).WriteTo(c)
-				return
+				req.Send(protocol.NewFail(err))
+				return err
 			}
-			continue
+
+			if revision != 0 {
+				merged = append(merged, revision)
+			}
+			kept = append(kept, k...)
 		}
 
-		current, err := app.passwords.GetByUUID(p.UUID.String())
+		if !sd.More {
+			break
+		}
+
+		p, err = req.Receive()
 		if err != nil {
-			protocol.NewFail(err.Error()).WriteTo(c)
-			return
+			return err
 		}
 
-		if p.LastChanged.After(current.LastChanged) {
-			err = app.passwords.DumbUpdate(p)
-			if err != nil {
-				protocol.NewFail(err.Error()).WriteTo(c)
-				return
-			}
+		if p.Type() != protocol.SYNC {
+			req.Send(protocol.NewFail(ErrSyncInterrupted))
+			return ErrSyncInterrupted
+		}
+	}
+
+	if since > current {
+		return req.Send(protocol.NewFail(protocol.ErrUnknownRevision))
+	}
+
+	// The client already has what its own batches changed
+	pws, revision, err := app.passwords.ServerChanges(id, since, merged)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	for _, k := range kept {
+		if !slices.ContainsFunc(pws, k.IsSame) {
+			pws = append(pws, k)
 		}
 	}
 
-	id, err := uuid.Parse(sd.UUID)
+	response, oversized, err := protocol.SyncPayloads(protocol.SyncData{Entries: protocol.NewEntries(pws), Revision: revision})
 	if err != nil {
-		protocol.NewFail(err.Error()).WriteTo(c)
-		return
+		req.Send(protocol.NewFail(err))
+		return err
 	}
 
-	pws, err := app.passwords.GetAllEncryptedForUser(models.User{ID: id})
+	// A client can send an entry a little bigger than fits in a batch of the
+	// reply. Other devices go without it, but the rest of the sync doesn't.
+	for _, entry := range oversized {
+		log.Println("Entry", entry.UUID, "is too large to sync")
+	}
+
+	for _, r := range response {
+		err = req.Send(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	// Sent in response to an AUTH when the credentials couldn't be
+	// checked, as opposed to not matching anyone
+	ErrAuthUnavailable = &protocol.Error{Code: protocol.CodeInternal, Retryable: true, Message: "Couldn't check credentials, try again later"}
+	// Sent in response to an AUTH or RCVR on a connection that's already
+	// authenticated
+	ErrAlreadyAuthenticated = &protocol.Error{Code: protocol.CodeMalformed, Message: "Connection is already authenticated"}
+)
+
+// Authenticates a user by their token, and their second factor if they have
+// one
+func (app *Application) authenticate(p protocol.Payload, device crypto.PublicKey) (bool, string, error) {
+	var ad protocol.AuthData
+	err := ad.Decode(p.Bytes())
 	if err != nil {
-		protocol.NewFail(err.Error()).WriteTo(c)
+		return false, "", err
+	}
+
+	u, err := app.userByToken(ad.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		var retired bool
+		retired, err = app.tokenRetired(ad.Token)
+		switch {
+		case err != nil:
+		case retired:
+			err = protocol.ErrCredentialsChanged
+		default:
+			err = protocol.ErrAuthFailed
+		}
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	err = app.secondFactor(u.ID.String(), ad.Code, device)
+	if err != nil {
+		return false, "", err
+	}
+
+	app.recordCredentials(u, ad)
+	return true, u.ID.String(), nil
+}
+
+// How many auth tokens are hashed at once, across every connection. Each
+// hash takes the parameters' memory, 64MiB by default, and clients can ask
+// for one per parameter set in use without authenticating, so this bounds
+// how much of it they can make the server use.
+const maxTokenHashes = 4
+
+var tokenHashSlots = make(chan struct{}, maxTokenHashes)
+
+// Like crypto.ServerAuthToken, but waits for one of the tokenHashSlots
+func hashToken(token []byte, params crypto.KDFParams) ([]byte, error) {
+	tokenHashSlots <- struct{}{}
+	defer func() { <-tokenHashSlots }()
+	return crypto.ServerAuthToken(token, params)
+}
+
+// Reports whether token belonged to a user before their credentials were
+// changed
+func (app *Application) tokenRetired(token []byte) (bool, error) {
+	params, err := app.users.RetiredTokenKDFParams()
+	if err != nil {
+		return false, err
+	}
+
+	for _, kdf := range params {
+		hashed, err := hashToken(token, kdf)
+		if err != nil {
+			return false, err
+		}
+
+		retired, err := app.users.ServerTokenRetired(hashed, kdf)
+		if err != nil {
+			return false, err
+		}
+
+		if retired {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Finds the user with the given client auth token. Tokens are hashed with
+// whatever parameters were current when they were set, so each set in use
+// is tried.
+func (app *Application) userByToken(token []byte) (*models.User, error) {
+	params, err := app.users.TokenKDFParams()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kdf := range params {
+		hashed, err := hashToken(token, kdf)
+		if err != nil {
+			return nil, err
+		}
+
+		u, err := app.users.ServerGetByAuthToken(hashed)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if u.TokenKDF == kdf {
+			return u, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// Records the parameters an authenticated client says the user's keys are
+// derived with, and hashes their token again if it was hashed with old
+// parameters. Failing to is only logged, the client is authenticated either
+// way.
+func (app *Application) recordCredentials(u *models.User, ad protocol.AuthData) {
+	changed := false
+	if ad.Lookup != nil && ad.KDF.Validate() == nil && (!bytes.Equal(ad.Lookup, u.Lookup) || ad.KDF != u.KDF) {
+		u.Lookup, u.KDF = ad.Lookup, ad.KDF
+		changed = true
+	}
+
+	if u.TokenKDF != crypto.DefaultServerKDFParams {
+		token, err := hashToken(ad.Token, crypto.DefaultServerKDFParams)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		u.AuthToken, u.TokenKDF = crypto.NewSecret(token), crypto.DefaultServerKDFParams
+		changed = true
+	}
+
+	if !changed {
 		return
 	}
 
-	rd := protocol.SyncData{
-		Passwords: pws,
+	err := app.users.ServerUpdateCredentials(*u)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Tells a client which parameters a user's keys might be derived with, so it
+// can work out their auth token. Anyone can ask, so the answer is the same
+// whatever lookup ID is sent: every set of parameters in use, or the default
+// ones if there are none yet. Answering with a user's own parameters would
+// tell anyone who asked whether the username has an account.
+func (app *Application) kdfParams(p protocol.Payload, req *protocol.Request) error {
+	var kd protocol.KDFData
+	err := kd.Decode(p.Bytes())
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
 	}
+
+	params, err := app.users.KDFParams()
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	if len(params) == 0 {
+		params = []crypto.KDFParams{crypto.DefaultKDFParams}
+	}
+
+	rd := protocol.KDFData{Params: params}
 	rdBytes, err := rd.Encode()
 	if err != nil {
-		protocol.NewFail(err.Error()).WriteTo(c)
-		return
+		req.Send(protocol.NewFail(err))
+		return err
 	}
 
-	response, err := protocol.NewPayload(protocol.SYNC, rdBytes)
+	response, err := protocol.NewPayload(protocol.KDFP, rdBytes)
 	if err != nil {
-		protocol.NewFail(err.Error()).WriteTo(c)
-		return
+		req.Send(protocol.NewFail(err))
+		return err
 	}
 
-	response.WriteTo(c)
+	return req.Send(response)
 }
 
-func (app *Application) authenticate(p protocol.Payload) (bool, string, error) {
+var (
+	ErrInvalidKDF   = &protocol.Error{Code: protocol.CodeInvalid, Message: "Invalid key derivation parameters"}
+	ErrNoWrappedKey = &protocol.Error{Code: protocol.CodeInvalid, Message: "Data key must be wrapped with the new credentials"}
+)
+
+// Replaces an authenticated user's token after their client has derived their
+// keys again, with new parameters for KDFU or from a new username or password
+// for CRED. Devices still using the old token have to log in again.
+func (app *Application) updateCredentials(p protocol.Payload, req *protocol.Request, id string) error {
 	var ad protocol.AuthData
 	err := ad.Decode(p.Bytes())
 	if err != nil {
-		return false, "", err
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	if ad.Lookup == nil || ad.KDF.Validate() != nil {
+		req.Send(protocol.NewFail(ErrInvalidKDF))
+		return ErrInvalidKDF
+	}
+
+	_, err = app.userByToken(ad.Token)
+	if err == nil {
+		req.Send(protocol.NewFail(protocol.ErrUserExists))
+		return protocol.ErrUserExists
 	}
 
-	ad.Token = crypto.ServerAuthToken(ad.Token)
+	u, err := app.users.GetByUUID(id)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
 
-	u, err := app.users.ServerGetByAuthToken(ad.Token)
+	// The stored data key can't be unwrapped with the new credentials
+	if u.WrappedKey != "" && ad.WrappedKey == "" {
+		req.Send(protocol.NewFail(ErrNoWrappedKey))
+		return ErrNoWrappedKey
+	}
+
+	err = app.users.ServerRetireToken(*u)
 	if err != nil {
-		log.Println(err.Error())
-		return false, "", err
+		req.Send(protocol.NewFail(err))
+		return err
 	}
 
-	return bytes.Equal(ad.Token, u.AuthToken), u.ID.String(), nil
+	token, err := hashToken(ad.Token, crypto.DefaultServerKDFParams)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+	u.AuthToken = crypto.NewSecret(token)
+	u.TokenKDF = crypto.DefaultServerKDFParams
+	u.Lookup, u.KDF = ad.Lookup, ad.KDF
+	u.WrappedKey = ad.WrappedKey
+
+	err = app.users.ServerUpdateCredentials(*u)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	return req.Send(protocol.NewSucc())
+}
+
+// Agrees on the authenticated user's data key with their client. The key is
+// wrapped, so the server never sees it.
+func (app *Application) dataKey(p protocol.Payload, req *protocol.Request, id string) error {
+	var dkd protocol.DataKeyData
+	err := dkd.Decode(p.Bytes())
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	stored, err := app.users.ServerOfferDataKey(id, dkd.WrappedKey)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	rd := protocol.DataKeyData{WrappedKey: stored}
+	rdBytes, err := rd.Encode()
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	response, err := protocol.NewPayload(protocol.VKEY, rdBytes)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	return req.Send(response)
 }
 
 var (
-	ErrUserExists     = errors.New("User already exists")
-	ErrUserCreateFail = errors.New("Failed to create new user")
+	ErrInvalidRecovery = &protocol.Error{Code: protocol.CodeInvalid, Message: "Recovery key and verifier are required"}
+	ErrRecoveryFail    = &protocol.Error{Code: protocol.CodeAuthFailed, Message: "Account ID or recovery key is incorrect"}
 )
 
-func (app *Application) newUser(p protocol.Payload, c net.Conn) error {
+// Stores the authenticated user's data key wrapped with their recovery key,
+// and the verifier for their recovery token
+func (app *Application) recoveryKey(p protocol.Payload, req *protocol.Request, id string) error {
+	var rd protocol.RecoveryData
+	err := rd.Decode(p.Bytes())
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	if rd.WrappedKey == "" || len(rd.Verifier) == 0 {
+		req.Send(protocol.NewFail(ErrInvalidRecovery))
+		return ErrInvalidRecovery
+	}
+
+	err = app.users.ServerSetRecoveryKey(id, rd.WrappedKey, rd.Verifier)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	return req.Send(protocol.NewSucc())
+}
+
+// Authenticates a user who's lost their password by their recovery token,
+// and their second factor if they have one, and gives them their data key
+// wrapped with their recovery key. They're then expected to set new
+// credentials with CRED. Returns the user's UUID.
+func (app *Application) recoverAccount(p protocol.Payload, req *protocol.Request, device crypto.PublicKey) (string, error) {
+	var rd protocol.RecoveryData
+	err := rd.Decode(p.Bytes())
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return "", err
+	}
+
+	wrappedKey, verifier, err := app.users.ServerGetRecoveryKey(rd.UUID)
+	if err == nil && !crypto.VerifyRecoveryToken(rd.Token, verifier) {
+		err = ErrRecoveryFail
+	}
+	if err != nil {
+		// Doesn't say whether the account exists
+		req.Send(protocol.NewFail(ErrRecoveryFail))
+		return "", err
+	}
+
+	err = app.secondFactor(rd.UUID, rd.Code, device)
+	if err != nil {
+		var perr *protocol.Error
+		if !errors.As(err, &perr) {
+			perr = ErrAuthUnavailable
+		}
+		req.Send(protocol.NewFail(perr))
+		return "", err
+	}
+
+	response := protocol.RecoveryData{UUID: rd.UUID, WrappedKey: wrappedKey}
+	b, err := response.Encode()
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return "", err
+	}
+
+	r, err := protocol.NewPayload(protocol.RCVR, b)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return "", err
+	}
+
+	err = req.Send(r)
+	return rd.UUID, err
+}
+
+var ErrUserCreateFail = &protocol.Error{Code: protocol.CodeInternal, Retryable: true, Message: "Failed to create new user"}
+
+func (app *Application) newUser(p protocol.Payload, req *protocol.Request, device crypto.PublicKey) error {
 	var nud protocol.NewUserData
 	err := nud.Decode(p.Bytes())
 	if err != nil {
-		protocol.NewFail(ErrUserCreateFail.Error()).WriteTo(c)
+		req.Send(protocol.NewFail(ErrUserCreateFail))
 		return err
 	}
 
-	nud.Token = crypto.ServerAuthToken(nud.Token)
-
 	// Check if user with same auth token or UUID exists
 	// if so, fail
-	_, err = app.users.ServerGetByAuthToken(nud.Token)
+	_, err = app.userByToken(nud.Token)
 	if err == nil {
-		protocol.NewFail(ErrUserExists.Error()).WriteTo(c)
-		return ErrUserExists
+		req.Send(protocol.NewFail(protocol.ErrUserExists))
+		return protocol.ErrUserExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		req.Send(protocol.NewFail(ErrUserCreateFail))
+		return err
 	}
 
 	_, err = app.users.GetByUUID(nud.UUID)
 	if err == nil {
-		protocol.NewFail(ErrUserExists.Error()).WriteTo(c)
-		return ErrUserExists
+		req.Send(protocol.NewFail(protocol.ErrUserExists))
+		return protocol.ErrUserExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		req.Send(protocol.NewFail(ErrUserCreateFail))
+		return err
 	}
 
 	if err = uuid.Validate(nud.UUID); err != nil {
 		temp, err := uuid.NewRandom()
 		if err != nil {
-			protocol.NewFail(ErrUserCreateFail.Error())
+			req.Send(protocol.NewFail(ErrUserCreateFail))
 			return err
 		}
 		nud.UUID = temp.String()
@@ -150,12 +527,25 @@ func (app *Application) newUser(p protocol.Payload, c net.Conn) error {
 	// Will never panic because of the above validation
 	UUID := uuid.MustParse(nud.UUID)
 
-	_, err = app.users.ServerInsert(models.User{ID: UUID, AuthToken: nud.Token})
+	u := models.User{ID: UUID, TokenKDF: crypto.DefaultServerKDFParams}
+	token, err := hashToken(nud.Token, u.TokenKDF)
 	if err != nil {
-		protocol.NewFail(ErrUserCreateFail.Error()).WriteTo(c)
+		req.Send(protocol.NewFail(ErrUserCreateFail))
 		return err
 	}
+	u.AuthToken = crypto.NewSecret(token)
+
+	if nud.Lookup != nil && nud.KDF.Validate() == nil {
+		u.Lookup, u.KDF = nud.Lookup, nud.KDF
+	}
+
+	_, err = app.users.ServerInsert(u)
+	if err != nil {
+		req.Send(protocol.NewFail(ErrUserCreateFail))
+		return err
+	}
+
+	app.registerDevice(device, nud.UUID)
 
-	_, err = protocol.NewSuccWithData([]byte(nud.UUID)).WriteTo(c)
-	return err
+	return req.Send(protocol.NewSuccWithData([]byte(nud.UUID)))
 }
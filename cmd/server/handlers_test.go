@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/models"
+	"github.com/Queueue0/qpass/internal/protocol"
+	"github.com/google/uuid"
+)
+
+func authPayload(t *testing.T, token string) protocol.Payload {
+	t.Helper()
+	b, err := (&protocol.AuthData{Token: []byte(token)}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := protocol.NewPayload(protocol.AUTH, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return *p
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	app, _ := testApplication(t)
+
+	_, _, err := app.authenticate(authPayload(t, "nobody's token"), crypto.PublicKey{})
+	if !errors.Is(err, protocol.ErrAuthFailed) {
+		t.Fatalf("unknown token: got %v, want ErrAuthFailed", err)
+	}
+
+	malformed, _ := protocol.NewPayload(protocol.AUTH, []byte{protocol.WireVersion, 0xff})
+	_, _, err = app.authenticate(*malformed, crypto.PublicKey{})
+	if !errors.Is(err, protocol.ErrMalformed) {
+		t.Fatalf("malformed body: got %v, want ErrMalformed", err)
+	}
+
+	// The client registers credentials the server says are unknown, so a
+	// server that can't check them mustn't say so
+	app.users.DB.Close()
+	_, _, err = app.authenticate(authPayload(t, "nobody's token"), crypto.PublicKey{})
+	if err == nil || errors.Is(err, protocol.ErrAuthFailed) {
+		t.Fatalf("database closed: got %v, want an error other than ErrAuthFailed", err)
+	}
+}
+
+func TestKDFParamsSameForAnyLookup(t *testing.T) {
+	app, _ := testApplication(t)
+	stronger := crypto.KDFParams{Algorithm: crypto.KDFArgon2id, Time: 4, Memory: 256 * 1024, Threads: 4}
+	lookup := crypto.UserLookupID("someone")
+	id := uuid.New()
+	_, err := app.users.ServerInsert(models.User{ID: id, AuthToken: crypto.NewSecret([]byte(id.String())), Lookup: lookup, KDF: stronger})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := net.Pipe()
+	go app.respond(pipeConn{s})
+	conn := protocol.NewClientConn(pipeConn{c})
+	defer conn.Close()
+
+	ask := func(lookup []byte) []crypto.KDFParams {
+		t.Helper()
+		b, err := (&protocol.KDFData{Lookup: lookup}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := protocol.NewPayload(protocol.KDFP, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := conn.Do(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var kd protocol.KDFData
+		err = kd.Decode(r.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return kd.Params
+	}
+
+	known, unknown := ask(lookup), ask(crypto.UserLookupID("nobody"))
+	if !slices.Equal(known, unknown) {
+		t.Fatalf("got %v for an account and %v for none", known, unknown)
+	}
+	if !slices.Contains(known, stronger) {
+		t.Fatalf("got %v, want %v among them", known, stronger)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	app, _ := testApplication(t)
+	defaultParams := crypto.DefaultServerKDFParams
+	crypto.DefaultServerKDFParams = crypto.KDFParams{Algorithm: crypto.KDFArgon2id, Time: 1, Memory: 8, Threads: 1}
+	t.Cleanup(func() { crypto.DefaultServerKDFParams = defaultParams })
+
+	// Every token hash has to wait, so each NUSR stays in flight
+	for range maxTokenHashes {
+		tokenHashSlots <- struct{}{}
+	}
+
+	c, s := net.Pipe()
+	go app.respond(pipeConn{s})
+	conn := protocol.NewClientConn(pipeConn{c})
+	defer conn.Close()
+
+	var reqs []*protocol.Request
+	for range maxRequestsInFlight {
+		id := uuid.New()
+		b, err := (&protocol.NewUserData{UUID: id.String(), Token: id[:]}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := protocol.NewPayload(protocol.NUSR, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := conn.Open()
+		defer req.Close()
+		err = req.Send(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	r, err := conn.Do(protocol.NewPing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Err(); err == nil || err.Error() != ErrTooManyRequests.Message {
+		t.Fatalf("request past the limit: got %s %v, want ErrTooManyRequests", r.TypeString(), err)
+	}
+
+	for range maxTokenHashes {
+		<-tokenHashSlots
+	}
+
+	for _, req := range reqs {
+		r, err := req.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Type() != protocol.SUCC {
+			t.Fatalf("NUSR: got %s %v, want SUCC", r.TypeString(), r.Err())
+		}
+	}
+
+	// Their slots are given back just after they reply
+	for range 100 {
+		r, err = conn.Do(protocol.NewPing())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Type() == protocol.PONG {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("once the requests in flight are done: got %s %v, want PONG", r.TypeString(), r.Err())
+}
+
+// A pipeConn that has agreed on delta syncs
+type deltaConn struct {
+	pipeConn
+}
+
+func (deltaConn) Capabilities() crypto.Capabilities {
+	return crypto.CapDeltaSync
+}
+
+// Returns a connection authenticated as the user with token, which it adds
+// if there isn't one yet
+func syncConn(t *testing.T, app *Application, id uuid.UUID, token string) *protocol.Conn {
+	t.Helper()
+	if exists, _ := app.users.Exists(id.String()); !exists {
+		hashed, err := hashToken([]byte(token), crypto.DefaultServerKDFParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.users.ServerInsert(models.User{ID: id, AuthToken: crypto.NewSecret(hashed), TokenKDF: crypto.DefaultServerKDFParams})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, s := net.Pipe()
+	go app.respond(deltaConn{pipeConn{s}})
+	conn := protocol.NewClientConn(deltaConn{pipeConn{c}})
+	t.Cleanup(func() { conn.Close() })
+
+	auth := authPayload(t, token)
+	r, err := conn.Do(&auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type() != protocol.SUCC {
+		t.Fatalf("AUTH: got %s %v, want SUCC", r.TypeString(), r.Err())
+	}
+
+	return conn
+}
+
+// Sends entries as a sync from since, and returns what the server sends back
+func syncEntries(t *testing.T, conn *protocol.Conn, since uint64, entries ...protocol.Entry) (protocol.SyncData, error) {
+	t.Helper()
+	payloads, _, err := protocol.SyncPayloads(protocol.SyncData{Entries: entries, Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := conn.Open()
+	defer req.Close()
+	for _, p := range payloads {
+		err = req.Send(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reply protocol.SyncData
+	for {
+		r, err := req.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Type() == protocol.FAIL {
+			return reply, r.Err()
+		}
+
+		var sd protocol.SyncData
+		err = sd.Decode(r.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply.Entries = append(reply.Entries, sd.Entries...)
+		reply.Revision = sd.Revision
+		if !sd.More {
+			return reply, nil
+		}
+	}
+}
+
+// Reports whether entries holds exactly the entries with the given UUIDs
+func sameEntries(entries []protocol.Entry, want ...uuid.UUID) bool {
+	got := make([]uuid.UUID, len(entries))
+	for i, e := range entries {
+		got[i] = e.UUID
+	}
+
+	return len(got) == len(want) && !slices.ContainsFunc(want, func(id uuid.UUID) bool {
+		return !slices.Contains(got, id)
+	})
+}
+
+func TestDeltaSync(t *testing.T) {
+	app, _ := testApplication(t)
+	defaultParams := crypto.DefaultServerKDFParams
+	crypto.DefaultServerKDFParams = crypto.KDFParams{Algorithm: crypto.KDFArgon2id, Time: 1, Memory: 8, Threads: 1}
+	t.Cleanup(func() { crypto.DefaultServerKDFParams = defaultParams })
+
+	id := uuid.New()
+	entry := func(password string) protocol.Entry {
+		return protocol.Entry{UUID: uuid.New(), UserID: id, EPassword: password, LastChanged: time.Now()}
+	}
+	first, second := syncConn(t, app, id, "token"), syncConn(t, app, id, "token")
+
+	// A device isn't sent back what it just sent
+	a := entry("a")
+	reply, err := syncEntries(t, first, 0, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Entries) != 0 || reply.Revision != 1 {
+		t.Fatalf("first sync: got %d entries at revision %d, want none at 1", len(reply.Entries), reply.Revision)
+	}
+
+	b := entry("b")
+	reply, err = syncEntries(t, second, 0, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameEntries(reply.Entries, a.UUID) || reply.Revision != 2 {
+		t.Fatalf("second device: got %v at revision %d, want only %s at 2", reply.Entries, reply.Revision, a.UUID)
+	}
+
+	// Only what changed since the revision the device is up to
+	reply, err = syncEntries(t, first, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameEntries(reply.Entries, b.UUID) || reply.Revision != 2 {
+		t.Fatalf("from revision 1: got %v at revision %d, want only %s at 2", reply.Entries, reply.Revision, b.UUID)
+	}
+
+	// A revision the server hasn't reached yet, as after it's restored from
+	// a backup, isn't merged from
+	c := entry("c")
+	_, err = syncEntries(t, first, 5, c)
+	if !errors.Is(err, protocol.ErrUnknownRevision) {
+		t.Fatalf("from revision 5: got %v, want ErrUnknownRevision", err)
+	}
+
+	// and the client starts over with everything it has
+	reply, err = syncEntries(t, syncConn(t, app, id, "token"), 0, a, b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameEntries(reply.Entries, a.UUID, b.UUID) || reply.Revision != 3 {
+		t.Fatalf("full resync: got %v at revision %d, want %s and %s at 3", reply.Entries, reply.Revision, a.UUID, b.UUID)
+	}
+}
+
+func TestUpdateCredentialsRetiresToken(t *testing.T) {
+	app, _ := testApplication(t)
+	defaultParams := crypto.DefaultServerKDFParams
+	crypto.DefaultServerKDFParams = crypto.KDFParams{Algorithm: crypto.KDFArgon2id, Time: 1, Memory: 8, Threads: 1}
+	t.Cleanup(func() { crypto.DefaultServerKDFParams = defaultParams })
+
+	for _, payloadType := range []byte{protocol.CRED, protocol.KDFU} {
+		id := uuid.New()
+		oldToken, newToken := id.String()+" old", id.String()+" new"
+		conn := syncConn(t, app, id, oldToken)
+
+		b, err := (&protocol.AuthData{Token: []byte(newToken), Lookup: crypto.UserLookupID("new user"), KDF: crypto.DefaultServerKDFParams}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := protocol.NewPayload(payloadType, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := conn.Do(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Type() != protocol.SUCC {
+			t.Fatalf("%s: got %s %v, want SUCC", p.TypeString(), r.TypeString(), r.Err())
+		}
+
+		_, _, err = app.authenticate(authPayload(t, oldToken), crypto.PublicKey{})
+		if !errors.Is(err, protocol.ErrCredentialsChanged) {
+			t.Fatalf("%s: old token got %v, want ErrCredentialsChanged", p.TypeString(), err)
+		}
+
+		ok, got, err := app.authenticate(authPayload(t, newToken), crypto.PublicKey{})
+		if err != nil || !ok || got != id.String() {
+			t.Fatalf("%s: new token got %v, %s, %v, want the user", p.TypeString(), ok, got, err)
+		}
+
+		// Another user can't take a token that's in use
+		other := syncConn(t, app, uuid.New(), id.String()+" other")
+		r, err = other.Do(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !errors.Is(r.Err(), protocol.ErrUserExists) {
+			t.Fatalf("%s: token in use got %v, want ErrUserExists", p.TypeString(), r.Err())
+		}
+	}
+}
@@ -1,97 +1,168 @@
 package main
 
 import (
-	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"log"
 	"os"
-)
 
-const (
-	filename = "key"
-	keySize  = 4096
+	"github.com/Queueue0/qpass/internal/crypto"
 )
 
-func haveKeys(dir string) bool {
-	_, err := os.Stat(dir+"/"+filename+".rsa")
-	// If there's any error, assume the files don't exist
+const filename = "key"
+
+var ErrInvalidKeyFile = errors.New("invalid key file")
+
+// Keys are stored as key.<algorithm>, with the public half alongside in
+// key.<algorithm>.pub. RSA keys stay PKCS1 so keys generated before other
+// algorithms were supported still load.
+func keyPath(dir string, alg byte) string {
+	return dir + "/" + filename + "." + crypto.KeyAlgorithmName(alg)
+}
+
+func haveKey(dir string, alg byte) bool {
+	_, err := os.Stat(keyPath(dir, alg))
+	// If there's any error, assume the file doesn't exist
 	// If this causes problems, the plan is to refactor to look more like:
 	// https://stackoverflow.com/a/12527546
-	if err != nil {
-		return false
+	return err == nil
+}
+
+func writeKey(path string, key *crypto.PrivateKey) error {
+	var privBlock, pubBlock *pem.Block
+	switch k := key.Signer().(type) {
+	case *rsa.PrivateKey:
+		privBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		pubBlock = &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&k.PublicKey)}
+	default:
+		privBytes, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return err
+		}
+
+		pubBytes, err := x509.MarshalPKIXPublicKey(k.Public())
+		if err != nil {
+			return err
+		}
+
+		privBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}
+		pubBlock = &pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}
 	}
 
-	_, err = os.Stat(dir+"/"+filename+".rsa.pub")
+	err := os.WriteFile(path, pem.EncodeToMemory(privBlock), 0600)
 	if err != nil {
-		return false
+		return err
 	}
 
-	return true
+	return os.WriteFile(path+".pub", pem.EncodeToMemory(pubBlock), 0644)
 }
 
-func genKeyPair(dir string) error {
-	key, err := rsa.GenerateKey(rand.Reader, keySize)
+func genKey(dir string, alg byte) error {
+	key, err := crypto.GenerateKey(alg)
 	if err != nil {
 		return err
 	}
 
-	pub := key.Public()
-
-	keyPem := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
-
-	pubPem := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: x509.MarshalPKCS1PublicKey(pub.(*rsa.PublicKey)),
-		},
-	)
+	return writeKey(keyPath(dir, alg), key)
+}
 
-	err = os.WriteFile(dir+"/"+filename+".rsa", keyPem, 0700)
+func readKey(path string) (*crypto.PrivateKey, error) {
+	privBytes, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = os.WriteFile(dir+"/"+filename+".rsa.pub", pubPem, 0755)
-	if err != nil {
-		return err
+	block, _ := pem.Decode(privBytes)
+	if block == nil {
+		return nil, ErrInvalidKeyFile
 	}
 
-	return nil
-}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.NewPrivateKey(key)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := key.(type) {
+		case ed25519.PrivateKey:
+			return crypto.NewPrivateKey(k)
+		case *ecdsa.PrivateKey:
+			return crypto.NewPrivateKey(k)
+		}
+	}
 
-type keyPair struct {
-	key *rsa.PrivateKey
-	pubKey *rsa.PublicKey
+	return nil, ErrInvalidKeyFile
 }
 
-func getKeyPair(dir string) (*keyPair, error) {
-	privBytes, err := os.ReadFile(dir+"/"+filename+".rsa")
+func getKey(dir string, alg byte) (*crypto.PrivateKey, error) {
+	key, err := readKey(keyPath(dir, alg))
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(privBytes)
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+	if key.Public().Algorithm != alg {
+		return nil, ErrInvalidKeyFile
 	}
 
-	pubBytes, err := os.ReadFile(dir+"/"+filename+".rsa.pub")
-	if err != nil {
-		return nil, err
+	return key, nil
+}
+
+// Loads the host keys named in keyTypes, generating any that don't exist yet.
+// With no key types, loads every key that exists, or generates an ed25519 key
+// if there are none.
+func loadHostKeys(dir string, keyTypes []string) ([]*crypto.PrivateKey, error) {
+	algs := []byte{}
+	for _, name := range keyTypes {
+		alg, err := crypto.ParseKeyAlgorithm(name)
+		if err != nil {
+			return nil, err
+		}
+		algs = append(algs, alg)
 	}
 
-	pBlock, _ := pem.Decode(pubBytes)
-	pubKey, err := x509.ParsePKCS1PublicKey(pBlock.Bytes)
-	if err != nil {
-		return nil, err
+	if len(algs) == 0 {
+		for _, alg := range crypto.DefaultKeyAlgorithms {
+			if haveKey(dir, alg) {
+				algs = append(algs, alg)
+			}
+		}
+	}
+
+	if len(algs) == 0 {
+		algs = append(algs, crypto.KeyEd25519)
+	}
+
+	keys := []*crypto.PrivateKey{}
+	for _, alg := range algs {
+		if !haveKey(dir, alg) {
+			log.Println("Generating", crypto.KeyAlgorithmName(alg), "host key")
+			err := genKey(dir, alg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		key, err := getKey(dir, alg)
+		if err != nil {
+			return nil, err
+		}
+
+		// Logged so users have something to compare against when their
+		// client asks whether to trust the server
+		log.Println("Host key", crypto.Fingerprint(key.Public()))
+		keys = append(keys, key)
 	}
-	
-	return &keyPair{key, pubKey}, nil
+
+	return keys, nil
 }
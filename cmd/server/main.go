@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/dbman"
@@ -14,7 +19,14 @@ import (
 type Application struct {
 	users     *models.UserModel
 	passwords *models.PasswordModel
+	devices   *models.DeviceModel
 	homeDir   string
+	connConf  *crypto.ServerConfig
+
+	rejectUnknownDevices bool
+	totpRemember         time.Duration
+	totpLimiter          *totpLimiter
+	clock                func() time.Time
 }
 
 func main() {
@@ -36,11 +48,68 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if !haveKeys(qpassHome) {
-		err = genKeyPair(qpassHome)
+	conf, err := ConfigInit(qpassHome)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dm := models.DeviceModel{
+		DB: db,
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-key":
+			err = rotateKey(qpassHome, conf, os.Args[2:])
+		case "revoke-tickets":
+			err = revokeTickets(qpassHome)
+		case "devices":
+			err = devicesCommand(&dm, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	hostKeys, err := loadHostKeys(qpassHome, conf.HostKeyTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	endorsements, err := loadEndorsements(qpassHome, hostKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	connConf := &crypto.ServerConfig{
+		HostKeys:         hostKeys,
+		Endorsements:     endorsements,
+		HandshakeTimeout: conf.HandshakeTimeout,
+		IdleTimeout:      conf.IdleTimeout,
+		Transports:       conf.Transports,
+		KeyUpdateBytes:   conf.KeyUpdateBytes,
+		KeyUpdateRecords: conf.KeyUpdateRecords,
+		Capabilities:     crypto.CapDeltaSync,
+	}
+
+	if slices.Contains(conf.Transports, crypto.TransportTLS) {
+		connConf.Certificate, err = loadCertificate(qpassHome, hostKeys, endorsements)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if conf.TicketLifetime > 0 {
+		connConf.TicketKey, err = loadTicketKey(qpassHome)
 		if err != nil {
 			log.Fatal(err)
 		}
+		connConf.TicketLifetime = conf.TicketLifetime
+		connConf.TicketsRevokedBefore = ticketsRevokedBefore(qpassHome)
 	}
 
 	um := models.UserModel{
@@ -54,10 +123,18 @@ func main() {
 	a := Application{
 		users:     &um,
 		passwords: &pm,
+		devices:   &dm,
 		homeDir:   qpassHome,
+		connConf:  connConf,
+
+		rejectUnknownDevices: conf.RejectUnknownDevices,
+		totpRemember:         conf.TOTPRememberDevice,
+		totpLimiter:          newTOTPLimiter(),
+		clock:                time.Now,
 	}
+	connConf.VerifyDevice = a.verifyDevice
 
-	srv, err := net.Listen("tcp", "127.0.0.1:10448")
+	srv, err := net.Listen("tcp", conf.ListenAddress)
 	if err != nil {
 		panic(err)
 	}
@@ -77,13 +154,7 @@ func main() {
 
 func (app *Application) handle(c net.Conn) {
 	log.Println("Received connection", c.RemoteAddr().String())
-	kp, err := getKeyPair(app.homeDir)
-	if err != nil {
-		log.Println(err.Error())
-		return
-	}
-
-	sc, err := crypto.NewServerConn(c, kp.key, kp.pubKey)
+	sc, err := crypto.Accept(c, app.connConf)
 	if err != nil {
 		log.Println(c.RemoteAddr(), err.Error())
 		return
@@ -92,57 +163,157 @@ func (app *Application) handle(c net.Conn) {
 	app.respond(sc)
 }
 
-const (
-	authFail   = "Auth Failure"
-	notAuthed  = "Not Authenticated"
-)
+// How many requests one connection can have handled at once. Requests past
+// that are turned away rather than waited for, as the requests in flight may
+// need more of their payloads read.
+const maxRequestsInFlight = 8
+
+var ErrTooManyRequests = &protocol.Error{Code: protocol.CodeInternal, Retryable: true, Message: "Too many requests at once, try again later"}
+
+// Reads requests from a client until it says goodbye or the connection
+// fails. AUTH and RCVR change who the connection is authenticated as, so
+// they're handled before anything after them is read. Everything else is
+// handled concurrently, up to maxRequestsInFlight at a time, as whoever the
+// connection was authenticated as when the request arrived, unless the
+// client's protocol version predates request IDs.
+func (app *Application) respond(c crypto.Conn) {
+	conn := protocol.NewServerConn(c)
+	device := c.PeerDevice()
+	inFlight := make(chan struct{}, maxRequestsInFlight)
+	var wg sync.WaitGroup
+	defer conn.Close()
+	defer wg.Wait()
 
-func (app *Application) respond(c net.Conn) {
-	defer c.Close()
 	authenticated := false
+	var userID string
 
-connLoop:
 	for {
-		var p protocol.Payload
-		_, err := p.ReadFrom(c)
+		req, p, err := conn.Accept()
 		if err != nil {
 			log.Println(c.RemoteAddr(), err.Error())
 			return
 		}
 
-		log.Println(c.RemoteAddr(), p.TypeString())
+		log.Println(c.RemoteAddr(), p.TypeString(), req.ID())
 
 		switch p.Type() {
-		case protocol.PING:
-			protocol.NewPong().WriteTo(c)
 		case protocol.AUTH:
 			if authenticated {
 				authenticated = false
-				protocol.NewFail(authFail).WriteTo(c)
+				req.Send(protocol.NewFail(ErrAlreadyAuthenticated))
+				req.Close()
 				continue
 			}
-			var id string
-			authenticated, id, err = app.authenticate(p)
-			if err != nil {
-				protocol.NewFail(authFail).WriteTo(c)
+			authenticated, userID, err = app.authenticate(p, device)
+			var perr *protocol.Error
+			if err != nil && !errors.As(err, &perr) {
+				// Only a verdict on the credentials can say they're
+				// unknown, or the client would register them as a new user
 				log.Println(c.RemoteAddr(), err.Error())
-				continue
+				perr = ErrAuthUnavailable
 			}
 
-			if authenticated {
-				protocol.NewSuccWithData([]byte(id)).WriteTo(c)
+			if perr != nil {
+				req.Send(protocol.NewFail(perr))
 			} else {
-				protocol.NewFail(authFail).WriteTo(c)
+				app.registerDevice(device, userID)
+				req.Send(protocol.NewSuccWithData([]byte(userID)))
+			}
+			req.Close()
+		case protocol.RCVR:
+			if authenticated {
+				authenticated = false
+				req.Send(protocol.NewFail(ErrAlreadyAuthenticated))
+				req.Close()
+				continue
 			}
-		case protocol.SYNC:
-			if !authenticated {
-				protocol.NewFail(notAuthed).WriteTo(c)
+			userID, err = app.recoverAccount(p, req, device)
+			req.Close()
+			if err != nil {
+				log.Println(c.RemoteAddr(), err.Error())
+				continue
 			}
-			app.sync(p, c)
-		case protocol.NUSR:
-			app.newUser(p, c)
+
+			authenticated = true
+			app.registerDevice(device, userID)
 		case protocol.SUCC:
-			break connLoop
+			req.Close()
+			return
+		default:
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				req.Send(protocol.NewFail(ErrTooManyRequests))
+				req.Close()
+				// The rest of a sync would be taken for new requests
+				if p.Type() == protocol.SYNC {
+					return
+				}
+				continue
+			}
+
+			wg.Add(1)
+			go func(authenticated bool, userID string) {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				defer req.Close()
+				app.serve(conn, req, p, device, authenticated, userID)
+			}(authenticated, userID)
 		}
 	}
 }
+
+// Handles a request that doesn't change who the connection is authenticated
+// as
+func (app *Application) serve(conn *protocol.Conn, req *protocol.Request, p protocol.Payload, device crypto.PublicKey, authenticated bool, userID string) {
+	var err error
+	switch p.Type() {
+	case protocol.PING:
+		req.Send(protocol.NewPong())
+	case protocol.SYNC:
+		// The client may still be sending the rest of the sync, which would
+		// be taken for new requests, so the connection can't carry on after
+		// a failure
+		if !authenticated {
+			req.Send(protocol.NewFail(protocol.ErrNotAuthenticated))
+			conn.Close()
+			return
+		}
+		err = app.sync(p, req, userID, conn.Capabilities().Has(crypto.CapDeltaSync))
+		if err != nil {
+			conn.Close()
+		}
+	case protocol.NUSR:
+		err = app.newUser(p, req, device)
+	case protocol.KDFP:
+		err = app.kdfParams(p, req)
+	case protocol.KDFU, protocol.CRED:
+		if !authenticated {
+			req.Send(protocol.NewFail(protocol.ErrNotAuthenticated))
+			return
+		}
+		err = app.updateCredentials(p, req, userID)
+	case protocol.VKEY:
+		if !authenticated {
+			req.Send(protocol.NewFail(protocol.ErrNotAuthenticated))
+			return
+		}
+		err = app.dataKey(p, req, userID)
+	case protocol.RKEY:
+		if !authenticated {
+			req.Send(protocol.NewFail(protocol.ErrNotAuthenticated))
+			return
+		}
+		err = app.recoveryKey(p, req, userID)
+	case protocol.TOTP:
+		if !authenticated {
+			req.Send(protocol.NewFail(protocol.ErrNotAuthenticated))
+			return
+		}
+		err = app.totp(p, req, userID, device)
+	}
+
+	if err != nil {
+		log.Println(conn.RemoteAddr(), err.Error())
+	}
+}
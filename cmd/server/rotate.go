@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// Rotating a host key generates the new key, has the old key sign it, and
+// moves the old key aside. Until the rotation is finished the server presents
+// that signature with the new key, so clients that pinned the old key switch
+// over by themselves.
+//
+//	qpass-server rotate-key start [-from rsa] [-to ed25519] [-period 720h]
+//	qpass-server rotate-key finish [-force]
+const (
+	endorsementFile    = "key.endorsement"
+	endorsementPEMType = "QPASS HOST KEY ENDORSEMENT"
+	defaultRotation    = 30 * 24 * time.Hour
+)
+
+var (
+	ErrRotationInProgress = errors.New("A key rotation is already in progress, finish it first")
+	ErrNoRotation         = errors.New("No key rotation in progress")
+)
+
+func oldKeyPath(dir string, alg byte) string {
+	return keyPath(dir, alg) + ".old"
+}
+
+func readEndorsement(dir string) (*crypto.Endorsement, error) {
+	b, err := os.ReadFile(dir + "/" + endorsementFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != endorsementPEMType {
+		return nil, ErrInvalidKeyFile
+	}
+
+	return crypto.ParseEndorsement(block.Bytes)
+}
+
+func writeEndorsement(dir string, e *crypto.Endorsement) error {
+	b := pem.EncodeToMemory(&pem.Block{Type: endorsementPEMType, Bytes: e.Marshal()})
+	return os.WriteFile(dir+"/"+endorsementFile, b, 0644)
+}
+
+// Returns the endorsement from an unfinished rotation, if it still applies to
+// one of the keys being presented
+func loadEndorsements(dir string, hostKeys []*crypto.PrivateKey) ([]*crypto.Endorsement, error) {
+	e, err := readEndorsement(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(e.Expires) {
+		log.Println("Host key endorsement expired, run rotate-key finish to remove the old key")
+		return nil, nil
+	}
+
+	for _, key := range hostKeys {
+		if key.Public().Equal(e.NewKey) {
+			log.Println("Presenting endorsement by", crypto.Fingerprint(e.OldKey), "until", e.Expires.Format(time.DateTime))
+			return []*crypto.Endorsement{e}, nil
+		}
+	}
+
+	log.Println("Host key endorsement doesn't match any host key, ignoring it")
+	return nil, nil
+}
+
+func rotateKey(dir string, conf *Config, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: rotate-key start|finish")
+	}
+
+	switch args[0] {
+	case "start":
+		return startRotation(dir, conf, args[1:])
+	case "finish":
+		return finishRotation(dir, args[1:])
+	}
+
+	return fmt.Errorf("unknown rotate-key command %q", args[0])
+}
+
+func startRotation(dir string, conf *Config, args []string) error {
+	fs := flag.NewFlagSet("rotate-key start", flag.ContinueOnError)
+	from := fs.String("from", "", "algorithm of the key being replaced, needed if there's more than one host key")
+	to := fs.String("to", "", "algorithm of the new key, defaults to the same as the old key")
+	period := fs.Duration("period", defaultRotation, "how long clients can still move over from the old key")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir + "/" + endorsementFile); err == nil {
+		return ErrRotationInProgress
+	}
+
+	var fromAlg byte
+	if *from == "" {
+		existing := []byte{}
+		for _, alg := range crypto.DefaultKeyAlgorithms {
+			if haveKey(dir, alg) {
+				existing = append(existing, alg)
+			}
+		}
+
+		if len(existing) != 1 {
+			return errors.New("-from is needed to pick which host key to replace")
+		}
+		fromAlg = existing[0]
+	} else {
+		fromAlg, err = crypto.ParseKeyAlgorithm(*from)
+		if err != nil {
+			return err
+		}
+	}
+
+	toAlg := fromAlg
+	if *to != "" {
+		toAlg, err = crypto.ParseKeyAlgorithm(*to)
+		if err != nil {
+			return err
+		}
+	}
+
+	if toAlg != fromAlg && haveKey(dir, toAlg) {
+		return fmt.Errorf("There is already a %s host key", crypto.KeyAlgorithmName(toAlg))
+	}
+
+	oldKey, err := getKey(dir, fromAlg)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := crypto.GenerateKey(toAlg)
+	if err != nil {
+		return err
+	}
+
+	e, err := crypto.Endorse(oldKey, newKey.Public(), time.Now().Add(*period))
+	if err != nil {
+		return err
+	}
+
+	err = writeEndorsement(dir, e)
+	if err != nil {
+		return err
+	}
+
+	// Keep the old key around until the rotation is finished, in case
+	// something goes wrong
+	err = os.Rename(keyPath(dir, fromAlg), oldKeyPath(dir, fromAlg))
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(keyPath(dir, fromAlg)+".pub", oldKeyPath(dir, fromAlg)+".pub")
+	if err != nil {
+		return err
+	}
+
+	err = writeKey(keyPath(dir, toAlg), newKey)
+	if err != nil {
+		return err
+	}
+
+	if toAlg != fromAlg && len(conf.HostKeyTypes) > 0 {
+		fromName, toName := crypto.KeyAlgorithmName(fromAlg), crypto.KeyAlgorithmName(toAlg)
+		i := slices.Index(conf.HostKeyTypes, fromName)
+		if i >= 0 {
+			conf.HostKeyTypes[i] = toName
+		}
+		conf.HostKeyTypes = slices.Compact(conf.HostKeyTypes)
+
+		err = conf.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Old key:", crypto.Fingerprint(oldKey.Public()))
+	fmt.Println("New key:", crypto.Fingerprint(newKey.Public()))
+	fmt.Println("Clients can move to the new key until", e.Expires.Format(time.DateTime))
+	fmt.Println("Restart the server to start presenting the new key")
+
+	return nil
+}
+
+func finishRotation(dir string, args []string) error {
+	fs := flag.NewFlagSet("rotate-key finish", flag.ContinueOnError)
+	force := fs.Bool("force", false, "finish before the rotation period is over")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	e, err := readEndorsement(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoRotation
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Now().Before(e.Expires) && !*force {
+		return fmt.Errorf("Clients can still move to the new key until %s, use -force to finish early", e.Expires.Format(time.DateTime))
+	}
+
+	oldPath := oldKeyPath(dir, e.OldKey.Algorithm)
+	for _, path := range []string{oldPath, oldPath + ".pub", dir + "/" + endorsementFile} {
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	fmt.Println("Removed old key", crypto.Fingerprint(e.OldKey))
+	fmt.Println("Restart the server to stop presenting the endorsement")
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// Session tickets are sealed under a key kept next to the host keys. Tickets
+// can be revoked with
+//
+//	qpass-server revoke-tickets
+//
+// which rejects every ticket issued so far, including on a running server.
+// Clients with a revoked ticket just do the full handshake.
+const (
+	ticketKeyFile      = "ticket.key"
+	ticketsRevokedFile = "tickets_revoked"
+)
+
+var ErrInvalidTicketKey = errors.New("Invalid ticket key file")
+
+// Reads the ticket key, generating one if there isn't one yet
+func loadTicketKey(dir string) ([]byte, error) {
+	path := dir + "/" + ticketKeyFile
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = crypto.GenerateTicketKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return key, os.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != crypto.TicketKeySize {
+		return nil, ErrInvalidTicketKey
+	}
+
+	return key, nil
+}
+
+// Returns a function that reports when tickets were last revoked. The file is
+// read on every call, so revoking takes effect without a restart.
+func ticketsRevokedBefore(dir string) func() time.Time {
+	path := dir + "/" + ticketsRevokedFile
+	return func() time.Time {
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return time.Time{}
+		}
+
+		var t time.Time
+		if err == nil {
+			t, err = time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+		}
+
+		if err != nil {
+			// Fail closed, a full handshake is only slower
+			log.Println("Unable to read", ticketsRevokedFile, err.Error())
+			return time.Now()
+		}
+
+		return t
+	}
+}
+
+func revokeTickets(dir string) error {
+	now := time.Now().Format(time.RFC3339)
+	err := os.WriteFile(dir+"/"+ticketsRevokedFile, []byte(now+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Revoked all session tickets issued before", now)
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/models"
+	"github.com/Queueue0/qpass/internal/protocol"
+)
+
+// Users can turn on a TOTP second factor. Once they have, AUTH needs a code
+// from their authenticator app, or one of their recovery codes, as well as
+// their token, and so does RCVR as well as their recovery token. Devices that
+// have passed it aren't asked again for TOTPRememberDevice, so syncing doesn't
+// need a code every time.
+
+var (
+	ErrTOTPEnabled    = &protocol.Error{Code: protocol.CodeConflict, Message: "Two-factor authentication is already on"}
+	ErrTOTPNotEnabled = &protocol.Error{Code: protocol.CodeConflict, Message: "Two-factor authentication is off"}
+	ErrNoPendingTOTP  = &protocol.Error{Code: protocol.CodeConflict, Message: "No authenticator to confirm, start again"}
+)
+
+// Wrong codes allowed for a user before they have to wait out totpLockout.
+// Codes are only six digits, so this is what stops someone with the first
+// factor guessing them.
+const (
+	maxTOTPFailures = 5
+	totpLockout     = 5 * time.Minute
+)
+
+type totpFailures struct {
+	count int
+	last  time.Time
+}
+
+// Counts wrong codes per user. Counts are forgotten on restart.
+type totpLimiter struct {
+	mu       sync.Mutex
+	failures map[string]totpFailures
+}
+
+func newTOTPLimiter() *totpLimiter {
+	return &totpLimiter{failures: map[string]totpFailures{}}
+}
+
+func (l *totpLimiter) allowed(id string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.failures[id]
+	return f.count < maxTOTPFailures || now.Sub(f.last) >= totpLockout
+}
+
+func (l *totpLimiter) fail(id string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.failures[id]
+	if now.Sub(f.last) >= totpLockout {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	l.failures[id] = f
+}
+
+func (l *totpLimiter) reset(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, id)
+}
+
+// Checks the second factor of a user who's proven the first, from device.
+// Returns protocol.ErrTOTPRequired or protocol.ErrTOTPIncorrect if they
+// have to try again with a code, or protocol.ErrTOTPLocked if they have to
+// wait first.
+func (app *Application) secondFactor(id, code string, device crypto.PublicKey) error {
+	t, err := app.users.ServerGetTOTP(id)
+	if err != nil {
+		return err
+	}
+
+	if !t.Enabled() || app.deviceRemembered(device, id) {
+		return nil
+	}
+
+	if code == "" {
+		return protocol.ErrTOTPRequired
+	}
+
+	err = app.checkCode(id, t, code)
+	if err != nil {
+		return err
+	}
+
+	app.rememberDevice(device, id)
+	return nil
+}
+
+// Checks code against a user's TOTP secret, or failing that their recovery
+// codes, and uses it up
+func (app *Application) checkCode(id string, t models.TOTP, code string) error {
+	now := app.clock()
+	if !app.totpLimiter.allowed(id, now) {
+		return protocol.ErrTOTPLocked
+	}
+
+	ok := false
+	step, valid := crypto.VerifyTOTP(t.Secret, code, now, t.LastStep)
+	var err error
+	if valid {
+		ok, err = app.users.ServerUseTOTPStep(id, step)
+	} else {
+		ok, err = app.users.ServerUseTOTPRecoveryCode(id, crypto.TOTPRecoveryCodeHash(code))
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		app.totpLimiter.fail(id, now)
+		return protocol.ErrTOTPIncorrect
+	}
+
+	app.totpLimiter.reset(id)
+	return nil
+}
+
+// Reports whether device passed the user's TOTP recently enough not to be
+// asked again
+func (app *Application) deviceRemembered(device crypto.PublicKey, id string) bool {
+	if app.totpRemember <= 0 || device.IsZero() {
+		return false
+	}
+
+	d, err := app.devices.Get(device)
+	if err != nil {
+		return false
+	}
+
+	return d.UserID.String() == id && !d.TOTPVerified.IsZero() && app.clock().Sub(d.TOTPVerified) < app.totpRemember
+}
+
+func (app *Application) rememberDevice(device crypto.PublicKey, id string) {
+	if device.IsZero() {
+		return
+	}
+
+	app.registerDevice(device, id)
+	err := app.devices.MarkTOTPVerified(device, app.clock())
+	if err != nil {
+		log.Println("Unable to remember device", crypto.Fingerprint(device), err.Error())
+	}
+}
+
+// Turns the authenticated user's second factor on or off
+func (app *Application) totp(p protocol.Payload, req *protocol.Request, id string, device crypto.PublicKey) error {
+	var td protocol.TOTPData
+	err := td.Decode(p.Bytes())
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	t, err := app.users.ServerGetTOTP(id)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	switch {
+	case td.Disable:
+		err = app.disableTOTP(id, t, td.Code)
+		if err != nil {
+			req.Send(protocol.NewFail(err))
+			return err
+		}
+
+		return req.Send(protocol.NewSucc())
+	case td.Code == "":
+		var rd protocol.TOTPData
+		rd.Secret, err = app.beginTOTP(id, t)
+		if err != nil {
+			req.Send(protocol.NewFail(err))
+			return err
+		}
+
+		return writeTOTPData(req, rd)
+	}
+
+	var rd protocol.TOTPData
+	rd.RecoveryCodes, err = app.enableTOTP(id, t, td.Code)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	// They've just shown they have the authenticator on this device
+	app.rememberDevice(device, id)
+
+	return writeTOTPData(req, rd)
+}
+
+// Gives a user a new secret to add to their authenticator
+func (app *Application) beginTOTP(id string, t models.TOTP) ([]byte, error) {
+	if t.Enabled() {
+		return nil, ErrTOTPEnabled
+	}
+
+	secret, err := crypto.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.users.ServerSetPendingTOTP(id, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// Turns on a user's second factor once they've confirmed their
+// authenticator works with a code from it, and returns their recovery codes
+func (app *Application) enableTOTP(id string, t models.TOTP, code string) ([]string, error) {
+	if t.Enabled() {
+		return nil, ErrTOTPEnabled
+	}
+
+	if len(t.Pending) == 0 {
+		return nil, ErrNoPendingTOTP
+	}
+
+	now := app.clock()
+	if !app.totpLimiter.allowed(id, now) {
+		return nil, protocol.ErrTOTPLocked
+	}
+
+	step, ok := crypto.VerifyTOTP(t.Pending, code, now, 0)
+	if !ok {
+		app.totpLimiter.fail(id, now)
+		return nil, protocol.ErrTOTPIncorrect
+	}
+	app.totpLimiter.reset(id)
+
+	codes, err := crypto.NewTOTPRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = crypto.TOTPRecoveryCodeHash(code)
+	}
+
+	err = app.users.ServerEnableTOTP(id, step, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Turns off a user's second factor, if code is a current one or a recovery
+// code
+func (app *Application) disableTOTP(id string, t models.TOTP, code string) error {
+	if !t.Enabled() {
+		return ErrTOTPNotEnabled
+	}
+
+	err := app.checkCode(id, t, code)
+	if err != nil {
+		return err
+	}
+
+	return app.users.ServerDisableTOTP(id)
+}
+
+func writeTOTPData(req *protocol.Request, td protocol.TOTPData) error {
+	b, err := td.Encode()
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	r, err := protocol.NewPayload(protocol.TOTP, b)
+	if err != nil {
+		req.Send(protocol.NewFail(err))
+		return err
+	}
+
+	return req.Send(r)
+}
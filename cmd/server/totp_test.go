@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/dbman"
+	"github.com/Queueue0/qpass/internal/models"
+	"github.com/Queueue0/qpass/internal/protocol"
+	"github.com/google/uuid"
+)
+
+// The secret the RFC 6238 SHA-1 test vectors use
+var rfc6238Secret = []byte("12345678901234567890")
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func testApplication(t *testing.T) (*Application, *fakeClock) {
+	t.Helper()
+	db, err := dbman.OpenDB("file:" + t.TempDir() + "/pwdb.sqlite?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = dbman.InitializeDB(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	app := &Application{
+		users:       &models.UserModel{DB: db},
+		passwords:   &models.PasswordModel{DB: db},
+		devices:     &models.DeviceModel{DB: db},
+		totpLimiter: newTOTPLimiter(),
+		clock:       clock.Now,
+	}
+
+	return app, clock
+}
+
+// Adds a user with their second factor on, using secret
+func totpUser(t *testing.T, app *Application, secret []byte) string {
+	t.Helper()
+	id := uuid.New()
+	_, err := app.users.ServerInsert(models.User{ID: id, AuthToken: crypto.NewSecret([]byte(id.String()))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.users.ServerSetPendingTOTP(id.String(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.users.ServerEnableTOTP(id.String(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id.String()
+}
+
+// Checks code as a device that hasn't been remembered
+func checkTOTP(app *Application, id, code string) error {
+	return app.secondFactor(id, code, crypto.PublicKey{})
+}
+
+func TestTOTPVectors(t *testing.T) {
+	// The SHA-1 vectors, cut down to six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	app, clock := testApplication(t)
+	id := totpUser(t, app, rfc6238Secret)
+	for _, tt := range tests {
+		clock.now = time.Unix(tt.unix, 0)
+		if got := crypto.TOTPCode(rfc6238Secret, clock.now); got != tt.code {
+			t.Errorf("%d: code %s, want %s", tt.unix, got, tt.code)
+		}
+
+		err := checkTOTP(app, id, tt.code)
+		if err != nil {
+			t.Errorf("%d: %v", tt.unix, err)
+		}
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	app, clock := testApplication(t)
+	secret := []byte("skewed clocks secret")
+	id := totpUser(t, app, secret)
+	now := clock.Now()
+
+	for _, off := range []time.Duration{-2 * crypto.TOTPPeriod, 2 * crypto.TOTPPeriod} {
+		err := checkTOTP(app, id, crypto.TOTPCode(secret, now.Add(off)))
+		if !errors.Is(err, protocol.ErrTOTPIncorrect) {
+			t.Errorf("code from %v away: got %v, want ErrTOTPIncorrect", off, err)
+		}
+	}
+
+	// A step either way is let through
+	for _, off := range []time.Duration{-crypto.TOTPPeriod, crypto.TOTPPeriod} {
+		err := checkTOTP(app, id, crypto.TOTPCode(secret, now.Add(off)))
+		if err != nil {
+			t.Errorf("code from %v away: %v", off, err)
+		}
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	app, clock := testApplication(t)
+	secret := []byte("replayed code secret")
+	id := totpUser(t, app, secret)
+
+	code := crypto.TOTPCode(secret, clock.Now())
+	err := checkTOTP(app, id, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkTOTP(app, id, code)
+	if !errors.Is(err, protocol.ErrTOTPIncorrect) {
+		t.Fatalf("reused code: got %v, want ErrTOTPIncorrect", err)
+	}
+
+	// Once a later code's been used, an earlier one that's still in the
+	// window isn't accepted either
+	clock.Advance(crypto.TOTPPeriod)
+	earlier := crypto.TOTPCode(secret, clock.Now().Add(-crypto.TOTPPeriod))
+	later := crypto.TOTPCode(secret, clock.Now().Add(crypto.TOTPPeriod))
+	err = checkTOTP(app, id, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkTOTP(app, id, earlier)
+	if !errors.Is(err, protocol.ErrTOTPIncorrect) {
+		t.Fatalf("earlier code: got %v, want ErrTOTPIncorrect", err)
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	app, clock := testApplication(t)
+	secret := []byte("locked out secret")
+	id := totpUser(t, app, secret)
+
+	for range maxTOTPFailures {
+		err := checkTOTP(app, id, "000000")
+		if !errors.Is(err, protocol.ErrTOTPIncorrect) {
+			t.Fatalf("got %v, want ErrTOTPIncorrect", err)
+		}
+	}
+
+	// Even the right code is refused until the lockout's over
+	err := checkTOTP(app, id, crypto.TOTPCode(secret, clock.Now()))
+	if !errors.Is(err, protocol.ErrTOTPLocked) {
+		t.Fatalf("got %v, want ErrTOTPLocked", err)
+	}
+
+	clock.Advance(totpLockout - time.Second)
+	err = checkTOTP(app, id, crypto.TOTPCode(secret, clock.Now()))
+	if !errors.Is(err, protocol.ErrTOTPLocked) {
+		t.Fatalf("before the lockout's over: got %v, want ErrTOTPLocked", err)
+	}
+
+	// Other users aren't affected
+	other := totpUser(t, app, secret)
+	err = checkTOTP(app, other, crypto.TOTPCode(secret, clock.Now()))
+	if err != nil {
+		t.Fatalf("other user: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	err = checkTOTP(app, id, crypto.TOTPCode(secret, clock.Now()))
+	if err != nil {
+		t.Fatalf("after the lockout: %v", err)
+	}
+}
+
+func TestTOTPLimiterExpiry(t *testing.T) {
+	l := newTOTPLimiter()
+	now := time.Unix(1_700_000_000, 0)
+
+	for range maxTOTPFailures - 1 {
+		l.fail("user", now)
+	}
+
+	// Failures from longer ago than the lockout are forgotten
+	now = now.Add(totpLockout)
+	l.fail("user", now)
+	if !l.allowed("user", now) {
+		t.Fatal("locked out by old failures")
+	}
+
+	for range maxTOTPFailures - 1 {
+		l.fail("user", now)
+	}
+	if l.allowed("user", now) {
+		t.Fatal("not locked out")
+	}
+
+	l.reset("user")
+	if !l.allowed("user", now) {
+		t.Fatal("still locked out after reset")
+	}
+}
+
+func TestTOTPRecoveryCodes(t *testing.T) {
+	app, clock := testApplication(t)
+	id := uuid.NewString()
+	_, err := app.users.ServerInsert(models.User{ID: uuid.MustParse(id), AuthToken: crypto.NewSecret([]byte(id))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("recovery codes secret")
+	err = app.users.ServerSetPendingTOTP(id, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := app.users.ServerGetTOTP(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := app.enableTOTP(id, pending, crypto.TOTPCode(secret, clock.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != crypto.TOTPRecoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), crypto.TOTPRecoveryCodeCount)
+	}
+
+	for _, code := range codes {
+		err = checkTOTP(app, id, code)
+		if err != nil {
+			t.Fatalf("%s: %v", code, err)
+		}
+
+		err = checkTOTP(app, id, code)
+		if !errors.Is(err, protocol.ErrTOTPIncorrect) {
+			t.Fatalf("%s used twice: got %v, want ErrTOTPIncorrect", code, err)
+		}
+
+		// Keeps the reuses from locking the user out
+		app.totpLimiter.reset(id)
+	}
+}
+
+// A client connection without a transport underneath
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) Version() byte {
+	return crypto.ProtocolVersion
+}
+
+func (pipeConn) Capabilities() crypto.Capabilities {
+	return 0
+}
+
+func (pipeConn) PeerDevice() crypto.PublicKey {
+	return crypto.PublicKey{}
+}
+
+func recoveryPayload(t *testing.T, id string, token *crypto.Secret, code string) *protocol.Payload {
+	t.Helper()
+	b, err := (&protocol.RecoveryData{UUID: id, Token: token.Bytes(), Code: code}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := protocol.NewPayload(protocol.RCVR, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestRecoveryNeedsTOTP(t *testing.T) {
+	app, clock := testApplication(t)
+	id := totpUser(t, app, rfc6238Secret)
+
+	recoveryKey, err := crypto.NewRecoveryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := crypto.RecoveryKeys(string(recoveryKey.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.users.ServerSetRecoveryKey(id, "wrapped key", crypto.RecoveryVerifier(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() *protocol.Conn {
+		c, s := net.Pipe()
+		go app.respond(pipeConn{s})
+		conn := protocol.NewClientConn(pipeConn{c})
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	syncPayload, _, err := protocol.SyncPayloads(protocol.SyncData{UUID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial()
+	r, err := conn.Do(recoveryPayload(t, id, token, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Err(); !errors.Is(err, protocol.ErrTOTPRequired) {
+		t.Fatalf("without a code: got %s %v, want ErrTOTPRequired", r.TypeString(), err)
+	}
+
+	// The recovery token alone mustn't authenticate the connection
+	r, err = conn.Do(syncPayload[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Err(); !errors.Is(err, protocol.ErrNotAuthenticated) {
+		t.Fatalf("sync after recovery without a code: got %s %v, want ErrNotAuthenticated", r.TypeString(), err)
+	}
+
+	conn = dial()
+	r, err = conn.Do(recoveryPayload(t, id, token, crypto.TOTPCode(rfc6238Secret, clock.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type() != protocol.RCVR {
+		t.Fatalf("with a code: got %s %v, want RCVR", r.TypeString(), r.Err())
+	}
+
+	var rd protocol.RecoveryData
+	err = rd.Decode(r.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.WrappedKey != "wrapped key" {
+		t.Fatalf("got wrapped key %q", rd.WrappedKey)
+	}
+}
@@ -3,14 +3,18 @@ package crypto
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"strings"
 
 	"golang.org/x/crypto/argon2"
 	chacha "golang.org/x/crypto/chacha20poly1305"
 )
 
-func Encrypt(s string, key []byte) (string, error) {
+var ErrCiphertextTooShort = errors.New("ciphertext too short")
+
+func Encrypt(s string, key *Secret) (string, error) {
 	sbytes := []byte(s)
-	encrypted, err := encryptBytes(sbytes, key, nil)
+	encrypted, err := encryptBytes(sbytes, key.Bytes(), nil)
 	if err != nil {
 		return "", err
 	}
@@ -20,13 +24,13 @@ func Encrypt(s string, key []byte) (string, error) {
 	return encStr, nil
 }
 
-func Decrypt(s string, key []byte) (string, error) {
+func Decrypt(s string, key *Secret) (string, error) {
 	b, err := base64.RawStdEncoding.DecodeString(s)
 	if err != nil {
 		return "", err
 	}
 
-	unsealed, err := decryptBytes(b, key, nil)
+	unsealed, err := decryptBytes(nil, b, key.Bytes(), nil)
 	if err != nil {
 		return "", err
 	}
@@ -34,6 +38,50 @@ func Decrypt(s string, key []byte) (string, error) {
 	return string(unsealed), nil
 }
 
+// Same as Decrypt, but the plaintext never leaves a Secret
+func DecryptSecret(s string, key *Secret) (*Secret, error) {
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptSecret(b, key, nil)
+}
+
+// Ciphertexts sealed with additional data, binding them to where they're
+// stored, start with this ahead of the same base64 encoding Encrypt uses. It
+// can't appear in a ciphertext from Encrypt.
+const boundPrefix = "v1:"
+
+var ErrUnboundCiphertext = errors.New("ciphertext isn't bound to where it's stored")
+
+func EncryptBound(plaintext []byte, key *Secret, additionalData []byte) (string, error) {
+	encrypted, err := encryptBytes(plaintext, key.Bytes(), additionalData)
+	if err != nil {
+		return "", err
+	}
+
+	return boundPrefix + base64.RawStdEncoding.EncodeToString(encrypted), nil
+}
+
+func DecryptBound(s string, key *Secret, additionalData []byte) (*Secret, error) {
+	if !IsBound(s) {
+		return nil, ErrUnboundCiphertext
+	}
+
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, boundPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptSecret(b, key, additionalData)
+}
+
+// Reports whether s was encrypted by EncryptBound rather than Encrypt
+func IsBound(s string) bool {
+	return strings.HasPrefix(s, boundPrefix)
+}
+
 func encryptBytes(plaintext, key, additionalData []byte) ([]byte, error) {
 	aead, err := chacha.NewX(key)
 	if err != nil {
@@ -50,15 +98,20 @@ func encryptBytes(plaintext, key, additionalData []byte) ([]byte, error) {
 	return sealed, nil
 }
 
-func decryptBytes(cyphertext, key, additionalData []byte) ([]byte, error) {
+// Opens cyphertext, appending the plaintext to dst
+func decryptBytes(dst, cyphertext, key, additionalData []byte) ([]byte, error) {
 	aead, err := chacha.NewX(key)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(cyphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrCiphertextTooShort
+	}
+
 	nonce, enc := cyphertext[:aead.NonceSize()], cyphertext[aead.NonceSize():]
 
-	unsealed, err := aead.Open(nil, nonce, enc, additionalData)
+	unsealed, err := aead.Open(dst, nonce, enc, additionalData)
 	if err != nil {
 		return nil, err
 	}
@@ -66,9 +119,69 @@ func decryptBytes(cyphertext, key, additionalData []byte) ([]byte, error) {
 	return unsealed, nil
 }
 
-func GetKey(password, salt string) []byte {
-	key := Hash([]byte(password), []byte(salt), 10)
-	return key
+// Opens cyphertext straight into a Secret of the right size, so the plaintext
+// is never anywhere else
+func decryptSecret(cyphertext []byte, key *Secret, additionalData []byte) (*Secret, error) {
+	n := len(cyphertext) - chacha.NonceSizeX - chacha.Overhead
+	if n < 0 {
+		return nil, ErrCiphertextTooShort
+	}
+
+	s := newSecret(n)
+	_, err := decryptBytes(s.b[:0], cyphertext, key.Bytes(), additionalData)
+	if err != nil {
+		s.Destroy()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Derives a user's vault key from their master password
+func GetKey(password, salt string, params KDFParams) (*Secret, error) {
+	p := []byte(password)
+	defer clear(p)
+
+	key, err := params.derive(p, []byte(salt))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSecret(key), nil
+}
+
+// A user's vault is encrypted with a random data key, which is stored wrapped
+// by the key derived from their master password. Changing the password or the
+// parameters only means wrapping the data key again.
+const dataKeyLabel = "qpass data key"
+
+func NewDataKey() (*Secret, error) {
+	key := newSecret(chacha.KeySize)
+	_, err := rand.Read(key.b)
+	if err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func WrapKey(key, kek *Secret) (string, error) {
+	wrapped, err := encryptBytes(key.Bytes(), kek.Bytes(), []byte(dataKeyLabel))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(wrapped), nil
+}
+
+func UnwrapKey(wrapped string, kek *Secret) (*Secret, error) {
+	b, err := base64.RawStdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptSecret(b, kek, []byte(dataKeyLabel))
 }
 
 func GenSalt(n uint32) (string, error) {
@@ -81,14 +194,37 @@ func GenSalt(n uint32) (string, error) {
 	return base64.RawStdEncoding.EncodeToString(b), nil
 }
 
-func Hash(plaintext []byte, salt []byte, time uint32) []byte {
-	return argon2.IDKey(plaintext, salt, time, 64*1024, 2, 32)
+func ClientAuthToken(username, password string, params KDFParams) (*Secret, error) {
+	key, err := GetKey(password, username, params)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	return KeyAuthToken(key, password, params)
+}
+
+// Same as ClientAuthToken, for when the vault key has already been derived
+func KeyAuthToken(key *Secret, password string, params KDFParams) (*Secret, error) {
+	p := []byte(password)
+	defer clear(p)
+
+	token, err := params.derive(key.Bytes(), p)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSecret(token), nil
 }
 
-func ClientAuthToken(username, password string) []byte {
-	return Hash(GetKey(password, username), []byte(password), 10)
+func ServerAuthToken(token []byte, params KDFParams) ([]byte, error) {
+	return params.derive(token, nil)
 }
 
-func ServerAuthToken(token []byte) []byte {
-	return Hash(token, nil, 30)
+// Identifies a user to the sync server before they've authenticated, so it
+// can say which parameters their keys are derived with. Several users can
+// share a username, and so a lookup ID. The parameters here can never
+// change.
+func UserLookupID(username string) []byte {
+	return argon2.IDKey([]byte(username), []byte("qpass user lookup"), 1, 64*1024, 2, 32)
 }
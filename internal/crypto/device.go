@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// Each client device has a long term key of its own. When both sides support
+// it, the client's first record after the handshake is a device proof: its
+// device key and a signature over a hash of the handshake transcript. The
+// signature can't be replayed on another connection, and as it's sent
+// encrypted, passive observers can't tell devices apart.
+//
+// The server checks the proof before NewServerConn returns, so it knows which
+// device it's talking to before reading any payloads.
+const deviceProofContext = "qpass device proof"
+
+var (
+	ErrDeviceRequired     = errors.New("Server requires a device key")
+	ErrInvalidDeviceProof = errors.New("invalid device proof")
+	ErrUnknownDevice      = errors.New("Device is not registered")
+	ErrDeviceRevoked      = errors.New("Device has been revoked")
+)
+
+// Decides whether to accept a device, based on its key. Returning an error
+// aborts the handshake.
+type DeviceCallback func(key PublicKey) error
+
+func deviceProofSigned(transcript []byte) []byte {
+	th := newBlake2b()
+	th.Write(transcript)
+	return slices.Concat([]byte(deviceProofContext), th.Sum(nil))
+}
+
+func newDeviceProof(key *PrivateKey, transcript []byte) ([]byte, error) {
+	sig, err := key.Sign(deviceProofSigned(transcript))
+	if err != nil {
+		return nil, err
+	}
+
+	proof := appendKey(nil, key.Public())
+	proof = binary.BigEndian.AppendUint16(proof, uint16(len(sig)))
+	return append(proof, sig...), nil
+}
+
+// Returns the device key in proof if its signature over transcript checks out
+func verifyDeviceProof(proof, transcript []byte) (PublicKey, error) {
+	key, rest, err := cutKey(proof)
+	if err != nil {
+		return PublicKey{}, ErrInvalidDeviceProof
+	}
+
+	sig, rest, ok := cutField(rest)
+	if !ok || len(rest) != 0 {
+		return PublicKey{}, ErrInvalidDeviceProof
+	}
+
+	err = key.Verify(deviceProofSigned(transcript), sig)
+	if err != nil {
+		return PublicKey{}, err
+	}
+
+	return key, nil
+}
+
+// Device key the client proved it holds during the handshake. Zero on client
+// connections and when device authentication wasn't used.
+func (s *secureConn) PeerDevice() PublicKey {
+	return s.peerDevice
+}
@@ -0,0 +1,850 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+// Both sides of the handshake run as a state machine. Each state reads or
+// writes one part of the handshake and picks the state that follows. Every
+// field is read in full before it is used, so a handshake that arrives a byte
+// at a time reads the same as one that arrives all at once. The whole handshake
+// has to finish before a deadline, so a peer that stops sending can't hold the
+// connection open.
+//
+// Client hello:
+//
+//	magic | min version | max version | capabilities | DH key | algorithm count |
+//	algorithms [| ticket length | ticket]
+//
+// Server hello, full handshake:
+//
+//	status | version | capabilities [| mode] | DH key | key algorithm | key length |
+//	host key | endorsement count | (length | endorsement)... | signature length |
+//	signature | MAC
+//
+// Server hello, resumed handshake:
+//
+//	status | version | capabilities | mode | DH key | MAC
+//
+// The signature covers everything sent so far except the length fields, the
+// MAC covers the signature too, and the traffic keys are salted with all of
+// it plus the MAC. If device authentication is in use, the client then sends
+// its device proof as the first encrypted record.
+type handshakeState int
+
+const (
+	clientSendHello handshakeState = iota
+	clientReadStatus
+	clientResume
+	clientReadHostKey
+	clientReadEndorsements
+	clientVerifySignature
+	clientCheckHostKey
+	clientConfirmKey
+	clientProveDevice
+	clientFinishNoise
+
+	serverReadHello
+	serverResume
+	serverSendHello
+	serverVerifyDevice
+	serverFinishNoise
+
+	tlsHandshake
+	handshakeDone
+)
+
+func (s handshakeState) String() string {
+	switch s {
+	case clientSendHello:
+		return "sending client hello"
+	case clientReadStatus:
+		return "reading server status"
+	case clientResume:
+		return "resuming session"
+	case clientReadHostKey:
+		return "reading host key"
+	case clientReadEndorsements:
+		return "reading host key endorsements"
+	case clientVerifySignature:
+		return "verifying host key signature"
+	case clientCheckHostKey:
+		return "checking host key"
+	case clientConfirmKey:
+		return "confirming shared key"
+	case clientProveDevice:
+		return "proving device key"
+	case clientFinishNoise:
+		return "sending final Noise message"
+	case serverReadHello:
+		return "reading client hello"
+	case serverResume:
+		return "resuming session"
+	case serverSendHello:
+		return "sending server hello"
+	case serverVerifyDevice:
+		return "verifying device key"
+	case serverFinishNoise:
+		return "reading final Noise message"
+	case tlsHandshake:
+		return "negotiating TLS"
+	case handshakeDone:
+		return "done"
+	}
+
+	return "unknown state"
+}
+
+const DefaultHandshakeTimeout = 30 * time.Second
+
+var (
+	ErrNoCommonAlgorithm = errors.New("No host key algorithm in common with the client")
+	ErrHandshakeMAC      = errors.New("MAC authentication failed")
+	ErrHandshakeTimeout  = errors.New("Handshake timed out")
+)
+
+// Returned for any failed handshake. Err is the cause, such as
+// ErrHandshakeMAC, ErrBadSignature, ErrHandshakeTimeout, ErrUnknownHost or a
+// *HostKeyChangedError.
+type HandshakeError struct {
+	Step string
+	Err  error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("Handshake failed while %s: %s", e.Step, e.Err.Error())
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+func handshakeError(state handshakeState, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = ErrHandshakeTimeout
+	}
+
+	return &HandshakeError{state.String(), err}
+}
+
+// A negative timeout means no deadline
+func handshakeDeadline(timeout time.Duration) time.Time {
+	if timeout < 0 {
+		return time.Time{}
+	}
+
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	return time.Now().Add(timeout)
+}
+
+func readField(c net.Conn, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(c, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+type clientHandshake struct {
+	c     net.Conn
+	conf  *ClientConfig
+	state handshakeState
+
+	hostname string
+	sessions *SessionCache
+	sess     *session // Ticket we presented, if any
+	privkey  *ecdh.PrivateKey
+	algs     []byte
+	version  byte
+	caps     Capabilities
+
+	// Everything the MAC covers so far
+	transcript []byte
+	remoteKey  *ecdh.PublicKey
+	hostKey    PublicKey
+	endorsedBy []PublicKey
+	ss         []byte
+
+	conn *secureConn
+}
+
+func NewClientConn(c net.Conn, conf *ClientConfig) (*secureConn, error) {
+	if conf == nil {
+		conf = &ClientConfig{}
+	}
+
+	h := &clientHandshake{
+		c:        c,
+		conf:     conf,
+		state:    clientSendHello,
+		hostname: conf.knownHostname(c),
+		sessions: conf.SessionCache,
+		caps:     conf.Capabilities | CapKeyUpdate,
+	}
+
+	if h.sessions != nil {
+		h.caps |= CapSessionTickets
+	}
+
+	if conf.DeviceKey != nil {
+		h.caps |= CapDeviceAuth
+	}
+
+	err := h.run()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return h.conn, nil
+}
+
+func (h *clientHandshake) run() error {
+	err := h.c.SetDeadline(handshakeDeadline(h.conf.HandshakeTimeout))
+	if err != nil {
+		return handshakeError(h.state, err)
+	}
+
+	for h.state != handshakeDone {
+		switch h.state {
+		case clientSendHello:
+			err = h.sendHello()
+		case clientReadStatus:
+			err = h.readStatus()
+		case clientResume:
+			err = h.resume()
+		case clientReadHostKey:
+			err = h.readHostKey()
+		case clientReadEndorsements:
+			err = h.readEndorsements()
+		case clientVerifySignature:
+			err = h.verifySignature()
+		case clientCheckHostKey:
+			err = h.checkHostKey()
+		case clientConfirmKey:
+			err = h.confirmKey()
+		case clientProveDevice:
+			err = h.proveDevice()
+		default:
+			err = errors.New("invalid handshake state")
+		}
+
+		if err != nil {
+			return handshakeError(h.state, err)
+		}
+	}
+
+	// Not before now, or it would replace the handshake deadline
+	h.conn.idleTimeout = h.conf.IdleTimeout
+	h.conn.setKeyUpdateLimits(h.conf.KeyUpdateBytes, h.conf.KeyUpdateRecords)
+	return h.c.SetDeadline(time.Time{})
+}
+
+// Sends the protocol versions and features we support, our ephemeral DH key,
+// the host key algorithms we accept, and a ticket from an earlier session if
+// we have one
+func (h *clientHandshake) sendHello() error {
+	var err error
+	h.privkey, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	h.algs = h.conf.keyAlgorithms(h.hostname)
+	hello := slices.Concat(protocolMagic, []byte{MinProtocolVersion, ProtocolVersion}, h.caps.bytes(),
+		h.privkey.PublicKey().Bytes(), []byte{byte(len(h.algs))}, h.algs)
+
+	if h.caps.Has(CapSessionTickets) {
+		var ticket []byte
+		h.sess, _ = h.sessions.take(h.hostname)
+		if h.sess != nil {
+			ticket = h.sess.ticket
+		}
+		hello = binary.BigEndian.AppendUint16(hello, uint16(len(ticket)))
+		hello = append(hello, ticket...)
+	}
+
+	_, err = h.c.Write(hello)
+	if err != nil {
+		return err
+	}
+
+	h.transcript = hello
+	h.state = clientReadStatus
+	return nil
+}
+
+// Reads the server's choice of version and features, or its reason for
+// hanging up
+func (h *clientHandshake) readStatus() error {
+	status, err := readField(h.c, 1)
+	if err != nil {
+		return err
+	}
+
+	switch status[0] {
+	case helloAccepted:
+	case helloRejected:
+		versions, err := readField(h.c, 2)
+		if err != nil {
+			return err
+		}
+		return &VersionMismatchError{MinProtocolVersion, ProtocolVersion, versions[0], versions[1]}
+	default:
+		return ErrNotQpass
+	}
+
+	negotiated, err := readField(h.c, 5)
+	if err != nil {
+		return err
+	}
+
+	h.version = negotiated[0]
+	if h.version < MinProtocolVersion || h.version > ProtocolVersion {
+		return &VersionMismatchError{MinProtocolVersion, ProtocolVersion, h.version, h.version}
+	}
+
+	// The server can't turn on features we didn't ask for
+	h.caps &= Capabilities(binary.BigEndian.Uint32(negotiated[1:]))
+	h.transcript = slices.Concat(h.transcript, status, negotiated)
+	h.state = clientReadHostKey
+
+	// With tickets in use, the server says whether it accepted ours
+	if h.caps.Has(CapSessionTickets) {
+		mode, err := readField(h.c, 1)
+		if err != nil {
+			return err
+		}
+		h.transcript = append(h.transcript, mode...)
+
+		switch {
+		case mode[0] == handshakeResumed && h.sess != nil:
+			h.state = clientResume
+		case mode[0] != handshakeFull:
+			return ErrInvalidTicket
+		}
+	}
+
+	return nil
+}
+
+// Finishes a handshake the server resumed from our ticket. Being able to open
+// the ticket is what proves it's the server we talked to before.
+func (h *clientHandshake) resume() error {
+	err := h.readRemoteKey()
+	if err != nil {
+		return err
+	}
+
+	dh, err := h.privkey.ECDH(h.remoteKey)
+	if err != nil {
+		return err
+	}
+
+	h.ss, err = resumedSecret(h.sess.secret, dh)
+	if err != nil {
+		return err
+	}
+
+	h.state = clientConfirmKey
+	return nil
+}
+
+func (h *clientHandshake) readRemoteKey() error {
+	rkBytes, err := readField(h.c, pubKeySize)
+	if err != nil {
+		return err
+	}
+
+	h.remoteKey, err = ecdh.X25519().NewPublicKey(rkBytes)
+	if err != nil {
+		return err
+	}
+
+	h.transcript = append(h.transcript, rkBytes...)
+	return nil
+}
+
+// Reads the server's DH key and its host key, prefixed by the host key's
+// algorithm and length
+func (h *clientHandshake) readHostKey() error {
+	err := h.readRemoteKey()
+	if err != nil {
+		return err
+	}
+
+	keyHeader, err := readField(h.c, 1+hostKeyByteLen)
+	if err != nil {
+		return err
+	}
+
+	keyAlg := keyHeader[0]
+	if !slices.Contains(h.algs, keyAlg) {
+		return ErrUnknownKeyAlgorithm
+	}
+
+	hostKeyBytes, err := readField(h.c, int(binary.BigEndian.Uint16(keyHeader[1:])))
+	if err != nil {
+		return err
+	}
+
+	h.hostKey, err = ParsePublicKey(keyAlg, hostKeyBytes)
+	if err != nil {
+		return err
+	}
+
+	h.transcript = slices.Concat(h.transcript, keyHeader[:1], hostKeyBytes)
+	h.state = clientReadEndorsements
+	return nil
+}
+
+// Reads endorsements of the host key by keys it replaced
+func (h *clientHandshake) readEndorsements() error {
+	count, err := readField(h.c, 1)
+	if err != nil {
+		return err
+	}
+	h.transcript = append(h.transcript, count...)
+
+	for range count[0] {
+		eLen, err := readField(h.c, 2)
+		if err != nil {
+			return err
+		}
+
+		eBytes, err := readField(h.c, int(binary.BigEndian.Uint16(eLen)))
+		if err != nil {
+			return err
+		}
+		h.transcript = slices.Concat(h.transcript, eLen, eBytes)
+
+		// Endorsements that don't check out are ignored, they can only
+		// ever make more keys trusted
+		e, err := ParseEndorsement(eBytes)
+		if err != nil || !e.NewKey.Equal(h.hostKey) || e.Verify(time.Now()) != nil {
+			continue
+		}
+		h.endorsedBy = append(h.endorsedBy, e.OldKey)
+	}
+
+	h.state = clientVerifySignature
+	return nil
+}
+
+// Checks the signature over everything exchanged so far, to confirm the
+// server has the host private key
+func (h *clientHandshake) verifySignature() error {
+	sigLen, err := readField(h.c, 2)
+	if err != nil {
+		return err
+	}
+
+	sig, err := readField(h.c, int(binary.BigEndian.Uint16(sigLen)))
+	if err != nil {
+		return err
+	}
+
+	err = h.hostKey.Verify(h.transcript, sig)
+	if err != nil {
+		return err
+	}
+
+	h.transcript = append(h.transcript, sig...)
+	h.state = clientCheckHostKey
+	return nil
+}
+
+// The server holds the private key, now check that it's a key we trust
+func (h *clientHandshake) checkHostKey() error {
+	callback := TrustOnFirstUse(nil, false)
+	if h.conf.HostKeyCallback != nil {
+		callback = h.conf.HostKeyCallback
+	}
+
+	// The callback may be waiting on the user, which shouldn't count
+	// against the deadline
+	err := h.c.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	err = callback(h.hostname, h.hostKey, h.endorsedBy)
+	if err != nil {
+		return err
+	}
+
+	err = h.c.SetDeadline(handshakeDeadline(h.conf.HandshakeTimeout))
+	if err != nil {
+		return err
+	}
+
+	dh, err := h.privkey.ECDH(h.remoteKey)
+	if err != nil {
+		return err
+	}
+
+	h.ss = genSharedKey(dh)
+	h.state = clientConfirmKey
+	return nil
+}
+
+// Checks the server's MAC, to confirm it computed the same shared secret, and
+// derives the traffic keys
+func (h *clientHandshake) confirmKey() error {
+	mac, err := readField(h.c, macLen)
+	if err != nil {
+		return err
+	}
+
+	expectedMac, err := handshakeMAC(h.ss, h.transcript)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(mac, expectedMac) {
+		return ErrHandshakeMAC
+	}
+
+	c2s, s2c, resumption, err := trafficKeys(h.ss, h.transcript, mac)
+	if err != nil {
+		return err
+	}
+
+	h.conn, err = newSecureConn(h.c, h.version, h.caps, s2c, c2s)
+	if err != nil {
+		return err
+	}
+	h.conn.isClient = true
+	h.conn.hostname = h.hostname
+	h.conn.sessions = h.sessions
+	h.conn.resumption = resumption
+
+	h.transcript = append(h.transcript, mac...)
+	h.state = handshakeDone
+	if h.caps.Has(CapDeviceAuth) {
+		h.state = clientProveDevice
+	}
+
+	return nil
+}
+
+// Proves we hold our device key by signing the handshake transcript
+func (h *clientHandshake) proveDevice() error {
+	proof, err := newDeviceProof(h.conf.DeviceKey, h.transcript)
+	if err != nil {
+		return err
+	}
+
+	err = h.conn.writeRecord(recordDeviceProof, proof)
+	if err != nil {
+		return err
+	}
+
+	h.state = handshakeDone
+	return nil
+}
+
+type serverHandshake struct {
+	c     net.Conn
+	conf  *ServerConfig
+	state handshakeState
+
+	version    byte
+	caps       Capabilities
+	remoteKey  *ecdh.PublicKey
+	algs       []byte
+	secret     []byte // Resumption secret from the client's ticket
+	hello      []byte
+	negotiated []byte
+	transcript []byte // Everything the traffic keys are salted with
+
+	conn *secureConn
+}
+
+func NewServerConn(c net.Conn, conf *ServerConfig) (*secureConn, error) {
+	h := &serverHandshake{
+		c:     c,
+		conf:  conf,
+		state: serverReadHello,
+	}
+
+	err := h.run()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return h.conn, nil
+}
+
+func (h *serverHandshake) run() error {
+	err := h.c.SetDeadline(handshakeDeadline(h.conf.HandshakeTimeout))
+	if err != nil {
+		return handshakeError(h.state, err)
+	}
+
+	for h.state != handshakeDone {
+		switch h.state {
+		case serverReadHello:
+			err = h.readHello()
+		case serverResume:
+			err = h.resume()
+		case serverSendHello:
+			err = h.sendHello()
+		case serverVerifyDevice:
+			err = h.verifyDevice()
+		default:
+			err = errors.New("invalid handshake state")
+		}
+
+		if err != nil {
+			return handshakeError(h.state, err)
+		}
+	}
+
+	// Not before now, or it would replace the handshake deadline
+	h.conn.idleTimeout = h.conf.IdleTimeout
+	h.conn.setKeyUpdateLimits(h.conf.KeyUpdateBytes, h.conf.KeyUpdateRecords)
+	return h.c.SetDeadline(time.Time{})
+}
+
+// Reads the protocol versions and features the client supports, its ephemeral
+// DH key, the host key algorithms it accepts and its ticket, if it sent one
+func (h *serverHandshake) readHello() error {
+	b, err := readField(h.c, len(protocolMagic)+2+4+pubKeySize+1)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(b[:len(protocolMagic)], protocolMagic) {
+		return ErrNotQpass
+	}
+	rest := b[len(protocolMagic):]
+
+	h.version, err = negotiateVersion(rest[0], rest[1])
+	if err != nil {
+		// Tell the client why before hanging up
+		h.c.Write([]byte{helloRejected, MinProtocolVersion, ProtocolVersion})
+		return err
+	}
+
+	clientCaps := Capabilities(binary.BigEndian.Uint32(rest[2:6]))
+	h.caps = h.conf.Capabilities | CapKeyUpdate
+	if len(h.conf.TicketKey) > 0 {
+		h.caps |= CapSessionTickets
+	}
+	if h.conf.VerifyDevice != nil {
+		h.caps |= CapDeviceAuth
+	}
+	h.caps &= clientCaps
+
+	if h.conf.VerifyDevice != nil && !h.caps.Has(CapDeviceAuth) {
+		return ErrDeviceRequired
+	}
+	h.negotiated = slices.Concat([]byte{helloAccepted, h.version}, h.caps.bytes())
+	rest = rest[6:]
+
+	h.remoteKey, err = ecdh.X25519().NewPublicKey(rest[:pubKeySize])
+	if err != nil {
+		return err
+	}
+
+	h.algs, err = readField(h.c, int(rest[pubKeySize]))
+	if err != nil {
+		return err
+	}
+
+	h.hello = slices.Concat(b, h.algs)
+	h.state = serverSendHello
+
+	// A client that supports tickets sends one, even if it's empty
+	if !clientCaps.Has(CapSessionTickets) {
+		return nil
+	}
+
+	ticketLen, err := readField(h.c, 2)
+	if err != nil {
+		return err
+	}
+
+	ticket, err := readField(h.c, int(binary.BigEndian.Uint16(ticketLen)))
+	if err != nil {
+		return err
+	}
+	h.hello = slices.Concat(h.hello, ticketLen, ticket)
+
+	// Tell the client whether its ticket is good. If not, fall back to the
+	// full handshake
+	if h.caps.Has(CapSessionTickets) {
+		h.secret, err = h.conf.openTicket(ticket)
+		if err == nil {
+			h.negotiated = append(h.negotiated, handshakeResumed)
+			h.state = serverResume
+		} else {
+			h.negotiated = append(h.negotiated, handshakeFull)
+		}
+	}
+
+	return nil
+}
+
+// Answers a client whose ticket we accepted, skipping the host key signature
+// and the Argon2 step
+func (h *serverHandshake) resume() error {
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pubkey := privkey.PublicKey().Bytes()
+
+	dh, err := privkey.ECDH(h.remoteKey)
+	if err != nil {
+		return err
+	}
+
+	ss, err := resumedSecret(h.secret, dh)
+	if err != nil {
+		return err
+	}
+
+	transcript := slices.Concat(h.hello, h.negotiated, pubkey)
+	mac, err := handshakeMAC(ss, transcript)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.c.Write(slices.Concat(h.negotiated, pubkey, mac))
+	if err != nil {
+		return err
+	}
+
+	return h.finish(ss, transcript, mac)
+}
+
+// Sends our DH key, our host key and its endorsements, a signature over the
+// handshake so far, and a MAC proving we computed the shared secret
+func (h *serverHandshake) sendHello() error {
+	hostKey, ok := h.conf.hostKey(h.algs)
+	if !ok {
+		return ErrNoCommonAlgorithm
+	}
+
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pubkey := privkey.PublicKey().Bytes()
+
+	// Compute (s)hared (s)ecret
+	ss, err := privkey.ECDH(h.remoteKey)
+	if err != nil {
+		return err
+	}
+
+	ss = genSharedKey(ss)
+
+	// Get byte representation of host public key to send
+	hostPub := hostKey.Public()
+	hostPubBytes := hostPub.Marshal()
+	keyHeader := make([]byte, 1+hostKeyByteLen)
+	keyHeader[0] = hostPub.Algorithm
+	binary.BigEndian.PutUint16(keyHeader[1:], uint16(len(hostPubBytes)))
+
+	// Endorsements of our key by the keys it replaced, so clients that
+	// pinned an old key can move to the new one
+	endorsementBytes, err := h.conf.endorsementList(hostPub)
+	if err != nil {
+		return err
+	}
+
+	// Sign all data so far with our host private key
+	signed := slices.Concat(h.hello, h.negotiated, pubkey, keyHeader[:1], hostPubBytes, endorsementBytes)
+	sig, err := hostKey.Sign(signed)
+	if err != nil {
+		return err
+	}
+
+	sigLen := binary.BigEndian.AppendUint16(nil, uint16(len(sig)))
+
+	// Generate a MAC over all data so far using the DH shared secret
+	transcript := slices.Concat(signed, sig)
+	mac, err := handshakeMAC(ss, transcript)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.c.Write(slices.Concat(h.negotiated, pubkey, keyHeader, hostPubBytes, endorsementBytes, sigLen, sig, mac))
+	if err != nil {
+		return err
+	}
+
+	return h.finish(ss, transcript, mac)
+}
+
+func (h *serverHandshake) finish(ss, transcript, mac []byte) error {
+	c2s, s2c, resumption, err := trafficKeys(ss, transcript, mac)
+	if err != nil {
+		return err
+	}
+
+	h.conn, err = newSecureConn(h.c, h.version, h.caps, c2s, s2c)
+	if err != nil {
+		return err
+	}
+
+	err = h.conn.queueTicket(h.conf, resumption)
+	if err != nil {
+		return err
+	}
+
+	h.transcript = slices.Concat(transcript, mac)
+	h.state = handshakeDone
+	if h.caps.Has(CapDeviceAuth) {
+		h.state = serverVerifyDevice
+	}
+
+	return nil
+}
+
+// Reads the client's device proof and asks VerifyDevice whether to accept the
+// device
+func (h *serverHandshake) verifyDevice() error {
+	recordType, proof, err := h.conn.readRecord()
+	if err != nil {
+		return err
+	}
+
+	if recordType != recordDeviceProof {
+		return ErrDeviceRequired
+	}
+
+	key, err := verifyDeviceProof(proof, h.transcript)
+	if err != nil {
+		return err
+	}
+
+	err = h.conf.VerifyDevice(key)
+	if err != nil {
+		return err
+	}
+
+	h.conn.peerDevice = key
+	h.state = handshakeDone
+	return nil
+}
@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Hands everything written to it to the peer a byte at a time
+type fragmentConn struct {
+	net.Conn
+}
+
+func (c fragmentConn) Write(b []byte) (int, error) {
+	for i := range b {
+		_, err := c.Conn.Write(b[i : i+1])
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flips the last bit of the first write, which for a server is the MAC at the
+// end of its hello
+type tamperConn struct {
+	net.Conn
+	done bool
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if !c.done {
+		c.done = true
+		b = bytes.Clone(b)
+		b[len(b)-1] ^= 1
+	}
+
+	return c.Conn.Write(b)
+}
+
+// Capabilities no build uses, for testing how they're negotiated
+const (
+	testCapA Capabilities = 1 << 30
+	testCapB Capabilities = 1 << 31
+)
+
+func acceptAnyHost(hostname string, key PublicKey, endorsedBy []PublicKey) error {
+	return nil
+}
+
+func testServerConfig(t *testing.T) *ServerConfig {
+	t.Helper()
+	key, err := GenerateKey(KeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ServerConfig{HostKeys: []*PrivateKey{key}}
+}
+
+type handshakeResult struct {
+	conn *secureConn
+	err  error
+}
+
+// Runs the server side of a handshake on s in the background
+func serveHandshake(s net.Conn, conf *ServerConfig) chan handshakeResult {
+	done := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := NewServerConn(s, conf)
+		done <- handshakeResult{conn, err}
+	}()
+
+	return done
+}
+
+func TestHandshakeFragmented(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := serveHandshake(fragmentConn{s}, testServerConfig(t))
+
+	client, err := NewClientConn(fragmentConn{c}, &ClientConfig{Hostname: "test", HostKeyCallback: acceptAnyHost})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	server := r.conn
+
+	if client.Version() != ProtocolVersion || server.Version() != ProtocolVersion {
+		t.Errorf("negotiated versions %d and %d, want %d", client.Version(), server.Version(), ProtocolVersion)
+	}
+
+	msg := []byte("hello over one byte writes")
+	go client.Write(msg)
+
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(server, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+
+	conf := testServerConfig(t)
+	conf.HandshakeTimeout = 50 * time.Millisecond
+
+	// Only part of the hello ever arrives
+	go c.Write(protocolMagic)
+
+	_, err := NewServerConn(s, conf)
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("got %v, want ErrHandshakeTimeout", err)
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+
+	// The server reads the hello and never answers
+	go io.Copy(io.Discard, s)
+
+	_, err := NewClientConn(c, &ClientConfig{Hostname: "test", HostKeyCallback: acceptAnyHost, HandshakeTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("got %v, want ErrHandshakeTimeout", err)
+	}
+}
+
+func TestHandshakeMAC(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := serveHandshake(&tamperConn{Conn: s}, testServerConfig(t))
+
+	_, err := NewClientConn(c, &ClientConfig{Hostname: "test", HostKeyCallback: acceptAnyHost})
+	if !errors.Is(err, ErrHandshakeMAC) {
+		t.Fatalf("got %v, want ErrHandshakeMAC", err)
+	}
+
+	<-done
+}
+
+func TestHandshakeUnknownHost(t *testing.T) {
+	// An empty known_hosts
+	t.Setenv("HOME", t.TempDir())
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := serveHandshake(s, testServerConfig(t))
+
+	_, err := NewClientConn(c, &ClientConfig{Hostname: "test"})
+	if !errors.Is(err, ErrUnknownHost) {
+		t.Fatalf("got %v, want ErrUnknownHost", err)
+	}
+
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.Step != clientCheckHostKey.String() {
+		t.Errorf("failed at %v, want %q", err, clientCheckHostKey.String())
+	}
+
+	<-done
+}
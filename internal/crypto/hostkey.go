@@ -0,0 +1,232 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+)
+
+// Server identity key algorithms. The algorithm is sent in the server hello
+// ahead of the key, so the client knows how to parse the key and check the
+// signature.
+const (
+	KeyRSA       byte = iota + 1 // RSA-PSS over a BLAKE2b-512 digest
+	KeyEd25519                   // Ed25519
+	KeyECDSAP256                 // ECDSA on P-256 over a SHA-256 digest
+)
+
+const rsaKeySize = 4096
+
+// Order clients ask for key algorithms in when they have no preference
+var DefaultKeyAlgorithms = []byte{KeyEd25519, KeyECDSAP256, KeyRSA}
+
+var (
+	ErrUnknownKeyAlgorithm = errors.New("unknown key algorithm")
+	ErrUnsupportedKey      = errors.New("unsupported key type")
+	ErrBadSignature        = errors.New("signature verification failed")
+)
+
+// Name used for the algorithm in known_hosts and config files
+func KeyAlgorithmName(alg byte) string {
+	switch alg {
+	case KeyRSA:
+		return "rsa"
+	case KeyEd25519:
+		return "ed25519"
+	case KeyECDSAP256:
+		return "ecdsa-p256"
+	}
+
+	return "unknown"
+}
+
+func ParseKeyAlgorithm(name string) (byte, error) {
+	for _, alg := range []byte{KeyRSA, KeyEd25519, KeyECDSAP256} {
+		if KeyAlgorithmName(alg) == name {
+			return alg, nil
+		}
+	}
+
+	return 0, ErrUnknownKeyAlgorithm
+}
+
+// Public half of a server identity key
+type PublicKey struct {
+	Algorithm byte
+	key       crypto.PublicKey
+}
+
+// Wraps a *rsa.PublicKey, ed25519.PublicKey or *ecdsa.PublicKey on P-256
+func NewPublicKey(key crypto.PublicKey) (PublicKey, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return PublicKey{KeyRSA, k}, nil
+	case ed25519.PublicKey:
+		return PublicKey{KeyEd25519, k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return PublicKey{}, ErrUnsupportedKey
+		}
+		return PublicKey{KeyECDSAP256, k}, nil
+	}
+
+	return PublicKey{}, ErrUnsupportedKey
+}
+
+// Parses a key as encoded by Marshal
+func ParsePublicKey(alg byte, b []byte) (PublicKey, error) {
+	switch alg {
+	case KeyRSA:
+		// PKCS1, as used before other algorithms were supported, so existing
+		// known_hosts entries still parse
+		key, err := x509.ParsePKCS1PublicKey(b)
+		if err != nil {
+			return PublicKey{}, err
+		}
+		return PublicKey{alg, key}, nil
+	case KeyEd25519, KeyECDSAP256:
+		key, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			return PublicKey{}, err
+		}
+
+		pub, err := NewPublicKey(key)
+		if err != nil {
+			return PublicKey{}, err
+		}
+
+		if pub.Algorithm != alg {
+			return PublicKey{}, ErrUnsupportedKey
+		}
+		return pub, nil
+	}
+
+	return PublicKey{}, ErrUnknownKeyAlgorithm
+}
+
+func (k PublicKey) Marshal() []byte {
+	if rsaKey, ok := k.key.(*rsa.PublicKey); ok {
+		return x509.MarshalPKCS1PublicKey(rsaKey)
+	}
+
+	// Only errors for key types NewPublicKey doesn't accept
+	b, _ := x509.MarshalPKIXPublicKey(k.key)
+	return b
+}
+
+func (k PublicKey) Equal(other PublicKey) bool {
+	if k.key == nil || other.key == nil {
+		return k.key == other.key
+	}
+
+	eq, ok := k.key.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Algorithm == other.Algorithm && eq.Equal(other.key)
+}
+
+func (k PublicKey) IsZero() bool {
+	return k.key == nil
+}
+
+// Checks sig is a signature over msg by the private half of k
+func (k PublicKey) Verify(msg, sig []byte) error {
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		opts := rsaSignOpts()
+		h := opts.HashFunc().New()
+		h.Write(msg)
+
+		err := rsa.VerifyPSS(key, opts.Hash, h.Sum(nil), sig, opts)
+		if err != nil {
+			return ErrBadSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, msg, sig) {
+			return ErrBadSignature
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		if !ecdsa.VerifyASN1(key, digest[:], sig) {
+			return ErrBadSignature
+		}
+	default:
+		return ErrUnsupportedKey
+	}
+
+	return nil
+}
+
+func rsaSignOpts() *rsa.PSSOptions {
+	return &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthAuto,
+		Hash:       crypto.BLAKE2b_512,
+	}
+}
+
+// Private half of a server identity key
+type PrivateKey struct {
+	signer crypto.Signer
+	public PublicKey
+}
+
+// Wraps a *rsa.PrivateKey, ed25519.PrivateKey or *ecdsa.PrivateKey on P-256
+func NewPrivateKey(signer crypto.Signer) (*PrivateKey, error) {
+	pub, err := NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrivateKey{signer, pub}, nil
+}
+
+func GenerateKey(alg byte) (*PrivateKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case KeyRSA:
+		signer, err = rsa.GenerateKey(rand.Reader, rsaKeySize)
+	case KeyEd25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case KeyECDSAP256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, ErrUnknownKeyAlgorithm
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPrivateKey(signer)
+}
+
+func (k *PrivateKey) Public() PublicKey {
+	return k.public
+}
+
+// Returns the wrapped standard library key, for storing it
+func (k *PrivateKey) Signer() crypto.Signer {
+	return k.signer
+}
+
+func (k *PrivateKey) Sign(msg []byte) ([]byte, error) {
+	switch k.public.Algorithm {
+	case KeyRSA:
+		opts := rsaSignOpts()
+		h := opts.HashFunc().New()
+		h.Write(msg)
+		return k.signer.Sign(rand.Reader, h.Sum(nil), opts)
+	case KeyEd25519:
+		return k.signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	case KeyECDSAP256:
+		digest := sha256.Sum256(msg)
+		return k.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+
+	return nil, ErrUnsupportedKey
+}
@@ -2,74 +2,473 @@ package crypto
 
 import (
 	"bufio"
-	"crypto/rsa"
-	"crypto/x509"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/Queueue0/qpass/internal/dbman"
 )
 
-func getKnownHosts() (map[string]*rsa.PublicKey, error) {
+// Entries in known_hosts are one per line, in the form
+//
+//	hostname algorithm key
+//
+// where hostname is the server address as configured by the user, algorithm
+// is the key algorithm's name and key is the server's base64 encoded public
+// key. Lines written before other algorithms were supported have no algorithm
+// field, and are RSA keys. Like OpenSSH, the hostname can
+// instead be stored hashed as |1|salt|hmac, so the file doesn't give away which
+// servers have been connected to.
+const hashedHostPrefix = "|1|"
+
+// A single known_hosts entry
+type KnownHost struct {
+	Host   string // Hostname, or the hashed form of it if Hashed is set
+	Hashed bool
+	Key    PublicKey
+	line   string // Original text, so entries we can't parse survive a rewrite
+}
+
+// Reports whether this entry is for hostname
+func (h KnownHost) Matches(hostname string) bool {
+	if h.Key.IsZero() {
+		return false
+	}
+
+	if !h.Hashed {
+		return h.Host == hostname
+	}
+
+	salt, sum, ok := parseHashedHost(h.Host)
+	if !ok {
+		return false
+	}
+
+	return hmac.Equal(sum, hashHost(hostname, salt))
+}
+
+func hashHost(hostname string, salt []byte) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(hostname))
+	return mac.Sum(nil)
+}
+
+func encodeHashedHost(hostname string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	sum := hashHost(hostname, salt)
+	return hashedHostPrefix + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(sum), nil
+}
+
+func parseHashedHost(host string) (salt, sum []byte, ok bool) {
+	saltStr, sumStr, ok := strings.Cut(strings.TrimPrefix(host, hashedHostPrefix), "|")
+	if !ok {
+		return nil, nil, false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(saltStr)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	sum, err = base64.StdEncoding.DecodeString(sumStr)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return salt, sum, true
+}
+
+func parseKnownHost(line string) (KnownHost, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return KnownHost{}, errors.New("missing key")
+	}
+
+	host, keyString := fields[0], fields[1]
+	alg := KeyRSA
+	if len(fields) > 2 {
+		var err error
+		alg, err = ParseKeyAlgorithm(fields[1])
+		if err != nil {
+			return KnownHost{}, err
+		}
+		keyString = fields[2]
+	}
+
+	hashed := strings.HasPrefix(host, hashedHostPrefix)
+	if hashed {
+		if _, _, ok := parseHashedHost(host); !ok {
+			return KnownHost{}, errors.New("invalid hashed hostname")
+		}
+	}
+
+	keyBytes, err := base64.RawStdEncoding.DecodeString(keyString)
+	if err != nil {
+		return KnownHost{}, err
+	}
+
+	key, err := ParsePublicKey(alg, keyBytes)
+	if err != nil {
+		return KnownHost{}, err
+	}
+
+	return KnownHost{Host: host, Hashed: hashed, Key: key, line: line}, nil
+}
+
+func (h KnownHost) String() string {
+	if h.Key.IsZero() {
+		return h.line
+	}
+
+	keyString := base64.RawStdEncoding.EncodeToString(h.Key.Marshal())
+	return fmt.Sprintf("%s %s %s", h.Host, KeyAlgorithmName(h.Key.Algorithm), keyString)
+}
+
+type knownHosts struct {
+	path    string
+	entries []KnownHost
+}
+
+func knownHostsPath() (string, error) {
 	home, err := dbman.GetQpassHome()
+	if err != nil {
+		return "", err
+	}
+
+	return home + "/known_hosts", nil
+}
+
+func loadKnownHosts() (*knownHosts, error) {
+	path, err := knownHostsPath()
 	if err != nil {
 		return nil, err
 	}
 
-	fName := home + "/known_hosts"
-	hostsFile, err := os.OpenFile(fName, os.O_RDONLY|os.O_CREATE, 0600)
+	hostsFile, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
 	}
 
 	defer hostsFile.Close()
 
-	hosts := make(map[string]*rsa.PublicKey)
+	kh := &knownHosts{path: path}
 
 	scanner := bufio.NewScanner(hostsFile)
+	lineNo := 0
 	for scanner.Scan() {
-		host, keyString, ok := strings.Cut(scanner.Text(), " ")
-		if !ok {
-			// Something went wrong, skip current line
+		lineNo++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
 
-		keyBytes, err := base64.RawStdEncoding.DecodeString(keyString)
+		entry, err := parseKnownHost(line)
 		if err != nil {
-			return nil, err
+			// One bad line shouldn't lock us out of every other server
+			log.Printf("%s:%d: skipping malformed entry: %s", path, lineNo, err.Error())
+			entry = KnownHost{line: line}
+		}
+
+		kh.entries = append(kh.entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return kh, nil
+}
+
+// Writes the whole file out again. Goes via a temporary file so a failed
+// write can't leave known_hosts half written.
+func (kh *knownHosts) save() error {
+	tmp := kh.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, entry := range kh.entries {
+		fmt.Fprintln(w, entry.String())
+	}
+
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, kh.path)
+}
+
+func (kh *knownHosts) lookup(hostname string) (PublicKey, bool) {
+	for _, entry := range kh.entries {
+		if entry.Matches(hostname) {
+			return entry.Key, true
+		}
+	}
+
+	return PublicKey{}, false
+}
+
+// Removes entries for host, which may be a hostname or the hashed form of one
+// as found in KnownHost.Host. Returns whether anything was removed.
+func (kh *knownHosts) remove(host string) bool {
+	removed := false
+	kept := kh.entries[:0]
+	for _, entry := range kh.entries {
+		if !entry.Key.IsZero() && (entry.Host == host || entry.Matches(host)) {
+			removed = true
+			continue
 		}
+		kept = append(kept, entry)
+	}
+	kh.entries = kept
 
-		key, err := x509.ParsePKCS1PublicKey(keyBytes)
+	return removed
+}
+
+func (kh *knownHosts) add(hostname string, key PublicKey, hashed bool) error {
+	entry := KnownHost{Host: hostname, Hashed: hashed, Key: key}
+	if hashed {
+		var err error
+		entry.Host, err = encodeHashedHost(hostname)
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+
+	kh.entries = append(kh.entries, entry)
+	return nil
+}
+
+// Records the key known for from under to as well, unless to already has an
+// entry. The new entry is hashed if the one it's copied from is. Returns
+// whether anything was added.
+func (kh *knownHosts) carryOver(from, to string) (bool, error) {
+	if _, ok := kh.lookup(to); ok {
+		return false, nil
+	}
+
+	for _, entry := range kh.entries {
+		if entry.Matches(from) {
+			return true, kh.add(to, entry.Key, entry.Hashed)
 		}
+	}
 
-		hosts[host] = key
+	return false, nil
+}
+
+// Returns every valid entry in known_hosts
+func ListKnownHosts() ([]KnownHost, error) {
+	kh, err := loadKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []KnownHost{}
+	for _, entry := range kh.entries {
+		if !entry.Key.IsZero() {
+			hosts = append(hosts, entry)
+		}
 	}
 
 	return hosts, nil
 }
 
-func addHost(addr string, key *rsa.PublicKey) error {
-	home, err := dbman.GetQpassHome()
+// Returns the key recorded for hostname, if there is one
+func LookupKnownHost(hostname string) (PublicKey, bool, error) {
+	kh, err := loadKnownHosts()
+	if err != nil {
+		return PublicKey{}, false, err
+	}
+
+	key, ok := kh.lookup(hostname)
+	return key, ok, nil
+}
+
+// Records key for hostname. If hashed is set, the hostname is stored hashed.
+func AddKnownHost(hostname string, key PublicKey, hashed bool) error {
+	kh, err := loadKnownHosts()
 	if err != nil {
 		return err
 	}
 
-	fName := home + "/known_hosts"
-	f, err := os.OpenFile(fName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	err = kh.add(hostname, key, hashed)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	return kh.save()
+}
 
-	keyBytes := x509.MarshalPKCS1PublicKey(key)
-	keyString := base64.RawStdEncoding.EncodeToString(keyBytes)
+// Keys recorded before a server's name could be configured are under its
+// address. Records the key known for addr under hostname too, so the server
+// isn't taken for an unknown one the first time it's dialled by name.
+func carryOverKnownHost(addr, hostname string) error {
+	kh, err := loadKnownHosts()
+	if err != nil {
+		return err
+	}
 
-	f.WriteString(fmt.Sprintf("%s %s\n", addr, keyString))
+	added, err := kh.carryOver(addr, hostname)
+	if err != nil || !added {
+		return err
+	}
 
-	return nil
+	return kh.save()
+}
+
+// Removes every entry for host. host can be a hostname, or KnownHost.Host for
+// removing a hashed entry as listed by ListKnownHosts.
+func RemoveKnownHost(host string) error {
+	kh, err := loadKnownHosts()
+	if err != nil {
+		return err
+	}
+
+	if !kh.remove(host) {
+		return nil
+	}
+
+	return kh.save()
+}
+
+// Replaces whatever is recorded for hostname with key. The new entry is
+// hashed if hashed is set or the entry it replaces was hashed.
+func ReplaceKnownHost(hostname string, key PublicKey, hashed bool) error {
+	kh, err := loadKnownHosts()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range kh.entries {
+		if entry.Hashed && entry.Matches(hostname) {
+			hashed = true
+		}
+	}
+
+	kh.remove(hostname)
+	err = kh.add(hostname, key, hashed)
+	if err != nil {
+		return err
+	}
+
+	return kh.save()
+}
+
+var (
+	ErrUnknownHost     = errors.New("Server is not in known_hosts")
+	ErrHostKeyRejected = errors.New("Server key was not trusted")
+)
+
+// Returned when a server presents a different key to the one recorded in
+// known_hosts. Either the server's key was replaced, or someone is
+// impersonating it.
+type HostKeyChangedError struct {
+	Hostname string
+	Old      string // Fingerprint of the key in known_hosts
+	New      string // Fingerprint of the key the server presented
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("Key does not match known key for %s (known %s, received %s)", e.Hostname, e.Old, e.New)
+}
+
+// Returns an ssh style SHA256 fingerprint of key, for showing to the user
+func Fingerprint(key PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return KeyAlgorithmName(key.Algorithm) + " SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Called by NewClientConn once the server has proven it holds the private half
+// of key. endorsedBy holds the retired keys that have validly signed over key
+// as their replacement. Returning an error aborts the handshake.
+type HostKeyCallback func(hostname string, key PublicKey, endorsedBy []PublicKey) error
+
+// Asks the user whether to trust a server that isn't in known_hosts yet.
+// Returns true if the key should be trusted.
+type HostKeyPrompt func(hostname, fingerprint string) bool
+
+// Returns a HostKeyCallback that accepts keys matching known_hosts, asks prompt
+// about hosts it hasn't seen before and only records them once the user
+// accepts. If prompt is nil, unknown hosts are rejected. A key endorsed by the
+// key in known_hosts replaces it. New entries are stored with hashed hostnames
+// if hashHostnames is set.
+func TrustOnFirstUse(prompt HostKeyPrompt, hashHostnames bool) HostKeyCallback {
+	return func(hostname string, key PublicKey, endorsedBy []PublicKey) error {
+		knownKey, ok, err := LookupKnownHost(hostname)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			if key.Equal(knownKey) {
+				return nil
+			}
+
+			// The server is rotating its key, and the key we know vouches
+			// for the new one
+			if slices.ContainsFunc(endorsedBy, knownKey.Equal) {
+				log.Printf("Server key for %s rotated to %s", hostname, Fingerprint(key))
+				return ReplaceKnownHost(hostname, key, hashHostnames)
+			}
+
+			return &HostKeyChangedError{hostname, Fingerprint(knownKey), Fingerprint(key)}
+		}
+
+		if prompt == nil {
+			return ErrUnknownHost
+		}
+
+		if !prompt(hostname, Fingerprint(key)) {
+			return ErrHostKeyRejected
+		}
+
+		return AddKnownHost(hostname, key, hashHostnames)
+	}
+}
+
+// Returns a HostKeyPrompt for command line tools. It asks the same question
+// as ssh on out and reads the answer from in.
+func TerminalPrompt(in io.Reader, out io.Writer) HostKeyPrompt {
+	return func(hostname, fingerprint string) bool {
+		fmt.Fprintf(out, "The authenticity of host '%s' can't be established.\n", hostname)
+		fmt.Fprintf(out, "Server key fingerprint is %s.\n", fingerprint)
+
+		scanner := bufio.NewScanner(in)
+		for {
+			fmt.Fprint(out, "Are you sure you want to continue connecting (yes/no)? ")
+			if !scanner.Scan() {
+				return false
+			}
+
+			switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+			case "yes":
+				return true
+			case "no":
+				return false
+			}
+		}
+	}
 }
@@ -0,0 +1,210 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Points known_hosts at a new file holding lines, and returns its path
+func testKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	path, err := knownHostsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func testPublicKey(t *testing.T, alg byte) PublicKey {
+	t.Helper()
+	key, err := GenerateKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key.Public()
+}
+
+// Looks hostname up, failing unless it's recorded with want
+func wantKnownHost(t *testing.T, hostname string, want PublicKey) {
+	t.Helper()
+	got, ok, err := LookupKnownHost(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !got.Equal(want) {
+		t.Fatalf("%s: got %v, %v, want the recorded key", hostname, got, ok)
+	}
+}
+
+func wantUnknownHost(t *testing.T, hostname string) {
+	t.Helper()
+	_, ok, err := LookupKnownHost(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatalf("%s found, want it unknown", hostname)
+	}
+}
+
+func TestHashedKnownHost(t *testing.T) {
+	path := testKnownHosts(t)
+	key := testPublicKey(t, KeyEd25519)
+
+	err := AddKnownHost("qpass.example:4000", key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "qpass.example") || !strings.HasPrefix(string(b), hashedHostPrefix) {
+		t.Fatalf("hostname stored as %q", b)
+	}
+
+	wantKnownHost(t, "qpass.example:4000", key)
+	wantUnknownHost(t, "qpass.example:4001")
+}
+
+func TestMalformedKnownHosts(t *testing.T) {
+	key := testPublicKey(t, KeyEd25519)
+	valid := KnownHost{Host: "good", Key: key}.String()
+	malformed := []string{
+		"nokey",
+		"bad ed25519 !!!",
+		"bad unknown-algorithm AAAA",
+		"|1|nosum " + strings.Fields(valid)[1] + " " + strings.Fields(valid)[2],
+	}
+	path := testKnownHosts(t, append(malformed, valid)...)
+
+	wantKnownHost(t, "good", key)
+	wantUnknownHost(t, "bad")
+
+	// Lines we can't read survive the file being rewritten
+	err := AddKnownHost("new", key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range malformed {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("%q dropped on rewrite", line)
+		}
+	}
+	wantKnownHost(t, "good", key)
+	wantKnownHost(t, "new", key)
+}
+
+func TestLegacyKnownHost(t *testing.T) {
+	key := testPublicKey(t, KeyRSA)
+	testKnownHosts(t, "legacy "+base64.RawStdEncoding.EncodeToString(key.Marshal()))
+
+	wantKnownHost(t, "legacy", key)
+
+	hosts, err := ListKnownHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Key.Algorithm != KeyRSA {
+		t.Fatalf("got %v, want one RSA key", hosts)
+	}
+}
+
+func TestReplaceAndRemoveKnownHost(t *testing.T) {
+	testKnownHosts(t)
+	old, replacement := testPublicKey(t, KeyEd25519), testPublicKey(t, KeyECDSAP256)
+
+	for _, hashed := range []bool{false, true} {
+		err := AddKnownHost("server", old, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = AddKnownHost("other", old, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A hashed entry stays hashed, whatever the caller asked for
+		err = ReplaceKnownHost("server", replacement, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantKnownHost(t, "server", replacement)
+		wantKnownHost(t, "other", old)
+
+		hosts, err := ListKnownHosts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 2 {
+			t.Fatalf("got %d entries after replacing, want 2", len(hosts))
+		}
+		for _, h := range hosts {
+			if h.Hashed != hashed {
+				t.Errorf("entry hashed %v, want %v", h.Hashed, hashed)
+			}
+		}
+
+		// By name, or by the host as listed
+		err = RemoveKnownHost("server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantUnknownHost(t, "server")
+
+		hosts, err = ListKnownHosts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 1 {
+			t.Fatalf("got %d entries after removing, want 1", len(hosts))
+		}
+		err = RemoveKnownHost(hosts[0].Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantUnknownHost(t, "other")
+	}
+}
+
+func TestKnownHostUnderAddress(t *testing.T) {
+	conf := testServerConfig(t)
+	key := conf.HostKeys[0].Public()
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// Recorded before the server's name could be configured
+	testKnownHosts(t, KnownHost{Host: c.RemoteAddr().String(), Key: key}.String())
+	done := serveHandshake(s, conf)
+
+	_, err := NewClientConn(c, &ClientConfig{Hostname: "qpass.example:4000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	wantKnownHost(t, "qpass.example:4000", key)
+	wantKnownHost(t, c.RemoteAddr().String(), key)
+}
@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The keys derived from a user's master password use Argon2id, with
+// parameters that are recorded alongside the user so they can be raised over
+// time. Parameters are written as
+//
+//	argon2id:m=65536,t=10,p=2
+//
+// with the memory in KiB. Users created before parameters were recorded use
+// LegacyKDFParams.
+const KDFArgon2id = "argon2id"
+
+type KDFParams struct {
+	Algorithm string
+	Time      uint32
+	Memory    uint32 // KiB
+	Threads   uint8
+}
+
+var (
+	// Parameters every key was derived with before they were recorded
+	LegacyKDFParams = KDFParams{KDFArgon2id, 10, 64 * 1024, 2}
+	// Parameters for new users, and what older parameters are upgraded to
+	DefaultKDFParams = KDFParams{KDFArgon2id, 3, 256 * 1024, 4}
+
+	// Parameters the server hashed auth tokens with before they were
+	// recorded
+	LegacyServerKDFParams = KDFParams{KDFArgon2id, 30, 64 * 1024, 2}
+	// Parameters the server hashes new auth tokens with
+	DefaultServerKDFParams = LegacyServerKDFParams
+)
+
+// Bounds on parameters we'll accept from elsewhere, such as the sync server,
+// so a bad record can't make us use gigabytes of memory
+const (
+	maxKDFTime   = 64
+	maxKDFMemory = 2 * 1024 * 1024
+)
+
+var (
+	ErrInvalidKDFParams = errors.New("Invalid key derivation parameters")
+	ErrWeakKDFParams    = errors.New("Key derivation parameters are too weak")
+)
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("%s:m=%d,t=%d,p=%d", p.Algorithm, p.Memory, p.Time, p.Threads)
+}
+
+func (p KDFParams) IsZero() bool {
+	return p == KDFParams{}
+}
+
+func ParseKDFParams(s string) (KDFParams, error) {
+	p := KDFParams{Algorithm: KDFArgon2id}
+	_, err := fmt.Sscanf(s, KDFArgon2id+":m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return KDFParams{}, ErrInvalidKDFParams
+	}
+
+	// Catches anything left over after the last field
+	if p.String() != s {
+		return KDFParams{}, ErrInvalidKDFParams
+	}
+
+	err = p.Validate()
+	if err != nil {
+		return KDFParams{}, err
+	}
+
+	return p, nil
+}
+
+func (p KDFParams) Validate() error {
+	if p.Algorithm != KDFArgon2id {
+		return ErrInvalidKDFParams
+	}
+
+	if p.Time < 1 || p.Time > maxKDFTime || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory {
+		return ErrInvalidKDFParams
+	}
+
+	return nil
+}
+
+// Validates parameters we were handed by someone else, such as the sync
+// server. Those aren't authenticated, so on top of the upper bounds, anything
+// weaker than LegacyKDFParams is refused: no key was ever derived with less,
+// and a token derived with less would make the master password cheap to guess.
+func (p KDFParams) ValidateRemote() error {
+	err := p.Validate()
+	if err != nil {
+		return err
+	}
+
+	if p.weakerThan(LegacyKDFParams) || p.Memory < LegacyKDFParams.Memory {
+		return ErrWeakKDFParams
+	}
+
+	return nil
+}
+
+// Reports whether p is weaker than DefaultKDFParams, and keys derived with it
+// should be derived again
+func (p KDFParams) NeedsUpgrade() bool {
+	return p.weakerThan(DefaultKDFParams)
+}
+
+func (p KDFParams) weakerThan(other KDFParams) bool {
+	if p.Algorithm != other.Algorithm {
+		return true
+	}
+
+	return uint64(p.Memory)*uint64(p.Time) < uint64(other.Memory)*uint64(other.Time)
+}
+
+func (p KDFParams) derive(secret, salt []byte) ([]byte, error) {
+	err := p.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return argon2.IDKey(secret, salt, p.Time, p.Memory, p.Threads, 32), nil
+}
@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateRemoteKDFParams(t *testing.T) {
+	tests := []struct {
+		params KDFParams
+		err    error
+	}{
+		{LegacyKDFParams, nil},
+		{DefaultKDFParams, nil},
+		{KDFParams{KDFArgon2id, 1, 8, 1}, ErrWeakKDFParams},
+		{KDFParams{KDFArgon2id, 9, 64 * 1024, 2}, ErrWeakKDFParams},
+		// As much work as the legacy parameters, with less memory
+		{KDFParams{KDFArgon2id, 40, 16 * 1024, 2}, ErrWeakKDFParams},
+		{KDFParams{KDFArgon2id, maxKDFTime + 1, 64 * 1024, 2}, ErrInvalidKDFParams},
+		{KDFParams{"scrypt", 10, 64 * 1024, 2}, ErrInvalidKDFParams},
+	}
+
+	for _, tt := range tests {
+		err := tt.params.ValidateRemote()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: got %v, want %v", tt.params, err, tt.err)
+		}
+	}
+}
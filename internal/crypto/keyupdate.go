@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"errors"
+
+	chacha "golang.org/x/crypto/chacha20poly1305"
+)
+
+// When both sides support it, each side replaces the key it sends with once
+// it has sent enough data under it, much like KeyUpdate in TLS 1.3. The sender
+// announces the change in a key update record, sealed under the old key, and
+// every record after it is sealed under the next key, starting again from
+// sequence number 0. The next key is derived from the current one, which is
+// then erased, so a key that leaks later doesn't expose earlier traffic.
+//
+// A key update record can also ask the peer to update its own key, which it
+// does before it next writes.
+const keyUpdateLabel = "qpass key update"
+
+const (
+	keyUpdateNotRequested byte = iota
+	keyUpdateRequested
+)
+
+const (
+	// Plaintext bytes sent under one key before it's replaced, by default
+	DefaultKeyUpdateBytes = 1 << 30
+	// Records sent under one key before it's replaced, by default
+	DefaultKeyUpdateRecords = 1 << 24
+)
+
+var ErrKeyUpdateDisabled = errors.New("Peer doesn't support key updates")
+
+// Returns the limit to use for a configured limit of n. Zero means the
+// default, and a negative limit means the key is only replaced on demand,
+// which is returned as 0.
+func keyUpdateLimit(n, def int64) uint64 {
+	switch {
+	case n == 0:
+		return uint64(def)
+	case n < 0:
+		return 0
+	}
+
+	return uint64(n)
+}
+
+func (s *secureConn) setKeyUpdateLimits(bytes, records int64) {
+	s.keyUpdateBytes = keyUpdateLimit(bytes, DefaultKeyUpdateBytes)
+	s.keyUpdateRecords = keyUpdateLimit(records, DefaultKeyUpdateRecords)
+}
+
+// Moves h to the next key and erases the current one
+func (h *halfConn) update() error {
+	next, err := hkdf.Expand(newBlake2b, h.key, keyUpdateLabel, chacha.KeySize)
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha.New(next)
+	if err != nil {
+		return err
+	}
+
+	clear(h.key)
+	h.key = next
+	h.aead = aead
+	h.seq = 0
+	h.bytes = 0
+	return nil
+}
+
+// Replaces the key we send with, and asks the peer to replace theirs too if
+// requestPeer is set. Write does this itself once a limit is reached, but it
+// can be called at any time, even while another goroutine is writing.
+func (s *secureConn) UpdateKey(requestPeer bool) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.updateKey(requestPeer)
+}
+
+// UpdateKey for callers already holding writeMu
+func (s *secureConn) updateKey(requestPeer bool) error {
+	if !s.caps.Has(CapKeyUpdate) {
+		return ErrKeyUpdateDisabled
+	}
+
+	request := keyUpdateNotRequested
+	if requestPeer {
+		request = keyUpdateRequested
+	}
+
+	err := s.writeRecord(recordKeyUpdate, []byte{request})
+	if err != nil {
+		return err
+	}
+
+	s.updateRequested.Store(false)
+	return s.out.update()
+}
+
+// Updates our key before the next record if the peer asked us to, or if the
+// next record would take it over a limit
+func (s *secureConn) maybeUpdateKey(next int) error {
+	if !s.caps.Has(CapKeyUpdate) {
+		return nil
+	}
+
+	due := s.updateRequested.Load()
+	if s.keyUpdateBytes > 0 && s.out.bytes+uint64(next) > s.keyUpdateBytes {
+		due = true
+	}
+	if s.keyUpdateRecords > 0 && s.out.seq >= s.keyUpdateRecords {
+		due = true
+	}
+
+	if !due {
+		return nil
+	}
+
+	return s.updateKey(false)
+}
+
+// Handles a key update record from the peer. Every record after it is opened
+// with the peer's next key.
+func (s *secureConn) readKeyUpdate(d []byte) error {
+	if !s.caps.Has(CapKeyUpdate) || len(d) != 1 || d[0] > keyUpdateRequested {
+		return ErrInvalidRecordType
+	}
+
+	if d[0] == keyUpdateRequested {
+		s.updateRequested.Store(true)
+	}
+
+	return s.in.update()
+}
@@ -0,0 +1,218 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	chacha "golang.org/x/crypto/chacha20poly1305"
+)
+
+// Returns both ends of a recordPipe with key updates negotiated
+func keyUpdatePipe(t *testing.T) (client, server *secureConn) {
+	t.Helper()
+	client, server = recordPipe(t)
+	client.caps = CapKeyUpdate
+	server.caps = CapKeyUpdate
+	return client, server
+}
+
+// Runs f on its own while to reads the message written after it
+func updateThenRoundTrip(t *testing.T, from, to *secureConn, f func() error, msg []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		err := f()
+		if err == nil {
+			_, err = from.Write(msg)
+		}
+		errc <- err
+	}()
+
+	got, err := to.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	client, server := keyUpdatePipe(t)
+	roundTrip(t, client, server, []byte("before"))
+
+	old := slices.Clone(client.out.key)
+	want, err := hkdf.Expand(newBlake2b, old, keyUpdateLabel, chacha.KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("after")
+	updateThenRoundTrip(t, client, server, func() error { return client.UpdateKey(false) }, msg)
+
+	if !bytes.Equal(client.out.key, want) {
+		t.Fatalf("got key %x, want %x", client.out.key, want)
+	}
+	if !bytes.Equal(server.in.key, want) {
+		t.Fatalf("server opens with %x, want %x", server.in.key, want)
+	}
+	// Only the message has been sealed under the new key
+	if client.out.seq != 1 || client.out.bytes != uint64(len(msg)) {
+		t.Fatalf("got seq %d and %d bytes, want 1 and %d", client.out.seq, client.out.bytes, len(msg))
+	}
+	if server.in.seq != 1 {
+		t.Fatalf("server expects seq %d, want 1", server.in.seq)
+	}
+}
+
+func TestKeyUpdateLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		bytes, records uint64
+		sizes          []int // Sizes of the messages sent
+		updatedAt      int   // Index of the first message sent under a new key
+	}{
+		{"bytes", 100, 0, []int{60, 40, 1}, 2},
+		{"records", 0, 3, []int{1, 1, 1, 1}, 3},
+		{"multi-record message", 0, 3, []int{1, 2*maxRecordPlaintext + 1}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := keyUpdatePipe(t)
+			client.keyUpdateBytes = tt.bytes
+			client.keyUpdateRecords = tt.records
+
+			key := slices.Clone(client.out.key)
+			for i, size := range tt.sizes {
+				roundTrip(t, client, server, bytes.Repeat([]byte{'a'}, size))
+
+				updated := !bytes.Equal(client.out.key, key)
+				if updated != (i >= tt.updatedAt) {
+					t.Fatalf("after message %d: key updated %v, want %v", i, updated, i >= tt.updatedAt)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerRequestedKeyUpdate(t *testing.T) {
+	client, server := keyUpdatePipe(t)
+
+	updateThenRoundTrip(t, client, server, func() error { return client.UpdateKey(true) }, []byte("update yours"))
+	if !server.updateRequested.Load() {
+		t.Fatal("request not recorded")
+	}
+
+	old := slices.Clone(server.out.key)
+	roundTrip(t, server, client, []byte("done"))
+
+	if bytes.Equal(server.out.key, old) {
+		t.Fatal("server didn't update its key before writing")
+	}
+	if server.updateRequested.Load() {
+		t.Fatal("request still outstanding after the update")
+	}
+
+	// Updating doesn't ask the client to update again
+	if client.updateRequested.Load() {
+		t.Fatal("client asked to update in return")
+	}
+}
+
+func TestKeyUpdateDisabled(t *testing.T) {
+	client, _ := recordPipe(t)
+
+	err := client.UpdateKey(false)
+	if !errors.Is(err, ErrKeyUpdateDisabled) {
+		t.Fatalf("got %v, want ErrKeyUpdateDisabled", err)
+	}
+
+	// Limits are ignored when the peer can't follow
+	client.keyUpdateRecords = 1
+	client.out.seq = 1
+	err = client.maybeUpdateKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, c, out := rawRecordPipe(t)
+	go c.Write(sealRecord(out, recordKeyUpdate, []byte{keyUpdateNotRequested}))
+	_, err = server.readMessage()
+	if !errors.Is(err, ErrInvalidRecordType) {
+		t.Fatalf("unexpected key update: got %v, want ErrInvalidRecordType", err)
+	}
+}
+
+func TestUpdateKeyDuringWrite(t *testing.T) {
+	client, server := keyUpdatePipe(t)
+
+	const writes = 50
+	msg := bytes.Repeat([]byte{'a'}, maxRecordPlaintext+1)
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 2*writes)
+	for range writes {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := client.Write(msg)
+			errc <- err
+		}()
+		go func() {
+			defer wg.Done()
+			errc <- client.UpdateKey(false)
+		}()
+	}
+
+	// Key updates can be the last thing written, so the server keeps reading
+	// until a final message
+	end := []byte("end")
+	readc := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			got, err := server.readMessage()
+			if err != nil {
+				readc <- err
+				return
+			}
+			if bytes.Equal(got, end) && i == writes {
+				readc <- nil
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				readc <- fmt.Errorf("message %d: got %d bytes back, want %d", i, len(got), len(msg))
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	_, err := client.Write(end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-readc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// The Noise transport replaces the qpass handshake with the XX pattern from
+// the Noise Protocol Framework, and keeps the qpass record layer for the
+// traffic that follows. The client starts by sending the protocol name, which
+// is also the Noise prologue, so the server can tell it apart from the other
+// transports by its first byte, 'N'. After that, each handshake message is
+// prefixed by its length as a uint16.
+//
+//	-> e                 payload: min version | max version | algorithm count | algorithms
+//	<- e, ee, s, es      payload: status | version | host key | endorsement count |
+//	                              (length | endorsement)... | signature length | signature |
+//	                              capabilities
+//	-> s, se             payload: capabilities | device proof, or nothing
+//
+// The capabilities are only sent from version 6 on, as a uint32 each. The
+// server sends the ones it supports, and the client the ones both sides do.
+//
+// Both sides use a fresh Noise static key for every connection, and bind it
+// to their long term key with a signature over the static key and the other
+// side's ephemeral key. The server signs with its host key, which the client
+// checks against known_hosts just as it does over the other transports. The
+// client signs with its device key, if it has one. Both signatures are sent
+// encrypted, so neither key is visible to passive observers, and the client's
+// isn't visible to anyone but the server it has already authenticated.
+//
+// If the server can't agree on a version, its payload is just the rejected
+// status followed by the versions it speaks, and it hangs up. Everything in
+// the payloads is covered by the Noise handshake hash, so none of it can be
+// tampered with. Session tickets aren't supported over this transport, and key
+// updates always are.
+var noiseProtocolName = []byte("Noise_XX_25519_ChaChaPoly_BLAKE2b")
+
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b)
+
+const noiseStaticContext = "qpass noise static key"
+
+var (
+	ErrNoiseMessageTooLarge = errors.New("Noise handshake message exceeds maximum size")
+	ErrInvalidNoisePayload  = errors.New("invalid Noise handshake payload")
+)
+
+// What each side signs to bind its Noise static key to its long term key
+func noiseStaticSigned(static, peerEphemeral []byte) []byte {
+	return slices.Concat([]byte(noiseStaticContext), static, peerEphemeral)
+}
+
+func noiseConfig(initiator bool, static noise.DHKey) noise.Config {
+	return noise.Config{
+		CipherSuite:   noiseSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      noiseProtocolName,
+		StaticKeypair: static,
+	}
+}
+
+func newNoiseHandshake(initiator bool) (*noise.HandshakeState, noise.DHKey, error) {
+	static, err := noiseSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return nil, noise.DHKey{}, err
+	}
+
+	hs, err := noise.NewHandshakeState(noiseConfig(initiator, static))
+	if err != nil {
+		return nil, noise.DHKey{}, err
+	}
+
+	return hs, static, nil
+}
+
+// Writes the next handshake message, prefixed by its length, after prefix.
+// The cipher states are only returned by the last message.
+func writeNoiseMessage(c net.Conn, hs *noise.HandshakeState, prefix, payload []byte) (*noise.CipherState, *noise.CipherState, error) {
+	msg, cs1, cs2, err := hs.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(msg) > noise.MaxMsgLen {
+		return nil, nil, ErrNoiseMessageTooLarge
+	}
+
+	_, err = c.Write(slices.Concat(prefix, binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cs1, cs2, nil
+}
+
+func readNoiseMessage(c net.Conn, hs *noise.HandshakeState) ([]byte, *noise.CipherState, *noise.CipherState, error) {
+	msgLen, err := readField(c, 2)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	msg, err := readField(c, int(binary.BigEndian.Uint16(msgLen)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return hs.ReadMessage(nil, msg)
+}
+
+// Returns the keys that validly endorse key, out of an encoded endorsement
+// list, and whatever follows the list
+func cutEndorsementList(b []byte, key PublicKey) ([]PublicKey, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, ErrInvalidNoisePayload
+	}
+
+	count := b[0]
+	rest := b[1:]
+	endorsedBy := []PublicKey{}
+	for range count {
+		var eBytes []byte
+		var ok bool
+		eBytes, rest, ok = cutField(rest)
+		if !ok {
+			return nil, nil, ErrInvalidNoisePayload
+		}
+
+		// As over the qpass transport, endorsements that don't check out
+		// are ignored
+		e, err := ParseEndorsement(eBytes)
+		if err != nil || !e.NewKey.Equal(key) || e.Verify(time.Now()) != nil {
+			continue
+		}
+		endorsedBy = append(endorsedBy, e.OldKey)
+	}
+
+	return endorsedBy, rest, nil
+}
+
+type noiseClientHandshake struct {
+	c     net.Conn
+	conf  *ClientConfig
+	state handshakeState
+
+	hostname   string
+	hs         *noise.HandshakeState
+	static     noise.DHKey
+	algs       []byte
+	version    byte
+	caps       Capabilities
+	hostKey    PublicKey
+	endorsedBy []PublicKey
+
+	conn *secureConn
+}
+
+func NewNoiseClientConn(c net.Conn, conf *ClientConfig) (*secureConn, error) {
+	if conf == nil {
+		conf = &ClientConfig{}
+	}
+
+	h := &noiseClientHandshake{
+		c:        c,
+		conf:     conf,
+		state:    clientSendHello,
+		hostname: conf.knownHostname(c),
+	}
+
+	err := h.run()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return h.conn, nil
+}
+
+func (h *noiseClientHandshake) run() error {
+	err := h.c.SetDeadline(handshakeDeadline(h.conf.HandshakeTimeout))
+	if err != nil {
+		return handshakeError(h.state, err)
+	}
+
+	for h.state != handshakeDone {
+		switch h.state {
+		case clientSendHello:
+			err = h.sendHello()
+		case clientReadHostKey:
+			err = h.readHostKey()
+		case clientCheckHostKey:
+			err = h.checkHostKey()
+		case clientFinishNoise:
+			err = h.finish()
+		default:
+			err = errors.New("invalid handshake state")
+		}
+
+		if err != nil {
+			return handshakeError(h.state, err)
+		}
+	}
+
+	h.conn.idleTimeout = h.conf.IdleTimeout
+	h.conn.setKeyUpdateLimits(h.conf.KeyUpdateBytes, h.conf.KeyUpdateRecords)
+	return h.c.SetDeadline(time.Time{})
+}
+
+// Sends the protocol name, then our ephemeral key along with the protocol
+// versions we support and the host key algorithms we accept
+func (h *noiseClientHandshake) sendHello() error {
+	var err error
+	h.hs, h.static, err = newNoiseHandshake(true)
+	if err != nil {
+		return err
+	}
+
+	h.algs = h.conf.keyAlgorithms(h.hostname)
+	payload := slices.Concat([]byte{MinProtocolVersion, ProtocolVersion, byte(len(h.algs))}, h.algs)
+	_, _, err = writeNoiseMessage(h.c, h.hs, noiseProtocolName, payload)
+	if err != nil {
+		return err
+	}
+
+	h.state = clientReadHostKey
+	return nil
+}
+
+// Reads the server's choice of version, its host key, endorsements and
+// capabilities, and checks the host key's signature over the server's static
+// key
+func (h *noiseClientHandshake) readHostKey() error {
+	payload, _, _, err := readNoiseMessage(h.c, h.hs)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) < 3 {
+		return ErrInvalidNoisePayload
+	}
+
+	switch payload[0] {
+	case helloAccepted:
+	case helloRejected:
+		return &VersionMismatchError{MinProtocolVersion, ProtocolVersion, payload[1], payload[2]}
+	default:
+		return ErrInvalidNoisePayload
+	}
+
+	h.version = payload[1]
+	if h.version < MinProtocolVersion || h.version > ProtocolVersion {
+		return &VersionMismatchError{MinProtocolVersion, ProtocolVersion, h.version, h.version}
+	}
+
+	if !slices.Contains(h.algs, payload[2]) {
+		return ErrUnknownKeyAlgorithm
+	}
+
+	var rest []byte
+	h.hostKey, rest, err = cutKey(payload[2:])
+	if err != nil {
+		return err
+	}
+
+	h.endorsedBy, rest, err = cutEndorsementList(rest, h.hostKey)
+	if err != nil {
+		return err
+	}
+
+	sig, rest, ok := cutField(rest)
+	if !ok {
+		return ErrInvalidNoisePayload
+	}
+
+	h.caps = CapKeyUpdate
+	if h.version >= versionTransportCaps {
+		if len(rest) < 4 {
+			return ErrInvalidNoisePayload
+		}
+		h.caps = transportCaps(h.conf.Capabilities, Capabilities(binary.BigEndian.Uint32(rest)))
+		rest = rest[4:]
+	}
+
+	if len(rest) != 0 {
+		return ErrInvalidNoisePayload
+	}
+
+	err = h.hostKey.Verify(noiseStaticSigned(h.hs.PeerStatic(), h.hs.LocalEphemeral().Public), sig)
+	if err != nil {
+		return err
+	}
+
+	h.state = clientCheckHostKey
+	return nil
+}
+
+// The server holds the host private key, now check that it's a key we trust
+func (h *noiseClientHandshake) checkHostKey() error {
+	callback := TrustOnFirstUse(nil, false)
+	if h.conf.HostKeyCallback != nil {
+		callback = h.conf.HostKeyCallback
+	}
+
+	// The callback may be waiting on the user, which shouldn't count
+	// against the deadline
+	err := h.c.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	err = callback(h.hostname, h.hostKey, h.endorsedBy)
+	if err != nil {
+		return err
+	}
+
+	err = h.c.SetDeadline(handshakeDeadline(h.conf.HandshakeTimeout))
+	if err != nil {
+		return err
+	}
+
+	h.state = clientFinishNoise
+	return nil
+}
+
+// Sends our static key, with the capabilities we agreed on and our device
+// proof if we have a device key, and switches to the traffic keys
+func (h *noiseClientHandshake) finish() error {
+	var payload []byte
+	if h.version >= versionTransportCaps {
+		payload = h.caps.bytes()
+	}
+
+	if h.conf.DeviceKey != nil {
+		proof, err := newDeviceProof(h.conf.DeviceKey, noiseStaticSigned(h.static.Public, h.hs.PeerEphemeral()))
+		if err != nil {
+			return err
+		}
+		payload = append(payload, proof...)
+	}
+
+	c2s, s2c, err := writeNoiseMessage(h.c, h.hs, nil, payload)
+	if err != nil {
+		return err
+	}
+
+	inKey, outKey := s2c.UnsafeKey(), c2s.UnsafeKey()
+	h.conn, err = newSecureConn(h.c, h.version, h.caps, inKey[:], outKey[:])
+	if err != nil {
+		return err
+	}
+	h.conn.isClient = true
+	h.conn.hostname = h.hostname
+
+	h.state = handshakeDone
+	return nil
+}
+
+type noiseServerHandshake struct {
+	c     net.Conn
+	conf  *ServerConfig
+	state handshakeState
+
+	hs      *noise.HandshakeState
+	static  noise.DHKey
+	algs    []byte
+	version byte
+	caps    Capabilities
+
+	conn *secureConn
+}
+
+func NewNoiseServerConn(c net.Conn, conf *ServerConfig) (*secureConn, error) {
+	h := &noiseServerHandshake{
+		c:     c,
+		conf:  conf,
+		state: serverReadHello,
+	}
+
+	err := h.run()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return h.conn, nil
+}
+
+func (h *noiseServerHandshake) run() error {
+	err := h.c.SetDeadline(handshakeDeadline(h.conf.HandshakeTimeout))
+	if err != nil {
+		return handshakeError(h.state, err)
+	}
+
+	for h.state != handshakeDone {
+		switch h.state {
+		case serverReadHello:
+			err = h.readHello()
+		case serverSendHello:
+			err = h.sendHello()
+		case serverFinishNoise:
+			err = h.finish()
+		default:
+			err = errors.New("invalid handshake state")
+		}
+
+		if err != nil {
+			return handshakeError(h.state, err)
+		}
+	}
+
+	h.conn.idleTimeout = h.conf.IdleTimeout
+	h.conn.setKeyUpdateLimits(h.conf.KeyUpdateBytes, h.conf.KeyUpdateRecords)
+	return h.c.SetDeadline(time.Time{})
+}
+
+// Reads the protocol name and the client's first message
+func (h *noiseServerHandshake) readHello() error {
+	name, err := readField(h.c, len(noiseProtocolName))
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(name, noiseProtocolName) {
+		return ErrNotQpass
+	}
+
+	h.hs, h.static, err = newNoiseHandshake(false)
+	if err != nil {
+		return err
+	}
+
+	payload, _, _, err := readNoiseMessage(h.c, h.hs)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) < 3 || len(payload) != 3+int(payload[2]) {
+		return ErrInvalidNoisePayload
+	}
+
+	h.version, err = negotiateVersion(payload[0], payload[1])
+	if err != nil {
+		// Tell the client why before hanging up
+		writeNoiseMessage(h.c, h.hs, nil, []byte{helloRejected, MinProtocolVersion, ProtocolVersion})
+		return err
+	}
+
+	h.algs = payload[3:]
+	h.state = serverSendHello
+	return nil
+}
+
+// Sends our static key, along with our host key, its endorsements, a
+// signature binding the static key to it, and our capabilities
+func (h *noiseServerHandshake) sendHello() error {
+	hostKey, ok := h.conf.hostKey(h.algs)
+	if !ok {
+		return ErrNoCommonAlgorithm
+	}
+
+	hostPub := hostKey.Public()
+	endorsementBytes, err := h.conf.endorsementList(hostPub)
+	if err != nil {
+		return err
+	}
+
+	sig, err := hostKey.Sign(noiseStaticSigned(h.static.Public, h.hs.PeerEphemeral()))
+	if err != nil {
+		return err
+	}
+
+	payload := appendKey([]byte{helloAccepted, h.version}, hostPub)
+	payload = append(payload, endorsementBytes...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(sig)))
+	payload = append(payload, sig...)
+	if h.version >= versionTransportCaps {
+		payload = append(payload, h.conf.Capabilities.bytes()...)
+	}
+
+	_, _, err = writeNoiseMessage(h.c, h.hs, nil, payload)
+	if err != nil {
+		return err
+	}
+
+	h.state = serverFinishNoise
+	return nil
+}
+
+// Reads the client's static key, capabilities and device proof, asks
+// VerifyDevice whether to accept the device, and switches to the traffic keys
+func (h *noiseServerHandshake) finish() error {
+	proof, c2s, s2c, err := readNoiseMessage(h.c, h.hs)
+	if err != nil {
+		return err
+	}
+
+	h.caps = CapKeyUpdate
+	if h.version >= versionTransportCaps {
+		if len(proof) < 4 {
+			return ErrInvalidNoisePayload
+		}
+		// The client can't turn on features we didn't offer
+		h.caps = transportCaps(h.conf.Capabilities, Capabilities(binary.BigEndian.Uint32(proof)))
+		proof = proof[4:]
+	}
+
+	var device PublicKey
+	if h.conf.VerifyDevice != nil {
+		if len(proof) == 0 {
+			return ErrDeviceRequired
+		}
+
+		device, err = verifyDeviceProof(proof, noiseStaticSigned(h.hs.PeerStatic(), h.hs.LocalEphemeral().Public))
+		if err != nil {
+			return err
+		}
+
+		err = h.conf.VerifyDevice(device)
+		if err != nil {
+			return err
+		}
+	}
+
+	inKey, outKey := c2s.UnsafeKey(), s2c.UnsafeKey()
+	h.conn, err = newSecureConn(h.c, h.version, h.caps, inKey[:], outKey[:])
+	if err != nil {
+		return err
+	}
+	h.conn.peerDevice = device
+
+	h.state = handshakeDone
+	return nil
+}
+
+// Like Dial, but with the Noise handshake
+func DialNoise(addr string, conf *ClientConfig) (*secureConn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy so the caller's config isn't modified
+	dialConf := ClientConfig{}
+	if conf != nil {
+		dialConf = *conf
+	}
+
+	if dialConf.Hostname == "" {
+		dialConf.Hostname = addr
+	}
+
+	return NewNoiseClientConn(c, &dialConf)
+}
@@ -0,0 +1,160 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// Returns the key pair for a fixed private key
+func fixedKeypair(t *testing.T, private string) noise.DHKey {
+	t.Helper()
+	key, err := noiseSuite.GenerateKeypair(bytes.NewReader(fromHex(t, private)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// The Noise_XX_25519_ChaChaPoly_BLAKE2b vector with payloads from the
+// cacophony test vectors
+func TestNoiseVectors(t *testing.T) {
+	messages := []struct {
+		payload    string
+		ciphertext string
+	}{
+		{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254746573745f6d73675f30"},
+		{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466b0b018e349141e1b16c68fe9a6cb1183c260c44bb83c93a140953ad45612b8c6c9a7ce6964ece59add85b2606ced1d6d19d85b03583048e0c2c9a492b15d90479c7b9af68fb1a47696d5"},
+		{"746573745f6d73675f32", "b4c5f23f127237b5a80ac12f3a3548fe46c39172f6b180eb1e023e6e19e283eec8b71c2ce9c0e29ca1766034c2c8feb14cb940f335a08c03246384d70b9a8ae83fd96cea468098f1f8d9"},
+		{"79656c6c6f777375626d6172696e65", "adcafe99678efda6f3d8c84a8fd41a63bb2cfc85aa6eb8ff3dbf724496b03e"},
+		{"7375626d6172696e6579656c6c6f77", "51d5c55fb055dc171c4bf7618270e30b393601f44f3a0abd7c276b63093c1a"},
+	}
+
+	if string(noiseProtocolName) != "Noise_XX_25519_ChaChaPoly_BLAKE2b" {
+		t.Fatalf("vectors are for Noise_XX_25519_ChaChaPoly_BLAKE2b, not %s", noiseProtocolName)
+	}
+
+	// The vector has no prologue, and the ephemeral keys are generated from
+	// fixed random bytes
+	initConf := noiseConfig(true, fixedKeypair(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"))
+	initConf.Prologue = nil
+	initConf.Random = bytes.NewReader(fromHex(t, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"))
+	respConf := noiseConfig(false, fixedKeypair(t, "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20"))
+	respConf.Prologue = nil
+	respConf.Random = bytes.NewReader(fromHex(t, "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60"))
+
+	initiator, err := noise.NewHandshakeState(initConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := noise.NewHandshakeState(respConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cipher states of each side, sending first. Only the last
+	// handshake message, which the initiator writes, returns them.
+	var initCS, respCS [2]*noise.CipherState
+	for i, m := range messages {
+		payload := fromHex(t, m.payload)
+		want := fromHex(t, m.ciphertext)
+
+		var got, read []byte
+		switch {
+		case i < 3:
+			writer, reader := initiator, responder
+			if i%2 == 1 {
+				writer, reader = responder, initiator
+			}
+
+			var cs1, cs2 *noise.CipherState
+			got, cs1, cs2, err = writer.WriteMessage(nil, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			initCS = [2]*noise.CipherState{cs1, cs2}
+
+			read, cs1, cs2, err = reader.ReadMessage(nil, got)
+			if err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+			respCS = [2]*noise.CipherState{cs2, cs1}
+		default:
+			// Transport messages take turns again, starting with the
+			// initiator
+			writer, reader := initCS[0], respCS[1]
+			if i%2 == 0 {
+				writer, reader = respCS[0], initCS[1]
+			}
+
+			got, err = writer.Encrypt(nil, nil, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			read, err = reader.Decrypt(nil, nil, got)
+			if err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: got %x, want %x", i, got, want)
+		}
+		if !bytes.Equal(read, payload) {
+			t.Fatalf("message %d: read %x, want %x", i, read, payload)
+		}
+	}
+}
+
+func TestNoiseRoundTrip(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan handshakeResult, 1)
+	go func() {
+		conf := testServerConfig(t)
+		conf.Capabilities = testCapB | CapSessionTickets
+		conn, err := NewNoiseServerConn(s, conf)
+		done <- handshakeResult{conn, err}
+	}()
+
+	client, err := NewNoiseClientConn(c, &ClientConfig{Hostname: "test", HostKeyCallback: acceptAnyHost, Capabilities: testCapA | testCapB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	server := r.conn
+
+	if client.Version() != ProtocolVersion || server.Version() != ProtocolVersion {
+		t.Errorf("negotiated versions %d and %d, want %d", client.Version(), server.Version(), ProtocolVersion)
+	}
+
+	if want := testCapB | CapKeyUpdate; client.Capabilities() != want || server.Capabilities() != want {
+		t.Errorf("negotiated capabilities %b and %b, want %b", client.Capabilities(), server.Capabilities(), want)
+	}
+
+	for _, msg := range [][]byte{[]byte("hello over Noise"), randomBytes(t, 3*maxRecordPlaintext+1)} {
+		roundTrip(t, client, server, msg)
+		roundTrip(t, server, client, msg)
+	}
+}
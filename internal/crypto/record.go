@@ -0,0 +1,260 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	chacha "golang.org/x/crypto/chacha20poly1305"
+)
+
+// Every write to a secureConn is split into one or more records. Each record
+// is sealed on its own, so a large message never needs a length prefix wider
+// than the uint16 in the record header. All records of a message but the last
+// are marked as continuations, and the reader only hands data back once it has
+// seen the final record.
+//
+// Record layout:
+//
+//	type (1 byte) | length (2 bytes, big endian) | sealed chunk (length bytes)
+//
+// Each direction has its own key and its own record sequence number. The
+// sequence number is never sent: it is used as the nonce and, together with the
+// header, as additional data. A record that is replayed, dropped, reordered or
+// reflected back at its sender fails authentication, as does one that has been
+// re-marked as final or continuation.
+//
+// Ticket records carry a session ticket from the server rather than
+// application data, and are never part of a message. The device proof record
+// is the first record a client sends when device authentication is in use, and
+// is read as part of the handshake. Key update records can come between any
+// two records.
+const (
+	recordFinal byte = iota
+	recordContinuation
+	recordTicket
+	recordDeviceProof
+	recordKeyUpdate
+)
+
+const (
+	recordHeaderLen = 3
+	// Maximum plaintext bytes carried by a single record
+	maxRecordPlaintext = 16 * 1024
+	// Maximum size of the sealed chunk in a single record, tag included
+	maxRecordCiphertext = maxRecordPlaintext + chacha.Overhead
+	// Upper bound on a reassembled message, so a peer can't make us buffer
+	// continuation records forever
+	maxMessageSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrRecordTooLarge    = errors.New("record exceeds maximum size")
+	ErrMessageTooLarge   = errors.New("message exceeds maximum size")
+	ErrInvalidRecordType = errors.New("invalid record type")
+	ErrBadRecordMAC      = errors.New("record authentication failed")
+	ErrSequenceOverflow  = errors.New("record sequence number exhausted")
+)
+
+// One direction of a secureConn
+type halfConn struct {
+	aead  cipher.AEAD
+	key   []byte // Kept to derive the next key from
+	seq   uint64 // Sequence number of the next record
+	bytes uint64 // Plaintext bytes sealed under the current key
+}
+
+func newHalfConn(key []byte) (*halfConn, error) {
+	aead, err := chacha.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &halfConn{aead: aead, key: slices.Clone(key)}, nil
+}
+
+// Returns the nonce and additional data for the current record and advances
+// the sequence number
+func (h *halfConn) next(header []byte) (nonce, ad []byte, err error) {
+	if h.seq == math.MaxUint64 {
+		return nil, nil, ErrSequenceOverflow
+	}
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, h.seq)
+	h.seq++
+
+	nonce = make([]byte, h.aead.NonceSize())
+	copy(nonce[len(nonce)-len(seq):], seq)
+
+	return nonce, slices.Concat(seq, header), nil
+}
+
+func (h *halfConn) seal(plaintext, header []byte) ([]byte, error) {
+	nonce, ad, err := h.next(header)
+	if err != nil {
+		return nil, err
+	}
+
+	h.bytes += uint64(len(plaintext))
+	return h.aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (h *halfConn) open(ciphertext, header []byte) ([]byte, error) {
+	nonce, ad, err := h.next(header)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := h.aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrBadRecordMAC
+	}
+
+	return plaintext, nil
+}
+
+func recordHeader(recordType byte, length int) []byte {
+	header := make([]byte, recordHeaderLen)
+	header[0] = recordType
+	binary.BigEndian.PutUint16(header[1:], uint16(length))
+	return header
+}
+
+func (s *secureConn) writeRecord(recordType byte, chunk []byte) error {
+	header := recordHeader(recordType, len(chunk)+chacha.Overhead)
+	e, err := s.out.seal(chunk, header)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.c.Write(slices.Concat(header, e))
+	return err
+}
+
+// Splits b into records and writes them to the underlying connection.
+// Returns the number of plaintext bytes that were fully written.
+func (s *secureConn) writeRecords(b []byte) (int, error) {
+	n := 0
+	for {
+		chunk := b[n:]
+		recordType := recordFinal
+		if len(chunk) > maxRecordPlaintext {
+			chunk = chunk[:maxRecordPlaintext]
+			recordType = recordContinuation
+		}
+
+		err := s.maybeUpdateKey(len(chunk))
+		if err != nil {
+			return n, err
+		}
+
+		err = s.writeRecord(recordType, chunk)
+		if err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		if recordType == recordFinal {
+			return n, nil
+		}
+	}
+}
+
+// Gives the peer idleTimeout to send the next record, unless the caller has
+// set an earlier deadline
+func (s *secureConn) setIdleDeadline() error {
+	if s.idleTimeout <= 0 {
+		return nil
+	}
+
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+
+	deadline := time.Now().Add(s.idleTimeout)
+	if !s.readDeadline.IsZero() && s.readDeadline.Before(deadline) {
+		deadline = s.readDeadline
+	}
+
+	return s.c.SetReadDeadline(deadline)
+}
+
+// Reads and opens a single record
+func (s *secureConn) readRecord() (byte, []byte, error) {
+	err := s.setIdleDeadline()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	header := make([]byte, recordHeaderLen)
+	_, err = io.ReadFull(s.c, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[1:]))
+	if size > maxRecordCiphertext {
+		return 0, nil, ErrRecordTooLarge
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(s.c, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	d, err := s.in.open(buf, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], d, nil
+}
+
+// Reads records from the underlying connection until a final record arrives
+// and returns the reassembled plaintext.
+func (s *secureConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		recordType, d, err := s.readRecord()
+		if err != nil {
+			return nil, err
+		}
+
+		switch recordType {
+		case recordFinal, recordContinuation:
+		case recordTicket:
+			// Only servers send tickets, and only between messages
+			if !s.isClient || !s.caps.Has(CapSessionTickets) || len(msg) > 0 {
+				return nil, ErrInvalidRecordType
+			}
+
+			err = s.storeTicket(d)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case recordKeyUpdate:
+			err = s.readKeyUpdate(d)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, ErrInvalidRecordType
+		}
+
+		if len(msg)+len(d) > maxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		msg = append(msg, d...)
+
+		if recordType == recordFinal {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+var (
+	testC2SKey = bytes.Repeat([]byte{1}, 32)
+	testS2CKey = bytes.Repeat([]byte{2}, 32)
+)
+
+// Returns both ends of a secureConn over a pipe, keyed with fixed keys
+func recordPipe(t *testing.T) (client, server *secureConn) {
+	t.Helper()
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	client, err := newSecureConn(c, ProtocolVersion, 0, testS2CKey, testC2SKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.isClient = true
+
+	server, err = newSecureConn(s, ProtocolVersion, 0, testC2SKey, testS2CKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+// Returns a secureConn that reads from the returned end of a pipe, and the
+// halfConn the records written to that end have to be sealed with
+func rawRecordPipe(t *testing.T) (*secureConn, net.Conn, *halfConn) {
+	t.Helper()
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	server, err := newSecureConn(s, ProtocolVersion, 0, testC2SKey, testS2CKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := newHalfConn(testC2SKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, c, out
+}
+
+func sealRecord(h *halfConn, recordType byte, chunk []byte) []byte {
+	header := recordHeader(recordType, len(chunk)+h.aead.Overhead())
+	// Only fails once the sequence number runs out
+	e, _ := h.seal(chunk, header)
+	return slices.Concat(header, e)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// Writes msg from one end and reads it back as a whole from the other
+func roundTrip(t *testing.T, from, to *secureConn, msg []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		n, err := from.Write(msg)
+		if err == nil && n != len(msg) {
+			err = io.ErrShortWrite
+		}
+		errc <- err
+	}()
+
+	got, err := to.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %d bytes back, want %d", len(got), len(msg))
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	sizes := []int{
+		0,
+		1,
+		maxRecordPlaintext - 1,
+		maxRecordPlaintext,
+		maxRecordPlaintext + 1,
+		2 * maxRecordPlaintext,
+		3<<20 + 7,
+		8 << 20,
+	}
+
+	client, server := recordPipe(t)
+	for _, size := range sizes {
+		msg := randomBytes(t, size)
+		roundTrip(t, client, server, msg)
+		roundTrip(t, server, client, msg)
+	}
+}
+
+func TestRecordBoundaries(t *testing.T) {
+	tests := []struct {
+		size    int
+		records int
+	}{
+		{maxRecordPlaintext, 1},
+		{maxRecordPlaintext + 1, 2},
+	}
+
+	for _, tt := range tests {
+		c, s := net.Pipe()
+		client, err := newSecureConn(c, ProtocolVersion, 0, testS2CKey, testC2SKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			client.Write(make([]byte, tt.size))
+			c.Close()
+		}()
+
+		raw, err := io.ReadAll(s)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		overhead := recordHeaderLen + client.out.aead.Overhead()
+		want := tt.size + tt.records*overhead
+		if len(raw) != want {
+			t.Errorf("%d bytes: wrote %d bytes, want %d in %d records", tt.size, len(raw), want, tt.records)
+		}
+
+		if raw[0] != recordFinal && tt.records == 1 {
+			t.Errorf("%d bytes: single record isn't final", tt.size)
+		}
+		if raw[0] != recordContinuation && tt.records > 1 {
+			t.Errorf("%d bytes: first record isn't a continuation", tt.size)
+		}
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	server, c, out := rawRecordPipe(t)
+
+	go func() {
+		chunk := make([]byte, maxRecordPlaintext)
+		for sent := 0; sent <= maxMessageSize; sent += len(chunk) {
+			_, err := c.Write(sealRecord(out, recordContinuation, chunk))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err := server.readMessage()
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	server, c, _ := rawRecordPipe(t)
+
+	go c.Write(recordHeader(recordFinal, maxRecordCiphertext+1))
+
+	_, err := server.readMessage()
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("got %v, want ErrRecordTooLarge", err)
+	}
+}
+
+func TestTamperedRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(records [][]byte) [][]byte
+	}{
+		{"ciphertext", func(r [][]byte) [][]byte {
+			r[0][recordHeaderLen] ^= 1
+			return r
+		}},
+		{"tag", func(r [][]byte) [][]byte {
+			r[0][len(r[0])-1] ^= 1
+			return r
+		}},
+		{"continuation marked final", func(r [][]byte) [][]byte {
+			r[0][0] = recordFinal
+			return r
+		}},
+		{"final marked continuation", func(r [][]byte) [][]byte {
+			r[1][0] = recordContinuation
+			return r
+		}},
+		{"reordered", func(r [][]byte) [][]byte {
+			return [][]byte{r[1], r[0]}
+		}},
+		{"replayed", func(r [][]byte) [][]byte {
+			return [][]byte{r[0], r[0], r[1]}
+		}},
+		{"dropped", func(r [][]byte) [][]byte {
+			return r[1:]
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, c, out := rawRecordPipe(t)
+			records := [][]byte{
+				sealRecord(out, recordContinuation, []byte("first half")),
+				sealRecord(out, recordFinal, []byte("second half")),
+			}
+
+			go c.Write(slices.Concat(tt.tamper(records)...))
+
+			_, err := server.readMessage()
+			if !errors.Is(err, ErrBadRecordMAC) {
+				t.Fatalf("got %v, want ErrBadRecordMAC", err)
+			}
+		})
+	}
+}
+
+func TestReadFailsAfterBadRecord(t *testing.T) {
+	server, c, out := rawRecordPipe(t)
+
+	record := sealRecord(out, recordFinal, []byte("hello"))
+	record[recordHeaderLen] ^= 1
+	go func() {
+		c.Write(record)
+		c.Write(sealRecord(out, recordFinal, []byte("again")))
+	}()
+
+	buf := make([]byte, 16)
+	for range 2 {
+		_, err := server.Read(buf)
+		if !errors.Is(err, ErrBadRecordMAC) {
+			t.Fatalf("got %v, want ErrBadRecordMAC", err)
+		}
+	}
+}
+
+func TestReflectedRecord(t *testing.T) {
+	server, c, _ := rawRecordPipe(t)
+
+	// Sealed the way the server seals its own first record, as if an attacker
+	// had bounced it straight back
+	reflected, err := newHalfConn(testS2CKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go c.Write(sealRecord(reflected, recordFinal, []byte("hello")))
+
+	_, err = server.readMessage()
+	if !errors.Is(err, ErrBadRecordMAC) {
+		t.Fatalf("got %v, want ErrBadRecordMAC", err)
+	}
+}
+
+func TestSetDeadlineDuringRead(t *testing.T) {
+	_, server := recordPipe(t)
+	server.idleTimeout = time.Minute
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		errc <- err
+	}()
+
+	for range 10 {
+		err := server.SetReadDeadline(time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Has to win over the idle deadline, whichever is set first
+	err := server.SetDeadline(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-errc:
+	case <-time.After(10 * time.Second):
+		t.Fatal("read didn't stop at the deadline")
+	}
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+}
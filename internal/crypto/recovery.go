@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	chacha "golang.org/x/crypto/chacha20poly1305"
+)
+
+// A recovery key is a random key a user writes down when their account is
+// created. It wraps their data key like the key derived from their master
+// password does, so the vault can still be opened if they forget the
+// password, and it proves to the sync server that they're allowed to set a
+// new one. It's random, so neither needs a slow KDF.
+//
+// Recovery keys are written as groups of base32, like
+//
+//	ABCDE-FGHIJ-KLMNO-PQRST-UVWXY-Z2345-67ABC-DEFGH
+const (
+	recoveryKeySize      = 25
+	recoveryKeyGroupSize = 5
+
+	recoveryKEKLabel   = "qpass recovery kek"
+	recoveryTokenLabel = "qpass recovery token"
+)
+
+var ErrInvalidRecoveryKey = errors.New("Invalid recovery key")
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generates a recovery key, written out ready to show to the user
+func NewRecoveryKey() (*Secret, error) {
+	raw := newSecret(recoveryKeySize)
+	defer raw.Destroy()
+	_, err := rand.Read(raw.b)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := newSecret(recoveryEncoding.EncodedLen(recoveryKeySize))
+	defer encoded.Destroy()
+	recoveryEncoding.Encode(encoded.b, raw.b)
+
+	groups := len(encoded.b) / recoveryKeyGroupSize
+	key := newSecret(len(encoded.b) + groups - 1)
+	for i := 0; i < groups; i++ {
+		start := i * (recoveryKeyGroupSize + 1)
+		copy(key.b[start:], encoded.b[i*recoveryKeyGroupSize:(i+1)*recoveryKeyGroupSize])
+		if i < groups-1 {
+			key.b[start+recoveryKeyGroupSize] = '-'
+		}
+	}
+
+	return key, nil
+}
+
+// Derives the key that wraps the data key, and the token that proves the
+// user holds the recovery key, from a recovery key as the user typed it.
+// Case, spaces and dashes don't matter.
+func RecoveryKeys(recoveryKey string) (kek, token *Secret, err error) {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(recoveryKey))
+
+	if len(cleaned) != recoveryEncoding.EncodedLen(recoveryKeySize) {
+		return nil, nil, ErrInvalidRecoveryKey
+	}
+
+	raw := newSecret(recoveryKeySize)
+	defer raw.Destroy()
+	_, err = recoveryEncoding.Decode(raw.b, []byte(cleaned))
+	if err != nil {
+		return nil, nil, ErrInvalidRecoveryKey
+	}
+
+	k, err := hkdf.Expand(newBlake2b, raw.b, recoveryKEKLabel, chacha.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := hkdf.Expand(newBlake2b, raw.b, recoveryTokenLabel, chacha.KeySize)
+	if err != nil {
+		clear(k)
+		return nil, nil, err
+	}
+
+	return NewSecret(k), NewSecret(t), nil
+}
+
+// What the sync server stores to check a recovery token against, so it never
+// has the token itself until it's used
+func RecoveryVerifier(token *Secret) []byte {
+	v := blake2b.Sum256(token.Bytes())
+	return v[:]
+}
+
+func VerifyRecoveryToken(token, verifier []byte) bool {
+	v := blake2b.Sum256(token)
+	return len(verifier) > 0 && subtle.ConstantTimeCompare(v[:], verifier) == 1
+}
@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+)
+
+// When a server replaces its host key, it keeps presenting a signature from
+// the old key over the new one for a while. Clients that pinned the old key can
+// check that signature and move over to the new key without the user having to
+// step in. Clients that don't connect before it expires see the key as changed.
+const endorsementContext = "qpass host key endorsement"
+
+var (
+	ErrEndorsementExpired  = errors.New("host key endorsement has expired")
+	ErrInvalidEndorsement  = errors.New("invalid host key endorsement")
+	ErrTooManyEndorsements = errors.New("too many host key endorsements")
+)
+
+// A statement by a retired host key that NewKey replaces it
+type Endorsement struct {
+	OldKey    PublicKey
+	NewKey    PublicKey
+	Expires   time.Time
+	Signature []byte
+}
+
+// Signs newKey with oldKey, valid until expires
+func Endorse(oldKey *PrivateKey, newKey PublicKey, expires time.Time) (*Endorsement, error) {
+	e := &Endorsement{
+		OldKey:  oldKey.Public(),
+		NewKey:  newKey,
+		Expires: expires,
+	}
+
+	sig, err := oldKey.Sign(e.signedBytes())
+	if err != nil {
+		return nil, err
+	}
+	e.Signature = sig
+
+	return e, nil
+}
+
+func appendKey(b []byte, key PublicKey) []byte {
+	keyBytes := key.Marshal()
+	b = append(b, key.Algorithm)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(keyBytes)))
+	return append(b, keyBytes...)
+}
+
+func (e *Endorsement) body() []byte {
+	b := appendKey(nil, e.OldKey)
+	b = appendKey(b, e.NewKey)
+	return binary.BigEndian.AppendUint64(b, uint64(e.Expires.Unix()))
+}
+
+func (e *Endorsement) signedBytes() []byte {
+	return slices.Concat([]byte(endorsementContext), e.body())
+}
+
+func (e *Endorsement) Marshal() []byte {
+	b := e.body()
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.Signature)))
+	return append(b, e.Signature...)
+}
+
+// Reads a length prefixed field from the front of b
+func cutField(b []byte) (field, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+
+	return b[2 : 2+n], b[2+n:], true
+}
+
+func cutKey(b []byte) (PublicKey, []byte, error) {
+	if len(b) < 1 {
+		return PublicKey{}, nil, ErrInvalidEndorsement
+	}
+
+	keyBytes, rest, ok := cutField(b[1:])
+	if !ok {
+		return PublicKey{}, nil, ErrInvalidEndorsement
+	}
+
+	key, err := ParsePublicKey(b[0], keyBytes)
+	if err != nil {
+		return PublicKey{}, nil, err
+	}
+
+	return key, rest, nil
+}
+
+func ParseEndorsement(b []byte) (*Endorsement, error) {
+	e := &Endorsement{}
+	var err error
+	e.OldKey, b, err = cutKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	e.NewKey, b, err = cutKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 8 {
+		return nil, ErrInvalidEndorsement
+	}
+	e.Expires = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+
+	sig, rest, ok := cutField(b[8:])
+	if !ok || len(rest) != 0 {
+		return nil, ErrInvalidEndorsement
+	}
+	e.Signature = sig
+
+	return e, nil
+}
+
+// Checks the endorsement hasn't expired and was signed by OldKey
+func (e *Endorsement) Verify(now time.Time) error {
+	if now.After(e.Expires) {
+		return ErrEndorsementExpired
+	}
+
+	return e.OldKey.Verify(e.signedBytes(), e.Signature)
+}
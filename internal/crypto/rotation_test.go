@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testPrivateKey(t *testing.T) *PrivateKey {
+	t.Helper()
+	key, err := GenerateKey(KeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func testEndorse(t *testing.T, oldKey *PrivateKey, newKey PublicKey, expires time.Time) *Endorsement {
+	t.Helper()
+	e, err := Endorse(oldKey, newKey, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestEndorsementEncoding(t *testing.T) {
+	oldKey, newKey := testPrivateKey(t), testPrivateKey(t).Public()
+	e := testEndorse(t, oldKey, newKey, time.Now().Add(time.Hour))
+
+	parsed, err := ParseEndorsement(e.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.OldKey.Equal(e.OldKey) || !parsed.NewKey.Equal(newKey) || !parsed.Expires.Equal(e.Expires.Truncate(time.Second)) {
+		t.Fatalf("got %+v, want %+v", parsed, e)
+	}
+	err = parsed.Verify(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = parsed.Verify(e.Expires.Add(time.Second))
+	if !errors.Is(err, ErrEndorsementExpired) {
+		t.Errorf("after expiry: got %v, want ErrEndorsementExpired", err)
+	}
+
+	b := e.Marshal()
+	for _, cut := range []int{0, 1, 10, len(b) - 1} {
+		_, err = ParseEndorsement(b[:cut])
+		if err == nil {
+			t.Errorf("cut to %d of %d bytes: parsed", cut, len(b))
+		}
+	}
+	_, err = ParseEndorsement(append(b, 0))
+	if !errors.Is(err, ErrInvalidEndorsement) {
+		t.Errorf("trailing byte: got %v, want ErrInvalidEndorsement", err)
+	}
+}
+
+// Connects to a server presenting hostKey and endorsements, trusting hosts
+// the way the client does
+func dialRotated(t *testing.T, hostKey *PrivateKey, endorsements ...*Endorsement) error {
+	t.Helper()
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := serveHandshake(s, &ServerConfig{HostKeys: []*PrivateKey{hostKey}, Endorsements: endorsements})
+	_, err := NewClientConn(c, &ClientConfig{Hostname: "server", HostKeyCallback: TrustOnFirstUse(nil, false)})
+	if err != nil {
+		s.Close()
+	}
+	<-done
+
+	return err
+}
+
+func TestEndorsedKeyReplacesPinned(t *testing.T) {
+	pinned, next := testPrivateKey(t), testPrivateKey(t)
+	testKnownHosts(t, KnownHost{Host: "server", Key: pinned.Public()}.String())
+
+	err := dialRotated(t, next, testEndorse(t, pinned, next.Public(), time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKnownHost(t, "server", next.Public())
+
+	hosts, err := ListKnownHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("got %d entries, want the pinned key replaced", len(hosts))
+	}
+
+	// The old key isn't accepted any more
+	err = dialRotated(t, pinned)
+	var changed *HostKeyChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("old key after rotation: got %v, want HostKeyChangedError", err)
+	}
+}
+
+func TestBadEndorsementsRejected(t *testing.T) {
+	pinned, next, other := testPrivateKey(t), testPrivateKey(t), testPrivateKey(t)
+	later := time.Now().Add(time.Hour)
+
+	forged := testEndorse(t, other, next.Public(), later)
+	forged.OldKey = pinned.Public()
+
+	tests := []struct {
+		name        string
+		endorsement *Endorsement
+	}{
+		{"forged", forged},
+		{"from an unpinned key", testEndorse(t, other, next.Public(), later)},
+		{"expired", testEndorse(t, pinned, next.Public(), time.Now().Add(-time.Hour))},
+		{"of another key", testEndorse(t, pinned, other.Public(), later)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testKnownHosts(t, KnownHost{Host: "server", Key: pinned.Public()}.String())
+
+			err := dialRotated(t, next, tt.endorsement)
+			var changed *HostKeyChangedError
+			if !errors.As(err, &changed) {
+				t.Fatalf("got %v, want HostKeyChangedError", err)
+			}
+			wantKnownHost(t, "server", pinned.Public())
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Keys, auth tokens and decrypted passwords are kept in a Secret rather than
+// ordinary Go memory. Where the platform allows, its bytes are allocated
+// outside the Go heap in pages locked into memory, so they're never written
+// to swap or copied around by the garbage collector. If they can't be locked,
+// for example because RLIMIT_MEMLOCK has been reached, they're kept on the
+// heap instead.
+//
+// Either way Destroy zeroes them as soon as they're no longer needed, rather
+// than whenever the memory happens to be reused. A Secret that's never
+// destroyed is zeroed once it's garbage collected.
+//
+// Locked memory is never unmapped. Once zeroed it's kept for the next Secret
+// that needs as many pages, so there's never more of it than the most secrets
+// alive at once needed. Unmapping it would make a slice from Bytes that's
+// still held when its Secret is destroyed, or when the garbage collector
+// finds the Secret itself unreachable, crash the whole program the moment
+// it's read. Kept mapped, such a slice reads as zeros, or as whichever Secret
+// reuses the memory, both of which the program survives.
+//
+// A nil Secret, or one that's been destroyed, is empty. Destroying a Secret
+// while another goroutine is using it isn't safe.
+type Secret struct {
+	b []byte
+	// The whole locked allocation b is at the start of, or nil if b is on
+	// the heap
+	mem     []byte
+	cleanup runtime.Cleanup
+}
+
+// Returns an n byte Secret to be filled in
+func newSecret(n int) *Secret {
+	s := &Secret{}
+	if n <= 0 {
+		return s
+	}
+
+	mem, err := allocLocked(n)
+	if err != nil {
+		s.b = make([]byte, n)
+		s.cleanup = runtime.AddCleanup(s, zero, s.b)
+		return s
+	}
+
+	s.mem = mem
+	s.b = mem[:n:n]
+	s.cleanup = runtime.AddCleanup(s, freeLocked, mem)
+	return s
+}
+
+// Zeroed locked memory that's free to reuse, by size
+var lockedPool = struct {
+	sync.Mutex
+	free map[int][][]byte
+}{free: map[int][][]byte{}}
+
+// Returns whole pages of locked memory with room for n bytes, reusing freed
+// ones where possible
+func allocLocked(n int) ([]byte, error) {
+	page := os.Getpagesize()
+	size := (n + page - 1) / page * page
+
+	lockedPool.Lock()
+	free := lockedPool.free[size]
+	if len(free) > 0 {
+		mem := free[len(free)-1]
+		lockedPool.free[size] = free[:len(free)-1]
+		lockedPool.Unlock()
+		return mem, nil
+	}
+	lockedPool.Unlock()
+
+	return lockedAlloc(size)
+}
+
+// Zeroes memory from allocLocked and keeps it for reuse
+func freeLocked(mem []byte) {
+	clear(mem)
+
+	lockedPool.Lock()
+	defer lockedPool.Unlock()
+	lockedPool.free[len(mem)] = append(lockedPool.free[len(mem)], mem)
+}
+
+func zero(b []byte) {
+	clear(b)
+}
+
+// Copies b into a new Secret, and zeroes b
+func NewSecret(b []byte) *Secret {
+	s := newSecret(len(b))
+	copy(s.b, b)
+	clear(b)
+	return s
+}
+
+// Copies s into a new Secret. Strings can't be zeroed, so s itself is left
+// for the garbage collector.
+func SecretFromString(s string) *Secret {
+	secret := newSecret(len(s))
+	copy(secret.b, s)
+	return secret
+}
+
+// Returns the secret's bytes, which are only valid until it's destroyed
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+
+	return s.b
+}
+
+func (s *Secret) Len() int {
+	return len(s.Bytes())
+}
+
+// Returns a copy of the secret as a string, for where nothing else will do,
+// such as showing it. The copy is ordinary memory, so it should be kept no
+// longer than needed.
+func (s *Secret) Reveal() string {
+	return string(s.Bytes())
+}
+
+// Compares two secrets in constant time
+func (s *Secret) Equal(other *Secret) bool {
+	return subtle.ConstantTimeCompare(s.Bytes(), other.Bytes()) == 1
+}
+
+func (s *Secret) Clone() *Secret {
+	c := newSecret(s.Len())
+	copy(c.b, s.Bytes())
+	return c
+}
+
+// Zeroes the secret and frees its memory for reuse. Destroying a secret more
+// than once is harmless.
+func (s *Secret) Destroy() {
+	if s == nil || s.b == nil {
+		return
+	}
+
+	s.cleanup.Stop()
+	if s.mem != nil {
+		freeLocked(s.mem)
+	} else {
+		clear(s.b)
+	}
+
+	s.b = nil
+	s.mem = nil
+}
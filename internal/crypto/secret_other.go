@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package crypto
+
+import "errors"
+
+var errNoLockedMemory = errors.New("locked memory isn't supported on this platform")
+
+// Secrets are always kept on the heap here
+func lockedAlloc(n int) ([]byte, error) {
+	return nil, errNoLockedMemory
+}
+
+func lockedFree(mem []byte) {
+	clear(mem)
+}
@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestDestroyedSecretReadsZeros(t *testing.T) {
+	s := NewSecret([]byte("correct horse battery staple"))
+	if s.mem == nil {
+		t.Skip("memory couldn't be locked")
+	}
+
+	held := s.Bytes()
+	s.Destroy()
+	if s.Len() != 0 {
+		t.Errorf("destroyed secret has %d bytes", s.Len())
+	}
+	s.Destroy()
+
+	// A slice kept past Destroy mustn't bring the program down
+	if !bytes.Equal(held, make([]byte, len(held))) {
+		t.Errorf("held slice reads %q after destroy, want zeros", held)
+	}
+}
+
+func TestFreedLockedMemoryReused(t *testing.T) {
+	// A size no other secret uses, so nothing else takes it from the pool
+	n := 7*os.Getpagesize() - 1
+	mem, err := allocLocked(n)
+	if err != nil {
+		t.Skip("memory couldn't be locked")
+	}
+
+	copy(mem, "secret")
+	freeLocked(mem)
+
+	// Freed pages are kept rather than unmapped, so they have to be handed
+	// out again for memory not to grow with every secret
+	next, err := allocLocked(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer freeLocked(next)
+
+	if unsafe.SliceData(next) != unsafe.SliceData(mem) {
+		t.Error("freed locked memory wasn't reused")
+	}
+	if !bytes.Equal(next, make([]byte, len(next))) {
+		t.Error("reused memory wasn't zeroed")
+	}
+}
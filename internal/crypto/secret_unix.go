@@ -0,0 +1,21 @@
+//go:build unix
+
+package crypto
+
+import "golang.org/x/sys/unix"
+
+// Allocates n bytes outside the Go heap and locks them into memory
+func lockedAlloc(n int) ([]byte, error) {
+	mem, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Mlock(mem)
+	if err != nil {
+		unix.Munmap(mem)
+		return nil, err
+	}
+
+	return mem, nil
+}
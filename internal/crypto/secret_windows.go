@@ -0,0 +1,29 @@
+//go:build windows
+
+package crypto
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Allocates n bytes outside the Go heap and locks them into memory
+func lockedAlloc(n int) ([]byte, error) {
+	addr, err := windows.VirtualAlloc(0, uintptr(n), windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_READWRITE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = windows.VirtualLock(addr, uintptr(n))
+	if err != nil {
+		windows.VirtualFree(addr, 0, windows.MEM_RELEASE)
+		return nil, err
+	}
+
+	// vet's unsafeptr check flags this conversion, as a uintptr normally
+	// can't be trusted to still point at a Go object. addr comes from
+	// VirtualAlloc, outside the Go heap, and is never released, so the
+	// garbage collector can't move or free what it points at.
+	return unsafe.Slice((*byte)(unsafe.Pointer(addr)), n), nil
+}
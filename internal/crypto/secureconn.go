@@ -1,21 +1,18 @@
 package crypto
 
 import (
-	"crypto"
-	"crypto/ecdh"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
+	"crypto/hkdf"
 	"encoding/binary"
-	"errors"
+	"hash"
 	"net"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Queueue0/qpass/internal/structures"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/blake2b"
+	chacha "golang.org/x/crypto/chacha20poly1305"
 )
 
 func genSharedKey(b []byte) []byte {
@@ -23,310 +20,336 @@ func genSharedKey(b []byte) []byte {
 }
 
 const (
-	pubKeySize    = 32
-	rsaKeyByteLen = 2
-	macLen        = 64
+	pubKeySize     = 32
+	hostKeyByteLen = 2
+	macLen         = 64
 )
 
 type secureConn struct {
-	c     net.Conn
-	ss    []byte                 // Shared Secret, generated by dh, hashed with argon2
-	queue structures.Queue[byte] // For storing leftover bytes if the buffer supplied to Read isn't big enough
+	c       net.Conn
+	version byte         // Negotiated protocol version
+	caps    Capabilities // Optional features both sides support
+	in      *halfConn    // Decrypts records from the peer
+	out     *halfConn    // Encrypts records to the peer
+	pending []byte       // For storing leftover bytes if the buffer supplied to Read isn't big enough
+	readErr error        // Once a record fails to read, every later Read fails too
+
+	isClient   bool
+	hostname   string        // Name of the server, client side only
+	sessions   *SessionCache // Where tickets from the server go, client side only
+	resumption []byte        // Secret a ticket for this connection resumes from
+	ticket     []byte        // Ticket record still to be sent, server side only
+	peerDevice PublicKey     // Client's device key, server side only
+
+	idleTimeout time.Duration // How long to wait for each record, if set
+	// Callers set deadlines while another goroutine reads, so this guards
+	// readDeadline along with the read deadline of c
+	deadlineMu   sync.Mutex
+	readDeadline time.Time // Read deadline set by the caller
+
+	// Held for each Write and key update, as both advance out
+	writeMu sync.Mutex
+
+	keyUpdateBytes   uint64      // Bytes sent under one key before it's replaced, if set
+	keyUpdateRecords uint64      // Records sent under one key before it's replaced, if set
+	updateRequested  atomic.Bool // Peer asked us to replace our key
 }
 
-func NewClientConn(c net.Conn) (*secureConn, error) {
-	// Generate ephemeral DH key pair
-	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
-	pubkey := privkey.PublicKey()
+func newBlake2b() hash.Hash {
+	// Only errors for keys longer than 64 bytes
+	h, _ := blake2b.New512(nil)
+	return h
+}
 
-	// Send client hello
-	// Initial packet to server containing our DH public key
-	_, err = c.Write(pubkey.Bytes())
+// Derives separate client to server and server to client traffic keys from the
+// shared secret, salted with a hash of everything sent during the handshake.
+// Also derives the secret a session ticket for the connection resumes from.
+func trafficKeys(ss []byte, transcript ...[]byte) (c2s, s2c, resumption []byte, err error) {
+	th := newBlake2b()
+	th.Write(slices.Concat(transcript...))
+	salt := th.Sum(nil)
+
+	c2s, err = hkdf.Key(newBlake2b, ss, salt, "qpass client to server", chacha.KeySize)
 	if err != nil {
-		c.Close()
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	// Receive server's DH public key
-	rkBytes := make([]byte, pubKeySize)
-	_, err = c.Read(rkBytes)
+	s2c, err = hkdf.Key(newBlake2b, ss, salt, "qpass server to client", chacha.KeySize)
 	if err != nil {
-		c.Close()
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	// Receive server's RSA public key
-	rsaKeyLenBuff := make([]byte, rsaKeyByteLen)
-	_, err = c.Read(rsaKeyLenBuff)
+	resumption, err = hkdf.Key(newBlake2b, ss, salt, "qpass resumption", chacha.KeySize)
 	if err != nil {
-		c.Close()
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	rsaKeyLen := binary.BigEndian.Uint16(rsaKeyLenBuff)
+	return c2s, s2c, resumption, nil
+}
 
-	rsaKeyBytes := make([]byte, rsaKeyLen)
-	_, err = c.Read(rsaKeyBytes)
+// Keyed BLAKE2b over the handshake transcript, proving the sender holds ss
+func handshakeMAC(ss []byte, transcript ...[]byte) ([]byte, error) {
+	hm, err := blake2b.New512(ss)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
+	hm.Write(slices.Concat(transcript...))
 
-	rsaKey, err := x509.ParsePKCS1PublicKey(rsaKeyBytes)
+	return hm.Sum(nil), nil
+}
+
+func newSecureConn(c net.Conn, version byte, caps Capabilities, inKey, outKey []byte) (*secureConn, error) {
+	in, err := newHalfConn(inKey)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
 
-	knownHosts, err := getKnownHosts()
+	out, err := newHalfConn(outKey)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
 
-	// Compare received RSA public key against our known hosts
-	knownKey, ok := knownHosts[c.RemoteAddr().String()]
-	if !ok {
-		// Add host if it doesn't exist
-		// TODO: probably add more checks for this case
-		// Example: ssh will ask if you want to trust a new server
-		addHost(c.RemoteAddr().String(), rsaKey)
-	} else {
-		// Verify that key matches the key we already have
-		if !rsaKey.Equal(knownKey) {
-			return nil, errors.New("Key does not match known key for this host")
-		}
-	}
+	return &secureConn{c: c, version: version, caps: caps, in: in, out: out}, nil
+}
 
-	// Receive signature over all data exchanged so far
-	sigLenBuff := make([]byte, 2)
-	_, err = c.Read(sigLenBuff)
-	if err != nil {
-		c.Close()
-		return nil, err
+type ClientConfig struct {
+	// Name the server's key is recorded under in known_hosts. Dial fills this
+	// in with the address it was given. If left empty, the connection's
+	// remote address is used. A key only recorded under the remote address
+	// is recorded under Hostname too.
+	Hostname string
+
+	// Decides whether to trust the server's key. If nil, only servers
+	// already in known_hosts are trusted.
+	HostKeyCallback HostKeyCallback
+
+	// Optional protocol features the client supports
+	Capabilities Capabilities
+
+	// Server key algorithms we accept, most preferred first. If empty,
+	// DefaultKeyAlgorithms is used, with the algorithm of the key in
+	// known_hosts for Hostname moved to the front. That way a server that
+	// has added a new key type keeps presenting the key we pinned.
+	HostKeyAlgorithms []byte
+
+	// Where session tickets from servers are kept. If set, tickets are
+	// asked for and used to resume sessions on later connections.
+	SessionCache *SessionCache
+
+	// How long the server has to complete the handshake. Time spent in
+	// HostKeyCallback doesn't count. If zero, DefaultHandshakeTimeout is
+	// used, if negative there is no limit.
+	HandshakeTimeout time.Duration
+
+	// How long Read waits for the server to send anything before failing.
+	// If zero, Read waits forever.
+	IdleTimeout time.Duration
+
+	// Long term key identifying this device. If set, the client proves it
+	// holds the key during the handshake, if the server asks.
+	DeviceKey *PrivateKey
+
+	// How much can be sent under one traffic key before it's replaced. If
+	// zero, DefaultKeyUpdateBytes and DefaultKeyUpdateRecords are used, if
+	// negative the key is only replaced on demand.
+	KeyUpdateBytes   int64
+	KeyUpdateRecords int64
+}
+
+// Returns the name the server's key is recorded under in known_hosts
+func (conf *ClientConfig) knownHostname(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if conf.Hostname == "" || conf.Hostname == addr {
+		return addr
 	}
 
-	sigLen := binary.BigEndian.Uint16(sigLenBuff)
+	// Any error here will come up again when the host key is checked
+	carryOverKnownHost(addr, conf.Hostname)
+	return conf.Hostname
+}
 
-	sig := make([]byte, sigLen)
-	_, err = c.Read(sig)
-	if err != nil {
-		c.Close()
-		return nil, err
+func (conf *ClientConfig) keyAlgorithms(hostname string) []byte {
+	if conf != nil && len(conf.HostKeyAlgorithms) > 0 {
+		return conf.HostKeyAlgorithms
 	}
 
-	// Verify signature to confirm the server has the RSA private key
-	opts := rsa.PSSOptions{
-		SaltLength: rsa.PSSSaltLengthAuto,
-		Hash:       crypto.BLAKE2b_512,
-	}
+	algs := slices.Clone(DefaultKeyAlgorithms)
 
-	sigHash := opts.HashFunc().New()
-	_, err = sigHash.Write(slices.Concat(pubkey.Bytes(), rkBytes, rsaKeyBytes))
-	if err != nil {
-		c.Close()
-		return nil, err
+	// Any error here will come up again when the host key is checked
+	known, ok, err := LookupKnownHost(hostname)
+	if err != nil || !ok {
+		return algs
 	}
 
-	err = rsa.VerifyPSS(rsaKey, crypto.BLAKE2b_512, sigHash.Sum(nil), sig, &opts)
-	if err != nil {
-		c.Close()
-		return nil, err
+	i := slices.Index(algs, known.Algorithm)
+	if i > 0 {
+		algs = slices.Concat([]byte{known.Algorithm}, algs[:i], algs[i+1:])
 	}
 
-	// Compute DH shared secret
-	remoteKey, err := ecdh.X25519().NewPublicKey(rkBytes)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
+	return algs
+}
 
-	ss, err := privkey.ECDH(remoteKey)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
+type ServerConfig struct {
+	// Identity keys the server can present, at most one per algorithm. The
+	// client's most preferred algorithm that has a key here is used.
+	HostKeys []*PrivateKey
 
-	ss = genSharedKey(ss)
+	// Signatures by retired host keys over the keys that replaced them.
+	// Any that endorse the key being presented are sent along with it.
+	Endorsements []*Endorsement
 
-	// Receive MAC from server
-	mac := make([]byte, macLen)
-	_, err = c.Read(mac)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
+	// Optional protocol features the server supports
+	Capabilities Capabilities
 
-	// Verify MAC to confirm server computed the same DH shared secret
-	hm, err := blake2b.New512(ss)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
-	hm.Write(slices.Concat(pubkey.Bytes(), remoteKey.Bytes(), rsaKeyBytes, sig))
-	expectedMac := hm.Sum(nil)
+	// Key session tickets are sealed under. If empty, no tickets are issued
+	// and clients always do the full handshake. Replacing it invalidates
+	// every ticket issued under the old key.
+	TicketKey []byte
 
-	if !hmac.Equal(mac, expectedMac) {
-		c.Close()
-		return nil, errors.New("MAC authentication failed")
-	}
+	// How long tickets are accepted for after being issued. If zero,
+	// DefaultTicketLifetime is used.
+	TicketLifetime time.Duration
 
-	return &secureConn{c, ss, structures.Queue[byte]{}}, nil
-}
+	// If set, tickets issued before the time it returns are rejected. Called
+	// for every ticket a client presents.
+	TicketsRevokedBefore func() time.Time
 
-// Just makes it easier to create a client-side secureConn
-func Dial(addr string) (*secureConn, error) {
-	c, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+	// How long clients have to complete the handshake. If zero,
+	// DefaultHandshakeTimeout is used, if negative there is no limit.
+	HandshakeTimeout time.Duration
+
+	// How long Read waits for the client to send anything before failing.
+	// If zero, Read waits forever.
+	IdleTimeout time.Duration
+
+	// If set, clients have to prove they hold a device key during the
+	// handshake, and VerifyDevice decides whether to accept it. The key is
+	// available from PeerDevice afterwards.
+	VerifyDevice DeviceCallback
+
+	// Transports Accept allows. If empty, only TransportQpass is allowed.
+	Transports []string
+
+	// How much can be sent under one traffic key before it's replaced. If
+	// zero, DefaultKeyUpdateBytes and DefaultKeyUpdateRecords are used, if
+	// negative the key is only replaced on demand.
+	KeyUpdateBytes   int64
+	KeyUpdateRecords int64
 
-	return NewClientConn(c)
+	// DER certificate for the TLS transport, made by NewCertificate from
+	// one of HostKeys
+	Certificate []byte
 }
 
-func NewServerConn(c net.Conn, rsaKey *rsa.PrivateKey, rsaPub *rsa.PublicKey) (*secureConn, error) {
-	// Receive client's ephemeral DH public key
-	b := make([]byte, pubKeySize)
-	_, err := c.Read(b)
-	if err != nil {
-		return nil, err
+func (conf *ServerConfig) endorsements(key PublicKey) []*Endorsement {
+	endorsements := []*Endorsement{}
+	for _, e := range conf.Endorsements {
+		if e.NewKey.Equal(key) {
+			endorsements = append(endorsements, e)
+		}
 	}
 
-	remoteKey, err := ecdh.X25519().NewPublicKey(b)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
+	return endorsements
+}
 
-	// Generate our own ephemeral DH key pair
-	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
-	if err != nil {
-		c.Close()
-		return nil, err
+// Encodes the endorsements of key as a count followed by each endorsement,
+// prefixed by its length
+func (conf *ServerConfig) endorsementList(key PublicKey) ([]byte, error) {
+	endorsements := conf.endorsements(key)
+	if len(endorsements) > 255 {
+		return nil, ErrTooManyEndorsements
 	}
 
-	// Compute (s)hared (s)ecret
-	ss, err := privkey.ECDH(remoteKey)
-	if err != nil {
-		c.Close()
-		return nil, err
+	list := []byte{byte(len(endorsements))}
+	for _, e := range endorsements {
+		eBytes := e.Marshal()
+		list = binary.BigEndian.AppendUint16(list, uint16(len(eBytes)))
+		list = append(list, eBytes...)
 	}
 
-	ss = genSharedKey(ss)
-
-	pubkey := privkey.PublicKey()
-
-	// Get byte representation of RSA public key to send
-	rsaPubBytes := x509.MarshalPKCS1PublicKey(rsaPub)
-	// Unsure if rsaPubLen is necessary, will research
-	rsaPubLen := make([]byte, rsaKeyByteLen)
-	binary.BigEndian.PutUint16(rsaPubLen, uint16(len(rsaPubBytes)))
+	return list, nil
+}
 
-	// Sign all data so far with our RSA private key
-	opts := rsa.PSSOptions{
-		SaltLength: rsa.PSSSaltLengthAuto,
-		Hash:       crypto.BLAKE2b_512,
+func (conf *ServerConfig) hostKey(algs []byte) (*PrivateKey, bool) {
+	for _, alg := range algs {
+		for _, key := range conf.HostKeys {
+			if key.Public().Algorithm == alg {
+				return key, true
+			}
+		}
 	}
 
-	sigHash := opts.HashFunc().New()
-	_, err = sigHash.Write(slices.Concat(remoteKey.Bytes(), pubkey.Bytes(), rsaPubBytes))
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
+	return nil, false
+}
 
-	sig, err := rsaKey.Sign(rand.Reader, sigHash.Sum(nil), &opts)
+// Just makes it easier to create a client-side secureConn
+func Dial(addr string, conf *ClientConfig) (*secureConn, error) {
+	c, err := net.Dial("tcp", addr)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
 
-	sigLen := make([]byte, 2)
-	binary.BigEndian.PutUint16(sigLen, uint16(len(sig)))
-
-	// Generate a MAC over all data so far using the DH shared secret
-	hm, err := blake2b.New512(ss)
-	if err != nil {
-		c.Close()
-		return nil, err
+	// Copy so the caller's config isn't modified
+	dialConf := ClientConfig{}
+	if conf != nil {
+		dialConf = *conf
 	}
-	hm.Write(slices.Concat(remoteKey.Bytes(), pubkey.Bytes(), rsaPubBytes, sig))
-	mac := hm.Sum(nil)
 
-	// Send server hello
-	_, err = c.Write(slices.Concat(pubkey.Bytes(), rsaPubLen, rsaPubBytes, sigLen, sig, mac))
-	if err != nil {
-		c.Close()
-		return nil, err
+	if dialConf.Hostname == "" {
+		dialConf.Hostname = addr
 	}
 
-	return &secureConn{c, ss, structures.Queue[byte]{}}, nil
+	return NewClientConn(c, &dialConf)
 }
 
-// TODO: Chunking for oversize packets
 func (s *secureConn) Read(b []byte) (int, error) {
-	n := 0
-	for s.queue.HasNext() && n < len(b) {
-		b[n] = s.queue.Dequeue()
-		n++
-	}
-
-	// Don't bother reading more from s.c if the supplied buffer filled up from the queue
-	if n < len(b) {
-		sizeBytes := make([]byte, 2)
-		_, err := s.c.Read(sizeBytes)
-		if err != nil {
-			return 0, err
+	// Hand out whatever is left over from the last message before reading
+	// another one. Empty messages are skipped so Read never returns 0, nil
+	for len(s.pending) == 0 && len(b) > 0 {
+		if s.readErr != nil {
+			return 0, s.readErr
 		}
 
-		size := binary.BigEndian.Uint16(sizeBytes)
-
-		buf := make([]byte, size)
-		_, err = s.c.Read(buf)
+		msg, err := s.readMessage()
 		if err != nil {
+			s.readErr = err
 			return 0, err
 		}
-
-		d, err := decryptBytes(buf, s.ss, nil)
-		if err != nil {
-			return 0, err
-		}
-
-		for i := 0; i < len(d); i++ {
-			if n < len(b) {
-				b[n] = d[i]
-				n++
-			} else {
-				s.queue.Enqueue(d[i])
-			}
-		}
+		s.pending = msg
 	}
 
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+
 	return n, nil
 }
 
 func (s *secureConn) Write(b []byte) (int, error) {
-	e, err := encryptBytes(b, s.ss, nil)
-	if err != nil {
-		return 0, err
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	// The ticket goes out ahead of our first message, as the client will be
+	// reading by then. Sending it straight after the handshake could block
+	// on a client that's still writing its first request.
+	if s.ticket != nil {
+		err := s.writeRecord(recordTicket, s.ticket)
+		if err != nil {
+			return 0, err
+		}
+		s.ticket = nil
 	}
 
-	sizeBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(sizeBytes, uint16(len(e)))
+	return s.writeRecords(b)
+}
 
-	n, err := s.c.Write(slices.Concat(sizeBytes, e))
-	if err != nil {
-		if n > len(b) {
-			n = len(b)
-		}
-		return n, err
-	}
+// Protocol version agreed on during the handshake
+func (s *secureConn) Version() byte {
+	return s.version
+}
 
-	return len(b), nil
+// Optional features both sides agreed to use
+func (s *secureConn) Capabilities() Capabilities {
+	return s.caps
 }
 
 func (s *secureConn) Close() error {
@@ -342,10 +365,18 @@ func (s *secureConn) RemoteAddr() net.Addr {
 }
 
 func (s *secureConn) SetDeadline(t time.Time) error {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+
+	s.readDeadline = t
 	return s.c.SetDeadline(t)
 }
 
 func (s *secureConn) SetReadDeadline(t time.Time) error {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+
+	s.readDeadline = t
 	return s.c.SetReadDeadline(t)
 }
 
@@ -0,0 +1,199 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	chacha "golang.org/x/crypto/chacha20poly1305"
+)
+
+// After a handshake, a server with a ticket key sends the client a session
+// ticket: the session's resumption secret, sealed under a key only the server
+// knows. On its next connection the client sends the ticket back in its hello,
+// and both sides derive new keys from the resumption secret and a fresh DH
+// exchange. That skips the host key signature and the Argon2 stretching of the
+// shared secret, while still giving every connection its own keys.
+//
+// Each ticket is only used once, and every connection gets a new one.
+const (
+	ticketContext         = "qpass session ticket"
+	DefaultTicketLifetime = 12 * time.Hour
+	maxTicketLen          = 1024
+	TicketKeySize         = chacha.KeySize
+)
+
+const (
+	handshakeFull byte = iota
+	handshakeResumed
+)
+
+var ErrInvalidTicket = errors.New("invalid session ticket")
+
+// Generates a key for ServerConfig.TicketKey
+func GenerateTicketKey() ([]byte, error) {
+	key := make([]byte, TicketKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (conf *ServerConfig) ticketLifetime() time.Duration {
+	if conf.TicketLifetime > 0 {
+		return conf.TicketLifetime
+	}
+
+	return DefaultTicketLifetime
+}
+
+func (conf *ServerConfig) sealTicket(secret []byte) ([]byte, error) {
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	plaintext = append(plaintext, secret...)
+
+	return encryptBytes(plaintext, conf.TicketKey, []byte(ticketContext))
+}
+
+// Returns the resumption secret in ticket, if the ticket is one of ours and
+// hasn't expired or been revoked
+func (conf *ServerConfig) openTicket(ticket []byte) ([]byte, error) {
+	if len(conf.TicketKey) == 0 {
+		return nil, ErrInvalidTicket
+	}
+
+	plaintext, err := decryptBytes(nil, ticket, conf.TicketKey, []byte(ticketContext))
+	if err != nil || len(plaintext) != 8+chacha.KeySize {
+		return nil, ErrInvalidTicket
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if !conf.ticketValid(issued) {
+		return nil, ErrInvalidTicket
+	}
+
+	return plaintext[8:], nil
+}
+
+// Reports whether a ticket issued at the given time has neither expired nor
+// been revoked
+func (conf *ServerConfig) ticketValid(issued time.Time) bool {
+	if time.Now().After(issued.Add(conf.ticketLifetime())) {
+		return false
+	}
+
+	// Issue times only have second precision, so a ticket from the same
+	// second as the revocation is rejected too
+	if conf.TicketsRevokedBefore != nil && !issued.After(conf.TicketsRevokedBefore()) {
+		return false
+	}
+
+	return true
+}
+
+// Builds the ticket record payload: the ticket's lifetime in seconds followed
+// by the ticket
+func (conf *ServerConfig) newTicketMessage(secret []byte) ([]byte, error) {
+	ticket, err := conf.sealTicket(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := binary.BigEndian.AppendUint32(nil, uint32(conf.ticketLifetime().Seconds()))
+	return append(msg, ticket...), nil
+}
+
+type session struct {
+	ticket  []byte
+	secret  []byte
+	expires time.Time
+}
+
+// Remembers session tickets between connections, so later connections to the
+// same server can skip the full handshake. Safe for concurrent use.
+type SessionCache struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	tls      tls.ClientSessionCache // Tickets for the TLS transport
+}
+
+func NewSessionCache() *SessionCache {
+	return &SessionCache{
+		sessions: make(map[string]*session),
+		tls:      tls.NewLRUClientSessionCache(0),
+	}
+}
+
+// Removes and returns the ticket for hostname, as tickets are single use
+func (sc *SessionCache) take(hostname string) (*session, bool) {
+	if sc == nil {
+		return nil, false
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	s, ok := sc.sessions[hostname]
+	delete(sc.sessions, hostname)
+	if !ok || time.Now().After(s.expires) {
+		return nil, false
+	}
+
+	return s, true
+}
+
+func (sc *SessionCache) put(hostname string, s *session) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.sessions[hostname] = s
+}
+
+// Shared secret for a resumed session. Mixing in a fresh DH exchange means
+// someone who later steals the ticket key can't decrypt resumed sessions
+// they recorded.
+func resumedSecret(secret, dh []byte) ([]byte, error) {
+	return hkdf.Key(newBlake2b, slices.Concat(secret, dh), nil, "qpass resumed session", chacha.KeySize)
+}
+
+// Seals a ticket for the connection, to be sent before our first message
+func (s *secureConn) queueTicket(conf *ServerConfig, resumption []byte) error {
+	if !s.caps.Has(CapSessionTickets) {
+		return nil
+	}
+
+	msg, err := conf.newTicketMessage(resumption)
+	if err != nil {
+		return err
+	}
+	s.ticket = msg
+
+	return nil
+}
+
+// Handles a ticket record from the server
+func (s *secureConn) storeTicket(msg []byte) error {
+	if len(msg) < 4 || len(msg) > 4+maxTicketLen {
+		return ErrInvalidTicket
+	}
+
+	// Nowhere to keep it, so don't bother
+	if s.sessions == nil {
+		return nil
+	}
+
+	lifetime := time.Duration(binary.BigEndian.Uint32(msg)) * time.Second
+	s.sessions.put(s.hostname, &session{
+		ticket:  msg[4:],
+		secret:  s.resumption,
+		expires: time.Now().Add(lifetime),
+	})
+
+	return nil
+}
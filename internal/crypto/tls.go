@@ -0,0 +1,596 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Over TLS, the server's certificate is self-signed by its host key, and
+// clients pin that key in known_hosts just as they do over the qpass
+// transport, so switching transports doesn't change what's trusted. Only the
+// key in the certificate is checked, never its issuer or expiry. Endorsements
+// from a key rotation travel in a certificate extension, and the client's
+// device key is presented as a self-signed client certificate. Only TLS 1.3
+// is accepted.
+//
+// Unlike the qpass transport, the server can't present a key of the client's
+// choosing, so the certificate is made from one host key only.
+//
+// The protocol version is negotiated with ALPN. The client offers "qpass/N"
+// for each version it speaks, highest first, and the server picks the highest
+// it speaks too. If there's none, the server finishes the handshake without
+// picking one, sends the rejected status followed by the versions it speaks,
+// as over the qpass transport, and hangs up.
+//
+// From version 6 on, the client offers "qpass/N+C" instead, C being the
+// capabilities it supports in hex. Once the handshake is done, the server
+// sends the ones both sides do as a uint32, before anything else.
+const alpnPrefix = "qpass/"
+
+// Private extension holding endorsements of the certificate's key
+var oidEndorsements = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+const (
+	certificateLifetime = 10 * 365 * 24 * time.Hour
+	// Certificates this close to expiring are replaced, for the sake of any
+	// TLS tooling in front of the server that does check
+	certificateRenewal = 30 * 24 * time.Hour
+)
+
+var ErrNoCertificate = errors.New("No TLS certificate for any host key")
+
+// ALPN protocol names for the versions we speak, highest first
+func alpnProtocols(caps Capabilities) []string {
+	protos := []string{}
+	for v := ProtocolVersion; v >= MinProtocolVersion; v-- {
+		proto := alpnPrefix + strconv.Itoa(int(v))
+		if v >= versionTransportCaps {
+			proto += "+" + strconv.FormatUint(uint64(caps), 16)
+		}
+		protos = append(protos, proto)
+	}
+
+	return protos
+}
+
+// Returns the version an ALPN protocol name is for, and the capabilities it
+// carries, if any
+func parseALPN(proto string) (byte, Capabilities, bool) {
+	v, ok := strings.CutPrefix(proto, alpnPrefix)
+	if !ok {
+		return 0, 0, false
+	}
+
+	v, c, _ := strings.Cut(v, "+")
+	version, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var caps uint64
+	if c != "" {
+		caps, err = strconv.ParseUint(c, 16, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+
+	return byte(version), Capabilities(caps), true
+}
+
+// The first of a client's ALPN protocols that's for version
+func alpnFor(protos []string, version byte) string {
+	for _, proto := range protos {
+		if v, _, ok := parseALPN(proto); ok && v == version {
+			return proto
+		}
+	}
+
+	return ""
+}
+
+// The range of versions offered in a client's ALPN protocols, or 0 to 0 if
+// it offered none
+func alpnRange(protos []string) (lowest, highest byte) {
+	for _, proto := range protos {
+		v, _, ok := parseALPN(proto)
+		if !ok {
+			continue
+		}
+
+		if lowest == 0 || v < lowest {
+			lowest = v
+		}
+		highest = max(highest, v)
+	}
+
+	return lowest, highest
+}
+
+func newCertificate(key *PrivateKey, commonName string, usage x509.ExtKeyUsage, extensions []pkix.Extension) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: commonName},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(certificateLifetime),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{usage},
+		ExtraExtensions: extensions,
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, template, key.Signer().Public(), key.Signer())
+}
+
+func endorsementExtension(key PublicKey, endorsements []*Endorsement) ([]pkix.Extension, error) {
+	list := [][]byte{}
+	for _, e := range endorsements {
+		if e.NewKey.Equal(key) {
+			list = append(list, e.Marshal())
+		}
+	}
+
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	value, err := asn1.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+
+	return []pkix.Extension{{Id: oidEndorsements, Value: value}}, nil
+}
+
+// Makes a self-signed certificate for the TLS transport, carrying whichever
+// endorsements are of key. Returns the certificate in DER form.
+func NewCertificate(key *PrivateKey, endorsements []*Endorsement) ([]byte, error) {
+	extensions, err := endorsementExtension(key.Public(), endorsements)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCertificate(key, "qpass server", x509.ExtKeyUsageServerAuth, extensions)
+}
+
+// Reports whether cert is for key, carries the same endorsements that
+// NewCertificate would put in it now, and isn't due for renewal
+func CertificateCurrent(cert []byte, key PublicKey, endorsements []*Endorsement) bool {
+	leaf, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return false
+	}
+
+	certKey, err := NewPublicKey(leaf.PublicKey)
+	if err != nil || !certKey.Equal(key) {
+		return false
+	}
+
+	if time.Now().Add(certificateRenewal).After(leaf.NotAfter) {
+		return false
+	}
+
+	want, err := endorsementExtension(key, endorsements)
+	if err != nil {
+		return false
+	}
+
+	var have []pkix.Extension
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidEndorsements) {
+			have = append(have, ext)
+		}
+	}
+
+	if len(have) != len(want) {
+		return false
+	}
+
+	return len(want) == 0 || bytes.Equal(have[0].Value, want[0].Value)
+}
+
+// Returns the key in a server certificate, and the keys that validly endorse it
+func certificateIdentity(cert *x509.Certificate) (PublicKey, []PublicKey, error) {
+	key, err := NewPublicKey(cert.PublicKey)
+	if err != nil {
+		return PublicKey{}, nil, err
+	}
+
+	endorsedBy := []PublicKey{}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidEndorsements) {
+			continue
+		}
+
+		var list [][]byte
+		_, err := asn1.Unmarshal(ext.Value, &list)
+		if err != nil {
+			continue
+		}
+
+		// As with the qpass transport, endorsements that don't check out
+		// are ignored
+		for _, b := range list {
+			e, err := ParseEndorsement(b)
+			if err != nil || !e.NewKey.Equal(key) || e.Verify(time.Now()) != nil {
+				continue
+			}
+			endorsedBy = append(endorsedBy, e.OldKey)
+		}
+	}
+
+	return key, endorsedBy, nil
+}
+
+func (conf *ServerConfig) tlsConfig() (*tls.Config, error) {
+	if len(conf.Certificate) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	leaf, err := x509.ParseCertificate(conf.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	certKey, err := NewPublicKey(leaf.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var hostKey *PrivateKey
+	for _, key := range conf.HostKeys {
+		if key.Public().Equal(certKey) {
+			hostKey = key
+		}
+	}
+
+	if hostKey == nil {
+		return nil, ErrNoCertificate
+	}
+
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{conf.Certificate},
+			PrivateKey:  hostKey.Signer(),
+			Leaf:        leaf,
+		}},
+		NextProtos: alpnProtocols(conf.Capabilities),
+	}
+
+	if conf.VerifyDevice != nil {
+		tc.ClientAuth = tls.RequireAnyClientCert
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			key, err := NewPublicKey(cs.PeerCertificates[0].PublicKey)
+			if err != nil {
+				return err
+			}
+
+			return conf.VerifyDevice(key)
+		}
+	}
+
+	if len(conf.TicketKey) != TicketKeySize {
+		tc.SessionTicketsDisabled = true
+		return tc, nil
+	}
+
+	// TLS has its own session tickets. Seal them under our ticket key, and
+	// stamp them with their issue time so the same lifetime and revocation
+	// apply as over the qpass transport.
+	tc.SetSessionTicketKeys([][32]byte{[32]byte(conf.TicketKey)})
+	tc.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		ss.Extra = append(ss.Extra, binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix())))
+		return tc.EncryptTicket(cs, ss)
+	}
+	tc.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		ss, err := tc.DecryptTicket(identity, cs)
+		if err != nil || ss == nil {
+			return nil, err
+		}
+
+		// Returning no session falls back to a full handshake
+		if len(ss.Extra) == 0 || len(ss.Extra[len(ss.Extra)-1]) != 8 {
+			return nil, nil
+		}
+
+		issued := time.Unix(int64(binary.BigEndian.Uint64(ss.Extra[len(ss.Extra)-1])), 0)
+		if !conf.ticketValid(issued) {
+			return nil, nil
+		}
+
+		return ss, nil
+	}
+
+	return tc, nil
+}
+
+type tlsConn struct {
+	*tls.Conn
+
+	version      byte          // Negotiated protocol version
+	caps         Capabilities  // Optional features both sides support
+	idleTimeout  time.Duration // How long to wait for each read, if set
+	readDeadline time.Time     // Read deadline set by the caller
+	peerDevice   PublicKey     // Client's device key, server side only
+}
+
+func newTLSConn(c *tls.Conn, version byte, caps Capabilities, idleTimeout time.Duration) *tlsConn {
+	return &tlsConn{Conn: c, version: version, caps: caps, idleTimeout: idleTimeout}
+}
+
+func NewTLSServerConn(c net.Conn, conf *ServerConfig) (*tlsConn, error) {
+	tc, err := conf.tlsConfig()
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	err = c.SetDeadline(handshakeDeadline(conf.HandshakeTimeout))
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	// Pick the client's own name for the version, which carries its
+	// capabilities. Without a version in common, the handshake still has to
+	// finish so the client can be told why it's being turned away.
+	var lowest, highest byte
+	tc.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		lowest, highest = alpnRange(hello.SupportedProtos)
+		picking := tc.Clone()
+		picking.NextProtos = nil
+		if version, err := negotiateVersion(lowest, highest); err == nil {
+			picking.NextProtos = []string{alpnFor(hello.SupportedProtos, version)}
+		}
+
+		return picking, nil
+	}
+
+	conn := tls.Server(c, tc)
+	err = conn.Handshake()
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	version, clientCaps, ok := parseALPN(conn.ConnectionState().NegotiatedProtocol)
+	if !ok {
+		// Tell the client why before hanging up
+		conn.Write([]byte{helloRejected, MinProtocolVersion, ProtocolVersion})
+		conn.Close()
+		return nil, handshakeError(tlsHandshake, &VersionMismatchError{MinProtocolVersion, ProtocolVersion, lowest, highest})
+	}
+
+	caps := CapKeyUpdate
+	if version >= versionTransportCaps {
+		caps = transportCaps(conf.Capabilities, clientCaps)
+		_, err = conn.Write(caps.bytes())
+		if err != nil {
+			c.Close()
+			return nil, handshakeError(tlsHandshake, err)
+		}
+	}
+
+	err = c.SetDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	t := newTLSConn(conn, version, caps, conf.IdleTimeout)
+	if conf.VerifyDevice != nil {
+		// Already checked by VerifyConnection
+		t.peerDevice, _ = NewPublicKey(conn.ConnectionState().PeerCertificates[0].PublicKey)
+	}
+
+	return t, nil
+}
+
+func NewTLSClientConn(c net.Conn, conf *ClientConfig) (*tlsConn, error) {
+	if conf == nil {
+		conf = &ClientConfig{}
+	}
+
+	hostname := conf.knownHostname(c)
+
+	serverName := hostname
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		serverName = host
+	}
+
+	callback := TrustOnFirstUse(nil, false)
+	if conf.HostKeyCallback != nil {
+		callback = conf.HostKeyCallback
+	}
+
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: serverName,
+		NextProtos: alpnProtocols(conf.Capabilities),
+		// The certificate is self-signed, the key in it is checked against
+		// known_hosts instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrNoCertificate
+			}
+
+			key, endorsedBy, err := certificateIdentity(cs.PeerCertificates[0])
+			if err != nil {
+				return err
+			}
+
+			// The callback may be waiting on the user, which shouldn't
+			// count against the deadline
+			c.SetDeadline(time.Time{})
+			defer c.SetDeadline(handshakeDeadline(conf.HandshakeTimeout))
+
+			return callback(hostname, key, endorsedBy)
+		},
+	}
+
+	if conf.DeviceKey != nil {
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := newCertificate(conf.DeviceKey, "qpass device", x509.ExtKeyUsageClientAuth, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			return &tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: conf.DeviceKey.Signer()}, nil
+		}
+	}
+
+	if conf.SessionCache != nil {
+		tc.ClientSessionCache = conf.SessionCache.tls
+	}
+
+	err := c.SetDeadline(handshakeDeadline(conf.HandshakeTimeout))
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	conn := tls.Client(c, tc)
+	err = conn.Handshake()
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	version, err := tlsVersion(conn)
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	caps, err := tlsCapabilities(conn, version, conf.Capabilities)
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(tlsHandshake, err)
+	}
+
+	err = c.SetDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return newTLSConn(conn, version, caps, conf.IdleTimeout), nil
+}
+
+// Returns the version the server picked, or reads why it didn't pick one
+func tlsVersion(conn *tls.Conn) (byte, error) {
+	proto := conn.ConnectionState().NegotiatedProtocol
+	if proto == "" {
+		status, err := readField(conn, 3)
+		if err != nil {
+			return 0, err
+		}
+
+		if status[0] != helloRejected {
+			return 0, ErrNotQpass
+		}
+
+		return 0, &VersionMismatchError{MinProtocolVersion, ProtocolVersion, status[1], status[2]}
+	}
+
+	version, _, ok := parseALPN(proto)
+	if !ok || version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, &VersionMismatchError{MinProtocolVersion, ProtocolVersion, version, version}
+	}
+
+	return version, nil
+}
+
+// Reads the capabilities the server agreed to, if the version negotiates them
+func tlsCapabilities(conn *tls.Conn, version byte, local Capabilities) (Capabilities, error) {
+	if version < versionTransportCaps {
+		return CapKeyUpdate, nil
+	}
+
+	b, err := readField(conn, 4)
+	if err != nil {
+		return 0, err
+	}
+
+	// The server can't turn on features we didn't ask for
+	return transportCaps(local, Capabilities(binary.BigEndian.Uint32(b))), nil
+}
+
+// Like Dial, but over TLS
+func DialTLS(addr string, conf *ClientConfig) (*tlsConn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy so the caller's config isn't modified
+	dialConf := ClientConfig{}
+	if conf != nil {
+		dialConf = *conf
+	}
+
+	if dialConf.Hostname == "" {
+		dialConf.Hostname = addr
+	}
+
+	return NewTLSClientConn(c, &dialConf)
+}
+
+func (t *tlsConn) Read(b []byte) (int, error) {
+	if t.idleTimeout > 0 {
+		deadline := time.Now().Add(t.idleTimeout)
+		if !t.readDeadline.IsZero() && t.readDeadline.Before(deadline) {
+			deadline = t.readDeadline
+		}
+
+		err := t.Conn.SetReadDeadline(deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return t.Conn.Read(b)
+}
+
+func (t *tlsConn) SetDeadline(d time.Time) error {
+	t.readDeadline = d
+	return t.Conn.SetDeadline(d)
+}
+
+func (t *tlsConn) SetReadDeadline(d time.Time) error {
+	t.readDeadline = d
+	return t.Conn.SetReadDeadline(d)
+}
+
+func (t *tlsConn) PeerDevice() PublicKey {
+	return t.peerDevice
+}
+
+// Protocol version agreed on during the handshake
+func (t *tlsConn) Version() byte {
+	return t.version
+}
+
+// Optional features both sides agreed to use. TLS replaces its keys on its
+// own.
+func (t *tlsConn) Capabilities() Capabilities {
+	return t.caps
+}
@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testTLSServerConfig(t *testing.T) *ServerConfig {
+	t.Helper()
+	conf := testServerConfig(t)
+	cert, err := NewCertificate(conf.HostKeys[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Certificate = cert
+
+	return conf
+}
+
+type tlsResult struct {
+	conn *tlsConn
+	err  error
+}
+
+func TestTLSVersion(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	conf := testTLSServerConfig(t)
+	conf.Capabilities = testCapB | CapDeviceAuth
+	done := make(chan tlsResult, 1)
+	go func() {
+		conn, err := NewTLSServerConn(s, conf)
+		done <- tlsResult{conn, err}
+	}()
+
+	client, err := NewTLSClientConn(c, &ClientConfig{Hostname: "test", HostKeyCallback: acceptAnyHost, Capabilities: testCapA | testCapB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if client.Version() != ProtocolVersion || r.conn.Version() != ProtocolVersion {
+		t.Errorf("negotiated versions %d and %d, want %d", client.Version(), r.conn.Version(), ProtocolVersion)
+	}
+
+	if want := testCapB | CapKeyUpdate; client.Capabilities() != want || r.conn.Capabilities() != want {
+		t.Errorf("negotiated capabilities %b and %b, want %b", client.Capabilities(), r.conn.Capabilities(), want)
+	}
+}
+
+func TestTLSOlderClient(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	conf := testTLSServerConfig(t)
+	conf.Capabilities = testCapB
+	done := make(chan tlsResult, 1)
+	go func() {
+		conn, err := NewTLSServerConn(s, conf)
+		done <- tlsResult{conn, err}
+	}()
+
+	// A client from before capabilities were negotiated over TLS
+	old := versionTransportCaps - 1
+	conn := tls.Client(c, &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpnPrefix + strconv.Itoa(int(old))},
+	})
+	err := conn.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if r.conn.Version() != old || r.conn.Capabilities() != CapKeyUpdate {
+		t.Errorf("negotiated version %d with capabilities %b, want %d with none", r.conn.Version(), r.conn.Capabilities(), old)
+	}
+
+	// Nothing the client doesn't expect is sent after the handshake
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := conn.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %d bytes and %v, want a timeout", n, err)
+	}
+}
+
+func TestTLSVersionMismatch(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	conf := testTLSServerConfig(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewTLSServerConn(s, conf)
+		done <- err
+	}()
+
+	// A client from the future
+	conn := tls.Client(c, &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpnPrefix + "200"},
+	})
+	err := conn.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tlsVersion(conn)
+	var mismatch *VersionMismatchError
+	if !errors.As(err, &mismatch) || mismatch.RemoteMin != MinProtocolVersion || mismatch.RemoteMax != ProtocolVersion {
+		t.Fatalf("client got %v, want the server's versions", err)
+	}
+
+	// Let the server's close notification through
+	go io.Copy(io.Discard, conn)
+
+	err = <-done
+	if !errors.As(err, &mismatch) || mismatch.RemoteMin != 200 || mismatch.RemoteMax != 200 {
+		t.Fatalf("server got %v, want the client's versions", err)
+	}
+}
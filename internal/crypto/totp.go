@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Time-based one-time passwords (RFC 6238) are the second factor the sync
+// server can ask for after a user's auth token. They use the defaults
+// authenticator apps expect: HMAC-SHA1, six digits and 30 second steps.
+//
+// Users who lose their authenticator can use one of a set of recovery codes
+// instead, each of which works once. They're written like
+//
+//	ABCDE-FGHIJ
+const (
+	TOTPPeriod = 30 * time.Second
+	TOTPDigits = 6
+
+	totpModulus = 1_000_000 // 10^TOTPDigits
+
+	totpSecretSize = 20
+	// How many steps either side of now a code is accepted for, to allow
+	// for clocks being a little out
+	totpSkew = 1
+
+	TOTPRecoveryCodeCount = 10
+	totpRecoveryCodeSize  = 6
+)
+
+// Generates a secret to share with the user's authenticator app
+func NewTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// The time step t falls in
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(step)))
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTPDigits, code%totpModulus)
+}
+
+// The code an authenticator app with secret shows at t
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpCode(secret, TOTPStep(t))
+}
+
+// Checks code against secret at t, and returns the step it was for. Codes
+// for lastStep or earlier are refused, so each code can only be used once.
+func VerifyTOTP(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits || len(secret) == 0 {
+		return 0, false
+	}
+
+	now := TOTPStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// The secret as users type it into an authenticator app
+func EncodeTOTPSecret(secret []byte) string {
+	return recoveryEncoding.EncodeToString(secret)
+}
+
+// An otpauth URI for the secret, which authenticator apps can import
+func TOTPURI(secret []byte, issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", EncodeTOTPSecret(secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// Generates a set of recovery codes to show the user
+func NewTOTPRecoveryCodes() ([]string, error) {
+	codes := make([]string, TOTPRecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, totpRecoveryCodeSize)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := recoveryEncoding.EncodeToString(raw)
+		half := len(encoded) / 2
+		codes[i] = encoded[:half] + "-" + encoded[half:]
+	}
+
+	return codes, nil
+}
+
+// What the sync server stores to check a recovery code against. Case,
+// spaces and dashes don't matter.
+func TOTPRecoveryCodeHash(code string) []byte {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+
+	h := blake2b.Sum256([]byte(cleaned))
+	return h[:]
+}
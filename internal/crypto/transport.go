@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// The payload stream can be carried by the qpass handshake and record layer,
+// by TLS 1.3 for running behind standard tooling, or by a Noise handshake and
+// the qpass record layer. A server can accept all three on the same port: the
+// first byte of a qpass client hello is always 'Q', the first byte of a TLS
+// client hello is always 0x16, and a Noise client starts with 'N'.
+const (
+	TransportQpass = "qpass"
+	TransportTLS   = "tls"
+	TransportNoise = "noise"
+)
+
+const tlsHandshakeRecord = 0x16
+
+var (
+	ErrUnknownTransport  = errors.New("unknown transport")
+	ErrTransportDisabled = errors.New("Transport is not enabled on this server")
+)
+
+// Connection returned by either transport
+type Conn interface {
+	net.Conn
+
+	// Protocol version both sides agreed to speak
+	Version() byte
+	// Optional features both sides agreed to use
+	Capabilities() Capabilities
+	// Device key the client proved it holds during the handshake. Zero on
+	// client connections and when device authentication wasn't used.
+	PeerDevice() PublicKey
+}
+
+func (conf *ServerConfig) transportEnabled(transport string) bool {
+	if len(conf.Transports) == 0 {
+		return transport == TransportQpass
+	}
+
+	return slices.Contains(conf.Transports, transport)
+}
+
+// Puts a byte we've already read back in front of the rest of the stream
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Works out from the first byte which transport the client is using, and
+// runs the server side of its handshake
+func Accept(c net.Conn, conf *ServerConfig) (Conn, error) {
+	first := make([]byte, 1)
+	err := c.SetReadDeadline(handshakeDeadline(conf.HandshakeTimeout))
+	if err == nil {
+		_, err = io.ReadFull(c, first)
+	}
+	if err != nil {
+		c.Close()
+		return nil, handshakeError(serverReadHello, err)
+	}
+
+	// The handshakes set their own deadlines
+	c.SetReadDeadline(time.Time{})
+	pc := &prefixConn{c, io.MultiReader(bytes.NewReader(first), c)}
+
+	transport := TransportQpass
+	switch first[0] {
+	case tlsHandshakeRecord:
+		transport = TransportTLS
+	case noiseProtocolName[0]:
+		transport = TransportNoise
+	}
+
+	if !conf.transportEnabled(transport) {
+		c.Close()
+		return nil, ErrTransportDisabled
+	}
+
+	switch transport {
+	case TransportTLS:
+		tc, err := NewTLSServerConn(pc, conf)
+		if err != nil {
+			return nil, err
+		}
+		return tc, nil
+	case TransportNoise:
+		nc, err := NewNoiseServerConn(pc, conf)
+		if err != nil {
+			return nil, err
+		}
+		return nc, nil
+	}
+
+	sc, err := NewServerConn(pc, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// Dials addr with the given transport. An empty transport means qpass.
+func DialTransport(transport, addr string, conf *ClientConfig) (Conn, error) {
+	switch transport {
+	case "", TransportQpass:
+		sc, err := Dial(addr, conf)
+		if err != nil {
+			return nil, err
+		}
+		return sc, nil
+	case TransportTLS:
+		tc, err := DialTLS(addr, conf)
+		if err != nil {
+			return nil, err
+		}
+		return tc, nil
+	case TransportNoise:
+		nc, err := DialNoise(addr, conf)
+		if err != nil {
+			return nil, err
+		}
+		return nc, nil
+	}
+
+	return nil, ErrUnknownTransport
+}
@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Every client hello starts with the magic bytes, followed by the range of
+// protocol versions the client speaks and the optional features it would like
+// to use. The server picks the highest version both sides speak and the
+// features both sides support, and sends them back at the start of its hello.
+// If there is no version in common, it says so in the clear and hangs up, so
+// the client can report that rather than failing to decrypt.
+//
+// The version and feature bits are part of the signed handshake transcript,
+// so they can't be tampered with to force a downgrade.
+var protocolMagic = []byte("QPASS")
+
+const (
+	// Highest protocol version this build speaks
+	ProtocolVersion byte = 6
+	// Lowest protocol version this build still speaks. Version 2 changed how
+	// payloads are framed and encoded, which version 1 peers can't read,
+	// version 3 added request IDs to the framing, version 4 sends errors
+	// with codes, version 5 added revisions to syncs, and version 6
+	// negotiates capabilities over the Noise and TLS transports. The
+	// payload layer speaks each of them according to the version a
+	// connection negotiated, so raising this locks out every client that
+	// hasn't updated.
+	MinProtocolVersion byte = 2
+)
+
+const (
+	helloAccepted byte = iota
+	helloRejected
+)
+
+// Bit set of optional protocol features. Bits are added as optional features
+// are introduced, and a feature is only used if both sides set its bit.
+type Capabilities uint32
+
+const (
+	// Server issues session tickets, and the client hello carries one
+	CapSessionTickets Capabilities = 1 << iota
+	// Client proves it holds a device key during the handshake
+	CapDeviceAuth
+	// Either side can replace its traffic key during the connection
+	CapKeyUpdate
+	// Syncs only send what changed since the last one
+	CapDeltaSync
+)
+
+// Features the qpass handshake negotiates for itself. The Noise and TLS
+// transports handle them their own way, so only the rest are negotiated
+// over them.
+const handshakeCaps = CapSessionTickets | CapDeviceAuth | CapKeyUpdate
+
+// First version in which the Noise and TLS transports negotiate capabilities
+const versionTransportCaps byte = 6
+
+// The features both sides set, out of those negotiated over the Noise and
+// TLS transports. Both replace their keys as needed.
+func transportCaps(local, remote Capabilities) Capabilities {
+	return local&remote&^handshakeCaps | CapKeyUpdate
+}
+
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+func (c Capabilities) bytes() []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(c))
+}
+
+var ErrNotQpass = errors.New("Peer is not speaking the qpass protocol")
+
+type VersionMismatchError struct {
+	LocalMin, LocalMax   byte
+	RemoteMin, RemoteMax byte
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("Incompatible protocol version: peer speaks versions %d to %d, we speak %d to %d",
+		e.RemoteMin, e.RemoteMax, e.LocalMin, e.LocalMax)
+}
+
+// Picks the highest version in both ranges
+func negotiateVersion(remoteMin, remoteMax byte) (byte, error) {
+	version := min(remoteMax, ProtocolVersion)
+	if version < max(remoteMin, MinProtocolVersion) {
+		return 0, &VersionMismatchError{MinProtocolVersion, ProtocolVersion, remoteMin, remoteMax}
+	}
+
+	return version, nil
+}
@@ -22,25 +22,109 @@ func OpenDB(dsn string) (*sql.DB, error) {
 
 func InitializeDB(db *sql.DB, client bool) error {
 	var stmt string
+	var columns map[string]string
 	// Only users table needs to be different between client and server
 	if client {
-		stmt = "CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, uuid TEXT UNIQUE, username TEXT)"
+		stmt = "CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, uuid TEXT UNIQUE, username TEXT, kdf TEXT, data_key TEXT, stale BOOLEAN DEFAULT FALSE, bound_entries BOOLEAN DEFAULT FALSE, recovery_key TEXT, recovery_verifier TEXT, sync_revision INTEGER DEFAULT 0)"
+		columns = map[string]string{"kdf": "TEXT", "data_key": "TEXT", "stale": "BOOLEAN DEFAULT FALSE", "bound_entries": "BOOLEAN DEFAULT FALSE", "recovery_key": "TEXT", "recovery_verifier": "TEXT", "sync_revision": "INTEGER DEFAULT 0"}
 	} else {
-		stmt = "CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, uuid TEXT UNIQUE, auth_token TEXT)"
+		stmt = "CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, uuid TEXT UNIQUE, auth_token TEXT, token_kdf TEXT, lookup TEXT, kdf TEXT, data_key TEXT, recovery_key TEXT, recovery_verifier TEXT, totp_secret TEXT, totp_pending TEXT, totp_last_step INTEGER, revision INTEGER DEFAULT 0)"
+		columns = map[string]string{"token_kdf": "TEXT", "lookup": "TEXT", "kdf": "TEXT", "data_key": "TEXT", "recovery_key": "TEXT", "recovery_verifier": "TEXT", "totp_secret": "TEXT", "totp_pending": "TEXT", "totp_last_step": "INTEGER", "revision": "INTEGER DEFAULT 0"}
 	}
 	_, err := db.Exec(stmt)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS passwords (id INTEGER PRIMARY KEY, uuid TEXT UNIQUE, userId TEXT, service TEXT, username TEXT, password TEXT, last_changed DATETIME DEFAULT CURRENT_TIMESTAMP, deleted BOOLEAN DEFAULT FALSE)")
+	// Users from before key derivation parameters were recorded have NULL
+	// parameters, meaning the legacy ones, and users from before data keys
+	// have no data key. Recovery keys and TOTP are optional, so NULL without
+	// them. Users from before syncs were tracked by revision start from 0,
+	// meaning a full sync.
+	for column, decl := range columns {
+		err = addColumn(db, "users", column, decl)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS passwords (id INTEGER PRIMARY KEY, uuid TEXT UNIQUE, userId TEXT, service TEXT, username TEXT, password TEXT, last_changed DATETIME DEFAULT CURRENT_TIMESTAMP, deleted BOOLEAN DEFAULT FALSE, revision INTEGER DEFAULT 0, unsynced BOOLEAN DEFAULT FALSE)")
+	if err != nil {
+		return err
+	}
+
+	// The server stamps each password with the revision of the user's
+	// passwords it was last changed in, and clients mark the ones changed
+	// since they last synced. Passwords from before either were all sent on
+	// every sync, and are again on the first one after.
+	err = addColumn(db, "passwords", "revision", "INTEGER DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = addColumn(db, "passwords", "unsynced", "BOOLEAN DEFAULT FALSE")
 	if err != nil {
 		return err
 	}
 
+	// Only the server keeps track of client devices
+	if !client {
+		// Tokens replaced by a credential change, so devices still using
+		// them can be told to log in again
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS retired_tokens (id INTEGER PRIMARY KEY, uuid TEXT, auth_token TEXT, token_kdf TEXT)")
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS devices (id INTEGER PRIMARY KEY, key_algorithm TEXT, public_key TEXT, user_uuid TEXT, last_seen DATETIME DEFAULT CURRENT_TIMESTAMP, revoked BOOLEAN DEFAULT FALSE, totp_verified DATETIME, UNIQUE (key_algorithm, public_key))")
+		if err != nil {
+			return err
+		}
+
+		// Devices from before TOTP haven't passed it
+		err = addColumn(db, "devices", "totp_verified", "DATETIME")
+		if err != nil {
+			return err
+		}
+
+		// Hashes of unused TOTP recovery codes
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS totp_recovery_codes (id INTEGER PRIMARY KEY, uuid TEXT, code_hash TEXT, UNIQUE (uuid, code_hash))")
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Adds a column to a table created by an older version, if it's missing
+func addColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+
+		if name == column {
+			return nil
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
 func getHome(dirname string) (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
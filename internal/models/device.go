@@ -0,0 +1,141 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/google/uuid"
+)
+
+// A client device known to the server, identified by the device key it
+// proves during the handshake. Devices are recorded the first time a user
+// logs in or registers from them.
+type Device struct {
+	ID       int
+	Key      crypto.PublicKey
+	UserID   uuid.UUID
+	LastSeen time.Time
+	Revoked  bool
+	// When the device last passed the user's TOTP second factor, or zero
+	TOTPVerified time.Time
+}
+
+func (d Device) Fingerprint() string {
+	return crypto.Fingerprint(d.Key)
+}
+
+type DeviceModel struct {
+	DB *sql.DB
+}
+
+var ErrNoDevice = errors.New("No such device")
+
+func encodeDeviceKey(key crypto.PublicKey) (string, string) {
+	return crypto.KeyAlgorithmName(key.Algorithm), base64.RawStdEncoding.EncodeToString(key.Marshal())
+}
+
+func scanDevice(row interface{ Scan(...any) error }) (Device, error) {
+	var d Device
+	var algStr, keyStr, userStr string
+	var totpVerified sql.NullTime
+	err := row.Scan(&d.ID, &algStr, &keyStr, &userStr, &d.LastSeen, &d.Revoked, &totpVerified)
+	if err != nil {
+		return Device{}, err
+	}
+	d.TOTPVerified = totpVerified.Time
+
+	alg, err := crypto.ParseKeyAlgorithm(algStr)
+	if err != nil {
+		return Device{}, err
+	}
+
+	keyBytes, err := base64.RawStdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return Device{}, err
+	}
+
+	d.Key, err = crypto.ParsePublicKey(alg, keyBytes)
+	if err != nil {
+		return Device{}, err
+	}
+
+	d.UserID, err = uuid.Parse(userStr)
+	if err != nil {
+		return Device{}, err
+	}
+
+	return d, nil
+}
+
+func (m *DeviceModel) Get(key crypto.PublicKey) (Device, error) {
+	alg, keyStr := encodeDeviceKey(key)
+	stmt := `SELECT id, key_algorithm, public_key, user_uuid, last_seen, revoked, totp_verified FROM devices WHERE key_algorithm = ? AND public_key = ?`
+	d, err := scanDevice(m.DB.QueryRow(stmt, alg, keyStr))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Device{}, ErrNoDevice
+	}
+
+	return d, err
+}
+
+func (m *DeviceModel) GetAll() ([]Device, error) {
+	stmt := `SELECT id, key_algorithm, public_key, user_uuid, last_seen, revoked, totp_verified FROM devices ORDER BY last_seen DESC`
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, d)
+	}
+
+	return devices, rows.Err()
+}
+
+// Records that the device was used by the user, adding the device if it's new.
+// A device that changes hands has to pass the new user's TOTP again.
+func (m *DeviceModel) Register(key crypto.PublicKey, userID uuid.UUID) error {
+	alg, keyStr := encodeDeviceKey(key)
+	stmt := `INSERT INTO devices (key_algorithm, public_key, user_uuid, last_seen) VALUES (?, ?, ?, ?)
+	ON CONFLICT (key_algorithm, public_key) DO UPDATE SET user_uuid = excluded.user_uuid, last_seen = excluded.last_seen,
+	totp_verified = CASE WHEN user_uuid = excluded.user_uuid THEN totp_verified ELSE NULL END`
+	_, err := m.DB.Exec(stmt, alg, keyStr, userID.String(), time.Now())
+	return err
+}
+
+// Records that the device passed its user's TOTP at the given time
+func (m *DeviceModel) MarkTOTPVerified(key crypto.PublicKey, at time.Time) error {
+	alg, keyStr := encodeDeviceKey(key)
+	stmt := `UPDATE devices SET totp_verified = ? WHERE key_algorithm = ? AND public_key = ?`
+	_, err := m.DB.Exec(stmt, at, alg, keyStr)
+	return err
+}
+
+func (m *DeviceModel) Revoke(id int) error {
+	result, err := m.DB.Exec(`UPDATE devices SET revoked = TRUE WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNoDevice
+	}
+
+	return nil
+}
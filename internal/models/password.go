@@ -19,29 +19,49 @@ type Password struct {
 	UserID       uuid.UUID
 	ServiceName  string
 	Username     string
-	Password     string
 	LastChanged  time.Time
 	Deleted      bool
 	EServiceName string
 	EUsername    string
 	EPassword    string
+
+	// Unexported so it's never sent to the sync server, which only ever
+	// sees the encrypted fields
+	password *crypto.Secret
 }
 
 type PasswordList []Password
 
+// Returns the decrypted password, which is only valid until p is destroyed
+func (p Password) Plaintext() *crypto.Secret {
+	return p.password
+}
+
+// Zeroes the decrypted password. Copies of p share it.
+func (p *Password) Destroy() {
+	p.password.Destroy()
+}
+
+// Zeroes every decrypted password in the list, on logout
+func (pl PasswordList) Destroy() {
+	for i := range pl {
+		pl[i].Destroy()
+	}
+}
+
 func (p *Password) decrypt(u User) error {
 	var err error
-	p.ServiceName, err = crypto.Decrypt(p.EServiceName, u.Key)
+	p.ServiceName, err = decryptString(p.EServiceName, u, p.UUID, "service")
 	if err != nil {
 		return err
 	}
 
-	p.Username, err = crypto.Decrypt(p.EUsername, u.Key)
+	p.Username, err = decryptString(p.EUsername, u, p.UUID, "username")
 	if err != nil {
 		return err
 	}
 
-	p.Password, err = crypto.Decrypt(p.EPassword, u.Key)
+	p.password, err = decryptField(p.EPassword, u, p.UUID, "password")
 	if err != nil {
 		return err
 	}
@@ -49,9 +69,68 @@ func (p *Password) decrypt(u User) error {
 	return nil
 }
 
+func (p *Password) encrypt(u User) error {
+	var err error
+	p.EServiceName, err = encryptField([]byte(p.ServiceName), u, p.UUID, "service")
+	if err != nil {
+		return err
+	}
+
+	p.EUsername, err = encryptField([]byte(p.Username), u, p.UUID, "username")
+	if err != nil {
+		return err
+	}
+
+	p.EPassword, err = encryptField(p.password.Bytes(), u, p.UUID, "password")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reports whether every field is encrypted by encryptField
+func (p *Password) isBound() bool {
+	return crypto.IsBound(p.EServiceName) && crypto.IsBound(p.EUsername) && crypto.IsBound(p.EPassword)
+}
+
+// Each field is bound to its owner, entry and field name, so a ciphertext
+// can't be moved to another entry or field without failing to decrypt
+func fieldBinding(owner, entry uuid.UUID, field string) []byte {
+	b := append([]byte("qpass entry v1"), owner[:]...)
+	b = append(b, entry[:]...)
+	return append(b, field...)
+}
+
+func encryptField(b []byte, u User, entry uuid.UUID, field string) (string, error) {
+	return crypto.EncryptBound(b, u.Key, fieldBinding(u.ID, entry, field))
+}
+
+// Fields from before they were bound are only accepted until all of the
+// user's entries have been re-encrypted
+func decryptField(s string, u User, entry uuid.UUID, field string) (*crypto.Secret, error) {
+	if !crypto.IsBound(s) && !u.BoundEntries {
+		return crypto.DecryptSecret(s, u.Key)
+	}
+
+	return crypto.DecryptBound(s, u.Key, fieldBinding(u.ID, entry, field))
+}
+
+// Service names and usernames are shown and searched as they are, so they're
+// kept as strings
+func decryptString(s string, u User, entry uuid.UUID, field string) (string, error) {
+	secret, err := decryptField(s, u, entry, field)
+	if err != nil {
+		return "", err
+	}
+	defer secret.Destroy()
+
+	return secret.Reveal(), nil
+}
+
 // Probably not the best way to write this...
 func (p *Password) isDecrypted() bool {
-	return p.ServiceName != "" && p.Username != "" && p.Password != ""
+	return p.ServiceName != "" && p.Username != "" && p.password.Len() > 0
 }
 
 // Notably not Equals(), because I'm only interested in if
@@ -66,28 +145,20 @@ type PasswordModel struct {
 }
 
 func (m *PasswordModel) Insert(u User, serviceName, username, password string) (int, error) {
-	eServiceName, err := crypto.Encrypt(serviceName, u.Key)
-	if err != nil {
-		return 0, err
-	}
-
-	eUsername, err := crypto.Encrypt(username, u.Key)
-	if err != nil {
-		return 0, err
-	}
-
-	ePassword, err := crypto.Encrypt(password, u.Key)
+	UUID, err := uuid.NewRandom()
 	if err != nil {
 		return 0, err
 	}
 
-	UUID, err := uuid.NewRandom()
+	p := Password{UUID: UUID, ServiceName: serviceName, Username: username, password: crypto.SecretFromString(password)}
+	err = p.encrypt(u)
+	p.Destroy()
 	if err != nil {
 		return 0, err
 	}
 
-	stmt := `INSERT INTO passwords (uuid, userId, service, username, password) VALUES (?, ?, ?, ?, ?)`
-	result, err := m.DB.Exec(stmt, UUID.String(), u.ID.String(), eServiceName, eUsername, ePassword)
+	stmt := `INSERT INTO passwords (uuid, userId, service, username, password, unsynced) VALUES (?, ?, ?, ?, ?, TRUE)`
+	result, err := m.DB.Exec(stmt, UUID.String(), u.ID.String(), p.EServiceName, p.EUsername, p.EPassword)
 	if err != nil {
 		return 0, err
 	}
@@ -100,24 +171,22 @@ func (m *PasswordModel) Insert(u User, serviceName, username, password string) (
 	return int(id), nil
 }
 
-func (m *PasswordModel) Update(u User, id, serviceName, username, password string) error {
-	eServiceName, err := crypto.Encrypt(serviceName, u.Key)
+// Takes the password as a Secret, so the client can keep the current one
+// without revealing it. It's left for the caller to destroy.
+func (m *PasswordModel) Update(u User, id, serviceName, username string, password *crypto.Secret) error {
+	UUID, err := uuid.Parse(id)
 	if err != nil {
 		return err
 	}
 
-	eUsername, err := crypto.Encrypt(username, u.Key)
+	p := Password{UUID: UUID, ServiceName: serviceName, Username: username, password: password}
+	err = p.encrypt(u)
 	if err != nil {
 		return err
 	}
 
-	ePassword, err := crypto.Encrypt(password, u.Key)
-	if err != nil {
-		return err
-	}
-
-	stmt := `UPDATE passwords SET service = ?, username = ?, password = ?, last_changed = ? WHERE uuid = ?`
-	_, err = m.DB.Exec(stmt, eServiceName, eUsername, ePassword, time.Now(), id)
+	stmt := `UPDATE passwords SET service = ?, username = ?, password = ?, last_changed = ?, unsynced = TRUE WHERE uuid = ?`
+	_, err = m.DB.Exec(stmt, p.EServiceName, p.EUsername, p.EPassword, time.Now(), id)
 	return err
 }
 
@@ -177,6 +246,7 @@ func (m *PasswordModel) GetAllForUser(u User, includeDeleted bool) (PasswordList
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	pws := PasswordList{}
 	for rows.Next() {
@@ -192,18 +262,19 @@ func (m *PasswordModel) GetAllForUser(u User, includeDeleted bool) (PasswordList
 			continue
 		}
 
-		err = pw.decrypt(u)
+		pw.UUID, err = uuid.Parse(uuidString)
 		if err != nil {
 			return nil, err
 		}
 
-		pw.UUID, err = uuid.Parse(uuidString)
+		pw.UserID, err = uuid.Parse(useridString)
 		if err != nil {
 			return nil, err
 		}
 
-		pw.UserID, err = uuid.Parse(useridString)
+		err = pw.decrypt(u)
 		if err != nil {
+			pws.Destroy()
 			return nil, err
 		}
 
@@ -221,6 +292,24 @@ func (m *PasswordModel) GetAllEncryptedForUser(u User) (PasswordList, error) {
 		return nil, err
 	}
 
+	return scanEncrypted(rows)
+}
+
+// Client only. Returns u's passwords that have changed since they were last
+// synced, still encrypted.
+func (m *PasswordModel) GetUnsyncedForUser(u User) (PasswordList, error) {
+	stmt := `SELECT id, uuid, userId, service, username, password, last_changed, deleted FROM passwords WHERE userId = ? AND unsynced = TRUE`
+	rows, err := m.DB.Query(stmt, u.ID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return scanEncrypted(rows)
+}
+
+func scanEncrypted(rows *sql.Rows) (PasswordList, error) {
+	defer rows.Close()
+
 	pws := PasswordList{}
 	for rows.Next() {
 		pw := Password{}
@@ -244,7 +333,7 @@ func (m *PasswordModel) GetAllEncryptedForUser(u User) (PasswordList, error) {
 		pws = append(pws, pw)
 	}
 
-	return pws, nil
+	return pws, rows.Err()
 }
 
 func (m *PasswordModel) DumbUpdate(p Password) error {
@@ -271,31 +360,228 @@ func (m *PasswordModel) Exists(UUID string) (bool, error) {
 	return result, err
 }
 
-func (m *PasswordModel) ReplaceAllForUser(userID string, pwl PasswordList) error {
-	userUUID, err := uuid.Parse(userID)
+var ErrNotOwner = errors.New("Passwords not for this user")
+
+// Reports whether p and other hold the same ciphertexts
+func (p *Password) sameCopy(other Password) bool {
+	return p.EServiceName == other.EServiceName && p.EUsername == other.EUsername && p.EPassword == other.EPassword && p.Deleted == other.Deleted
+}
+
+// Server only. Merges a batch of a client's passwords into the user's,
+// keeping whichever copy of each changed last, and a deleted copy over any
+// other. Deleted passwords are kept so other clients find out about them.
+// Passwords that change are stamped with a new revision of the user's
+// passwords, which is returned, or 0 if nothing changed, along with the
+// server's copies that were kept over the client's.
+func (m *PasswordModel) ServerMerge(userID uuid.UUID, pl PasswordList) (uint64, PasswordList, error) {
+	tx, err := m.DB.Begin()
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
+	defer tx.Rollback()
+
+	// Taking the revision first locks the database for writing, so merges
+	// commit in the order of their revisions
+	var revision uint64
+	err = tx.QueryRow(`UPDATE users SET revision = revision + 1 WHERE uuid = ? RETURNING revision`, userID.String()).Scan(&revision)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	changed := false
+	kept := PasswordList{}
+	for _, p := range pl {
+		if p.UserID != userID {
+			return 0, nil, ErrNotOwner
+		}
+
+		rows, err := tx.Query(`SELECT id, uuid, userId, service, username, password, last_changed, deleted FROM passwords WHERE uuid = ?`, p.UUID.String())
+		if err != nil {
+			return 0, nil, err
+		}
 
-	for _, pw := range pwl {
-		if !bytes.Equal(userUUID[:], pw.UserID[:]) {
-			return errors.New("Passwords not for this user")
+		current, err := scanEncrypted(rows)
+		if err != nil {
+			return 0, nil, err
 		}
+
+		switch {
+		case len(current) == 0:
+			_, err = tx.Exec(`INSERT INTO passwords (uuid, userId, service, username, password, last_changed, deleted, revision) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				p.UUID.String(), p.UserID.String(), p.EServiceName, p.EUsername, p.EPassword, p.LastChanged, p.Deleted, revision)
+			changed = true
+		case current[0].UserID != userID:
+			return 0, nil, ErrNotOwner
+		case current[0].sameCopy(p):
+		case !current[0].Deleted && (p.Deleted || p.LastChanged.After(current[0].LastChanged)):
+			_, err = tx.Exec(`UPDATE passwords SET service = ?, username = ?, password = ?, last_changed = ?, deleted = ?, revision = ? WHERE uuid = ?`,
+				p.EServiceName, p.EUsername, p.EPassword, p.LastChanged, p.Deleted, revision, p.UUID.String())
+			changed = true
+		default:
+			kept = append(kept, current[0])
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if !changed {
+		return 0, kept, nil
+	}
+
+	return revision, kept, tx.Commit()
+}
+
+// Server only. Returns the user's passwords changed since the given
+// revision, or all of them from 0, leaving out those changed in any of the
+// revisions in skip, along with the revision they're up to.
+func (m *PasswordModel) ServerChanges(userID uuid.UUID, since uint64, skip []uint64) (PasswordList, uint64, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, 0, err
 	}
+	defer tx.Rollback()
 
-	_, err = m.DB.Exec(`DELETE FROM passwords WHERE userId = ?`, userID)
+	var revision uint64
+	err = tx.QueryRow(`SELECT revision FROM users WHERE uuid = ?`, userID.String()).Scan(&revision)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+
+	stmt := `SELECT id, uuid, userId, service, username, password, last_changed, deleted FROM passwords WHERE userId = ? AND revision > ?`
+	args := []any{userID.String(), since}
+	if since == 0 {
+		// Passwords from before revisions are at 0
+		stmt = `SELECT id, uuid, userId, service, username, password, last_changed, deleted FROM passwords WHERE userId = ?`
+		args = args[:1]
+	}
+	for _, r := range skip {
+		stmt += ` AND revision != ?`
+		args = append(args, r)
+	}
+
+	rows, err := tx.Query(stmt, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pws, err := scanEncrypted(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return pws, revision, tx.Commit()
+}
+
+// Server only. Returns the revision the user's passwords are up to.
+func (m *PasswordModel) ServerRevision(userID uuid.UUID) (uint64, error) {
+	var revision uint64
+	err := m.DB.QueryRow(`SELECT revision FROM users WHERE uuid = ?`, userID.String()).Scan(&revision)
+	return revision, err
+}
+
+// Client only. Returns the revision of the server's copies of u's passwords
+// that they were last synced up to, or 0 if they never were.
+func (m *PasswordModel) SyncRevision(u User) (uint64, error) {
+	var revision uint64
+	err := m.DB.QueryRow(`SELECT sync_revision FROM users WHERE uuid = ?`, u.ID.String()).Scan(&revision)
+	return revision, err
+}
+
+// Client only. Records a sync of u's passwords: the ones that were sent are
+// marked as synced, unless they've changed again since, and the server's
+// changes are taken, except over passwords that have. Changes that can't be
+// read with u's key are left out and returned. The next sync starts from
+// revision, or from where this one did if any were left out, so the server
+// sends them again.
+func (m *PasswordModel) ApplySync(u User, sent, changes PasswordList, revision uint64) (PasswordList, error) {
+	for _, p := range changes {
+		if p.UserID != u.ID {
+			return nil, ErrNotOwner
+		}
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	for _, pw := range pwl {
-		err = m.DumbInsert(pw)
+	for _, p := range sent {
+		_, err = tx.Exec(`UPDATE passwords SET unsynced = FALSE WHERE uuid = ? AND service = ? AND username = ? AND password = ? AND deleted = ?`,
+			p.UUID.String(), p.EServiceName, p.EUsername, p.EPassword, p.Deleted)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	skipped := PasswordList{}
+	for _, p := range changes {
+		// A copy that can't be read would leave the whole list unreadable,
+		// so it's left out. One from a device that hasn't bound its entries
+		// yet is bound here, and sent back unless it's deleted.
+		unsynced := false
+		if u.BoundEntries && !p.isBound() {
+			bound, ok := bindEntry(u, p)
+			if !ok {
+				skipped = append(skipped, p)
+				continue
+			}
+			p = bound
+			unsynced = !p.Deleted
+		} else if !p.readable(u) {
+			skipped = append(skipped, p)
+			continue
+		}
+
+		stmt := `INSERT INTO passwords (uuid, userId, service, username, password, last_changed, deleted, unsynced) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (uuid) DO UPDATE SET service = excluded.service, username = excluded.username, password = excluded.password,
+			last_changed = excluded.last_changed, deleted = excluded.deleted, unsynced = excluded.unsynced WHERE userId = excluded.userId AND unsynced = FALSE`
+		_, err = tx.Exec(stmt, p.UUID.String(), p.UserID.String(), p.EServiceName, p.EUsername, p.EPassword, p.LastChanged, p.Deleted, unsynced)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(skipped) == 0 {
+		_, err = tx.Exec(`UPDATE users SET sync_revision = ? WHERE uuid = ?`, revision, u.ID.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return skipped, tx.Commit()
+}
+
+// Reports whether every field of p decrypts with u's key
+func (p Password) readable(u User) bool {
+	err := p.decrypt(u)
+	p.Destroy()
+	return err == nil
+}
+
+// Re-encrypts a password from before fields were bound, reporting false if it
+// can't be decrypted with u's key at all. Live passwords are stamped as
+// changed, so the server takes the bound copy over the one it has.
+func bindEntry(u User, p Password) (Password, bool) {
+	legacy := u
+	legacy.BoundEntries = false
+	err := p.decrypt(legacy)
+	if err != nil {
+		return p, false
+	}
+	defer p.Destroy()
+
+	err = p.encrypt(u)
+	if err != nil {
+		return p, false
+	}
+
+	if !p.Deleted {
+		p.LastChanged = time.Now()
+	}
+
+	return p, true
 }
 
 func (pl PasswordList) Search(searchTerm string) PasswordList {
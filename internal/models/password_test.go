@@ -0,0 +1,291 @@
+package models
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/Queueue0/qpass/internal/dbman"
+	"github.com/google/uuid"
+)
+
+// Cheap enough to derive keys with in every test
+var testKDFParams = crypto.KDFParams{Algorithm: crypto.KDFArgon2id, Time: 1, Memory: 8, Threads: 1}
+
+func testDB(t *testing.T, client bool) *sql.DB {
+	t.Helper()
+	db, err := dbman.OpenDB("file:" + t.TempDir() + "/pwdb.sqlite?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = dbman.InitializeDB(db, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// Adds a user to a new client database and logs them in
+func testUser(t *testing.T) (*UserModel, *PasswordModel, User) {
+	t.Helper()
+	db := testDB(t, true)
+	users := &UserModel{DB: db}
+	passwords := &PasswordModel{DB: db}
+
+	_, err := users.Insert("user", "password", uuid.NewString(), testKDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := users.Authenticate("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.Destroy() })
+
+	return users, passwords, u
+}
+
+// A copy of a password as another of u's devices would sync it
+func syncedCopy(t *testing.T, u User, id uuid.UUID, serviceName string) Password {
+	t.Helper()
+	p := Password{UUID: id, UserID: u.ID, ServiceName: serviceName, Username: "username", password: crypto.SecretFromString("password"), LastChanged: time.Now()}
+	defer p.Destroy()
+
+	err := p.encrypt(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestApplySyncRevision(t *testing.T) {
+	_, passwords, u := testUser(t)
+
+	skipped, err := passwords.ApplySync(u, nil, PasswordList{syncedCopy(t, u, uuid.New(), "first")}, 3)
+	if err != nil || len(skipped) != 0 {
+		t.Fatalf("got %v skipped, %v", skipped, err)
+	}
+
+	revision, err := passwords.SyncRevision(u)
+	if err != nil || revision != 3 {
+		t.Fatalf("got revision %d, %v, want 3", revision, err)
+	}
+
+	// Encrypted under a key u doesn't have
+	other := u
+	other.Key, err = crypto.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Key.Destroy()
+	unreadable := syncedCopy(t, other, uuid.New(), "unreadable")
+
+	skipped, err = passwords.ApplySync(u, nil, PasswordList{unreadable, syncedCopy(t, u, uuid.New(), "second")}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].UUID != unreadable.UUID {
+		t.Fatalf("got %v skipped, want only %s", skipped, unreadable.UUID)
+	}
+
+	// The server has to send the skipped one again next time
+	revision, err = passwords.SyncRevision(u)
+	if err != nil || revision != 3 {
+		t.Fatalf("got revision %d, %v, want it left at 3", revision, err)
+	}
+
+	pws, err := passwords.GetAllForUser(u, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pws.Destroy()
+	if len(pws) != 2 {
+		t.Fatalf("got %d passwords, want the 2 readable ones", len(pws))
+	}
+}
+
+func TestApplySyncKeepsUnsynced(t *testing.T) {
+	_, passwords, u := testUser(t)
+
+	id, err := passwords.Insert(u, "local", "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := passwords.Get(id, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Destroy()
+	remote := syncedCopy(t, u, local.UUID, "remote")
+
+	// Changed here since it was sent, so the server's copy waits for the
+	// next sync to be merged
+	_, err = passwords.ApplySync(u, nil, PasswordList{remote}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := passwords.Get(id, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Destroy()
+	if got.ServiceName != "local" {
+		t.Fatalf("got %q, want the unsynced local copy kept", got.ServiceName)
+	}
+
+	unsynced, err := passwords.GetUnsyncedForUser(u)
+	if err != nil || len(unsynced) != 1 {
+		t.Fatalf("got %d unsynced, %v, want 1", len(unsynced), err)
+	}
+
+	// Once the local copy has been sent, the server's is taken
+	_, err = passwords.ApplySync(u, unsynced, PasswordList{remote}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = passwords.Get(id, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Destroy()
+	if got.ServiceName != "remote" {
+		t.Fatalf("got %q, want the server's copy", got.ServiceName)
+	}
+
+	unsynced, err = passwords.GetUnsyncedForUser(u)
+	if err != nil || len(unsynced) != 0 {
+		t.Fatalf("got %d unsynced, %v, want none", len(unsynced), err)
+	}
+}
+
+func TestFieldBinding(t *testing.T) {
+	_, _, u := testUser(t)
+	u.BoundEntries = true
+	p := syncedCopy(t, u, uuid.New(), "service")
+
+	readable := func(p Password, u User) bool {
+		err := p.decrypt(u)
+		p.Destroy()
+		return err == nil
+	}
+
+	if !readable(p, u) {
+		t.Fatal("bound copy doesn't decrypt")
+	}
+
+	swapped := p
+	swapped.EUsername, swapped.EPassword = p.EPassword, p.EUsername
+	if readable(swapped, u) {
+		t.Error("fields swapped within an entry decrypted")
+	}
+
+	moved := syncedCopy(t, u, uuid.New(), "other service")
+	moved.EPassword = p.EPassword
+	if readable(moved, u) {
+		t.Error("field moved to another entry decrypted")
+	}
+
+	// Only the entry's own binding opens it, even with the right key
+	other := u
+	other.ID = uuid.New()
+	if readable(p, other) {
+		t.Error("entry decrypted as another user's")
+	}
+
+	_, err := decryptField(p.EPassword, u, p.UUID, "username")
+	if err == nil {
+		t.Error("field decrypted under another field's name")
+	}
+}
+
+func TestBindEntries(t *testing.T) {
+	users, passwords, u := testUser(t)
+
+	id, err := passwords.Insert(u, "bound", "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := passwords.Get(id, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound.Destroy()
+
+	// Synced, so anything BindEntries touches shows up as unsynced again
+	_, err = passwords.ApplySync(u, PasswordList{bound}, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As written before fields were bound
+	legacy := Password{UUID: uuid.New(), UserID: u.ID, LastChanged: time.Now()}
+	for _, f := range []*string{&legacy.EServiceName, &legacy.EUsername, &legacy.EPassword} {
+		*f, err = crypto.Encrypt("legacy", u.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if legacy.isBound() {
+		t.Fatal("legacy copy is bound")
+	}
+	err = passwords.DumbInsert(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = users.BindEntries(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.BoundEntries {
+		t.Fatal("user not marked as bound")
+	}
+
+	migrated, err := passwords.GetByUUID(legacy.UUID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated.isBound() || !migrated.readable(u) {
+		t.Fatal("legacy copy not re-encrypted as bound")
+	}
+
+	after, err := passwords.GetByUUID(bound.UUID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.sameCopy(bound) {
+		t.Error("bound copy re-encrypted")
+	}
+
+	// Only the migrated copy has to go to the server
+	unsynced, err := passwords.GetUnsyncedForUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unsynced) != 1 || unsynced[0].UUID != legacy.UUID {
+		t.Fatalf("got %v unsynced, want only %s", unsynced, legacy.UUID)
+	}
+
+	// Unbound fields aren't accepted any more
+	if legacy.readable(u) {
+		t.Error("unbound copy still decrypts")
+	}
+
+	relogin, err := users.Authenticate("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relogin.Destroy()
+	if !relogin.BoundEntries {
+		t.Error("bound entries not recorded")
+	}
+}
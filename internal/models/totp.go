@@ -0,0 +1,137 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base64"
+)
+
+// A user's TOTP second factor, as the sync server keeps it. Secret is empty
+// until they've enrolled. Pending is a secret they've been given but haven't
+// confirmed with a code yet. LastStep is the step of the last code used, so
+// codes can't be used twice.
+type TOTP struct {
+	Secret   []byte
+	Pending  []byte
+	LastStep int64
+}
+
+func (t TOTP) Enabled() bool {
+	return len(t.Secret) > 0
+}
+
+func (m *UserModel) ServerGetTOTP(id string) (TOTP, error) {
+	var secret, pending sql.NullString
+	var lastStep sql.NullInt64
+	stmt := `SELECT totp_secret, totp_pending, totp_last_step FROM users WHERE uuid = ?`
+	err := m.DB.QueryRow(stmt, id).Scan(&secret, &pending, &lastStep)
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	t := TOTP{LastStep: lastStep.Int64}
+	t.Secret, err = base64.RawStdEncoding.DecodeString(secret.String)
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	t.Pending, err = base64.RawStdEncoding.DecodeString(pending.String)
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	return t, nil
+}
+
+// Gives a user a secret to enroll with, replacing any they haven't confirmed
+func (m *UserModel) ServerSetPendingTOTP(id string, secret []byte) error {
+	stmt := `UPDATE users SET totp_pending = ? WHERE uuid = ?`
+	_, err := m.DB.Exec(stmt, base64.RawStdEncoding.EncodeToString(secret), id)
+	return err
+}
+
+// Makes a user's pending secret their second factor, now that they've
+// confirmed it with the code for step, and replaces their recovery codes
+func (m *UserModel) ServerEnableTOTP(id string, step int64, recoveryCodes [][]byte) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE users SET totp_secret = totp_pending, totp_pending = NULL, totp_last_step = ? WHERE uuid = ?`
+	_, err = tx.Exec(stmt, step, id)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRecoveryCodes(tx, id, recoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *UserModel) ServerDisableTOTP(id string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE users SET totp_secret = NULL, totp_pending = NULL, totp_last_step = NULL WHERE uuid = ?`
+	_, err = tx.Exec(stmt, id)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRecoveryCodes(tx, id, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, id string, recoveryCodes [][]byte) error {
+	_, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE uuid = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		stmt := `INSERT INTO totp_recovery_codes (uuid, code_hash) VALUES (?, ?)`
+		_, err = tx.Exec(stmt, id, base64.RawStdEncoding.EncodeToString(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Records that a user's code for step was used. Reports false if a code for
+// it or a later step already was, which can happen if two connections race.
+func (m *UserModel) ServerUseTOTPStep(id string, step int64) (bool, error) {
+	stmt := `UPDATE users SET totp_last_step = ? WHERE uuid = ? AND (totp_last_step IS NULL OR totp_last_step < ?)`
+	result, err := m.DB.Exec(stmt, step, id, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// Uses up one of a user's recovery codes by its hash. Reports false if
+// they don't have it.
+func (m *UserModel) ServerUseTOTPRecoveryCode(id string, hash []byte) (bool, error) {
+	stmt := `DELETE FROM totp_recovery_codes WHERE uuid = ? AND code_hash = ?`
+	result, err := m.DB.Exec(stmt, id, base64.RawStdEncoding.EncodeToString(hash))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"errors"
+	"slices"
+	"time"
 
 	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/google/uuid"
@@ -14,28 +16,95 @@ type User struct {
 	encryptedUsername string
 	ID                uuid.UUID
 	Username          string
-	Key               []byte
-	AuthToken         []byte
+	// The data key passwords are encrypted with. Users from before data
+	// keys have their passwords encrypted with kek instead, and no
+	// WrappedKey.
+	Key        *crypto.Secret
+	WrappedKey string
+	AuthToken  *crypto.Secret
+	// Set once all of the user's password fields are bound to where they're
+	// stored, after which fields that aren't are refused
+	BoundEntries bool
+	// The data key wrapped with the user's recovery key, if they have one,
+	// and what the sync server checks the recovery token against
+	RecoveryKey      string
+	RecoveryVerifier []byte
+	// Parameters kek and AuthToken are derived with
+	KDF crypto.KDFParams
+	// Server only, the parameters the stored AuthToken is hashed with
+	TokenKDF crypto.KDFParams
+	Lookup   []byte
+
+	// Derived from the master password, and wraps Key
+	kek *crypto.Secret
 }
 
 func (u User) EUsername() string {
 	return u.encryptedUsername
 }
 
+// Zeroes u's keys and auth token, on logout. Copies of u share them, so none
+// can be used afterwards.
+func (u *User) Destroy() {
+	u.Key.Destroy()
+	u.kek.Destroy()
+	u.AuthToken.Destroy()
+}
+
+// Copies u with keys and an auth token of its own, so it can be changed or
+// destroyed without touching u
+func (u User) Clone() User {
+	c := u
+	c.kek = cloneSecret(u.kek)
+	c.AuthToken = cloneSecret(u.AuthToken)
+	c.Key = cloneSecret(u.Key)
+	// Without a data key the key is the kek, and they're replaced together
+	if u.Key == u.kek {
+		c.Key = c.kek
+	}
+	c.Lookup = slices.Clone(u.Lookup)
+	c.RecoveryVerifier = slices.Clone(u.RecoveryVerifier)
+
+	return c
+}
+
+func cloneSecret(s *crypto.Secret) *crypto.Secret {
+	if s == nil {
+		return nil
+	}
+
+	return s.Clone()
+}
+
 type UserModel struct {
 	DB *sql.DB
 }
 
-func (m *UserModel) Insert(username, password, uuid string) (int, error) {
-	key := crypto.GetKey(password, username)
+func (m *UserModel) Insert(username, password, uuid string, params crypto.KDFParams) (int, error) {
+	kek, err := crypto.GetKey(password, username, params)
+	if err != nil {
+		return 0, err
+	}
+	defer kek.Destroy()
+
+	encryptedUsername, err := crypto.Encrypt(username, kek)
+	if err != nil {
+		return 0, err
+	}
 
-	encryptedUsername, err := crypto.Encrypt(username, key)
+	key, err := crypto.NewDataKey()
 	if err != nil {
 		return 0, err
 	}
+	defer key.Destroy()
 
-	stmt := `INSERT INTO users (uuid, username) VALUES (?, ?)`
-	result, err := m.DB.Exec(stmt, uuid, encryptedUsername)
+	wrappedKey, err := crypto.WrapKey(key, kek)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `INSERT INTO users (uuid, username, kdf, data_key) VALUES (?, ?, ?, ?)`
+	result, err := m.DB.Exec(stmt, uuid, encryptedUsername, params.String(), wrappedKey)
 	if err != nil {
 		return 0, err
 	}
@@ -49,9 +118,10 @@ func (m *UserModel) Insert(username, password, uuid string) (int, error) {
 }
 
 func (m *UserModel) ServerInsert(u User) (int, error) {
-	token := base64.RawStdEncoding.EncodeToString(u.AuthToken)
-	stmt := `INSERT INTO users (uuid, auth_token) VALUES (?, ?)`
-	result, err := m.DB.Exec(stmt, u.ID.String(), token)
+	token := base64.RawStdEncoding.EncodeToString(u.AuthToken.Bytes())
+	lookup, kdf := lookupColumns(u)
+	stmt := `INSERT INTO users (uuid, auth_token, token_kdf, lookup, kdf, data_key) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := m.DB.Exec(stmt, u.ID.String(), token, u.TokenKDF.String(), lookup, kdf, nullIfEmpty(u.WrappedKey))
 	if err != nil {
 		return 0, err
 	}
@@ -61,28 +131,50 @@ func (m *UserModel) ServerInsert(u User) (int, error) {
 }
 
 func (m *UserModel) GetByUUID(id string) (*User, error) {
-	row := m.DB.QueryRow("SELECT uuid, auth_token FROM users WHERE uuid = ?", id)
+	row := m.DB.QueryRow("SELECT uuid, auth_token, token_kdf, lookup, kdf, data_key FROM users WHERE uuid = ?", id)
+	return scanServerUser(row)
+}
+
+func (m *UserModel) ServerGetByAuthToken(at []byte) (*User, error) {
+	t := base64.RawStdEncoding.EncodeToString(at)
+	row := m.DB.QueryRow("SELECT uuid, auth_token, token_kdf, lookup, kdf, data_key FROM users WHERE auth_token = ?", t)
+	return scanServerUser(row)
+}
 
+func scanServerUser(row *sql.Row) (*User, error) {
 	var uuidStr, tokenStr string
-	err := row.Scan(&uuidStr, &tokenStr)
+	var tokenKDF, lookup, kdf, wrappedKey sql.NullString
+	err := row.Scan(&uuidStr, &tokenStr, &tokenKDF, &lookup, &kdf, &wrappedKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseFromStrings(uuidStr, tokenStr)
-}
-
-func (m *UserModel) ServerGetByAuthToken(at []byte) (*User, error) {
-	t := base64.RawStdEncoding.EncodeToString(at)
-	row := m.DB.QueryRow("SELECT uuid, auth_token FROM users WHERE auth_token = ?", t)
+	u, err := parseFromStrings(uuidStr, tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	u.WrappedKey = wrappedKey.String
 
-	var uuidStr, tokenStr string
-	err := row.Scan(&uuidStr, &tokenStr)
+	u.TokenKDF, err = parseKDFParams(tokenKDF, crypto.LegacyServerKDFParams)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseFromStrings(uuidStr, tokenStr)
+	// Users from before lookups were recorded have neither of these until
+	// they next log in
+	if lookup.Valid {
+		u.Lookup, err = base64.RawStdEncoding.DecodeString(lookup.String)
+		if err != nil {
+			return nil, err
+		}
+
+		u.KDF, err = parseKDFParams(kdf, crypto.LegacyKDFParams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
 }
 
 func parseFromStrings(uuidStr, tokenStr string) (*User, error) {
@@ -93,14 +185,130 @@ func parseFromStrings(uuidStr, tokenStr string) (*User, error) {
 		return nil, err
 	}
 
-	u.AuthToken, err = base64.RawStdEncoding.DecodeString(tokenStr)
+	token, err := base64.RawStdEncoding.DecodeString(tokenStr)
 	if err != nil {
 		return nil, err
 	}
+	u.AuthToken = crypto.NewSecret(token)
 
 	return &u, nil
 }
 
+// NULL parameters are the ones used before parameters were recorded
+func parseKDFParams(s sql.NullString, legacy crypto.KDFParams) (crypto.KDFParams, error) {
+	if !s.Valid {
+		return legacy, nil
+	}
+
+	return crypto.ParseKDFParams(s.String)
+}
+
+// Returns every set of parameters the server has hashed auth tokens with
+func (m *UserModel) TokenKDFParams() ([]crypto.KDFParams, error) {
+	return m.distinctKDFParams("SELECT DISTINCT token_kdf FROM users", crypto.LegacyServerKDFParams)
+}
+
+// Returns every set of parameters the server knows users' keys are derived
+// with, the most used first
+func (m *UserModel) KDFParams() ([]crypto.KDFParams, error) {
+	return m.distinctKDFParams("SELECT kdf FROM users WHERE lookup IS NOT NULL GROUP BY kdf ORDER BY COUNT(*) DESC", crypto.LegacyKDFParams)
+}
+
+func (m *UserModel) distinctKDFParams(stmt string, legacy crypto.KDFParams, args ...any) ([]crypto.KDFParams, error) {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var params []crypto.KDFParams
+	for rows.Next() {
+		var s sql.NullString
+		err = rows.Scan(&s)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := parseKDFParams(s, legacy)
+		if err != nil {
+			return nil, err
+		}
+
+		// NULL and the legacy parameters written out can both appear
+		if !slices.Contains(params, p) {
+			params = append(params, p)
+		}
+	}
+
+	return params, rows.Err()
+}
+
+// Replaces a user's auth token, and records the parameters it and their keys
+// are derived with, along with their data key if it's been wrapped again
+func (m *UserModel) ServerUpdateCredentials(u User) error {
+	token := base64.RawStdEncoding.EncodeToString(u.AuthToken.Bytes())
+	lookup, kdf := lookupColumns(u)
+	stmt := `UPDATE users SET auth_token = ?, token_kdf = ?, lookup = ?, kdf = ?, data_key = COALESCE(?, data_key) WHERE uuid = ?`
+	_, err := m.DB.Exec(stmt, token, u.TokenKDF.String(), lookup, kdf, nullIfEmpty(u.WrappedKey), u.ID.String())
+	return err
+}
+
+// Keeps u's current auth token after it's replaced, so devices still using it
+// can be told their credentials have changed
+func (m *UserModel) ServerRetireToken(u User) error {
+	token := base64.RawStdEncoding.EncodeToString(u.AuthToken.Bytes())
+	stmt := `INSERT INTO retired_tokens (uuid, auth_token, token_kdf) VALUES (?, ?, ?)`
+	_, err := m.DB.Exec(stmt, u.ID.String(), token, u.TokenKDF.String())
+	return err
+}
+
+// Returns every set of parameters retired auth tokens were hashed with
+func (m *UserModel) RetiredTokenKDFParams() ([]crypto.KDFParams, error) {
+	return m.distinctKDFParams("SELECT DISTINCT token_kdf FROM retired_tokens", crypto.LegacyServerKDFParams)
+}
+
+func (m *UserModel) ServerTokenRetired(at []byte, params crypto.KDFParams) (bool, error) {
+	t := base64.RawStdEncoding.EncodeToString(at)
+	row := m.DB.QueryRow("SELECT EXISTS(SELECT id FROM retired_tokens WHERE auth_token = ? AND token_kdf = ?)", t, params.String())
+	var result bool
+	err := row.Scan(&result)
+	return result, err
+}
+
+// Stores a user's wrapped data key if they don't have one yet, and returns
+// the one they end up with. The first device to offer a key decides it. An
+// empty offer just returns the stored key.
+func (m *UserModel) ServerOfferDataKey(id, wrappedKey string) (string, error) {
+	if wrappedKey != "" {
+		_, err := m.DB.Exec(`UPDATE users SET data_key = ? WHERE uuid = ? AND data_key IS NULL`, wrappedKey, id)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var stored sql.NullString
+	err := m.DB.QueryRow(`SELECT data_key FROM users WHERE uuid = ?`, id).Scan(&stored)
+	return stored.String, err
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// Clients that don't record parameters don't send a lookup ID either, and
+// their users are stored with NULLs for both
+func lookupColumns(u User) (any, any) {
+	if u.Lookup == nil {
+		return nil, nil
+	}
+
+	return base64.RawStdEncoding.EncodeToString(u.Lookup), u.KDF.String()
+}
+
 func (m *UserModel) IDtoUUID(id int) (string, error) {
 	stmt := `SELECT uuid FROM users WHERE id=?`
 	row := m.DB.QueryRow(stmt, id)
@@ -112,7 +320,7 @@ func (m *UserModel) IDtoUUID(id int) (string, error) {
 var ErrIncorrectCreds = errors.New("Username or password is incorrect")
 
 func (m *UserModel) Authenticate(username, password string) (User, error) {
-	stmt := `SELECT uuid, username FROM users`
+	stmt := `SELECT uuid, username, kdf, data_key, stale, bound_entries, recovery_key, recovery_verifier FROM users`
 	rows, err := m.DB.Query(stmt)
 	if err != nil {
 		return User{}, err
@@ -120,17 +328,44 @@ func (m *UserModel) Authenticate(username, password string) (User, error) {
 
 	defer rows.Close()
 
-	key := crypto.GetKey(password, username)
+	// Users can have different parameters, but deriving a key is slow so
+	// only do it once for each. Only the one that matches is kept.
+	keks := map[crypto.KDFParams]*crypto.Secret{}
+	var kept *crypto.Secret
+	defer func() {
+		for _, kek := range keks {
+			if kek != kept {
+				kek.Destroy()
+			}
+		}
+	}()
+
 	for rows.Next() {
 		var u User
 		var uuidString string
+		var kdf, wrappedKey, recoveryKey, recoveryVerifier sql.NullString
+		var stale bool
+
+		err := rows.Scan(&uuidString, &u.encryptedUsername, &kdf, &wrappedKey, &stale, &u.BoundEntries, &recoveryKey, &recoveryVerifier)
+		if err != nil {
+			return User{}, err
+		}
 
-		err := rows.Scan(&uuidString, &u.encryptedUsername)
+		u.KDF, err = parseKDFParams(kdf, crypto.LegacyKDFParams)
 		if err != nil {
 			return User{}, err
 		}
 
-		u.Username, err = crypto.Decrypt(u.encryptedUsername, key)
+		kek, ok := keks[u.KDF]
+		if !ok {
+			kek, err = crypto.GetKey(password, username, u.KDF)
+			if err != nil {
+				return User{}, err
+			}
+			keks[u.KDF] = kek
+		}
+
+		u.Username, err = crypto.Decrypt(u.encryptedUsername, kek)
 		if err != nil {
 			if err.Error() == "chacha20poly1305: message authentication failed" {
 				continue
@@ -139,13 +374,38 @@ func (m *UserModel) Authenticate(username, password string) (User, error) {
 		}
 
 		if u.Username == username {
-			u.Key = key
+			if stale {
+				return User{}, ErrStaleCredentials
+			}
+
+			u.kek = kek
+			u.Key = kek
+			if wrappedKey.Valid {
+				u.WrappedKey = wrappedKey.String
+				u.Key, err = crypto.UnwrapKey(u.WrappedKey, kek)
+				if err != nil {
+					return User{}, err
+				}
+			}
+
 			u.ID, err = uuid.Parse(uuidString)
 			if err != nil {
 				return User{}, err
 			}
 
-			u.AuthToken = crypto.ClientAuthToken(username, password)
+			u.RecoveryKey = recoveryKey.String
+			u.RecoveryVerifier, err = base64.RawStdEncoding.DecodeString(recoveryVerifier.String)
+			if err != nil {
+				return User{}, err
+			}
+
+			u.AuthToken, err = crypto.KeyAuthToken(kek, password, u.KDF)
+			if err != nil {
+				return User{}, err
+			}
+
+			u.Lookup = crypto.UserLookupID(username)
+			kept = kek
 			return u, nil
 		}
 	}
@@ -153,6 +413,490 @@ func (m *UserModel) Authenticate(username, password string) (User, error) {
 	return User{}, ErrIncorrectCreds
 }
 
+// Derives u's keys again with new parameters, and wraps their data key with
+// the result. Users without a data key have everything re-encrypted instead;
+// when touch is set their passwords are then marked as changed, so the sync
+// server takes the re-encrypted copies, otherwise they're expected to already
+// be encrypted with the new key there.
+func (m *UserModel) Rekey(u *User, password string, params crypto.KDFParams, touch bool) error {
+	c, err := u.NewCredentials(u.Username, password, params)
+	if err != nil {
+		return err
+	}
+
+	err = m.setCredentials(u, c, touch)
+	if err != nil {
+		c.Destroy()
+	}
+
+	return err
+}
+
+// A user's credentials after a change, derived ahead of storing them so the
+// sync server can be given them first
+type Credentials struct {
+	Username   string
+	KDF        crypto.KDFParams
+	AuthToken  *crypto.Secret
+	Lookup     []byte
+	WrappedKey string
+
+	kek               *crypto.Secret
+	encryptedUsername string
+}
+
+// Zeroes credentials that won't be stored. Once they have been, they belong
+// to the user.
+func (c *Credentials) Destroy() {
+	c.kek.Destroy()
+	c.AuthToken.Destroy()
+}
+
+// Derives new credentials for u. Their data key is wrapped with the new key,
+// so unless they don't have one nothing else needs to change.
+func (u User) NewCredentials(username, password string, params crypto.KDFParams) (*Credentials, error) {
+	c := Credentials{Username: username, KDF: params}
+	var err error
+	c.kek, err = crypto.GetKey(password, username, params)
+	if err != nil {
+		return nil, err
+	}
+
+	c.AuthToken, err = crypto.KeyAuthToken(c.kek, password, params)
+	if err != nil {
+		c.Destroy()
+		return nil, err
+	}
+
+	c.encryptedUsername, err = crypto.Encrypt(username, c.kek)
+	if err != nil {
+		c.Destroy()
+		return nil, err
+	}
+
+	if u.WrappedKey != "" {
+		c.WrappedKey, err = crypto.WrapKey(u.Key, c.kek)
+		if err != nil {
+			c.Destroy()
+			return nil, err
+		}
+	}
+
+	c.Lookup = crypto.UserLookupID(username)
+	return &c, nil
+}
+
+// Stores credentials from NewCredentials, after which u can only log in with
+// them
+func (m *UserModel) SetCredentials(u *User, c *Credentials) error {
+	return m.setCredentials(u, c, true)
+}
+
+func (m *UserModel) setCredentials(u *User, c *Credentials, touch bool) error {
+	key := u.Key
+	if c.WrappedKey == "" {
+		key = c.kek
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET username = ?, kdf = ?, data_key = ?, stale = FALSE WHERE uuid = ?`, c.encryptedUsername, c.KDF.String(), nullIfEmpty(c.WrappedKey), u.ID.String())
+	if err != nil {
+		return err
+	}
+
+	if c.WrappedKey == "" {
+		err = reencryptPasswords(tx, *u, key, touch)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// Without a data key the old kek was also the key, which has been
+	// replaced too
+	u.kek.Destroy()
+	u.AuthToken.Destroy()
+
+	u.encryptedUsername = c.encryptedUsername
+	u.Username = c.Username
+	u.kek = c.kek
+	u.Key = key
+	u.WrappedKey = c.WrappedKey
+	u.AuthToken = c.AuthToken
+	u.KDF = c.KDF
+	u.Lookup = c.Lookup
+	return nil
+}
+
+var ErrStaleCredentials = errors.New("Username or password was changed on another device, log in with Sync")
+
+// Stops a user logging in locally after their credentials were changed on
+// another device, until they log in with the new ones through the server
+func (m *UserModel) MarkStale(id string) error {
+	_, err := m.DB.Exec(`UPDATE users SET stale = TRUE WHERE uuid = ?`, id)
+	return err
+}
+
+func (m *UserModel) Exists(UUID string) (bool, error) {
+	row := m.DB.QueryRow("SELECT EXISTS(SELECT uuid FROM users WHERE uuid = ?)", UUID)
+	var result bool
+	err := row.Scan(&result)
+	return result, err
+}
+
+// Takes over an existing user with credentials that were changed on another
+// device. The data key is the same, wrapped with the new credentials, so
+// their passwords can still be read. Any that can't, because they were
+// encrypted with a key that's gone, are dropped and come back from the server
+// on the next sync.
+func (m *UserModel) Relogin(id, username, password string, params crypto.KDFParams, wrappedKey string) error {
+	kek, err := crypto.GetKey(password, username, params)
+	if err != nil {
+		return err
+	}
+	defer kek.Destroy()
+
+	encryptedUsername, err := crypto.Encrypt(username, kek)
+	if err != nil {
+		return err
+	}
+
+	key := kek
+	if wrappedKey != "" {
+		key, err = crypto.UnwrapKey(wrappedKey, kek)
+		if err != nil {
+			return err
+		}
+		defer key.Destroy()
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Passwords that can't be read are dropped below, so the next sync has
+	// to fetch everything again
+	_, err = tx.Exec(`UPDATE users SET username = ?, kdf = ?, data_key = ?, stale = FALSE, sync_revision = 0 WHERE uuid = ?`, encryptedUsername, params.String(), nullIfEmpty(wrappedKey), id)
+	if err != nil {
+		return err
+	}
+
+	UUID, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+
+	var bound bool
+	err = tx.QueryRow(`SELECT bound_entries FROM users WHERE uuid = ?`, id).Scan(&bound)
+	if err != nil {
+		return err
+	}
+
+	err = dropUnreadablePasswords(tx, User{ID: UUID, Key: key, BoundEntries: bound})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func dropUnreadablePasswords(tx *sql.Tx, u User) error {
+	rows, err := tx.Query(`SELECT uuid, password FROM passwords WHERE userId = ?`, u.ID.String())
+	if err != nil {
+		return err
+	}
+
+	var unreadable []string
+	for rows.Next() {
+		var uuidString, ePassword string
+		err = rows.Scan(&uuidString, &ePassword)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		entry, err := uuid.Parse(uuidString)
+		if err == nil {
+			var password *crypto.Secret
+			password, err = decryptField(ePassword, u, entry, "password")
+			password.Destroy()
+		}
+		if err != nil {
+			unreadable = append(unreadable, uuidString)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range unreadable {
+		_, err = tx.Exec(`DELETE FROM passwords WHERE uuid = ?`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Generates a data key for u, wrapped so it can be given to SetDataKey
+func (u User) NewDataKey() (string, error) {
+	key, err := crypto.NewDataKey()
+	if err != nil {
+		return "", err
+	}
+	defer key.Destroy()
+
+	return crypto.WrapKey(key, u.kek)
+}
+
+// Switches u to the given wrapped data key, re-encrypting their passwords
+// with it if it's not the one they already have. When touch is set the
+// passwords are marked as changed, as with Rekey.
+func (m *UserModel) SetDataKey(u *User, wrappedKey string, touch bool) error {
+	key, err := crypto.UnwrapKey(wrappedKey, u.kek)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		key.Destroy()
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET data_key = ? WHERE uuid = ?`, wrappedKey, u.ID.String())
+	if err != nil {
+		key.Destroy()
+		return err
+	}
+
+	same := key.Equal(u.Key)
+	if !same {
+		err = reencryptPasswords(tx, *u, key, touch)
+		if err != nil {
+			key.Destroy()
+			return err
+		}
+
+		// A recovery key wraps the old data key, and can't be used to
+		// wrap the new one without the user typing it in
+		_, err = tx.Exec(`UPDATE users SET recovery_key = NULL, recovery_verifier = NULL WHERE uuid = ?`, u.ID.String())
+		if err != nil {
+			key.Destroy()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		key.Destroy()
+		return err
+	}
+
+	u.WrappedKey = wrappedKey
+	if same {
+		key.Destroy()
+		return nil
+	}
+
+	u.RecoveryKey, u.RecoveryVerifier = "", nil
+
+	// Users from before data keys were using their kek, which is still
+	// needed
+	if u.Key != u.kek {
+		u.Key.Destroy()
+	}
+	u.Key = key
+	return nil
+}
+
+var ErrNoDataKey = errors.New("User has no data key yet, sync first")
+
+// Gives u a new recovery key, which can unwrap their data key if they forget
+// their master password, and returns it to be shown to them. It isn't kept,
+// so it's only ever shown once. Any recovery key they had before stops
+// working once the sync server has the new one.
+func (m *UserModel) SetRecoveryKey(u *User) (*crypto.Secret, error) {
+	// Users from before data keys have nothing that a recovery key could
+	// wrap, without it changing once they sync
+	if u.WrappedKey == "" {
+		return nil, ErrNoDataKey
+	}
+
+	recoveryKey, err := crypto.NewRecoveryKey()
+	if err != nil {
+		return nil, err
+	}
+
+	kek, token, err := crypto.RecoveryKeys(recoveryKey.Reveal())
+	if err != nil {
+		recoveryKey.Destroy()
+		return nil, err
+	}
+	defer kek.Destroy()
+	defer token.Destroy()
+
+	wrapped, err := crypto.WrapKey(u.Key, kek)
+	if err != nil {
+		recoveryKey.Destroy()
+		return nil, err
+	}
+
+	verifier := crypto.RecoveryVerifier(token)
+	stmt := `UPDATE users SET recovery_key = ?, recovery_verifier = ? WHERE uuid = ?`
+	_, err = m.DB.Exec(stmt, wrapped, base64.RawStdEncoding.EncodeToString(verifier), u.ID.String())
+	if err != nil {
+		recoveryKey.Destroy()
+		return nil, err
+	}
+
+	u.RecoveryKey, u.RecoveryVerifier = wrapped, verifier
+	return recoveryKey, nil
+}
+
+// Unwraps a data key with the key derived from a recovery key, and derives
+// new credentials that wrap it, for a user who's forgotten their master
+// password
+func RecoverCredentials(recoveryKey string, recoveryKEK *crypto.Secret, username, password string, params crypto.KDFParams) (*Credentials, error) {
+	key, err := crypto.UnwrapKey(recoveryKey, recoveryKEK)
+	if err != nil {
+		return nil, crypto.ErrInvalidRecoveryKey
+	}
+	defer key.Destroy()
+
+	// NewCredentials only wraps the data key if the user has a wrapped
+	// one, which they do, just not with a password
+	u := User{Key: key, WrappedKey: recoveryKey}
+	return u.NewCredentials(username, password, params)
+}
+
+// Stores the data key wrapped with a user's recovery key, and the verifier for
+// their recovery token, replacing any they had
+func (m *UserModel) ServerSetRecoveryKey(id, wrappedKey string, verifier []byte) error {
+	stmt := `UPDATE users SET recovery_key = ?, recovery_verifier = ? WHERE uuid = ?`
+	_, err := m.DB.Exec(stmt, wrappedKey, base64.RawStdEncoding.EncodeToString(verifier), id)
+	return err
+}
+
+// Returns the data key wrapped with a user's recovery key, and the verifier
+// for their recovery token. Both are empty if they don't have one.
+func (m *UserModel) ServerGetRecoveryKey(id string) (string, []byte, error) {
+	var wrappedKey, verifier sql.NullString
+	err := m.DB.QueryRow(`SELECT recovery_key, recovery_verifier FROM users WHERE uuid = ?`, id).Scan(&wrappedKey, &verifier)
+	if err != nil {
+		return "", nil, err
+	}
+
+	v, err := base64.RawStdEncoding.DecodeString(verifier.String)
+	return wrappedKey.String, v, err
+}
+
+// Re-encrypts u's passwords with newKey, bound to where they're stored.
+// Passwords that already are, and keep their key, are left alone.
+func reencryptPasswords(tx *sql.Tx, u User, newKey *crypto.Secret, touch bool) error {
+	rows, err := tx.Query(`SELECT uuid, service, username, password FROM passwords WHERE userId = ?`, u.ID.String())
+	if err != nil {
+		return err
+	}
+
+	var pws PasswordList
+	for rows.Next() {
+		var p Password
+		var uuidString string
+		err = rows.Scan(&uuidString, &p.EServiceName, &p.EUsername, &p.EPassword)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		p.UUID, err = uuid.Parse(uuidString)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		pws = append(pws, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	newUser := u
+	newUser.Key = newKey
+	now := time.Now()
+	for _, p := range pws {
+		if p.isBound() && u.Key.Equal(newKey) {
+			continue
+		}
+
+		err = p.decrypt(u)
+		if err != nil {
+			return err
+		}
+
+		err = p.encrypt(newUser)
+		p.Destroy()
+		if err != nil {
+			return err
+		}
+
+		if touch {
+			_, err = tx.Exec(`UPDATE passwords SET service = ?, username = ?, password = ?, last_changed = ?, unsynced = TRUE WHERE uuid = ?`, p.EServiceName, p.EUsername, p.EPassword, now, p.UUID.String())
+		} else {
+			_, err = tx.Exec(`UPDATE passwords SET service = ?, username = ?, password = ? WHERE uuid = ?`, p.EServiceName, p.EUsername, p.EPassword, p.UUID.String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Re-encrypts any of u's passwords from before fields were bound to where
+// they're stored, marking them as changed so the sync server takes them, and
+// from then on refuses fields that aren't bound
+func (m *UserModel) BindEntries(u *User) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = reencryptPasswords(tx, *u, u.Key, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET bound_entries = TRUE WHERE uuid = ?`, u.ID.String())
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.BoundEntries = true
+	return nil
+}
+
 func (m *UserModel) Count() int {
 	row := m.DB.QueryRow("SELECT COUNT(id) FROM users")
 	var c int
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// Fails unless u can read every one of their passwords, and they number n
+func wantReadable(t *testing.T, passwords *PasswordModel, u User, n int) {
+	t.Helper()
+	pws, err := passwords.GetAllForUser(u, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pws.Destroy()
+
+	if len(pws) != n {
+		t.Fatalf("got %d passwords, want %d", len(pws), n)
+	}
+	for _, p := range pws {
+		if p.Plaintext().Reveal() != "password" {
+			t.Fatalf("%s: got password %q", p.ServiceName, p.Plaintext().Reveal())
+		}
+	}
+}
+
+func TestSetDataKey(t *testing.T) {
+	users, passwords, u := testUser(t)
+	_, err := passwords.Insert(u, "service", "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := u.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.UnwrapKey(wrapped, u.kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Destroy()
+
+	// Only the key encryption key unwraps it
+	other, err := crypto.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+	_, err = crypto.UnwrapKey(wrapped, other)
+	if err == nil {
+		t.Fatal("unwrapped with the wrong key")
+	}
+	_, err = crypto.UnwrapKey(wrapped, u.Key)
+	if err == nil {
+		t.Fatal("unwrapped with the data key")
+	}
+
+	err = users.SetDataKey(&u, wrapped, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Key.Equal(key) || u.WrappedKey != wrapped {
+		t.Fatal("user not switched to the new data key")
+	}
+	wantReadable(t, passwords, u, 1)
+
+	// Stored wrapped, for the next login to unwrap
+	relogin, err := users.Authenticate("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relogin.Destroy()
+	if !relogin.Key.Equal(key) {
+		t.Fatal("login unwrapped a different data key")
+	}
+
+	// A key wrapped for someone else changes nothing
+	foreign, err := crypto.WrapKey(other, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.SetDataKey(&u, foreign, true)
+	if err == nil {
+		t.Fatal("took a key wrapped with another key encryption key")
+	}
+	if !u.Key.Equal(key) || u.WrappedKey != wrapped {
+		t.Fatal("user's data key changed")
+	}
+	wantReadable(t, passwords, u, 1)
+}
+
+func TestSetCredentials(t *testing.T) {
+	for _, dataKey := range []bool{false, true} {
+		users, passwords, u := testUser(t)
+		_, err := passwords.Insert(u, "service", "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dataKey {
+			wrapped, err := u.NewDataKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = users.SetDataKey(&u, wrapped, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Changed on a copy, as the account window does, which leaves the
+		// original usable until it's swapped out
+		changed := u.Clone()
+		defer changed.Destroy()
+		creds, err := changed.NewCredentials("new user", "new password", testKDFParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = users.SetCredentials(&changed, creds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.AuthToken.Len() == 0 || u.Key.Len() == 0 {
+			t.Fatal("original user's secrets destroyed")
+		}
+		if changed.AuthToken.Equal(u.AuthToken) {
+			t.Fatal("auth token unchanged")
+		}
+		wantReadable(t, passwords, changed, 1)
+
+		_, err = users.Authenticate("user", "password")
+		if !errors.Is(err, ErrIncorrectCreds) {
+			t.Fatalf("old credentials: got %v, want ErrIncorrectCreds", err)
+		}
+		relogin, err := users.Authenticate("new user", "new password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer relogin.Destroy()
+		if !relogin.AuthToken.Equal(changed.AuthToken) {
+			t.Fatal("login derived a different auth token")
+		}
+		wantReadable(t, passwords, relogin, 1)
+	}
+}
+
+// Another device logs in with credentials changed on the first
+func TestReloginAfterCredentialChange(t *testing.T) {
+	users, _, u := testUser(t)
+	wrapped, err := u.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.SetDataKey(&u, wrapped, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same user and data key, as a sync would leave them
+	db := testDB(t, true)
+	otherUsers, otherPasswords := &UserModel{DB: db}, &PasswordModel{DB: db}
+	_, err = otherUsers.Insert("user", "password", u.ID.String(), testKDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := otherUsers.Authenticate("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+	err = otherUsers.SetDataKey(&other, wrapped, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = otherPasswords.Insert(other, "service", "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := u.NewCredentials("new user", "new password", testKDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.SetCredentials(&u, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = otherUsers.Relogin(u.ID.String(), "new user", "new password", creds.KDF, creds.WrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = otherUsers.Authenticate("user", "password")
+	if !errors.Is(err, ErrIncorrectCreds) {
+		t.Fatalf("old credentials: got %v, want ErrIncorrectCreds", err)
+	}
+	relogin, err := otherUsers.Authenticate("new user", "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relogin.Destroy()
+	if !relogin.AuthToken.Equal(u.AuthToken) || !relogin.Key.Equal(u.Key) {
+		t.Fatal("relogin derived different secrets")
+	}
+	wantReadable(t, otherPasswords, relogin, 1)
+}
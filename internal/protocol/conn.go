@@ -0,0 +1,354 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// A connection can carry several requests at once. The client gives each
+// request an ID, and every payload sent for it, in either direction, carries
+// that ID, so the server can work on requests concurrently and answer them in
+// any order. Most requests are one payload each way, but a request can be
+// made of several, like a sync sent in batches. The client doesn't reuse an
+// ID while its request is in flight, and a payload with an ID the server
+// isn't working on starts a new request.
+//
+// ID 0 is kept for messages the server sends of its own accord rather than
+// in reply to a request. There aren't any yet, so clients ignore them.
+//
+// Before version 3 payloads had no request IDs, so a connection carries one
+// request at a time: the client waits for the request in flight to be closed
+// before opening another, and the server for it to be handled before
+// accepting another. The request in flight reads the connection itself.
+const pushID uint32 = 0
+
+// The ID of every request on connections without request IDs
+const soleID uint32 = 1
+
+var (
+	ErrConnClosed = errors.New("Connection closed")
+	ErrReservedID = errors.New("Request ID 0 is reserved for the server")
+)
+
+// How many payloads for a request can be waiting to be received before the
+// connection stops reading
+const requestBacklog = 8
+
+type Conn struct {
+	c       net.Conn
+	version byte
+	caps    crypto.Capabilities
+
+	wmu  sync.Mutex    // Held while a payload is written
+	turn chan struct{} // Held by the request in flight, without request IDs
+
+	mu       sync.Mutex
+	requests map[uint32]*Request // Requests in flight
+	nextID   uint32              // Last ID given to a request, client side only
+	err      error               // Why the connection stopped reading
+	closed   chan struct{}       // Closed once it has
+}
+
+// A request in flight on a Conn, and the payloads that belong to it
+type Request struct {
+	id       uint32
+	conn     *Conn
+	payloads chan Payload
+	done     chan struct{}
+	once     sync.Once
+	turn     bool // Whether it holds the connection's turn
+}
+
+func newConn(c crypto.Conn) *Conn {
+	return &Conn{
+		c:        c,
+		version:  c.Version(),
+		caps:     c.Capabilities(),
+		turn:     make(chan struct{}, 1),
+		requests: map[uint32]*Request{},
+		closed:   make(chan struct{}),
+	}
+}
+
+// Wraps the client side of a connection, speaking the version its transport
+// negotiated, and starts reading replies from it
+func NewClientConn(c crypto.Conn) *Conn {
+	m := newConn(c)
+	if m.hasIDs() {
+		go m.readReplies()
+	}
+	return m
+}
+
+// Wraps the server side of a connection, speaking the version its transport
+// negotiated. Payloads are read by Accept.
+func NewServerConn(c crypto.Conn) *Conn {
+	return newConn(c)
+}
+
+// Protocol version the connection speaks
+func (m *Conn) Version() byte {
+	return m.version
+}
+
+// Optional features both sides agreed to use
+func (m *Conn) Capabilities() crypto.Capabilities {
+	return m.caps
+}
+
+func (m *Conn) hasIDs() bool {
+	return m.version >= versionRequestIDs
+}
+
+func (m *Conn) RemoteAddr() net.Addr {
+	return m.c.RemoteAddr()
+}
+
+// Closes the connection. Requests still waiting on it fail.
+func (m *Conn) Close() error {
+	m.fail(ErrConnClosed)
+	return m.c.Close()
+}
+
+// Stops handing out payloads, and records why
+func (m *Conn) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil {
+		m.err = err
+		close(m.closed)
+	}
+}
+
+func (m *Conn) write(p *Payload) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	_, err := p.writeTo(m.c, m.version)
+	return err
+}
+
+// Reads the next payload, which belongs to the request in flight if there
+// are no request IDs
+func (m *Conn) read() (Payload, error) {
+	var p Payload
+	_, err := p.readFrom(m.c, m.version)
+	if err == nil && m.hasIDs() && p.id == pushID {
+		err = ErrReservedID
+	}
+	if err != nil {
+		m.fail(err)
+		return p, err
+	}
+
+	if !m.hasIDs() {
+		p.id = soleID
+	}
+
+	return p, nil
+}
+
+// Waits until no other request is in flight, on connections without request
+// IDs. Reports false if the connection closed first.
+func (m *Conn) takeTurn() bool {
+	select {
+	case m.turn <- struct{}{}:
+		return true
+	case <-m.closed:
+		return false
+	}
+}
+
+// Hands p to the request it belongs to, if that's still in flight
+func (m *Conn) deliver(p Payload) bool {
+	m.mu.Lock()
+	r, ok := m.requests[p.id]
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case r.payloads <- p:
+	case <-r.done:
+	}
+
+	return true
+}
+
+func (m *Conn) newRequest(id uint32) *Request {
+	r := &Request{id: id, conn: m, payloads: make(chan Payload, requestBacklog), done: make(chan struct{})}
+	m.requests[id] = r
+	return r
+}
+
+// Starts a request on a connection without request IDs. Nothing is delivered
+// to it, so it isn't kept with the requests in flight.
+func (m *Conn) soleRequest(turn bool) *Request {
+	return &Request{id: soleID, conn: m, done: make(chan struct{}), turn: turn}
+}
+
+// Why the connection stopped reading
+func (m *Conn) closedErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Starts a new request from the client. It has to be closed once its last
+// reply has been received.
+func (m *Conn) Open() *Request {
+	if !m.hasIDs() {
+		// If the connection closed first, anything sent or received on the
+		// request fails
+		return m.soleRequest(m.takeTurn())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	for m.nextID == pushID || m.requests[m.nextID] != nil {
+		m.nextID++
+	}
+
+	return m.newRequest(m.nextID)
+}
+
+// Sends p as a new request and waits for the reply
+func (m *Conn) Do(p *Payload) (Payload, error) {
+	r := m.Open()
+	defer r.Close()
+
+	err := r.Send(p)
+	if err != nil {
+		return Payload{}, err
+	}
+
+	return r.Receive()
+}
+
+// Sends p as a new request that has no reply
+func (m *Conn) Send(p *Payload) error {
+	r := m.Open()
+	defer r.Close()
+
+	return r.Send(p)
+}
+
+func (m *Conn) readReplies() {
+	for {
+		p, err := m.read()
+		if err != nil {
+			return
+		}
+
+		// Replies to requests that have given up on them are dropped too
+		if p.id != pushID {
+			m.deliver(p)
+		}
+	}
+}
+
+// Reads from the client until a payload starts a new request, handing any
+// that belong to requests in flight to them, and returns the new request
+// with its first payload. The request has to be closed once it's been
+// handled.
+func (m *Conn) Accept() (*Request, Payload, error) {
+	if !m.hasIDs() {
+		return m.acceptTurn()
+	}
+
+	for {
+		p, err := m.read()
+		if err != nil {
+			return nil, p, err
+		}
+
+		if m.deliver(p) {
+			continue
+		}
+
+		m.mu.Lock()
+		r := m.newRequest(p.id)
+		m.mu.Unlock()
+
+		return r, p, nil
+	}
+}
+
+// Accepts the next request once the one in flight has been handled, on
+// connections without request IDs
+func (m *Conn) acceptTurn() (*Request, Payload, error) {
+	if !m.takeTurn() {
+		return nil, Payload{}, m.closedErr()
+	}
+
+	p, err := m.read()
+	if err != nil {
+		<-m.turn
+		return nil, p, err
+	}
+
+	return m.soleRequest(true), p, nil
+}
+
+func (r *Request) ID() uint32 {
+	return r.id
+}
+
+// Sends p as part of the request
+func (r *Request) Send(p *Payload) error {
+	if !r.conn.hasIDs() && !r.turn {
+		return r.conn.closedErr()
+	}
+
+	p.id = r.id
+	return r.conn.write(p)
+}
+
+// Waits for the next payload of the request. Payloads that arrived before
+// the connection closed are still received.
+func (r *Request) Receive() (Payload, error) {
+	if !r.conn.hasIDs() {
+		if !r.turn {
+			return Payload{}, r.conn.closedErr()
+		}
+		return r.conn.read()
+	}
+
+	select {
+	case p := <-r.payloads:
+		return p, nil
+	case <-r.conn.closed:
+	}
+
+	select {
+	case p := <-r.payloads:
+		return p, nil
+	default:
+	}
+
+	return Payload{}, r.conn.closedErr()
+}
+
+// Ends the request. Anything else that arrives for it is dropped, or on the
+// server, starts a new request.
+func (r *Request) Close() {
+	r.once.Do(func() {
+		r.conn.mu.Lock()
+		if r.conn.requests[r.id] == r {
+			delete(r.conn.requests, r.id)
+		}
+		r.conn.mu.Unlock()
+		close(r.done)
+
+		if r.turn {
+			<-r.conn.turn
+		}
+	})
+}
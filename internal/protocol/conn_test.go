@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+)
+
+// A connection that claims to have negotiated version
+type versionConn struct {
+	net.Conn
+	version byte
+}
+
+func (c versionConn) Version() byte {
+	return c.version
+}
+
+func (c versionConn) Capabilities() crypto.Capabilities {
+	return 0
+}
+
+func (c versionConn) PeerDevice() crypto.PublicKey {
+	return crypto.PublicKey{}
+}
+
+// Answers PINGs with their body, SYNCs with how many payloads they were made
+// of, and anything else with ErrTOTPRequired
+func serveTest(server *Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		req, p, err := server.Accept()
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer req.Close()
+
+			switch p.Type() {
+			case PING:
+				reply, _ := NewPayload(PONG, p.Bytes())
+				req.Send(reply)
+			case SYNC:
+				n := 1
+				for p.String() != "last" {
+					p, err = req.Receive()
+					if err != nil {
+						return
+					}
+					n++
+				}
+				req.Send(NewSuccWithData([]byte(fmt.Sprint(n))))
+			default:
+				req.Send(NewFail(ErrTOTPRequired))
+			}
+		}()
+	}
+}
+
+func TestConnVersions(t *testing.T) {
+	for version := crypto.MinProtocolVersion; version <= crypto.ProtocolVersion; version++ {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			c, s := net.Pipe()
+			client := NewClientConn(versionConn{c, version})
+			server := NewServerConn(versionConn{s, version})
+			defer client.Close()
+			defer server.Close()
+			go serveTest(server)
+
+			var wg sync.WaitGroup
+			for i := range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					body := []byte(fmt.Sprint("ping ", i))
+					ping, _ := NewPayload(PING, body)
+					reply, err := client.Do(ping)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if reply.Type() != PONG || !bytes.Equal(reply.Bytes(), body) {
+						t.Errorf("got %s %q, want PONG %q", reply.TypeString(), reply.Bytes(), body)
+					}
+				}()
+			}
+
+			// A request made of several payloads, alongside the rest
+			req := client.Open()
+			for _, b := range []string{"a", "b", "c", "last"} {
+				p, _ := NewPayload(SYNC, []byte(b))
+				err := req.Send(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			reply, err := req.Receive()
+			req.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.String() != "4" {
+				t.Errorf("server got %s payloads, want 4", reply.String())
+			}
+
+			wg.Wait()
+
+			// Errors keep their codes whether or not the version sends them
+			reply, err = client.Do(NewPong())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := reply.Err(); !errors.Is(err, ErrTOTPRequired) {
+				t.Errorf("got %v, want ErrTOTPRequired", err)
+			}
+		})
+	}
+}
+
+func TestLegacyFraming(t *testing.T) {
+	var buf bytes.Buffer
+	ping, _ := NewPayload(PING, []byte("hello"))
+	_, err := ping.writeTo(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := append([]byte{PING, 0, 0, 0, 5}, "hello"...); !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", buf.Bytes(), want)
+	}
+
+	// Before error codes, FAIL bodies are just the message
+	buf.Reset()
+	_, err = NewFail(errors.New("disk full")).writeTo(&buf, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := append([]byte{FAIL, 0, 0, 0, 0, 0, 0, 0, 9}, "disk full"...); !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", buf.Bytes(), want)
+	}
+
+	var p Payload
+	_, err = p.readFrom(&buf, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var perr *Error
+	if !errors.As(p.Err(), &perr) || perr.Code != CodeUnknown || perr.Message != "disk full" {
+		t.Fatalf("read %v, want a CodeUnknown error with the message", p.Err())
+	}
+}
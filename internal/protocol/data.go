@@ -1,111 +1,545 @@
 package protocol
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
+	"math"
+	"time"
 
+	"github.com/Queueue0/qpass/internal/crypto"
 	"github.com/Queueue0/qpass/internal/models"
+	"github.com/google/uuid"
 )
 
 type PayloadData interface {
 	Encode() ([]byte, error)
-	Decode([]byte)
+	Decode([]byte) error
 }
 
+// One batch of a sync. More is set on every batch but the last, so the
+// receiver knows when it has them all.
+//
+// The client sends the entries changed since the revision of the user's
+// entries it last synced up to, as Since, or all of them with Since 0. The
+// server replies with the entries changed since then by other syncs, and the
+// revision they bring the client up to. Every batch carries the same Since
+// and Revision. Unless both sides set crypto.CapDeltaSync, the client sends
+// all of its entries and the server ignores Since.
+//
+// Fields:
+//
+//	1 UUID      string
+//	2 Entries   repeated Entry
+//	3 More      bool
+//	4 Since     uint
+//	5 Revision  uint
 type SyncData struct {
-	UUID      string
-	Passwords models.PasswordList
+	UUID     string
+	Entries  []Entry
+	More     bool
+	Since    uint64
+	Revision uint64
 }
 
 func (s *SyncData) Encode() (data []byte, err error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-
-	err = enc.Encode(s)
-	if err != nil {
-		return nil, err
+	e := newMessage()
+	e.string(1, s.UUID)
+	for _, entry := range s.Entries {
+		e.message(2, entry.encode())
 	}
+	e.bool(3, s.More)
+	e.uint(4, s.Since)
+	e.uint(5, s.Revision)
 
-	return buf.Bytes(), nil
+	return e.b, nil
 }
 
 func (s *SyncData) Decode(data []byte) error {
-	var buf bytes.Buffer
-	_, err := buf.Write(data)
-	if err != nil {
+	*s = SyncData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			s.UUID = string(v)
+		case 2:
+			var entry Entry
+			err = entry.decode(v)
+			s.Entries = append(s.Entries, entry)
+		case 3:
+			s.More, err = decodeBool(v)
+		case 4:
+			s.Since, err = decodeUint(v, math.MaxUint64)
+		case 5:
+			s.Revision, err = decodeUint(v, math.MaxUint64)
+		}
+
 		return err
+	})
+}
+
+// How full a SYNC body is let get before starting another, leaving room for
+// the rest of the message
+const syncBatchSize = int(MaxSyncPayloadSize) - 1024
+
+// Splits sd into as many SYNC payloads as its entries need. Entries too big to
+// fit in a payload on their own are left out and returned, so the caller can
+// say which they were instead of every sync failing on them.
+func SyncPayloads(sd SyncData) (payloads []*Payload, oversized []Entry, err error) {
+	e := newMessage()
+	e.string(1, sd.UUID)
+	header := len(e.b)
+	batched := 0
+
+	var flush = func(more bool) error {
+		e.bool(3, more)
+		e.uint(4, sd.Since)
+		e.uint(5, sd.Revision)
+		p, err := NewPayload(SYNC, e.b)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, p)
+
+		e = newMessage()
+		e.string(1, sd.UUID)
+		batched = 0
+		return nil
+	}
+
+	for _, entry := range sd.Entries {
+		m := entry.encode()
+		if header+len(m.b)+2*binary.MaxVarintLen64 > syncBatchSize {
+			// Wouldn't fit even in a batch of its own
+			oversized = append(oversized, entry)
+			continue
+		}
+
+		if batched > 0 && len(e.b)+len(m.b)+2*binary.MaxVarintLen64 > syncBatchSize {
+			err := flush(true)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		e.message(2, m)
+		batched++
 	}
 
-	dec := gob.NewDecoder(&buf)
-	err = dec.Decode(s)
+	err = flush(false)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
+	return payloads, oversized, nil
 }
 
-type AuthData struct {
-	Token []byte
+// A password as it's synced. Only the encrypted fields have anywhere to go,
+// so nothing decrypted can be sent by mistake.
+//
+// Fields:
+//
+//	1 UUID          uuid
+//	2 UserID        uuid
+//	3 EServiceName  string
+//	4 EUsername     string
+//	5 EPassword     string
+//	6 LastChanged   time
+//	7 Deleted       bool
+type Entry struct {
+	UUID         uuid.UUID
+	UserID       uuid.UUID
+	EServiceName string
+	EUsername    string
+	EPassword    string
+	LastChanged  time.Time
+	Deleted      bool
 }
 
-func (d *AuthData) Encode() (data []byte, err error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
+func NewEntry(p models.Password) Entry {
+	return Entry{
+		UUID:         p.UUID,
+		UserID:       p.UserID,
+		EServiceName: p.EServiceName,
+		EUsername:    p.EUsername,
+		EPassword:    p.EPassword,
+		LastChanged:  p.LastChanged,
+		Deleted:      p.Deleted,
+	}
+}
 
-	err = enc.Encode(d)
-	if err != nil {
-		return nil, err
+func NewEntries(pl models.PasswordList) []Entry {
+	entries := make([]Entry, len(pl))
+	for i, p := range pl {
+		entries[i] = NewEntry(p)
 	}
 
-	return buf.Bytes(), nil
+	return entries
 }
 
-func (d *AuthData) Decode(data []byte) error {
-	var buf bytes.Buffer
-	_, err := buf.Write(data)
-	if err != nil {
-		return err
+// The entry as a password that's still encrypted
+func (e Entry) Password() models.Password {
+	return models.Password{
+		UUID:         e.UUID,
+		UserID:       e.UserID,
+		EServiceName: e.EServiceName,
+		EUsername:    e.EUsername,
+		EPassword:    e.EPassword,
+		LastChanged:  e.LastChanged,
+		Deleted:      e.Deleted,
 	}
+}
+
+func Passwords(entries []Entry) models.PasswordList {
+	pl := make(models.PasswordList, len(entries))
+	for i, e := range entries {
+		pl[i] = e.Password()
+	}
+
+	return pl
+}
+
+func (e Entry) encode() *encoder {
+	m := &encoder{}
+	m.uuid(1, e.UUID)
+	m.uuid(2, e.UserID)
+	m.string(3, e.EServiceName)
+	m.string(4, e.EUsername)
+	m.string(5, e.EPassword)
+	m.time(6, e.LastChanged)
+	m.bool(7, e.Deleted)
+	return m
+}
+
+func (e *Entry) decode(data []byte) error {
+	return decodeFields(data, func(tag uint64, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			e.UUID, err = decodeUUID(v)
+		case 2:
+			e.UserID, err = decodeUUID(v)
+		case 3:
+			e.EServiceName = string(v)
+		case 4:
+			e.EUsername = string(v)
+		case 5:
+			e.EPassword = string(v)
+		case 6:
+			e.LastChanged, err = decodeTime(v)
+		case 7:
+			e.Deleted, err = decodeBool(v)
+		}
 
-	dec := gob.NewDecoder(&buf)
-	err = dec.Decode(d)
-	if err != nil {
 		return err
+	})
+}
+
+// crypto.KDFParams, nested in other messages.
+//
+// Fields:
+//
+//	1 Algorithm  string
+//	2 Time       uint
+//	3 Memory     uint
+//	4 Threads    uint
+func encodeKDFParams(p crypto.KDFParams) *encoder {
+	m := &encoder{}
+	m.string(1, p.Algorithm)
+	m.uint(2, uint64(p.Time))
+	m.uint(3, uint64(p.Memory))
+	m.uint(4, uint64(p.Threads))
+	return m
+}
+
+func decodeKDFParams(data []byte) (crypto.KDFParams, error) {
+	var p crypto.KDFParams
+	err := decodeFields(data, func(tag uint64, v []byte) error {
+		var u uint64
+		var err error
+		switch tag {
+		case 1:
+			p.Algorithm = string(v)
+		case 2:
+			u, err = decodeUint(v, math.MaxUint32)
+			p.Time = uint32(u)
+		case 3:
+			u, err = decodeUint(v, math.MaxUint32)
+			p.Memory = uint32(u)
+		case 4:
+			u, err = decodeUint(v, math.MaxUint8)
+			p.Threads = uint8(u)
+		}
+
+		return err
+	})
+
+	return p, err
+}
+
+// Also sent with KDFU and CRED, carrying the new token and parameters, and the
+// data key wrapped again to match. Lookup and KDF are empty from clients that
+// don't record parameters. Code is a TOTP code or recovery code, for users
+// with a second factor.
+//
+// Fields:
+//
+//	1 Token       bytes
+//	2 Lookup      bytes
+//	3 KDF         KDFParams
+//	4 WrappedKey  string
+//	5 Code        string
+type AuthData struct {
+	Token      []byte
+	Lookup     []byte
+	KDF        crypto.KDFParams
+	WrappedKey string
+	Code       string
+}
+
+func (d *AuthData) Encode() (data []byte, err error) {
+	e := newMessage()
+	e.bytes(1, d.Token)
+	e.bytes(2, d.Lookup)
+	if d.KDF != (crypto.KDFParams{}) {
+		e.message(3, encodeKDFParams(d.KDF))
 	}
+	e.string(4, d.WrappedKey)
+	e.string(5, d.Code)
+
+	return e.b, nil
+}
 
-	return nil
+func (d *AuthData) Decode(data []byte) error {
+	*d = AuthData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			d.Token = decodeBytes(v)
+		case 2:
+			d.Lookup = decodeBytes(v)
+		case 3:
+			d.KDF, err = decodeKDFParams(v)
+		case 4:
+			d.WrappedKey = string(v)
+		case 5:
+			d.Code = string(v)
+		}
+
+		return err
+	})
 }
 
+// Fields:
+//
+//	1 UUID    string
+//	2 Token   bytes
+//	3 Lookup  bytes
+//	4 KDF     KDFParams
 type NewUserData struct {
-	UUID  string
-	Token []byte
+	UUID   string
+	Token  []byte
+	Lookup []byte
+	KDF    crypto.KDFParams
 }
 
 func (d *NewUserData) Encode() (data []byte, err error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-
-	err = enc.Encode(d)
-	if err != nil {
-		return nil, err
+	e := newMessage()
+	e.string(1, d.UUID)
+	e.bytes(2, d.Token)
+	e.bytes(3, d.Lookup)
+	if d.KDF != (crypto.KDFParams{}) {
+		e.message(4, encodeKDFParams(d.KDF))
 	}
 
-	return buf.Bytes(), nil
+	return e.b, nil
 }
 
 func (d *NewUserData) Decode(data []byte) error {
-	var buf bytes.Buffer
-	_, err := buf.Write(data)
-	if err != nil {
+	*d = NewUserData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			d.UUID = string(v)
+		case 2:
+			d.Token = decodeBytes(v)
+		case 3:
+			d.Lookup = decodeBytes(v)
+		case 4:
+			d.KDF, err = decodeKDFParams(v)
+		}
+
 		return err
+	})
+}
+
+// Sent with KDFP to ask which parameters a user's keys might be derived with,
+// before they've authenticated. The server replies with Params.
+//
+// Fields:
+//
+//	1 Lookup  bytes
+//	2 Params  repeated KDFParams
+type KDFData struct {
+	Lookup []byte
+	Params []crypto.KDFParams
+}
+
+func (d *KDFData) Encode() (data []byte, err error) {
+	e := newMessage()
+	e.bytes(1, d.Lookup)
+	for _, p := range d.Params {
+		e.message(2, encodeKDFParams(p))
 	}
 
-	dec := gob.NewDecoder(&buf)
-	err = dec.Decode(d)
-	if err != nil {
-		return err
+	return e.b, nil
+}
+
+func (d *KDFData) Decode(data []byte) error {
+	*d = KDFData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		switch tag {
+		case 1:
+			d.Lookup = decodeBytes(v)
+		case 2:
+			p, err := decodeKDFParams(v)
+			if err != nil {
+				return err
+			}
+			d.Params = append(d.Params, p)
+		}
+
+		return nil
+	})
+}
+
+// Sent with VKEY to offer a wrapped data key for the authenticated user, or
+// with no key to ask for theirs. The server replies with the key the user
+// has, which is the offered one unless another device got there first.
+//
+// Fields:
+//
+//	1 WrappedKey  string
+type DataKeyData struct {
+	WrappedKey string
+}
+
+func (d *DataKeyData) Encode() (data []byte, err error) {
+	e := newMessage()
+	e.string(1, d.WrappedKey)
+
+	return e.b, nil
+}
+
+func (d *DataKeyData) Decode(data []byte) error {
+	*d = DataKeyData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		if tag == 1 {
+			d.WrappedKey = string(v)
+		}
+
+		return nil
+	})
+}
+
+// Sent with RKEY to store the authenticated user's data key wrapped with
+// their recovery key, along with a verifier for the recovery token. Sent with
+// RCVR by a user who's lost their password, with the account's UUID, the
+// recovery token, and a second factor Code if they have one, and the server
+// replies with the wrapped key.
+//
+// Fields:
+//
+//	1 UUID        string
+//	2 Token       bytes
+//	3 Verifier    bytes
+//	4 WrappedKey  string
+//	5 Code        string
+type RecoveryData struct {
+	UUID       string
+	Token      []byte
+	Verifier   []byte
+	WrappedKey string
+	Code       string
+}
+
+func (d *RecoveryData) Encode() (data []byte, err error) {
+	e := newMessage()
+	e.string(1, d.UUID)
+	e.bytes(2, d.Token)
+	e.bytes(3, d.Verifier)
+	e.string(4, d.WrappedKey)
+	e.string(5, d.Code)
+
+	return e.b, nil
+}
+
+func (d *RecoveryData) Decode(data []byte) error {
+	*d = RecoveryData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		switch tag {
+		case 1:
+			d.UUID = string(v)
+		case 2:
+			d.Token = decodeBytes(v)
+		case 3:
+			d.Verifier = decodeBytes(v)
+		case 4:
+			d.WrappedKey = string(v)
+		case 5:
+			d.Code = string(v)
+		}
+
+		return nil
+	})
+}
+
+// Sent with TOTP by an authenticated user to manage their second factor.
+// With nothing set, the server replies with a new Secret to enroll with.
+// With the Code for it, the server turns it on and replies with
+// RecoveryCodes. With Disable and a current code or recovery code, the
+// server turns it off and replies SUCC.
+//
+// Fields:
+//
+//	1 Code           string
+//	2 Disable        bool
+//	3 Secret         bytes
+//	4 RecoveryCodes  repeated string
+type TOTPData struct {
+	Code          string
+	Disable       bool
+	Secret        []byte
+	RecoveryCodes []string
+}
+
+func (d *TOTPData) Encode() (data []byte, err error) {
+	e := newMessage()
+	e.string(1, d.Code)
+	e.bool(2, d.Disable)
+	e.bytes(3, d.Secret)
+	for _, code := range d.RecoveryCodes {
+		e.string(4, code)
 	}
 
-	return nil
+	return e.b, nil
+}
+
+func (d *TOTPData) Decode(data []byte) error {
+	*d = TOTPData{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			d.Code = string(v)
+		case 2:
+			d.Disable, err = decodeBool(v)
+		case 3:
+			d.Secret = decodeBytes(v)
+		case 4:
+			d.RecoveryCodes = append(d.RecoveryCodes, string(v))
+		}
+
+		return err
+	})
 }
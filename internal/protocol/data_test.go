@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSyncPayloadsOversizedEntry(t *testing.T) {
+	small := Entry{UUID: uuid.New(), EPassword: "small"}
+	big := Entry{UUID: uuid.New(), EPassword: strings.Repeat("x", int(MaxSyncPayloadSize))}
+
+	// The rest of the entries are still synced
+	payloads, oversized, err := SyncPayloads(SyncData{Entries: []Entry{small, big}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oversized) != 1 || oversized[0].UUID != big.UUID {
+		t.Fatalf("got oversized %v, want only %s", oversized, big.UUID)
+	}
+
+	var sd SyncData
+	if len(payloads) != 1 || sd.Decode(payloads[0].Bytes()) != nil {
+		t.Fatalf("got %d payloads, want 1 that decodes", len(payloads))
+	}
+	if len(sd.Entries) != 1 || sd.Entries[0].UUID != small.UUID {
+		t.Fatalf("sent %v, want only %s", sd.Entries, small.UUID)
+	}
+
+	// Entries that only fit a batch each are still split up
+	half := strings.Repeat("x", syncBatchSize/2)
+	entries := []Entry{{UUID: uuid.New(), EPassword: half}, {UUID: uuid.New(), EPassword: half}, small}
+	payloads, oversized, err = SyncPayloads(SyncData{Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 2 || len(oversized) != 0 {
+		t.Errorf("got %d payloads and %d oversized, want 2 and 0", len(payloads), len(oversized))
+	}
+}
@@ -0,0 +1,177 @@
+package protocol
+
+import "math"
+
+// What went wrong with a request, so the client can decide what to do about
+// it without reading the message. Codes are sent on the wire, so they're
+// never renumbered, and new ones go at the end. A client that gets a code it
+// doesn't know should treat it like CodeUnknown.
+type ErrorCode uint64
+
+const (
+	// Nothing more specific applies
+	CodeUnknown ErrorCode = iota
+	// The request couldn't be decoded, or wasn't allowed where it was sent
+	CodeMalformed
+	// The request was encoded in a version the server doesn't speak
+	CodeVersionMismatch
+	// The request was bigger than the server allows
+	CodeTooLarge
+	// The credentials didn't match any user
+	CodeAuthFailed
+	// The request needs the connection to be authenticated first
+	CodeNotAuthenticated
+	// The credentials belonged to the user before they were changed on
+	// another device
+	CodeCredentialsChanged
+	// The user has a second factor, and no code was sent with the request
+	CodeTOTPRequired
+	// The second factor code was wrong
+	CodeTOTPIncorrect
+	// Too many wrong second factor codes have been tried
+	CodeTOTPLocked
+	// A user with that ID or token already exists
+	CodeUserExists
+	// The request was understood but its contents weren't valid
+	CodeInvalid
+	// The request doesn't fit the state the user's account is in
+	CodeConflict
+	// Reserved for a storage quota, which the server doesn't have yet
+	_
+	// The server failed to handle the request
+	CodeInternal
+	// A sync was asked for changes since a revision the server hasn't
+	// reached, so the client should sync everything instead
+	CodeUnknownRevision
+)
+
+// An error sent in a FAIL payload. Errors with the same code are treated as
+// the same error by errors.Is, so a client can check what it got against the
+// values below.
+//
+// Fields:
+//
+//	1 Code       uint
+//	2 Retryable  bool
+//	3 Message    string
+type Error struct {
+	Code ErrorCode
+	// Whether the same request might succeed if it's sent again later
+	Retryable bool
+	// Describes the error to the user
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+func (e *Error) Encode() (data []byte, err error) {
+	m := newMessage()
+	m.uint(1, uint64(e.Code))
+	m.bool(2, e.Retryable)
+	m.string(3, e.Message)
+
+	return m.b, nil
+}
+
+func (e *Error) Decode(data []byte) error {
+	*e = Error{}
+	return decodeMessage(data, func(tag uint64, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			var code uint64
+			code, err = decodeUint(v, math.MaxUint64)
+			e.Code = ErrorCode(code)
+		case 2:
+			e.Retryable, err = decodeBool(v)
+		case 3:
+			e.Message = string(v)
+		}
+
+		return err
+	})
+}
+
+var (
+	ErrAuthFailed       = &Error{Code: CodeAuthFailed, Message: "Auth Failure"}
+	ErrNotAuthenticated = &Error{Code: CodeNotAuthenticated, Message: "Not Authenticated"}
+	ErrUserExists       = &Error{Code: CodeUserExists, Message: "User already exists"}
+)
+
+// Sent in response to an AUTH with a token that was replaced, so the client
+// knows to ask for the new credentials
+var ErrCredentialsChanged = &Error{Code: CodeCredentialsChanged, Message: "Credentials were changed on another device"}
+
+// Sent in response to an AUTH with the right token for a user with TOTP, but
+// no code or the wrong one, so the client knows to ask for it, or once too
+// many wrong codes have been tried
+var (
+	ErrTOTPRequired  = &Error{Code: CodeTOTPRequired, Message: "Authentication code required"}
+	ErrTOTPIncorrect = &Error{Code: CodeTOTPIncorrect, Message: "Authentication code is incorrect"}
+	ErrTOTPLocked    = &Error{Code: CodeTOTPLocked, Retryable: true, Message: "Too many incorrect codes, try again later"}
+)
+
+// Sent in response to a SYNC from a revision the server doesn't know, as when
+// its copy of the user's entries was restored from an older one, so the
+// client knows to send all of its entries again
+var ErrUnknownRevision = &Error{Code: CodeUnknownRevision, Message: "Sync revision unknown, sync everything"}
+
+// Before version 4, FAIL bodies were only the error message. The errors a
+// client tells apart are matched back up with their codes by message, and
+// the rest become CodeUnknown.
+var legacyErrors = []*Error{
+	ErrAuthFailed,
+	ErrNotAuthenticated,
+	ErrUserExists,
+	ErrCredentialsChanged,
+	ErrTOTPRequired,
+	ErrTOTPIncorrect,
+	ErrTOTPLocked,
+}
+
+// Returns the FAIL body a peer before version 4 expects for an encoded Error
+func legacyFailBody(b []byte) []byte {
+	e := &Error{}
+	if e.Decode(b) != nil {
+		return b
+	}
+
+	return []byte(e.Message)
+}
+
+// Returns the encoded Error for a FAIL body from a peer before version 4
+func failFromLegacy(b []byte) []byte {
+	e := &Error{Code: CodeUnknown, Message: string(b)}
+	for _, known := range legacyErrors {
+		if known.Message == e.Message {
+			e = known
+			break
+		}
+	}
+
+	// Only errors for oversized messages, which this can't be
+	b, _ = e.Encode()
+	return b
+}
+
+// Returns the error a FAIL payload carries, or nil for any other payload
+func (m *Payload) Err() error {
+	if m.payloadType != FAIL {
+		return nil
+	}
+
+	e := &Error{}
+	err := e.Decode(m.bytes)
+	if err != nil {
+		return err
+	}
+
+	return e
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Peers before version 4 only have the message to go on, so these can never
+// change
+func TestLegacyErrorMessages(t *testing.T) {
+	messages := map[*Error]string{
+		ErrAuthFailed:         "Auth Failure",
+		ErrNotAuthenticated:   "Not Authenticated",
+		ErrUserExists:         "User already exists",
+		ErrCredentialsChanged: "Credentials were changed on another device",
+		ErrTOTPRequired:       "Authentication code required",
+		ErrTOTPIncorrect:      "Authentication code is incorrect",
+		ErrTOTPLocked:         "Too many incorrect codes, try again later",
+	}
+
+	if len(legacyErrors) != len(messages) {
+		t.Fatalf("%d legacy errors, but %d messages pinned here", len(legacyErrors), len(messages))
+	}
+
+	for _, e := range legacyErrors {
+		want, ok := messages[e]
+		if !ok {
+			t.Errorf("%q has no message pinned here", e.Message)
+			continue
+		}
+		if e.Message != want {
+			t.Errorf("got %q, want %q", e.Message, want)
+		}
+
+		var buf bytes.Buffer
+		_, err := NewFail(e).writeTo(&buf, versionErrorCodes-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte(want)) {
+			t.Errorf("%q: wrote %q", want, buf.Bytes())
+		}
+
+		var p Payload
+		_, err = p.readFrom(&buf, versionErrorCodes-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !errors.Is(p.Err(), e) {
+			t.Errorf("%q: read back %v", want, p.Err())
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+
+	"github.com/Queueue0/qpass/internal/crypto"
 )
 
 const (
@@ -16,14 +18,49 @@ const (
 	SPWD
 	SUCC
 	FAIL
+	KDFP
+	KDFU
+	VKEY
+	CRED
+	RKEY
+	RCVR
+	TOTP
+)
+
+// Payloads are framed as
+//
+//	type (1 byte) | request ID (4 bytes) | length (4 bytes) | body
+//
+// with the request ID and length big endian. The request ID says which
+// request the payload belongs to, see Conn. Before version 3 there was no
+// request ID.
+//
+// Bodies are limited so a peer can't make the other side allocate more than
+// this for one payload. SYNC bodies carry a batch of entries, and can be
+// bigger than the rest. A sync with more entries than fit in one is sent as
+// several.
+const (
+	MaxPayloadSize     uint32 = 64 << 10 // 64KiB
+	MaxSyncPayloadSize uint32 = 1 << 20  // 1MiB
 
-	MaxPayloadSize uint16 = 50 * (2 << 9) // 50KiB
+	headerSize       = 9
+	legacyHeaderSize = 5
 )
 
-var ErrMaxSizeExceeded = errors.New("maximum paylod size exceeded")
+// Protocol versions that changed how payloads are framed or encoded. Which
+// one a connection speaks is negotiated by its transport.
+const (
+	// Payloads carry request IDs, so several requests can be in flight
+	versionRequestIDs byte = 3
+	// FAIL bodies are an Error rather than just its message
+	versionErrorCodes byte = 4
+)
+
+var ErrMaxSizeExceeded = &Error{Code: CodeTooLarge, Message: "maximum payload size exceeded"}
 
 type Payload struct {
 	payloadType byte
+	id          uint32
 	bytes       []byte
 }
 
@@ -31,6 +68,11 @@ func (m *Payload) Type() byte {
 	return m.payloadType
 }
 
+// The request the payload belongs to
+func (m *Payload) ID() uint32 {
+	return m.id
+}
+
 // Returns a string representation of the payload type
 // for logging and debugging purposes
 func (m *Payload) TypeString() string {
@@ -53,6 +95,20 @@ func (m *Payload) TypeString() string {
 		return "SUCC"
 	case FAIL:
 		return "FAIL"
+	case KDFP:
+		return "KDFP"
+	case KDFU:
+		return "KDFU"
+	case VKEY:
+		return "VKEY"
+	case CRED:
+		return "CRED"
+	case RKEY:
+		return "RKEY"
+	case RCVR:
+		return "RCVR"
+	case TOTP:
+		return "TOTP"
 	}
 
 	return "INVALID TYPE"
@@ -66,12 +122,37 @@ func (m *Payload) String() string {
 	return string(m.bytes)
 }
 
+// The most a body of the given type can be
+func maxSize(payloadType byte) uint32 {
+	if payloadType == SYNC {
+		return MaxSyncPayloadSize
+	}
+
+	return MaxPayloadSize
+}
+
 func (m *Payload) WriteTo(w io.Writer) (int64, error) {
-	bytes := []byte{m.payloadType}
-	lenBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBytes, uint16(len(m.Bytes())))
-	bytes = append(bytes, lenBytes...)
-	bytes = append(bytes, m.Bytes()...)
+	return m.writeTo(w, crypto.ProtocolVersion)
+}
+
+// Writes the payload as the given protocol version frames and encodes it
+func (m *Payload) writeTo(w io.Writer, version byte) (int64, error) {
+	body := m.bytes
+	if m.payloadType == FAIL && version < versionErrorCodes {
+		body = legacyFailBody(body)
+	}
+
+	if len(body) > int(maxSize(m.payloadType)) {
+		return 0, ErrMaxSizeExceeded
+	}
+
+	bytes := make([]byte, 0, headerSize+len(body))
+	bytes = append(bytes, m.payloadType)
+	if version >= versionRequestIDs {
+		bytes = binary.BigEndian.AppendUint32(bytes, m.id)
+	}
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(len(body)))
+	bytes = append(bytes, body...)
 
 	n, err := w.Write(bytes)
 	if err != nil {
@@ -82,43 +163,50 @@ func (m *Payload) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (m *Payload) ReadFrom(r io.Reader) (int64, error) {
-	err := binary.Read(r, binary.BigEndian, &m.payloadType)
-	if err != nil {
-		return 0, err
+	return m.readFrom(r, crypto.ProtocolVersion)
+}
+
+// Reads a payload as the given protocol version frames and encodes it
+func (m *Payload) readFrom(r io.Reader, version byte) (int64, error) {
+	header := make([]byte, legacyHeaderSize)
+	if version >= versionRequestIDs {
+		header = make([]byte, headerSize)
 	}
-	var n int64 = 1
 
-	var size uint16
-	err = binary.Read(r, binary.BigEndian, &size)
+	n, err := io.ReadFull(r, header)
 	if err != nil {
-		return 0, err
+		return int64(n), err
 	}
-	n += 4
 
-	if size > MaxPayloadSize {
-		return n, ErrMaxSizeExceeded
+	m.payloadType = header[0]
+	m.id = 0
+	if version >= versionRequestIDs {
+		m.id = binary.BigEndian.Uint32(header[1:])
+	}
+	size := binary.BigEndian.Uint32(header[len(header)-4:])
+	if size > maxSize(m.payloadType) {
+		return int64(n), ErrMaxSizeExceeded
 	}
 
 	m.bytes = make([]byte, size)
-	b, err := r.Read(m.bytes)
-
-	if err != nil {
-		return n, err
+	b, err := io.ReadFull(r, m.bytes)
+	if err == nil && m.payloadType == FAIL && version < versionErrorCodes {
+		m.bytes = failFromLegacy(m.bytes)
 	}
 
-	return n + int64(b), err
+	return int64(n + b), err
 }
 
 func NewPing() *Payload {
-	return &Payload{PING, []byte{}}
+	return &Payload{payloadType: PING, bytes: []byte{}}
 }
 
 func NewPong() *Payload {
-	return &Payload{PONG, []byte{}}
+	return &Payload{payloadType: PONG, bytes: []byte{}}
 }
 
 func NewSucc() *Payload {
-	return &Payload{SUCC, []byte{}}
+	return &Payload{payloadType: SUCC, bytes: []byte{}}
 }
 
 func NewSuccWithData(data []byte) *Payload {
@@ -130,16 +218,25 @@ func NewSuccWithData(data []byte) *Payload {
 	}
 
 	// Recepient will just have to know what to do with the data
-	return &Payload{SUCC, data}
+	return &Payload{payloadType: SUCC, bytes: data}
 }
 
-func NewFail(message string) *Payload {
-	return &Payload{FAIL, []byte(message)}
+// Makes a FAIL carrying err. Errors that aren't an *Error are sent as
+// CodeInternal.
+func NewFail(err error) *Payload {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Code: CodeInternal, Retryable: true, Message: err.Error()}
+	}
+
+	// Only errors for oversized messages, which an error message won't be
+	b, _ := e.Encode()
+	return &Payload{payloadType: FAIL, bytes: b}
 }
 
 func NewPayload(payloadType byte, bytes []byte) (*Payload, error) {
-	if len(bytes) > int(MaxPayloadSize) {
+	if len(bytes) > int(maxSize(payloadType)) {
 		return nil, ErrMaxSizeExceeded
 	}
-	return &Payload{payloadType, bytes}, nil
+	return &Payload{payloadType: payloadType, bytes: bytes}, nil
 }
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Payload bodies are encoded so any language can read them, and so nothing
+// is sent that isn't listed here. PING and PONG bodies are empty. SUCC bodies
+// are empty, or the user's UUID as text in reply to AUTH and NUSR. Every
+// other body is a message, FAIL bodies being an Error from version 4 on:
+//
+//	message = version (1 byte) field*
+//	field   = tag (uvarint) length (uvarint) value
+//
+// Values are encoded by type:
+//
+//	bytes, string  as is, strings in UTF-8
+//	uint           uvarint
+//	bool           1 byte, 0 or 1
+//	time           varint of nanoseconds since the Unix epoch
+//	uuid           16 bytes
+//	message        its fields, with no version byte
+//
+// A repeated field appears once per element, in order. Fields with the zero
+// value are left out. Each message type lists its fields by tag.
+//
+// Decoders skip tags they don't know, so fields can be added without
+// breaking older clients or servers. Tags are never reused. A change older
+// decoders couldn't read safely would need a new WireVersion, and decoders
+// refuse versions other than their own.
+const WireVersion byte = 1
+
+var (
+	ErrWireVersion = &Error{Code: CodeVersionMismatch, Message: "unsupported message version"}
+	ErrMalformed   = &Error{Code: CodeMalformed, Message: "malformed message"}
+)
+
+// Builds a message, or a nested one
+type encoder struct {
+	b []byte
+}
+
+func newMessage() *encoder {
+	return &encoder{b: []byte{WireVersion}}
+}
+
+func (e *encoder) field(tag uint64, v []byte) {
+	e.b = binary.AppendUvarint(e.b, tag)
+	e.b = binary.AppendUvarint(e.b, uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) bytes(tag uint64, v []byte) {
+	if len(v) > 0 {
+		e.field(tag, v)
+	}
+}
+
+func (e *encoder) string(tag uint64, s string) {
+	if s != "" {
+		e.field(tag, []byte(s))
+	}
+}
+
+func (e *encoder) uint(tag uint64, u uint64) {
+	if u != 0 {
+		e.field(tag, binary.AppendUvarint(nil, u))
+	}
+}
+
+func (e *encoder) bool(tag uint64, b bool) {
+	if b {
+		e.field(tag, []byte{1})
+	}
+}
+
+func (e *encoder) time(tag uint64, t time.Time) {
+	if !t.IsZero() {
+		e.field(tag, binary.AppendVarint(nil, t.UnixNano()))
+	}
+}
+
+func (e *encoder) uuid(tag uint64, id uuid.UUID) {
+	if id != uuid.Nil {
+		e.field(tag, id[:])
+	}
+}
+
+func (e *encoder) message(tag uint64, m *encoder) {
+	e.field(tag, m.b)
+}
+
+// Calls fn with each field of a message, after checking its version
+func decodeMessage(data []byte, fn func(tag uint64, v []byte) error) error {
+	if len(data) == 0 {
+		return ErrMalformed
+	}
+
+	if data[0] != WireVersion {
+		return ErrWireVersion
+	}
+
+	return decodeFields(data[1:], fn)
+}
+
+// Calls fn with each field of a nested message
+func decodeFields(data []byte, fn func(tag uint64, v []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		data = data[n:]
+
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return ErrMalformed
+		}
+		data = data[n:]
+
+		err := fn(tag, data[:length])
+		if err != nil {
+			return err
+		}
+		data = data[length:]
+	}
+
+	return nil
+}
+
+// Values are copied, as they point into the payload
+func decodeBytes(v []byte) []byte {
+	return bytes.Clone(v)
+}
+
+func decodeUint(v []byte, max uint64) (uint64, error) {
+	u, n := binary.Uvarint(v)
+	if n != len(v) || u > max {
+		return 0, ErrMalformed
+	}
+
+	return u, nil
+}
+
+func decodeBool(v []byte) (bool, error) {
+	if len(v) != 1 || v[0] > 1 {
+		return false, ErrMalformed
+	}
+
+	return v[0] == 1, nil
+}
+
+func decodeTime(v []byte) (time.Time, error) {
+	ns, n := binary.Varint(v)
+	if n != len(v) {
+		return time.Time{}, ErrMalformed
+	}
+
+	return time.Unix(0, ns), nil
+}
+
+func decodeUUID(v []byte) (uuid.UUID, error) {
+	id, err := uuid.FromBytes(v)
+	if err != nil {
+		return uuid.Nil, ErrMalformed
+	}
+
+	return id, nil
+}
@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Queueue0/qpass/internal/crypto"
+	"github.com/google/uuid"
+)
+
+// One of every message type, with every field set
+func testMessages() []PayloadData {
+	params := crypto.KDFParams{Algorithm: crypto.KDFArgon2id, Time: 3, Memory: 256 * 1024, Threads: 4}
+	entry := Entry{
+		UUID:         uuid.New(),
+		UserID:       uuid.New(),
+		EServiceName: "service",
+		EUsername:    "username",
+		EPassword:    "password",
+		LastChanged:  time.Unix(1700000000, 123),
+		Deleted:      true,
+	}
+
+	return []PayloadData{
+		&SyncData{UUID: uuid.NewString(), Entries: []Entry{entry, {UUID: uuid.New()}}, More: true, Since: 7, Revision: 1 << 40},
+		&AuthData{Token: []byte("token"), Lookup: []byte("lookup"), KDF: params, WrappedKey: "wrapped", Code: "123456"},
+		&NewUserData{UUID: uuid.NewString(), Token: []byte("token"), Lookup: []byte("lookup"), KDF: params},
+		&KDFData{Lookup: []byte("lookup"), Params: []crypto.KDFParams{params, crypto.LegacyKDFParams}},
+		&DataKeyData{WrappedKey: "wrapped"},
+		&RecoveryData{UUID: uuid.NewString(), Token: []byte("token"), Verifier: []byte("verifier"), WrappedKey: "wrapped", Code: "code"},
+		&TOTPData{Code: "123456", Disable: true, Secret: []byte("secret"), RecoveryCodes: []string{"one", "two"}},
+		&Error{Code: CodeInternal, Retryable: true, Message: "message"},
+	}
+}
+
+// Returns a new, empty value of the same type as m
+func emptyLike(m PayloadData) PayloadData {
+	return reflect.New(reflect.TypeOf(m).Elem()).Interface().(PayloadData)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, m := range testMessages() {
+		name := reflect.TypeOf(m).Elem().Name()
+		b, err := m.Encode()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		got := emptyLike(m)
+		err = got.Decode(b)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%s: got %+v, want %+v", name, got, m)
+		}
+
+		// Zero values are left out, and come back as zero values
+		empty := emptyLike(m)
+		b, err = empty.Encode()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(b, []byte{WireVersion}) {
+			t.Errorf("%s: empty message encoded as %x", name, b)
+		}
+	}
+}
+
+func TestUnknownFieldsSkipped(t *testing.T) {
+	unknown := func(b []byte) []byte {
+		b = binary.AppendUvarint(b, 1000)
+		b = binary.AppendUvarint(b, 3)
+		return append(b, "new"...)
+	}
+
+	for _, m := range testMessages() {
+		name := reflect.TypeOf(m).Elem().Name()
+		b, err := m.Encode()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		got := emptyLike(m)
+		err = got.Decode(unknown(b))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%s: got %+v, want %+v", name, got, m)
+		}
+	}
+
+	// Nested messages skip them too
+	entry := Entry{UUID: uuid.New(), EPassword: "password"}
+	e := newMessage()
+	e.message(2, &encoder{b: unknown(entry.encode().b)})
+	params := &encoder{b: unknown(encodeKDFParams(crypto.DefaultKDFParams).b)}
+	k := newMessage()
+	k.message(2, params)
+
+	var sd SyncData
+	err := sd.Decode(e.b)
+	if err != nil || len(sd.Entries) != 1 || sd.Entries[0] != entry {
+		t.Errorf("entry: got %+v, %v, want %+v", sd.Entries, err, entry)
+	}
+
+	var kd KDFData
+	err = kd.Decode(k.b)
+	if err != nil || !slices.Equal(kd.Params, []crypto.KDFParams{crypto.DefaultKDFParams}) {
+		t.Errorf("KDF parameters: got %v, %v, want %v", kd.Params, err, crypto.DefaultKDFParams)
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	field := func(tag, length uint64, v ...byte) []byte {
+		b := []byte{WireVersion}
+		b = binary.AppendUvarint(b, tag)
+		b = binary.AppendUvarint(b, length)
+		return append(b, v...)
+	}
+
+	tests := []struct {
+		name string
+		m    PayloadData
+		b    []byte
+		want error
+	}{
+		{"empty", &AuthData{}, nil, ErrMalformed},
+		{"wrong version", &AuthData{}, []byte{WireVersion + 1}, ErrWireVersion},
+		{"length past the end", &AuthData{}, field(1, 5, 'a'), ErrMalformed},
+		{"length past the end of memory", &AuthData{}, field(1, 1<<63, 'a'), ErrMalformed},
+		{"tag overflows", &AuthData{}, slices.Concat([]byte{WireVersion}, slices.Repeat([]byte{0xff}, 11)), ErrMalformed},
+		{"length overflows", &AuthData{}, slices.Concat([]byte{WireVersion, 1}, slices.Repeat([]byte{0xff}, 11)), ErrMalformed},
+		{"tag without a length", &AuthData{}, []byte{WireVersion, 1}, ErrMalformed},
+		{"bool out of range", &TOTPData{}, field(2, 1, 2), ErrMalformed},
+		{"bool too long", &TOTPData{}, field(2, 2, 1, 0), ErrMalformed},
+		{"uint with trailing bytes", &SyncData{}, field(4, 2, 1, 0), ErrMalformed},
+		{"uint out of range", &KDFData{}, field(2, 4, 4, 2, 0x80, 0x02), ErrMalformed},
+		{"short uuid", &SyncData{}, field(2, 3, 1, 1, 0), ErrMalformed},
+		{"truncated nested length", &SyncData{}, field(2, 2, 1, 5), ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.m.Decode(tt.b)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// A message cut short anywhere but between fields fails, and never panics
+func TestTruncatedMessages(t *testing.T) {
+	for _, m := range testMessages() {
+		name := reflect.TypeOf(m).Elem().Name()
+		b, err := m.Encode()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// Where each top level field ends
+		ends := map[int]bool{1: true}
+		rest := b[1:]
+		for len(rest) > 0 {
+			_, n := binary.Uvarint(rest)
+			length, l := binary.Uvarint(rest[n:])
+			rest = rest[n+l+int(length):]
+			ends[len(b)-len(rest)] = true
+		}
+
+		for i := range len(b) {
+			err = emptyLike(m).Decode(b[:i])
+			if ends[i] {
+				if err != nil {
+					t.Errorf("%s cut after a field at %d: %v", name, i, err)
+				}
+			} else if !errors.Is(err, ErrMalformed) {
+				t.Errorf("%s cut at %d of %d: got %v, want ErrMalformed", name, i, len(b), err)
+			}
+		}
+	}
+}